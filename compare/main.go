@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Lockstep comparison server. This replaces the old test/server.rb and speaks the
+// same protocol:
+//
+//  1. Each client connects and sends "IDENTIFY <name>\n"
+//  2. Once every client has connected, the server sends "W" to each of them
+//  3. Each client then sends WINDOW lines of CPU state in the i8080-core compare
+//     format (one line per instruction) and waits for the next "W"
+//  4. The server compares the lines from every client. If they all match, it
+//     sends "W" again; otherwise it reports the first divergence and exits
+//
+// A client which closes its connection is treated as having finished its program.
+
+// CLIENTS - How many emulators will be compared against each other
+var CLIENTS = 2
+
+// WINDOW - How many lines each client sends before waiting for the next "W".
+// This must match the client (LINESTOWRITE in space_invaders)
+var WINDOW = 1024 * 1024
+
+// CONTEXT - How many matching lines to show before the first divergence
+var CONTEXT = 10
+
+// client - One connected emulator
+type client struct {
+	name       string
+	connection net.Conn
+	reader     *bufio.Reader
+	finished   bool     // The client has closed the connection
+	lines      []string // Lines in the current window
+	previous   []string // The last CONTEXT lines of the previous window
+}
+
+func newClient(connection net.Conn) (*client, error) {
+	c := &client{connection: connection, reader: bufio.NewReaderSize(connection, 1024*1024)}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%s did not identify itself: %s", connection.RemoteAddr(), err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "IDENTIFY" {
+		return nil, fmt.Errorf("%s started sending data without first identifying", connection.RemoteAddr())
+	}
+	c.name = strings.Join(fields[1:], " ")
+	return c, nil
+}
+
+// readWindow - Reads up to WINDOW lines from the client. Stops early
+// if the client closes its connection
+func (c *client) readWindow() error {
+	if len(c.lines) > CONTEXT {
+		c.previous = append(c.previous[:0], c.lines[len(c.lines)-CONTEXT:]...)
+	} else {
+		c.previous = append(c.previous, c.lines...)
+		if len(c.previous) > CONTEXT {
+			c.previous = c.previous[len(c.previous)-CONTEXT:]
+		}
+	}
+	c.lines = c.lines[:0]
+	if c.finished {
+		return nil
+	}
+	for len(c.lines) < WINDOW {
+		line, err := c.reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			c.lines = append(c.lines, line)
+		}
+		if err == io.EOF {
+			c.finished = true
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading from %s: %s", c.name, err)
+		}
+	}
+	return nil
+}
+
+func (c *client) sendWriteFlag() error {
+	_, err := c.connection.Write([]byte("W"))
+	return err
+}
+
+// line - Returns line i of the current window, or "" if the client did not send it
+func (c *client) line(i int) string {
+	if i < len(c.lines) {
+		return c.lines[i]
+	}
+	return ""
+}
+
+// compareWindow - Returns the index of the first line in the current window
+// that is not the same for every client, or -1 if they all match
+func compareWindow(clients []*client) int {
+	longest := 0
+	for _, c := range clients {
+		if len(c.lines) > longest {
+			longest = len(c.lines)
+		}
+	}
+	for i := 0; i < longest; i++ {
+		first := clients[0].line(i)
+		for _, c := range clients[1:] {
+			if c.line(i) != first {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// run - Accepts CLIENTS connections and compares their output until they
+// either diverge or all of them finish. Returns true if no divergence was found
+func run(listener net.Listener, out io.Writer) (bool, error) {
+	clients := []*client{}
+	for len(clients) < CLIENTS {
+		connection, err := listener.Accept()
+		if err != nil {
+			return false, err
+		}
+		c, err := newClient(connection)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			connection.Close()
+			continue
+		}
+		defer c.connection.Close()
+		clients = append(clients, c)
+		fmt.Fprintf(out, "Client identified: %s (%d/%d)\n", c.name, len(clients), CLIENTS)
+	}
+
+	windowStart := int64(0)
+	for {
+		for _, c := range clients {
+			if c.finished {
+				continue
+			}
+			if err := c.sendWriteFlag(); err != nil {
+				c.finished = true // The client has already gone away
+			}
+		}
+		allFinished := true
+		for _, c := range clients {
+			if err := c.readWindow(); err != nil {
+				return false, err
+			}
+			allFinished = allFinished && c.finished
+		}
+
+		if index := compareWindow(clients); index >= 0 {
+			writeDivergence(out, clients, windowStart, index)
+			return false, nil
+		}
+		windowStart += int64(len(clients[0].lines))
+		fmt.Fprintf(out, "%d instructions compared OK\n", windowStart)
+
+		if allFinished {
+			return true, nil
+		}
+	}
+}
+
+func main() {
+	port := flag.Int("port", 5679, "TCP port to listen on")
+	flag.IntVar(&CLIENTS, "clients", CLIENTS, "Number of emulators to compare")
+	flag.IntVar(&WINDOW, "window", WINDOW, "Number of lines each client sends per W")
+	flag.IntVar(&CONTEXT, "context", CONTEXT, "Number of lines to show before the first divergence")
+	flag.Parse()
+
+	if CLIENTS < 2 {
+		fmt.Println("At least two clients are needed for a comparison")
+		os.Exit(2)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		fmt.Printf("Could not listen on port %d: %s\n", *port, err)
+		os.Exit(2)
+	}
+	defer listener.Close()
+	fmt.Printf("Waiting for %d clients on %s\n", CLIENTS, listener.Addr())
+
+	ok, err := run(listener, os.Stdout)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+	fmt.Println("No differences found")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func stateLine(pc uint16, a uint8, flags string) string {
+	return fmt.Sprintf("%04X 00 00 00 00 00 00 00 00 00 %02X %s FFFF\n", pc, a, flags)
+}
+
+// fakeClient - Connects to the server and identifies itself
+func fakeClient(t *testing.T, address string, name string) net.Conn {
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(connection, "IDENTIFY %s\n", name)
+	return connection
+}
+
+// sendLines - Sends the given lines to the server, window by window
+func sendLines(connection net.Conn, lines []string) {
+	defer connection.Close()
+	flag := make([]byte, 1)
+	for start := 0; start < len(lines); start += WINDOW {
+		if _, err := connection.Read(flag); err != nil || flag[0] != 'W' {
+			return // The server stopped the comparison
+		}
+		end := start + WINDOW
+		if end > len(lines) {
+			end = len(lines)
+		}
+		connection.Write([]byte(strings.Join(lines[start:end], "")))
+	}
+}
+
+// setSizes - Sets WINDOW and CONTEXT for a test, and puts them back after it
+func setSizes(t *testing.T, window int, context int) {
+	oldWindow, oldContext := WINDOW, CONTEXT
+	t.Cleanup(func() { WINDOW, CONTEXT = oldWindow, oldContext })
+	WINDOW, CONTEXT = window, context
+}
+
+func runComparison(t *testing.T, first []string, second []string) (bool, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go sendLines(fakeClient(t, listener.Addr().String(), "first"), first)
+	go sendLines(fakeClient(t, listener.Addr().String(), "second"), second)
+	out := &bytes.Buffer{}
+	ok, err := run(listener, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok, out.String()
+}
+
+func TestCompareIdentical(t *testing.T) {
+	setSizes(t, 4, CONTEXT)
+	lines := []string{}
+	for i := 0; i < 10; i++ {
+		lines = append(lines, stateLine(uint16(0x100+i), uint8(i), "00000010"))
+	}
+	ok, output := runComparison(t, lines, lines)
+	if !ok {
+		t.Errorf("Expected no differences, got:\n%s", output)
+	}
+}
+
+func TestCompareDivergence(t *testing.T) {
+	setSizes(t, 4, 3)
+	first := []string{}
+	second := []string{}
+	for i := 0; i < 10; i++ {
+		first = append(first, stateLine(uint16(0x100+i), uint8(i), "00000010"))
+		if i == 6 {
+			second = append(second, stateLine(uint16(0x100+i), 0xFF, "01000011"))
+		} else {
+			second = append(second, stateLine(uint16(0x100+i), uint8(i), "00000010"))
+		}
+	}
+	ok, output := runComparison(t, first, second)
+	if ok {
+		t.Fatal("Expected a divergence to be found")
+	}
+	for _, expected := range []string{"instruction 6", "A: 06 != FF", "flag Z: 0 != 1", "flag C: 0 != 1", "0103"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the report to contain '%s':\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, "0102") {
+		t.Errorf("Expected only %d lines of context:\n%s", CONTEXT, output)
+	}
+}
+
+func TestCompareEarlyStop(t *testing.T) {
+	setSizes(t, 4, CONTEXT)
+	lines := []string{}
+	for i := 0; i < 6; i++ {
+		lines = append(lines, stateLine(uint16(0x100+i), uint8(i), "00000010"))
+	}
+	ok, output := runComparison(t, lines, lines[:5])
+	if ok || !strings.Contains(output, "second stopped after 5 instructions") {
+		t.Errorf("Expected the second client to stop early:\n%s", output)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Sample line: 0318 C2 00 00 13 34 0C 0A 00 ED 6A 00010010 0500
+const header = "ADDR OP DA TA B  C  D  E  H  L  A  SZ-X-P-C SP  "
+
+// fieldNames - Names of the space separated fields of a compare line
+var fieldNames = []string{"PC", "OP", "DATA1", "DATA2", "B", "C", "D", "E", "H", "L", "A", "FLAGS", "SP"}
+
+// flagNames - Names of the bits of the flags field, MSB first
+var flagNames = []string{"S", "Z", "-", "AC", "-", "P", "-", "C"}
+
+// contextLine - Returns line i of the current window. Negative values of i
+// refer to the lines kept from the previous window
+func (c *client) contextLine(i int) string {
+	if i >= 0 {
+		return c.line(i)
+	}
+	if len(c.previous)+i >= 0 {
+		return c.previous[len(c.previous)+i]
+	}
+	return ""
+}
+
+func pad(line string) string {
+	if len(line) < len(header) {
+		return line + strings.Repeat(" ", len(header)-len(line))
+	}
+	return line
+}
+
+func writeRow(out io.Writer, lines []string, marker string) {
+	for i := range lines {
+		lines[i] = pad(lines[i])
+	}
+	fmt.Fprintf(out, "%s %s\n", strings.Join(lines, " | "), marker)
+}
+
+// fieldDifferences - Describes every field of the two lines which is not the same
+func fieldDifferences(expected string, actual string) []string {
+	a := strings.Fields(expected)
+	b := strings.Fields(actual)
+	differences := []string{}
+	for i, name := range fieldNames {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x == y {
+			continue
+		}
+		if name == "FLAGS" && len(x) == 8 && len(y) == 8 {
+			for bit, flagName := range flagNames {
+				if x[bit] != y[bit] && flagName != "-" {
+					differences = append(differences, fmt.Sprintf("flag %s: %c != %c", flagName, x[bit], y[bit]))
+				}
+			}
+			continue
+		}
+		if x == "" {
+			x = "<missing>"
+		}
+		if y == "" {
+			y = "<missing>"
+		}
+		differences = append(differences, fmt.Sprintf("%s: %s != %s", name, x, y))
+	}
+	return differences
+}
+
+// writeDivergence - Prints the lines leading up to the first divergence (at index
+// within the current window) followed by the differences between each client and
+// the first client
+func writeDivergence(out io.Writer, clients []*client, windowStart int64, index int) {
+	names := make([]string, len(clients))
+	headers := make([]string, len(clients))
+	for i, c := range clients {
+		names[i] = c.name
+		if len(names[i]) < len(header) {
+			names[i] = fmt.Sprintf("%*s", -len(header), fmt.Sprintf("%*s", (len(header)+len(c.name))/2, c.name))
+		}
+		headers[i] = header
+	}
+	fmt.Fprintf(out, "\nDiscrepancy found at instruction %d\n\n", windowStart+int64(index))
+	writeRow(out, names, "")
+	writeRow(out, headers, "")
+
+	for i := index - CONTEXT; i <= index; i++ {
+		row := make([]string, len(clients))
+		found := false
+		for j, c := range clients {
+			row[j] = c.contextLine(i)
+			found = found || row[j] != ""
+		}
+		if !found {
+			continue // Before the start of the program
+		}
+		marker := " OK"
+		if i == index {
+			marker = " <--"
+		}
+		writeRow(out, row, marker)
+	}
+
+	fmt.Fprintln(out)
+	expected := clients[0].line(index)
+	for _, c := range clients[1:] {
+		actual := c.line(index)
+		if actual == expected {
+			continue
+		}
+		if actual == "" {
+			fmt.Fprintf(out, "%s stopped after %d instructions\n", c.name, windowStart+int64(len(c.lines)))
+			continue
+		}
+		if expected == "" {
+			fmt.Fprintf(out, "%s stopped after %d instructions\n", clients[0].name, windowStart+int64(len(clients[0].lines)))
+			continue
+		}
+		fmt.Fprintf(out, "%s vs %s:\n", clients[0].name, c.name)
+		for _, difference := range fieldDifferences(expected, actual) {
+			fmt.Fprintf(out, "    %s\n", difference)
+		}
+	}
+}
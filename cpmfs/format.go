@@ -0,0 +1,278 @@
+// Package cpmfs reads and writes CP/M 2.2 file systems in disk images, like
+// cpmtools. An image holds the sectors of the disk one after the other in
+// physical order, track by track, which is how cpmtools, SIMH and z80pack
+// store them. The geometry of a disk is given by a diskdef in the format used
+// by cpmtools' diskdefs file:
+//
+//	diskdef ibm-3740
+//	  seclen 128
+//	  tracks 77
+//	  sectrk 26
+//	  blocksize 1024
+//	  maxdir 64
+//	  skew 6
+//	  boottrk 2
+//	  os 2.2
+//	end
+package cpmfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builtinDiskDefs - The formats which are always available
+const builtinDiskDefs = `
+# 8" single sided single density, the standard CP/M distribution format
+diskdef ibm-3740
+  seclen 128
+  tracks 77
+  sectrk 26
+  blocksize 1024
+  maxdir 64
+  skew 6
+  boottrk 2
+  os 2.2
+end
+
+# 4MB hard disk (z80pack drive I:)
+diskdef 4mb-hd
+  seclen 128
+  tracks 1024
+  sectrk 32
+  blocksize 2048
+  maxdir 256
+  skew 1
+  boottrk 0
+  os 2.2
+end
+`
+
+// Format - The geometry of a disk
+type Format struct {
+	Name             string
+	SectorSize       int // seclen
+	Tracks           int
+	SectorsPerTrack  int // sectrk
+	BlockSize        int
+	DirectoryEntries int // maxdir
+	Skew             int
+	SkewTable        []int // The physical sector of each logical sector, from skew or skewtab
+	BootTracks       int   // boottrk: tracks reserved for the system
+}
+
+// Formats - The known disk formats by name. More can be added with LoadDiskDefs
+var Formats = map[string]*Format{}
+
+func init() {
+	formats, err := ParseDiskDefs(strings.NewReader(builtinDiskDefs))
+	if err != nil {
+		panic(err)
+	}
+	Formats = formats
+}
+
+// ParseDiskDefs - Reads diskdefs in the cpmtools format. Settings which don't
+// matter to CP/M 2.2 (ie: os, offset) are ignored
+func ParseDiskDefs(reader io.Reader) (map[string]*Format, error) {
+	formats := map[string]*Format{}
+	var format *Format
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if format == nil {
+			if fields[0] != "diskdef" || len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected diskdef <name>", lineNumber)
+			}
+			format = &Format{Name: fields[1], SectorSize: 128, Skew: 1}
+			continue
+		}
+		if fields[0] == "end" {
+			if err := format.check(); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+			formats[format.Name] = format
+			format = nil
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected <setting> <value>", lineNumber)
+		}
+		if fields[0] == "skewtab" {
+			format.SkewTable = []int{}
+			for _, sector := range strings.Split(fields[1], ",") {
+				value, err := strconv.Atoi(sector)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid skewtab", lineNumber)
+				}
+				format.SkewTable = append(format.SkewTable, value)
+			}
+			continue
+		}
+		value, err := strconv.Atoi(fields[1])
+		settings := map[string]*int{"seclen": &format.SectorSize, "tracks": &format.Tracks,
+			"sectrk": &format.SectorsPerTrack, "blocksize": &format.BlockSize, "maxdir": &format.DirectoryEntries,
+			"skew": &format.Skew, "boottrk": &format.BootTracks}
+		if setting, ok := settings[fields[0]]; ok {
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s", lineNumber, fields[0])
+			}
+			*setting = value
+		}
+	}
+	if format != nil {
+		return nil, fmt.Errorf("diskdef %s has no end", format.Name)
+	}
+	return formats, scanner.Err()
+}
+
+// LoadDiskDefs - Adds the formats in a diskdefs file to Formats
+func LoadDiskDefs(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	formats, err := ParseDiskDefs(file)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fileName, err)
+	}
+	for name, format := range formats {
+		Formats[name] = format
+	}
+	return nil
+}
+
+// check - Validates the format and works out the skew table
+func (f *Format) check() error {
+	switch {
+	case f.SectorSize < 128 || f.SectorSize%128 != 0:
+		return fmt.Errorf("%s: seclen must be a multiple of 128", f.Name)
+	case f.Tracks <= f.BootTracks || f.SectorsPerTrack <= 0:
+		return fmt.Errorf("%s: tracks and sectrk must be given", f.Name)
+	case f.BlockSize < 1024 || f.BlockSize&(f.BlockSize-1) != 0:
+		return fmt.Errorf("%s: blocksize must be a power of 2 of at least 1024", f.Name)
+	case f.DirectoryEntries <= 0 || f.DirectoryEntries*32 > 16*f.BlockSize:
+		return fmt.Errorf("%s: maxdir must be given and fit in 16 blocks", f.Name)
+	case f.SkewTable != nil && len(f.SkewTable) != f.SectorsPerTrack:
+		return fmt.Errorf("%s: skewtab must have sectrk entries", f.Name)
+	}
+	if f.SkewTable == nil {
+		// The same calculation as cpmtools: every skew'th sector, moving on to the
+		// next free one when a sector has already been used
+		f.SkewTable = make([]int, f.SectorsPerTrack)
+		used := make([]bool, f.SectorsPerTrack)
+		for i, j := 0, 0; i < f.SectorsPerTrack; i, j = i+1, (j+f.Skew)%f.SectorsPerTrack {
+			for used[j] {
+				j = (j + 1) % f.SectorsPerTrack
+			}
+			f.SkewTable[i], used[j] = j, true
+		}
+	}
+	return nil
+}
+
+// ImageSize - The size of an image of a whole disk
+func (f *Format) ImageSize() int64 {
+	return int64(f.Tracks) * int64(f.SectorsPerTrack) * int64(f.SectorSize)
+}
+
+// RecordsPerTrack - The number of 128 byte records (CP/M's sectors) in a track
+func (f *Format) RecordsPerTrack() int {
+	return f.SectorsPerTrack * f.SectorSize / 128
+}
+
+// Blocks - The number of allocation blocks after the system tracks (DSM + 1)
+func (f *Format) Blocks() int {
+	return (f.Tracks - f.BootTracks) * f.SectorsPerTrack * f.SectorSize / f.BlockSize
+}
+
+// DirectoryBlocks - The number of blocks at the start of the disk used by the directory
+func (f *Format) DirectoryBlocks() int {
+	return (f.DirectoryEntries*32 + f.BlockSize - 1) / f.BlockSize
+}
+
+// ExtentMask - EXM: the number of 16K logical extents in a directory entry, less one
+func (f *Format) ExtentMask() int {
+	if f.Blocks() > 256 {
+		return f.BlockSize/2048 - 1
+	}
+	return f.BlockSize/1024 - 1
+}
+
+// DPB - The disk parameter block which describes the format to the BDOS
+func (f *Format) DPB() []uint8 {
+	recordsPerBlock := f.BlockSize / 128
+	shift := 0
+	for 1<<uint(shift) < recordsPerBlock {
+		shift++
+	}
+	dsm := f.Blocks() - 1
+	allocation := uint16(0xFFFF << uint(16-f.DirectoryBlocks()))
+	spt := f.RecordsPerTrack()
+	drm := f.DirectoryEntries - 1
+	cks := f.DirectoryEntries / 4
+	return []uint8{
+		uint8(spt), uint8(spt >> 8),
+		uint8(shift), uint8(recordsPerBlock - 1), uint8(f.ExtentMask()),
+		uint8(dsm), uint8(dsm >> 8),
+		uint8(drm), uint8(drm >> 8),
+		uint8(allocation >> 8), uint8(allocation),
+		uint8(cks), uint8(cks >> 8),
+		uint8(f.BootTracks), uint8(f.BootTracks >> 8),
+	}
+}
+
+// RecordOffset - Where a 128 byte record of a track is in an image. The
+// sectors of the system tracks are not skewed
+func (f *Format) RecordOffset(track int, record int) (int64, error) {
+	recordsPerSector := f.SectorSize / 128
+	sector := record / recordsPerSector
+	if track < 0 || track >= f.Tracks || record < 0 || sector >= f.SectorsPerTrack {
+		return 0, fmt.Errorf("no track %d record %d", track, record)
+	}
+	if track >= f.BootTracks {
+		sector = f.SkewTable[sector]
+	}
+	return (int64(track)*int64(f.SectorsPerTrack)+int64(sector))*int64(f.SectorSize) + int64(record%recordsPerSector*128), nil
+}
+
+// FormatNames - The known formats in alphabetical order
+func FormatNames() []string {
+	names := []string{}
+	for name := range Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FindFormat - The format called name. When name is empty, the format whose
+// images are size bytes
+func FindFormat(name string, size int64) (*Format, error) {
+	if name != "" {
+		format, ok := Formats[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown disk format %s (available: %s)", name, strings.Join(FormatNames(), ", "))
+		}
+		return format, nil
+	}
+	for _, name := range FormatNames() {
+		if Formats[name].ImageSize() == size {
+			return Formats[name], nil
+		}
+	}
+	return nil, fmt.Errorf("no disk format is %d bytes", size)
+}
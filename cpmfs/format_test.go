@@ -0,0 +1,49 @@
+package cpmfs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDiskFormats : The DPB and skew of the standard 8" format and reading diskdefs
+func TestDiskFormats(t *testing.T) {
+	format := Formats["ibm-3740"]
+	expected := []uint8{26, 0, 3, 7, 0, 242, 0, 63, 0, 0xC0, 0x00, 16, 0, 2, 0}
+	if dpb := format.DPB(); !reflect.DeepEqual(dpb, expected) {
+		t.Errorf("Wrong DPB for ibm-3740: % X", dpb)
+	}
+	if skew := format.SkewTable[:6]; !reflect.DeepEqual(skew, []int{0, 6, 12, 18, 24, 4}) {
+		t.Errorf("Wrong skew for ibm-3740: %v", skew)
+	}
+
+	formats, err := ParseDiskDefs(strings.NewReader(`
+diskdef kaypro  # 5.25" double density
+  seclen 512
+  tracks 40
+  sectrk 10
+  blocksize 1024
+  maxdir 64
+  skewtab 0,2,4,6,8,1,3,5,7,9
+  boottrk 1
+  os 2.2
+end`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kaypro := formats["kaypro"]
+	expected = []uint8{40, 0, 3, 7, 0, 194, 0, 63, 0, 0xC0, 0x00, 16, 0, 1, 0}
+	if dpb := kaypro.DPB(); !reflect.DeepEqual(dpb, expected) {
+		t.Errorf("Wrong DPB for kaypro: % X", dpb)
+	}
+	// The 6th 128 byte record of track 1 is the 2nd quarter of the 2nd physical sector, which is sector 2
+	if offset, _ := kaypro.RecordOffset(1, 5); offset != (10+2)*512+128 {
+		t.Errorf("Record 5 of track 1 is at %d", offset)
+	}
+	if _, err := ParseDiskDefs(strings.NewReader("diskdef bad\n  seclen 100\nend\n")); err == nil {
+		t.Errorf("A sector size which isn't a multiple of 128 should be rejected")
+	}
+	if format, err := FindFormat("", 77*26*128); err != nil || format.Name != "ibm-3740" {
+		t.Errorf("An image of 256256 bytes should be ibm-3740, got %v %v", format, err)
+	}
+}
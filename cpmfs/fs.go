@@ -0,0 +1,365 @@
+package cpmfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The CP/M 2.2 file system. The directory is in the first blocks after the
+// system tracks and each of its 32 byte entries is
+//
+//	UU F1..F8 T1..T3 EX S1 S2 RC AL0..AL15
+//
+// UU is the user number (0xE5 when the entry is free), F and T are the name
+// and type padded with spaces (the high bits of T1 and T2 are the read only
+// and system attributes), and AL are the blocks of the entry: 16 of them when
+// the disk has 256 blocks or fewer, otherwise 8 of 16 bits. A file which is
+// bigger than the blocks of one entry has several, numbered by their extent
+// (EX + 32*S2). An extent is 16K and RC is the number of records used in the
+// last extent of the entry, which can cover several (see Format.ExtentMask).
+
+// deleted - The user number of a free directory entry
+const deleted = 0xE5
+
+// ErrNotFound - The file isn't on the disk
+var ErrNotFound = errors.New("file not found")
+
+// FileSystem - The file system of an image
+type FileSystem struct {
+	image     *Image
+	format    *Format
+	directory []uint8 // The directory entries, which are written back by flush
+}
+
+// File - A file in the directory
+type File struct {
+	User     int
+	Name     string // ie: HELLO.TXT, or HELLO when the type is blank
+	Records  int    // The size in 128 byte records
+	ReadOnly bool
+	System   bool
+	entries  []int // Its directory entries, in the order of their extents
+}
+
+// Size - The size of the file in bytes
+func (f File) Size() int {
+	return f.Records * 128
+}
+
+// NewFileSystem - Reads the directory of an image
+func NewFileSystem(image *Image) (*FileSystem, error) {
+	fs := &FileSystem{image: image, format: image.Format}
+	fs.directory = make([]uint8, image.Format.DirectoryEntries*32)
+	for record := 0; record*128 < len(fs.directory); record++ {
+		if err := fs.readRecord(record, fs.directory[record*128:]); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// readRecord - Reads a record of the data area (the tracks after the system tracks)
+func (fs *FileSystem) readRecord(record int, buffer []uint8) error {
+	perTrack := fs.format.RecordsPerTrack()
+	return fs.image.ReadRecord(fs.format.BootTracks+record/perTrack, record%perTrack, buffer)
+}
+
+func (fs *FileSystem) writeRecord(record int, buffer []uint8) error {
+	perTrack := fs.format.RecordsPerTrack()
+	return fs.image.WriteRecord(fs.format.BootTracks+record/perTrack, record%perTrack, buffer)
+}
+
+// flush - Writes the directory back to the image
+func (fs *FileSystem) flush() error {
+	for record := 0; record*128 < len(fs.directory); record++ {
+		if err := fs.writeRecord(record, fs.directory[record*128:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) entry(index int) []uint8 {
+	return fs.directory[index*32 : index*32+32]
+}
+
+// wideBlocks - Whether block numbers are 16 bits
+func (fs *FileSystem) wideBlocks() bool {
+	return fs.format.Blocks() > 256
+}
+
+// blocksPerEntry - How many blocks a directory entry can hold
+func (fs *FileSystem) blocksPerEntry() int {
+	if fs.wideBlocks() {
+		return 8
+	}
+	return 16
+}
+
+// blocks - The blocks used by a directory entry
+func (fs *FileSystem) blocks(entry []uint8) []int {
+	blocks := []int{}
+	for i := 0; i < fs.blocksPerEntry(); i++ {
+		block := int(entry[16+i])
+		if fs.wideBlocks() {
+			block = int(entry[16+2*i]) | int(entry[17+2*i])<<8
+		}
+		if block != 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// extent - The number of the last extent of a directory entry
+func extent(entry []uint8) int {
+	return int(entry[12]&0x1F) + int(entry[14]&0x3F)<<5
+}
+
+// recordsInEntry - How many records of the file a directory entry holds
+func (fs *FileSystem) recordsInEntry(entry []uint8) int {
+	return (extent(entry)&fs.format.ExtentMask())*128 + int(entry[15])
+}
+
+// fileName - The name of a directory entry, without the attributes
+func fileName(entry []uint8) string {
+	name := make([]byte, 11)
+	for i := range name {
+		name[i] = entry[1+i] & 0x7F
+	}
+	base, extension := strings.TrimRight(string(name[:8]), " "), strings.TrimRight(string(name[8:]), " ")
+	if extension == "" {
+		return base
+	}
+	return base + "." + extension
+}
+
+// directoryName - Turns a name like hello.txt into its 11 characters in a
+// directory entry, HELLO   TXT
+func directoryName(name string) ([]byte, error) {
+	name = strings.ToUpper(name)
+	base, extension := name, ""
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		base, extension = name[:dot], name[dot+1:]
+	}
+	if base == "" || len(base) > 8 || len(extension) > 3 {
+		return nil, fmt.Errorf("%s is not an 8.3 file name", name)
+	}
+	for _, c := range base + extension {
+		if c <= ' ' || c >= 0x7F || strings.ContainsRune("<>.,;:=?*[]", c) {
+			return nil, fmt.Errorf("%s is not a valid CP/M file name", name)
+		}
+	}
+	return []byte(fmt.Sprintf("%-8s%-3s", base, extension)), nil
+}
+
+// Files - The files on the disk in all user areas (0 to 15), by user then name
+func (fs *FileSystem) Files() []File {
+	files := map[string]*File{}
+	for i := 0; i < fs.format.DirectoryEntries; i++ {
+		entry := fs.entry(i)
+		if entry[0] > 15 {
+			continue // Free, or not a file (ie: a CP/M 3 disk label)
+		}
+		key := fmt.Sprintf("%02d:%s", entry[0], fileName(entry))
+		file, ok := files[key]
+		if !ok {
+			file = &File{User: int(entry[0]), Name: fileName(entry)}
+			files[key] = file
+		}
+		file.entries = append(file.entries, i)
+		if records := extent(entry)*128 + int(entry[15]); records > file.Records {
+			file.Records = records
+		}
+		file.ReadOnly = file.ReadOnly || entry[9]&0x80 != 0
+		file.System = file.System || entry[10]&0x80 != 0
+	}
+
+	keys := []string{}
+	for key, file := range files {
+		sort.Slice(file.entries, func(i, j int) bool {
+			return extent(fs.entry(file.entries[i])) < extent(fs.entry(file.entries[j]))
+		})
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := []File{}
+	for _, key := range keys {
+		list = append(list, *files[key])
+	}
+	return list
+}
+
+// find - The file called name in a user area
+func (fs *FileSystem) find(user int, name string) (File, error) {
+	for _, file := range fs.Files() {
+		if file.User == user && file.Name == strings.ToUpper(name) {
+			return file, nil
+		}
+	}
+	return File{}, fmt.Errorf("%d:%s: %s", user, strings.ToUpper(name), ErrNotFound)
+}
+
+// ReadFile - Reads a file. It is a whole number of records; the end of a text
+// file is marked with ^Z (0x1A)
+func (fs *FileSystem) ReadFile(user int, name string) ([]byte, error) {
+	file, err := fs.find(user, name)
+	if err != nil {
+		return nil, err
+	}
+	recordsPerBlock := fs.format.BlockSize / 128
+	data := []byte{}
+	buffer := make([]byte, 128)
+	for _, index := range file.entries {
+		entry := fs.entry(index)
+		records := fs.recordsInEntry(entry)
+		for i, block := range fs.blocks(entry) {
+			for record := i * recordsPerBlock; record < (i+1)*recordsPerBlock && record < records; record++ {
+				if block >= fs.format.Blocks() {
+					return nil, fmt.Errorf("%d:%s uses block %d, which isn't on the disk", user, file.Name, block)
+				}
+				if err := fs.readRecord(block*recordsPerBlock+record%recordsPerBlock, buffer); err != nil {
+					return nil, err
+				}
+				data = append(data, buffer...)
+			}
+		}
+	}
+	return data, nil
+}
+
+// usedBlocks - Which blocks are in use, including the directory's
+func (fs *FileSystem) usedBlocks() []bool {
+	used := make([]bool, fs.format.Blocks())
+	for i := 0; i < fs.format.DirectoryBlocks(); i++ {
+		used[i] = true
+	}
+	for i := 0; i < fs.format.DirectoryEntries; i++ {
+		if entry := fs.entry(i); entry[0] < 32 {
+			for _, block := range fs.blocks(entry) {
+				if block < len(used) {
+					used[block] = true
+				}
+			}
+		}
+	}
+	return used
+}
+
+// Free - How many bytes are free
+func (fs *FileSystem) Free() int {
+	free := 0
+	for _, used := range fs.usedBlocks() {
+		if !used {
+			free += fs.format.BlockSize
+		}
+	}
+	return free
+}
+
+// Erase - Deletes a file
+func (fs *FileSystem) Erase(user int, name string) error {
+	file, err := fs.find(user, name)
+	if err != nil {
+		return err
+	}
+	for _, index := range file.entries {
+		fs.entry(index)[0] = deleted
+	}
+	return fs.flush()
+}
+
+// WriteFile - Writes a file to a user area, replacing the file if it is already
+// there. The last record is padded with ^Z
+func (fs *FileSystem) WriteFile(user int, name string, data []byte) error {
+	if user < 0 || user > 15 {
+		return fmt.Errorf("there is no user area %d", user)
+	}
+	entryName, err := directoryName(name)
+	if err != nil {
+		return err
+	}
+	saved := append([]uint8{}, fs.directory...)
+	if err := fs.write(user, name, entryName, data); err != nil {
+		fs.directory = saved
+		return err
+	}
+	return fs.flush()
+}
+
+func (fs *FileSystem) write(user int, name string, entryName []byte, data []byte) error {
+	old, err := fs.find(user, name)
+	if err == nil && old.ReadOnly {
+		return fmt.Errorf("%d:%s is read only", user, old.Name)
+	}
+
+	// The new blocks are allocated while the old file still holds its blocks, so
+	// an error leaves the old file intact once the directory is put back
+	recordsPerBlock := fs.format.BlockSize / 128
+	records := (len(data) + 127) / 128
+	blockCount := (records + recordsPerBlock - 1) / recordsPerBlock
+	blocks := []int{}
+	for block, used := range fs.usedBlocks() {
+		if !used && len(blocks) < blockCount {
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) < blockCount {
+		return fmt.Errorf("the disk is full: %s needs %d blocks and %d are free", name, blockCount, len(blocks))
+	}
+	for _, index := range old.entries {
+		fs.entry(index)[0] = deleted
+	}
+	entryCount := (blockCount + fs.blocksPerEntry() - 1) / fs.blocksPerEntry()
+	if entryCount == 0 {
+		entryCount = 1 // An empty file still has an entry
+	}
+	entries := []int{}
+	for i := 0; i < fs.format.DirectoryEntries && len(entries) < entryCount; i++ {
+		if fs.entry(i)[0] == deleted {
+			entries = append(entries, i)
+		}
+	}
+	if len(entries) < entryCount {
+		return fmt.Errorf("the directory is full: %s needs %d entries", name, entryCount)
+	}
+
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{0x1A}, records*128-len(data))...)
+	for i := 0; i < records; i++ {
+		if err := fs.writeRecord(blocks[i/recordsPerBlock]*recordsPerBlock+i%recordsPerBlock, padded[i*128:]); err != nil {
+			return err
+		}
+	}
+
+	recordsPerEntry := fs.blocksPerEntry() * recordsPerBlock
+	for i, index := range entries {
+		entry := fs.entry(index)
+		for j := range entry {
+			entry[j] = 0
+		}
+		entry[0] = uint8(user)
+		copy(entry[1:], entryName)
+		count := records - i*recordsPerEntry
+		if count > recordsPerEntry {
+			count = recordsPerEntry
+		}
+		number, rc := i*(fs.format.ExtentMask()+1), 0
+		if count > 0 {
+			number += (count - 1) / 128
+			rc = count - (count-1)/128*128
+		}
+		entry[12], entry[14], entry[15] = uint8(number&0x1F), uint8(number>>5), uint8(rc)
+		first := i * fs.blocksPerEntry()
+		for j := first; j < first+fs.blocksPerEntry() && j < len(blocks); j++ {
+			if fs.wideBlocks() {
+				entry[16+2*(j-first)], entry[17+2*(j-first)] = uint8(blocks[j]), uint8(blocks[j]>>8)
+			} else {
+				entry[16+j-first] = uint8(blocks[j])
+			}
+		}
+	}
+	return nil
+}
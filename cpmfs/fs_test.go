@@ -0,0 +1,148 @@
+package cpmfs
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// newTestImage - A freshly formatted image in a temporary directory
+func newTestImage(t *testing.T, format string) (*Image, *FileSystem, func()) {
+	image, err := CreateImage(filepath.Join(t.TempDir(), "test.dsk"), Formats[format])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileSystem(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image, fs, func() { image.Close() }
+}
+
+// pattern - size bytes which differ from record to record
+func pattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i/128 + i)
+	}
+	return data
+}
+
+// TestRoundTrip : Files put in user areas are listed and read back, also after reopening the image
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{"ibm-3740", "4mb-hd"} {
+		image, fs, cleanup := newTestImage(t, format)
+		free := fs.Free()
+		files := map[string][]byte{"HELLO.TXT": []byte("Hello\r\n"), "BIG.COM": pattern(40000), "EMPTY": {}}
+		for name, data := range files {
+			if err := fs.WriteFile(0, name, data); err != nil {
+				t.Fatalf("%s: %s", format, err)
+			}
+		}
+		if err := fs.WriteFile(3, "hello.txt", []byte("user 3")); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := OpenImage(image.Name + ":" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, _ = NewFileSystem(reopened)
+		list := fs.Files()
+		names := []string{}
+		for _, file := range list {
+			names = append(names, string('0'+rune(file.User))+":"+file.Name)
+		}
+		if len(list) != 4 || names[0] != "0:BIG.COM" || names[1] != "0:EMPTY" || names[3] != "3:HELLO.TXT" || list[0].Size() != 40064 {
+			t.Errorf("%s: listed %v, BIG.COM is %d bytes", format, names, list[0].Size())
+		}
+		for name, expected := range files {
+			data, err := fs.ReadFile(0, name)
+			padded := append(append([]byte{}, expected...), bytes.Repeat([]byte{0x1A}, len(data)-len(expected))...)
+			if err != nil || len(data) != (len(expected)+127)/128*128 || !bytes.Equal(data, padded) {
+				t.Errorf("%s: %s read back as %d bytes, %v", format, name, len(data), err)
+			}
+		}
+		if data, _ := fs.ReadFile(3, "HELLO.TXT"); !bytes.HasPrefix(data, []byte("user 3\x1a")) {
+			t.Errorf("%s: user 3's HELLO.TXT is %q", format, data)
+		}
+
+		// Replacing a file frees its blocks and erasing every file frees them all
+		if err := fs.WriteFile(0, "big.com", pattern(1000)); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range fs.Files() {
+			if err := fs.Erase(file.User, file.Name); err != nil {
+				t.Error(err)
+			}
+		}
+		if len(fs.Files()) != 0 || fs.Free() != free {
+			t.Errorf("%s: after erasing everything %v are left with %d bytes free of %d", format, fs.Files(), fs.Free(), free)
+		}
+		if _, err := fs.ReadFile(0, "HELLO.TXT"); err == nil {
+			t.Errorf("%s: an erased file could be read", format)
+		}
+		reopened.Close()
+		cleanup()
+	}
+}
+
+// TestDirectoryEntries : The extents of a 20K file on an 8" disk are laid out as CP/M does
+func TestDirectoryEntries(t *testing.T) {
+	_, fs, cleanup := newTestImage(t, "ibm-3740")
+	defer cleanup()
+	if err := fs.WriteFile(2, "FILE.DAT", pattern(20*1024)); err != nil {
+		t.Fatal(err)
+	}
+	first := append([]byte{2}, "FILE    DAT"...)
+	first = append(first, 0, 0, 0, 0x80, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17)
+	second := append([]byte{2}, "FILE    DAT"...)
+	second = append(second, 1, 0, 0, 32, 18, 19, 20, 21, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	if !bytes.Equal(fs.entry(0), first) || !bytes.Equal(fs.entry(1), second) || fs.entry(2)[0] != deleted {
+		t.Errorf("Wrong directory entries:\n% X\n% X", fs.entry(0), fs.entry(1))
+	}
+}
+
+// TestWriteErrors : Bad names, full disks and read only files
+func TestWriteErrors(t *testing.T) {
+	_, fs, cleanup := newTestImage(t, "ibm-3740")
+	defer cleanup()
+	for _, name := range []string{"TOOLONGNAME.TXT", "A.TEXT", "*.COM", "A B.C", ".TXT"} {
+		if err := fs.WriteFile(0, name, nil); err == nil {
+			t.Errorf("%s should be rejected", name)
+		}
+	}
+	if err := fs.WriteFile(16, "A", nil); err == nil {
+		t.Errorf("User 16 should be rejected")
+	}
+	if err := fs.WriteFile(0, "HUGE", make([]byte, 300*1024)); err == nil {
+		t.Errorf("A file bigger than the disk should be rejected")
+	}
+	if len(fs.Files()) != 0 {
+		t.Errorf("A failed write left %v in the directory", fs.Files())
+	}
+	if err := fs.image.ReadRecord(2, 1, make([]uint8, 64)); err == nil {
+		t.Errorf("A short buffer should be rejected by ReadRecord")
+	}
+	if err := fs.image.WriteRecord(2, 1, make([]uint8, 64)); err == nil {
+		t.Errorf("A short buffer should be rejected by WriteRecord")
+	}
+
+	// A replacement which doesn't fit leaves the old file as it was
+	if err := fs.WriteFile(0, "KEEP.COM", pattern(200*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(0, "KEEP.COM", make([]byte, 100*1024)); err == nil {
+		t.Errorf("A replacement bigger than the free space should be rejected")
+	}
+	if data, err := fs.ReadFile(0, "KEEP.COM"); err != nil || !bytes.Equal(data, pattern(200*1024)) {
+		t.Errorf("A failed replacement changed the old file: %v", err)
+	}
+	fs.Erase(0, "KEEP.COM")
+
+	fs.WriteFile(0, "RO.TXT", []byte("x"))
+	fs.entry(0)[9] |= 0x80
+	if err := fs.WriteFile(0, "RO.TXT", []byte("y")); err == nil || !fs.Files()[0].ReadOnly {
+		t.Errorf("A read only file should not be replaced")
+	}
+}
@@ -0,0 +1,145 @@
+package cpmfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Image - An open disk image. Records are read and written the way a BIOS
+// does, by track and 128 byte record, with the skew applied
+type Image struct {
+	Name     string
+	Format   *Format
+	ReadOnly bool
+	file     *os.File
+}
+
+// SplitSpec - Splits an image given as <file> or <file>:<format>
+func SplitSpec(spec string) (string, string) {
+	if colon := strings.LastIndex(spec, ":"); colon > 1 { // Not a Windows drive letter
+		return spec[:colon], spec[colon+1:]
+	}
+	return spec, ""
+}
+
+// OpenImage - Opens an image given as <file> or <file>:<format>. Without a
+// format, the one whose size matches the file is used. An image which can't
+// be written is opened read only
+func OpenImage(spec string) (*Image, error) {
+	path, formatName := SplitSpec(spec)
+	image := &Image{Name: path}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		image.ReadOnly = true
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	image.Format, err = FindFormat(formatName, info.Size())
+	if err != nil {
+		file.Close()
+		if formatName == "" {
+			return nil, fmt.Errorf("%s: %s, give one as %s:<format>", path, err, path)
+		}
+		return nil, err
+	}
+	image.file = file
+	return image, nil
+}
+
+// CreateImage - Creates an image of a freshly formatted disk, replacing any
+// file which is already there. Every byte is 0xE5, which is an empty directory
+// and blank system tracks
+func CreateImage(path string, format *Format) (*Image, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	track := bytes.Repeat([]byte{0xE5}, format.SectorsPerTrack*format.SectorSize)
+	for i := 0; i < format.Tracks; i++ {
+		if _, err := file.Write(track); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &Image{Name: path, Format: format, file: file}, nil
+}
+
+// ReadRecord - Reads a record. Parts of the image past the end of the file read as 0xE5 (empty)
+func (i *Image) ReadRecord(track int, record int, buffer []uint8) error {
+	if len(buffer) < 128 {
+		return fmt.Errorf("%s: a record needs a 128 byte buffer, not %d", i.Name, len(buffer))
+	}
+	offset, err := i.Format.RecordOffset(track, record)
+	if err != nil {
+		return fmt.Errorf("%s: %s", i.Name, err)
+	}
+	n, err := i.file.ReadAt(buffer[:128], offset)
+	for j := n; j < 128; j++ {
+		buffer[j] = 0xE5
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// WriteRecord - Writes a record
+func (i *Image) WriteRecord(track int, record int, buffer []uint8) error {
+	if i.ReadOnly {
+		return fmt.Errorf("%s is read only", i.Name)
+	}
+	if len(buffer) < 128 {
+		return fmt.Errorf("%s: a record needs a 128 byte buffer, not %d", i.Name, len(buffer))
+	}
+	offset, err := i.Format.RecordOffset(track, record)
+	if err != nil {
+		return fmt.Errorf("%s: %s", i.Name, err)
+	}
+	_, err = i.file.WriteAt(buffer[:128], offset)
+	return err
+}
+
+// ReadSystem - Reads the system tracks
+func (i *Image) ReadSystem() ([]uint8, error) {
+	perTrack := i.Format.RecordsPerTrack()
+	system := make([]uint8, i.Format.BootTracks*perTrack*128)
+	for record := 0; record*128 < len(system); record++ {
+		if err := i.ReadRecord(record/perTrack, record%perTrack, system[record*128:]); err != nil {
+			return nil, err
+		}
+	}
+	return system, nil
+}
+
+// WriteSystem - Writes the system (ie: the boot loader, CCP, BDOS and BIOS) to
+// the system tracks, like SYSGEN. The rest of the tracks are left as they are
+func (i *Image) WriteSystem(system []uint8) error {
+	perTrack := i.Format.RecordsPerTrack()
+	if len(system) > i.Format.BootTracks*perTrack*128 {
+		return fmt.Errorf("the system is %d bytes but the system tracks of %s only hold %d",
+			len(system), i.Format.Name, i.Format.BootTracks*perTrack*128)
+	}
+	buffer := make([]uint8, 128)
+	for record := 0; record*128 < len(system); record++ {
+		copy(buffer, bytes.Repeat([]byte{0xE5}, 128))
+		copy(buffer, system[record*128:])
+		if err := i.WriteRecord(record/perTrack, record%perTrack, buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close - Closes the image file
+func (i *Image) Close() error {
+	return i.file.Close()
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Insood/8080/cpmfs"
+)
+
+// Manages the files on CP/M 2.2 disk images without booting them, like
+// cpmtools:
+//
+//	cpmtool ls disk.dsk                 List the files in every user area
+//	cpmtool get disk.dsk 0:README.TXT   Copy a file from the disk
+//	cpmtool put disk.dsk hello.com      Copy a file to the disk
+//	cpmtool erase disk.dsk *.BAK        Delete files
+//	cpmtool format -f ibm-3740 new.dsk  Make an empty disk
+//	cpmtool sysgen disk.dsk cpm.sys     Write the system tracks
+//
+// Files on the disk are given as [user:]name, where the user area is 0 unless
+// it is given. The format of an image is found from its size unless it is
+// given with -f.
+
+var commands = map[string]func(args []string) error{
+	"ls":     listCommand,
+	"get":    getCommand,
+	"put":    putCommand,
+	"erase":  eraseCommand,
+	"format": formatCommand,
+	"sysgen": sysgenCommand,
+}
+
+// usages - The arguments of each command
+var usages = map[string]string{
+	"ls":     "ls [options] <image> [[user:]pattern...]",
+	"get":    "get [options] <image> [user:]<name> [<host file>|-]",
+	"put":    "put [options] <image> <host file> [[user:]<name>]",
+	"erase":  "erase [options] <image> [user:]<pattern>...",
+	"format": "format [options] <image>",
+	"sysgen": "sysgen [options] <image> <system file>",
+}
+
+// newFlags - The flags of a command, including the ones every command has.
+// The format given with -f is returned
+func newFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	format := flags.String("f", "", "The format of the image (default: found from its size)")
+	flags.Func("diskdefs", "Load more formats from this cpmtools diskdefs file", cpmfs.LoadDiskDefs)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s %s\n", os.Args[0], usages[name])
+		flags.PrintDefaults()
+	}
+	return flags, format
+}
+
+// openImage - Opens an image and reads its directory
+func openImage(fileName string, format string) (*cpmfs.Image, *cpmfs.FileSystem, error) {
+	if format != "" {
+		fileName += ":" + format
+	}
+	image, err := cpmfs.OpenImage(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, err := cpmfs.NewFileSystem(image)
+	if err != nil {
+		image.Close()
+		return nil, nil, err
+	}
+	return image, fs, nil
+}
+
+// splitUser - Splits [user:]name. user is -1 when it isn't given
+func splitUser(name string) (int, string, error) {
+	colon := strings.Index(name, ":")
+	if colon < 0 {
+		return -1, name, nil
+	}
+	user, err := strconv.Atoi(name[:colon])
+	if err != nil || user < 0 || user > 15 {
+		return 0, "", fmt.Errorf("%s: the user area must be 0 to 15", name)
+	}
+	return user, name[colon+1:], nil
+}
+
+// matching - The files which match [user:]pattern, where the pattern can use
+// * and ?. Without a user area, every user area is searched
+func matching(fs *cpmfs.FileSystem, pattern string) ([]cpmfs.File, error) {
+	user, pattern, err := splitUser(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files := []cpmfs.File{}
+	for _, file := range fs.Files() {
+		if ok, err := path.Match(strings.ToUpper(pattern), file.Name); err != nil {
+			return nil, err
+		} else if ok && (user < 0 || user == file.User) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func listCommand(args []string) error {
+	flags, format := newFlags("ls")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return errors.New("no image given")
+	}
+	image, fs, err := openImage(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	patterns := flags.Args()[1:]
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	listed := map[string]cpmfs.File{}
+	for _, pattern := range patterns {
+		files, err := matching(fs, pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			listed[fmt.Sprintf("%02d:%s", file.User, file.Name)] = file
+		}
+	}
+	keys := []string{}
+	for key := range listed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		file := listed[key]
+		attributes := ""
+		if file.ReadOnly {
+			attributes += " R/O"
+		}
+		if file.System {
+			attributes += " SYS"
+		}
+		fmt.Printf("%2d: %-12s %7d%s\n", file.User, file.Name, file.Size(), attributes)
+	}
+	fmt.Printf("%d files, %d bytes free (%s)\n", len(keys), fs.Free(), image.Format.Name)
+	return nil
+}
+
+func getCommand(args []string) error {
+	flags, format := newFlags("get")
+	text := flags.Bool("t", false, "Text file: stop at ^Z and turn CR LF into LF")
+	flags.Parse(args)
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		flags.Usage()
+		return errors.New("expected an image, a file and optionally where to put it")
+	}
+	image, fs, err := openImage(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	user, name, err := splitUser(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if user < 0 {
+		user = 0
+	}
+	data, err := fs.ReadFile(user, name)
+	if err != nil {
+		return err
+	}
+	if *text {
+		if end := bytes.IndexByte(data, 0x1A); end >= 0 {
+			data = data[:end]
+		}
+		data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	}
+	destination := strings.ToLower(name)
+	if flags.NArg() == 3 {
+		destination = flags.Arg(2)
+	}
+	if destination == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(destination, data, 0666)
+}
+
+func putCommand(args []string) error {
+	flags, format := newFlags("put")
+	text := flags.Bool("t", false, "Text file: turn LF into CR LF")
+	flags.Parse(args)
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		flags.Usage()
+		return errors.New("expected an image, a host file and optionally its name on the disk")
+	}
+	image, fs, err := openImage(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	data, err := ioutil.ReadFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *text {
+		data = bytes.Replace(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+	}
+	user, name := 0, filepath.Base(flags.Arg(1))
+	if flags.NArg() == 3 {
+		if user, name, err = splitUser(flags.Arg(2)); err != nil {
+			return err
+		}
+		if user < 0 {
+			user = 0
+		}
+	}
+	return fs.WriteFile(user, name, data)
+}
+
+func eraseCommand(args []string) error {
+	flags, format := newFlags("erase")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return errors.New("expected an image and the files to erase")
+	}
+	image, fs, err := openImage(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	for _, pattern := range flags.Args()[1:] {
+		files, err := matching(fs, pattern)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("%s: %s", pattern, cpmfs.ErrNotFound)
+		}
+		for _, file := range files {
+			if err := fs.Erase(file.User, file.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatCommand(args []string) error {
+	flags, format := newFlags("format")
+	system := flags.String("system", "", "Write this file to the system tracks (see sysgen)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("no image given")
+	}
+	if *format == "" {
+		*format = "ibm-3740"
+	}
+	diskFormat, err := cpmfs.FindFormat(*format, 0)
+	if err != nil {
+		return err
+	}
+	image, err := cpmfs.CreateImage(flags.Arg(0), diskFormat)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	if *system != "" {
+		return writeSystem(image, *system)
+	}
+	return nil
+}
+
+func sysgenCommand(args []string) error {
+	flags, format := newFlags("sysgen")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected an image and a system file")
+	}
+	image, _, err := openImage(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	return writeSystem(image, flags.Arg(1))
+}
+
+// writeSystem - Writes a file (ie: the boot sector followed by the CCP, BDOS
+// and BIOS, as saved by SYSGEN) to the system tracks
+func writeSystem(image *cpmfs.Image, fileName string) error {
+	system, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return image.WriteSystem(system)
+}
+
+func usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Manages the files on CP/M disk images. Formats: %s\n", strings.Join(cpmfs.FormatNames(), ", "))
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", os.Args[0], usages[name])
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,203 @@
+// Package intelhex reads and writes files in the Intel HEX format, which
+// assemblers and EPROM programmers use for 8080 programs. Each line is a record
+//
+//	:LLAAAATTDD...CC
+//
+// of LL data bytes for address AAAA, of type TT, with a checksum CC which makes
+// the sum of all of the bytes of the record 0. The types are
+//
+//	00  Data
+//	01  End of file
+//	02  Extended segment address: the data is a paragraph (x16) added to later addresses
+//	03  Start segment address: CS and IP of the start address
+//	04  Extended linear address: the upper 16 bits of later addresses
+//	05  Start linear address: the start address
+package intelhex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Record types
+const (
+	Data = iota
+	EndOfFile
+	ExtendedSegmentAddress
+	StartSegmentAddress
+	ExtendedLinearAddress
+	StartLinearAddress
+)
+
+// Segment - Bytes which go one after the other from an address
+type Segment struct {
+	Address uint32
+	Data    []byte
+}
+
+// File - What a HEX file holds. The segments are in the order they are in the
+// file, with records which carry on from the one before joined together
+type File struct {
+	Segments []Segment
+	Start    uint32
+	HasStart bool // The file has a start address record
+}
+
+// Read - Reads a HEX file. Any record with a bad checksum, a length which doesn't
+// match the line or an unknown type is an error, and so is a file without an
+// end of file record. Blank lines are skipped
+func Read(r io.Reader) (*File, error) {
+	file := &File{}
+	base := uint32(0)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		recordType, address, data, err := parseRecord(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		switch recordType {
+		case Data:
+			file.add(base+uint32(address), data)
+		case EndOfFile:
+			return file, nil
+		case ExtendedSegmentAddress, ExtendedLinearAddress:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %d: an extended address record needs 2 bytes", line)
+			}
+			base = uint32(data[0])<<8 | uint32(data[1])
+			if recordType == ExtendedSegmentAddress {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case StartSegmentAddress, StartLinearAddress:
+			if len(data) != 4 {
+				return nil, fmt.Errorf("line %d: a start address record needs 4 bytes", line)
+			}
+			start := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+			if recordType == StartSegmentAddress {
+				start = start>>16<<4 + start&0xFFFF // CS:IP
+			}
+			file.Start, file.HasStart = start, true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("there is no end of file record")
+}
+
+// parseRecord - The type, address and data of a record, after checking it
+func parseRecord(text string) (int, uint16, []byte, error) {
+	if text[0] != ':' {
+		return 0, 0, nil, errors.New("a record must start with :")
+	}
+	record, err := hex.DecodeString(text[1:])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("bad hex digits in %s", text)
+	}
+	if len(record) < 5 || len(record) != 5+int(record[0]) {
+		return 0, 0, nil, fmt.Errorf("the length of the record doesn't match its byte count")
+	}
+	sum := byte(0)
+	for _, b := range record {
+		sum += b
+	}
+	if sum != 0 {
+		return 0, 0, nil, fmt.Errorf("checksum error (the checksum should be %02X)", record[len(record)-1]-sum)
+	}
+	if record[3] > StartLinearAddress {
+		return 0, 0, nil, fmt.Errorf("unknown record type %02X", record[3])
+	}
+	return int(record[3]), uint16(record[1])<<8 | uint16(record[2]), record[4 : len(record)-1], nil
+}
+
+// add - Adds data to the last segment if it carries on from it
+func (f *File) add(address uint32, data []byte) {
+	if n := len(f.Segments); n > 0 {
+		last := &f.Segments[n-1]
+		if last.Address+uint32(len(last.Data)) == address {
+			last.Data = append(last.Data, data...)
+			return
+		}
+	}
+	f.Segments = append(f.Segments, Segment{address, append([]byte{}, data...)})
+}
+
+// Bounds - The lowest address and one past the highest address of the data
+func (f *File) Bounds() (uint32, uint32) {
+	if len(f.Segments) == 0 {
+		return 0, 0
+	}
+	low, high := f.Segments[0].Address, uint32(0)
+	for _, segment := range f.Segments {
+		if segment.Address < low {
+			low = segment.Address
+		}
+		if end := segment.Address + uint32(len(segment.Data)); end > high {
+			high = end
+		}
+	}
+	return low, high
+}
+
+// Image - The data from the lowest address to the highest, with any gaps
+// between the segments filled with fill
+func (f *File) Image(fill byte) []byte {
+	low, high := f.Bounds()
+	image := bytes.Repeat([]byte{fill}, int(high-low))
+	for _, segment := range f.Segments {
+		copy(image[segment.Address-low:], segment.Data)
+	}
+	return image
+}
+
+// Write - Writes a HEX file with up to 16 bytes in a record. Extended linear
+// address records are written for data above 64K, and the start address is
+// written if there is one
+func Write(w io.Writer, file *File) error {
+	out := bufio.NewWriter(w)
+	upper := uint32(0)
+	for _, segment := range file.Segments {
+		for offset := 0; offset < len(segment.Data); {
+			address := segment.Address + uint32(offset)
+			if address>>16 != upper {
+				upper = address >> 16
+				writeRecord(out, ExtendedLinearAddress, 0, []byte{byte(upper >> 8), byte(upper)})
+			}
+			n := len(segment.Data) - offset
+			if n > 16 {
+				n = 16
+			}
+			if toBoundary := 0x10000 - int(address&0xFFFF); n > toBoundary {
+				n = toBoundary // A record can't cross into the next 64K
+			}
+			writeRecord(out, Data, uint16(address), segment.Data[offset:offset+n])
+			offset += n
+		}
+	}
+	if file.HasStart {
+		start := file.Start
+		writeRecord(out, StartLinearAddress, 0, []byte{byte(start >> 24), byte(start >> 16), byte(start >> 8), byte(start)})
+	}
+	writeRecord(out, EndOfFile, 0, nil)
+	return out.Flush()
+}
+
+func writeRecord(w io.Writer, recordType int, address uint16, data []byte) {
+	record := append([]byte{byte(len(data)), byte(address >> 8), byte(address), byte(recordType)}, data...)
+	sum := byte(0)
+	for _, b := range record {
+		sum += b
+	}
+	fmt.Fprintf(w, ":%s%02X\n", strings.ToUpper(hex.EncodeToString(record)), -sum)
+}
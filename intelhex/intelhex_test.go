@@ -0,0 +1,74 @@
+package intelhex
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestRead : Data records are joined into segments, extended addresses are
+// added and the start address is kept
+func TestRead(t *testing.T) {
+	file, err := Read(strings.NewReader(`
+:0301000021000CCF
+:02010300C90031
+:020000021000EC
+:01000000AA55
+:0400000300001234B3
+:00000001FF
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Segment{{0x100, []byte{0x21, 0x00, 0x0C, 0xC9, 0x00}}, {0x10000, []byte{0xAA}}}
+	if !reflect.DeepEqual(file.Segments, expected) {
+		t.Errorf("Expected %v, got %v", expected, file.Segments)
+	}
+	if !file.HasStart || file.Start != 0x1234 {
+		t.Errorf("Expected a start address of 1234, got %X", file.Start)
+	}
+}
+
+// TestReadErrors : Bad records are reported with their line
+func TestReadErrors(t *testing.T) {
+	tests := map[string]string{
+		":0301000021000CCE\n:00000001FF\n": "line 1: checksum error (the checksum should be CF)",
+		":03010000210CCF\n":                "line 1: the length of the record doesn't match its byte count",
+		":00000006FA\n":                    "line 1: unknown record type 06",
+		"\n0300\n":                         "line 2: a record must start with :",
+		":0100000000FF\n":                  "there is no end of file record",
+	}
+	for text, expected := range tests {
+		if _, err := Read(strings.NewReader(text)); err == nil || err.Error() != expected {
+			t.Errorf("%q: expected %q, got %v", text, expected, err)
+		}
+	}
+}
+
+// TestWrite : What is written reads back the same, with records split at 16
+// bytes and at 64K
+func TestWrite(t *testing.T) {
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	file := &File{Segments: []Segment{{0x100, data}, {0xFFF8, data}}, Start: 0x100, HasStart: true}
+	buffer := bytes.Buffer{}
+	if err := Write(&buffer, file); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buffer.String(), ":10010000") || !strings.Contains(buffer.String(), ":020000040001F9\n") {
+		t.Errorf("Unexpected records:\n%s", buffer.String())
+	}
+	read, err := Read(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, file) {
+		t.Errorf("Expected %v, got %v", file, read)
+	}
+	if image := read.Image(0xFF); len(image) != 0xFFF8+40-0x100 || image[40] != 0xFF {
+		t.Errorf("Expected the image to be filled between the segments")
+	}
+}
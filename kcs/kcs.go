@@ -0,0 +1,195 @@
+// Package kcs encodes and decodes the audio of cassette tapes in the Kansas
+// City Standard (KCS) and the faster CUTS format of the Processor Technology
+// CUTS board. Both send bytes as a serial line would, with a start bit (0), 8
+// data bits from the lowest and 2 stop bits (1), with each bit a burst of
+// tone:
+//
+//	KCS, 300 baud    0: 4 cycles of 1200 Hz  1: 8 cycles of 2400 Hz
+//	CUTS, 1200 baud  0: 1 cycle of 1200 Hz   1: 2 cycles of 2400 Hz
+//
+// Between bytes, and in the leader before the first one, the line is held at
+// 1 (the mark tone). The audio is kept as 16 bit samples (see ReadWAV and
+// WriteWAV).
+package kcs
+
+import "math"
+
+const (
+	markHz  = 2400 // The tone of a 1
+	spaceHz = 1200 // The tone of a 0
+)
+
+// Baud rates of the two formats
+const (
+	KCS  = 300
+	CUTS = 1200
+)
+
+// DefaultRate - The sample rate tapes are written at
+const DefaultRate = 22050
+
+// amplitude - How loud the tones are, leaving some headroom
+const amplitude = 24000
+
+// Encoder - Makes the audio for a tape
+type Encoder struct {
+	Baud    int
+	Rate    int // Samples per second
+	samples []int16
+	phase   float64 // Of the tone, which carries on from bit to bit
+	time    float64 // The samples there should be by the end of the last bit
+}
+
+// NewEncoder - An encoder for a tape at baud (KCS or CUTS) with rate samples per second
+func NewEncoder(baud int, rate int) *Encoder {
+	return &Encoder{Baud: baud, Rate: rate}
+}
+
+// bit - Adds a bit of tone
+func (e *Encoder) bit(one bool) {
+	frequency := float64(spaceHz)
+	if one {
+		frequency = markHz
+	}
+	e.time += float64(e.Rate) / float64(e.Baud)
+	for float64(len(e.samples)) < e.time {
+		e.samples = append(e.samples, int16(amplitude*math.Sin(e.phase)))
+		e.phase = math.Mod(e.phase+2*math.Pi*frequency/float64(e.Rate), 2*math.Pi)
+	}
+}
+
+// Mark - Holds the line at 1 for a number of seconds (the leader, or a gap
+// between bytes), rounded to whole bits
+func (e *Encoder) Mark(seconds float64) {
+	for bits := int(seconds*float64(e.Baud) + 0.5); bits > 0; bits-- {
+		e.bit(true)
+	}
+}
+
+// WriteByte - Adds a byte
+func (e *Encoder) WriteByte(b byte) error {
+	e.bit(false)
+	for i := uint(0); i < 8; i++ {
+		e.bit(b>>i&1 != 0)
+	}
+	e.bit(true)
+	e.bit(true)
+	return nil
+}
+
+// Write - Adds bytes one after the other
+func (e *Encoder) Write(data []byte) (int, error) {
+	for _, b := range data {
+		e.WriteByte(b)
+	}
+	return len(data), nil
+}
+
+// Samples - The audio so far
+func (e *Encoder) Samples() []int16 {
+	return e.samples
+}
+
+// ByteSeconds - How long a byte takes on the tape
+func ByteSeconds(baud int) float64 {
+	return 11 / float64(baud)
+}
+
+// Encode - The audio of a whole tape: a leader, the data and a second of trailer
+func Encode(data []byte, baud int, rate int, leader float64) []int16 {
+	e := NewEncoder(baud, rate)
+	e.Mark(leader)
+	e.Write(data)
+	e.Mark(1)
+	return e.Samples()
+}
+
+// Byte - A byte found on a tape, and where its start bit is (in seconds)
+type Byte struct {
+	Value byte
+	Time  float64
+}
+
+// Decode - Finds the bytes on a tape. Each half cycle of the audio is taken to
+// be the mark or the space tone by its length, and the bytes are then read
+// from the tones the way a UART would: a start bit is a change from mark to
+// space, each bit is taken to be what most of the middle half of it is, and a
+// byte without its stop bit is thrown away. Silence counts as mark
+func Decode(samples []int16, rate int, baud int) []Byte {
+	mark := tones(samples, rate)
+	bitLength := float64(rate) / float64(baud)
+	// vote - Whether most of the middle of bit n after start is mark
+	vote := func(start int, n int) bool {
+		from, to := start+int((float64(n)+0.25)*bitLength), start+int((float64(n)+0.75)*bitLength)
+		marks := 0
+		for i := from; i < to; i++ {
+			marks += int(boolToByte(mark[i]))
+		}
+		return marks*2 > to-from
+	}
+	bytes := []Byte{}
+	frame := int(10 * bitLength) // Start, data and the first stop bit
+	for i := 1; i+frame < len(mark); i++ {
+		if !mark[i-1] || mark[i] || vote(i, 0) || !vote(i, 9) {
+			continue
+		}
+		value := byte(0)
+		for n := 0; n < 8; n++ {
+			value |= boolToByte(vote(i, n+1)) << uint(n)
+		}
+		bytes = append(bytes, Byte{value, float64(i) / float64(rate)})
+		i += int(9.5 * bitLength) // To the middle of the stop bit
+	}
+	return bytes
+}
+
+// tones - Whether each sample is in a half cycle of the mark tone. The zero
+// crossings are found with some hysteresis so that noise on a quiet tape
+// doesn't make crossings of its own
+func tones(samples []int16, rate int) []bool {
+	peak := 0
+	for _, s := range samples {
+		if v := int(s); v > peak {
+			peak = v
+		} else if -v > peak {
+			peak = -v
+		}
+	}
+	threshold := peak / 8
+	shortest := float64(rate) / (markHz + spaceHz) // Between the half cycles of the two tones
+	longest := float64(rate) / (spaceHz / 2)       // Anything longer is silence
+
+	mark := make([]bool, len(samples))
+	level, last := 0, 0
+	for i, s := range samples {
+		switch {
+		case int(s) > threshold && level <= 0, int(s) < -threshold && level >= 0:
+			if level != 0 {
+				length := float64(i - last)
+				isMark := length < shortest || length > longest
+				for j := last; j < i; j++ {
+					mark[j] = isMark
+				}
+			} else {
+				for j := 0; j < i; j++ {
+					mark[j] = true
+				}
+			}
+			level, last = 1, i
+			if s < 0 {
+				level = -1
+			}
+		}
+	}
+	for j := last; j < len(mark); j++ {
+		mark[j] = true
+	}
+	return mark
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
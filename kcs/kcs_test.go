@@ -0,0 +1,88 @@
+package kcs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func allBytes() []byte {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func decoded(found []Byte) []byte {
+	data := []byte{}
+	for _, b := range found {
+		data = append(data, b.Value)
+	}
+	return data
+}
+
+// TestRoundTrip : Every byte comes back through a WAV file, in both formats and
+// at the usual sample rates
+func TestRoundTrip(t *testing.T) {
+	for _, baud := range []int{KCS, CUTS} {
+		for _, rate := range []int{11025, 22050, 44100, 48000} {
+			data := allBytes()
+			buffer := bytes.Buffer{}
+			if err := WriteWAV(&buffer, Encode(data, baud, rate, 2), rate); err != nil {
+				t.Fatal(err)
+			}
+			samples, readRate, err := ReadWAV(&buffer)
+			if err != nil || readRate != rate {
+				t.Fatalf("Couldn't read the WAV file back: %v (rate %d)", err, readRate)
+			}
+			found := Decode(samples, rate, baud)
+			if got := decoded(found); !bytes.Equal(got, data) {
+				t.Errorf("%d baud at %d Hz: expected 256 bytes back, got %d: % X", baud, rate, len(got), got)
+				continue
+			}
+			// The first start bit is after the 2 second leader, and the rest follow 11 bits apart
+			if found[0].Time < 1.99 || found[0].Time > 2.01 {
+				t.Errorf("%d baud at %d Hz: expected the first byte at 2 seconds, not %.3f", baud, rate, found[0].Time)
+			}
+			if gap := found[255].Time - found[254].Time; gap < ByteSeconds(baud)*0.95 || gap > ByteSeconds(baud)*1.05 {
+				t.Errorf("%d baud at %d Hz: bytes are %.4f seconds apart", baud, rate, gap)
+			}
+		}
+	}
+}
+
+// TestNoisyTape : A quiet tape with noise, an offset and silence in it still
+// decodes
+func TestNoisyTape(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	e := NewEncoder(KCS, DefaultRate)
+	e.Mark(1)
+	e.Write([]byte("HELLO"))
+	samples := append(make([]int16, DefaultRate), e.Samples()...) // A second of silence first
+	for i, s := range samples {
+		samples[i] = s/4 + 500 + int16(random.Intn(1200)-600)
+	}
+	if got := decoded(Decode(samples, DefaultRate, KCS)); string(got) != "HELLO" {
+		t.Errorf("Expected HELLO, got %q", got)
+	}
+}
+
+// TestReadWAV : 16 bit stereo files are read from their first channel, and
+// other files are refused
+func TestReadWAV(t *testing.T) {
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x02\x00\x44\xAC\x00\x00\x10\xB1\x02\x00\x04\x00\x10\x00" +
+		"data\x08\x00\x00\x00\x01\x02\xFF\xFF\x03\x04\x00\x00")
+	samples, rate, err := ReadWAV(bytes.NewReader(wav))
+	if err != nil || rate != 44100 || len(samples) != 2 || samples[0] != 0x0201 || samples[1] != 0x0403 {
+		t.Errorf("Expected 0201 0403 at 44100 Hz, got %04X at %d (%v)", samples, rate, err)
+	}
+	if _, _, err := ReadWAV(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00AVI "))); err == nil {
+		t.Error("Read an AVI file as a WAV file")
+	}
+	// Cut short in a chunk of an odd length, whose padding byte is missing
+	truncated := []byte("RIFF\x00\x00\x00\x00WAVELIST\x33\x00\x00\x00INFOISFT\x03\x00\x00")
+	if _, _, err := ReadWAV(bytes.NewReader(truncated)); err == nil || err.Error() != "there is no audio in the WAV file" {
+		t.Errorf("Expected a truncated file without audio to be refused, got %v", err)
+	}
+}
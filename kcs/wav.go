@@ -0,0 +1,85 @@
+package kcs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ReadWAV - Reads the audio of a WAV file of 8 or 16 bit PCM samples. Only the
+// first channel of a stereo file is used. Returns the samples and the sample rate
+func ReadWAV(r io.Reader) ([]int16, int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("not a WAV file")
+	}
+	channels, rate, bits := 0, 0, 0
+	for chunk := data[12:]; len(chunk) >= 8; {
+		id, size := string(chunk[0:4]), int(binary.LittleEndian.Uint32(chunk[4:8]))
+		if size > len(chunk)-8 {
+			size = len(chunk) - 8 // Files cut short are still read
+		}
+		body := chunk[8 : 8+size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, 0, errors.New("the format chunk is too short")
+			}
+			format := binary.LittleEndian.Uint16(body[0:2])
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			rate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			if format != 1 && format != 0xFFFE || bits != 8 && bits != 16 || channels < 1 {
+				return nil, 0, fmt.Errorf("only 8 and 16 bit PCM is supported (format %d with %d bits)", format, bits)
+			}
+		case "data":
+			if channels == 0 {
+				return nil, 0, errors.New("the data comes before the format")
+			}
+			frame := channels * bits / 8
+			samples := make([]int16, size/frame)
+			for i := range samples {
+				if bits == 8 {
+					samples[i] = int16(int(body[i*frame])-128) << 8
+				} else {
+					samples[i] = int16(binary.LittleEndian.Uint16(body[i*frame:]))
+				}
+			}
+			return samples, rate, nil
+		}
+		next := 8 + size + size&1 // Chunks are padded to an even length
+		if next > len(chunk) {
+			break // The file was cut short in the last chunk
+		}
+		chunk = chunk[next:]
+	}
+	return nil, 0, errors.New("there is no audio in the WAV file")
+}
+
+// WriteWAV - Writes audio as a mono WAV file of 8 bit samples, which is plenty
+// for a tape
+func WriteWAV(w io.Writer, samples []int16, rate int) error {
+	out := bufio.NewWriter(w)
+	size := uint32(len(samples))
+	header := []interface{}{
+		[]byte("RIFF"), 36 + size + size&1, []byte("WAVE"),
+		[]byte("fmt "), uint32(16), uint16(1), uint16(1), uint32(rate), uint32(rate), uint16(1), uint16(8),
+		[]byte("data"), size,
+	}
+	for _, field := range header {
+		binary.Write(out, binary.LittleEndian, field)
+	}
+	for _, s := range samples {
+		out.WriteByte(byte(int(s)>>8 + 128))
+	}
+	if size&1 != 0 {
+		out.WriteByte(0) // Chunks are padded to an even length
+	}
+	return out.Flush()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Insood/8080/intelhex"
+	"github.com/Insood/8080/kcs"
+)
+
+// Converts between programs and the audio of Kansas City Standard cassette
+// tapes, the WAV files the Altair's -cassette and -record use:
+//
+//	kcstool encode program.bin tape.wav        Make a tape of a file
+//	kcstool decode tape.wav program.bin        Read a file back from a tape
+//
+// A file whose name ends in .hex or .ihx is Intel HEX: its data goes on the
+// tape from its lowest address to its highest, and decoding a tape into one
+// puts the data at the address given with -addr. -cuts selects the 1200 baud
+// CUTS format instead of 300 baud KCS.
+
+var commands = map[string]func(args []string) error{
+	"encode": encodeCommand,
+	"decode": decodeCommand,
+}
+
+// usages - The arguments of each command
+var usages = map[string]string{
+	"encode": "encode [options] <file.bin|file.hex> <tape.wav>",
+	"decode": "decode [options] <tape.wav> <file.bin|file.hex|->",
+}
+
+// newFlags - The flags of a command, including the ones every command has. The
+// baud rate selected with -cuts is returned
+func newFlags(name string) (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	cuts := flags.Bool("cuts", false, "Use the 1200 baud CUTS format instead of 300 baud KCS")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s %s\n", os.Args[0], usages[name])
+		flags.PrintDefaults()
+	}
+	return flags, cuts
+}
+
+func baudRate(cuts bool) int {
+	if cuts {
+		return kcs.CUTS
+	}
+	return kcs.KCS
+}
+
+func isHex(fileName string) bool {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	return extension == ".hex" || extension == ".ihx"
+}
+
+func encodeCommand(args []string) error {
+	flags, cuts := newFlags("encode")
+	rate := flags.Int("rate", kcs.DefaultRate, "The sample rate of the WAV file")
+	leader := flags.Float64("leader", 5, "The seconds of leader before the data")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected a file and the tape to write")
+	}
+	if *rate < 8000 {
+		return errors.New("the sample rate must be at least 8000")
+	}
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if isHex(flags.Arg(0)) {
+		file, err := intelhex.Read(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %s", flags.Arg(0), err)
+		}
+		low, high := file.Bounds()
+		fmt.Printf("%04X-%04X\n", low, high-1)
+		data = file.Image(0)
+	}
+	out, err := os.Create(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if err := kcs.WriteWAV(out, kcs.Encode(data, baudRate(*cuts), *rate, *leader), *rate); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func decodeCommand(args []string) error {
+	flags, cuts := newFlags("decode")
+	address := flags.String("addr", "0x100", "Decoding into Intel HEX: the address of the data")
+	verbose := flags.Bool("v", false, "Show where each byte is on the tape")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected a tape and where to put what is on it")
+	}
+	start, err := strconv.ParseUint(*address, 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid address %s", *address)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	samples, rate, err := kcs.ReadWAV(in)
+	in.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", flags.Arg(0), err)
+	}
+	found := kcs.Decode(samples, rate, baudRate(*cuts))
+	if len(found) == 0 {
+		return fmt.Errorf("%s: nothing was found on the tape", flags.Arg(0))
+	}
+	data := []byte{}
+	for _, b := range found {
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "%9.4fs %02X\n", b.Time, b.Value)
+		}
+		data = append(data, b.Value)
+	}
+	fmt.Fprintf(os.Stderr, "%d bytes from %.1fs to %.1fs\n", len(data), found[0].Time, found[len(found)-1].Time)
+
+	if isHex(flags.Arg(1)) {
+		buffer := bytes.Buffer{}
+		intelhex.Write(&buffer, &intelhex.File{Segments: []intelhex.Segment{{Address: uint32(start), Data: data}}})
+		data = buffer.Bytes()
+	}
+	if flags.Arg(1) == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(flags.Arg(1), data, 0666)
+}
+
+func usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Converts between files and the audio of KCS and CUTS cassette tapes")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", os.Args[0], usages[name])
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRoundTrip : A binary file and an Intel HEX file come back the same after
+// being put on a tape and read from it
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, _ = os.Open(os.DevNull)
+	os.Stderr = os.Stdout
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	program := []byte{0x21, 0x00, 0x01, 0x7E, 0xD3, 0x01, 0xC3, 0x00, 0x00, 0xFF, 0x00, 0x55}
+	binary, tape, back := filepath.Join(dir, "p.bin"), filepath.Join(dir, "p.wav"), filepath.Join(dir, "back.bin")
+	ioutil.WriteFile(binary, program, 0666)
+	if err := encodeCommand([]string{"-cuts", "-leader", "1", binary, tape}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeCommand([]string{"-cuts", tape, back}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(back); !bytes.Equal(data, program) {
+		t.Errorf("Expected % X back, got % X", program, data)
+	}
+
+	hex := []byte(":0C0100002100017ED301C30000FF005568\n:00000001FF\n")
+	hexFile, hexBack := filepath.Join(dir, "p.hex"), filepath.Join(dir, "back.hex")
+	ioutil.WriteFile(hexFile, hex, 0666)
+	if err := encodeCommand([]string{"-rate", "11025", hexFile, tape}); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeCommand([]string{"-addr", "0x100", tape, hexBack}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(hexBack); !bytes.Equal(data, hex) {
+		t.Errorf("Expected the HEX file back, got\n%s", data)
+	}
+}
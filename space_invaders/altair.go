@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Insood/8080/kcs"
+)
+
+// The MITS Altair 8800: 64K of RAM, a front panel and a Teletype on the serial
+// ports. Both of the serial boards MITS software expects are fitted:
+//
+//	00-01  88-SIO, as used by 4K BASIC 3.2
+//	06-07  88-ACR, the cassette interface (only when there is a tape, see cassette.go)
+//	10-13  88-2SIO, as used by 8K BASIC 4.0 (selected by the sense switches)
+//	FF     The sense switches (A15-A8 of the front panel's switches)
+//
+// A program can be put into memory by loading a paper tape in the MITS
+// checksum format (-tape), by reading a tape through the Teletype's reader
+// with a bootstrap loader toggled in on the front panel (-reader and -panel),
+// or both.
+
+// ALTAIRTAPE - A paper tape to load straight into memory before starting
+var ALTAIRTAPE = ""
+
+// ALTAIRREADER - A paper tape in the Teletype's reader. The serial ports read it
+// before any keys that are typed
+var ALTAIRREADER = ""
+
+// ALTAIRPANEL - Front panel operations to carry out before starting (see frontPanel.command)
+var ALTAIRPANEL = ""
+
+// SENSESWITCHES - The setting of the sense switches (A15-A8) when the program is
+// started, after the front panel operations. -1 leaves them as they are
+var SENSESWITCHES = -1
+
+// waitingPolls - How many times in a row a program has to ask a serial port for
+// a key, in a tight loop, after the input has ended before it is taken to be
+// waiting for a key which will never come. The emulation then stops
+const waitingPolls = 1000
+
+// serialTerminal - What is on the other end of a serial board: the Teletype,
+// or a line bound to the board with -serial (see lineTerminal)
+type serialTerminal interface {
+	ready() bool // A character has been received
+	read() uint8
+	sendable() bool // A character can be sent
+	write(character uint8)
+}
+
+// teletype - The terminal on the serial ports. Keys come from the console,
+// after whatever is left of the paper tape in its reader
+type teletype struct {
+	console  *cpmConsole
+	tape     []uint8
+	mc       *microcontroller
+	lastPoll int64 // When the program last found there was no key
+	polls    int   // How many times it has found that in a tight loop
+	ended    bool  // The input has ended and the program is waiting for more
+}
+
+// ready - Whether there is a key to read. Once the input has ended, this is
+// false until the program has been seen to wait for a key, which ends it
+func (t *teletype) ready() bool {
+	if len(t.tape) > 0 || len(t.console.keys) > 0 {
+		return true
+	}
+	if t.console.finished() {
+		if t.mc.cycles-t.lastPoll < 200 {
+			t.polls++
+		} else {
+			t.polls = 0
+		}
+		t.lastPoll = t.mc.cycles
+		t.ended = t.polls >= waitingPolls
+	}
+	return false
+}
+
+// read - The next key, or 0 if there isn't one
+func (t *teletype) read() uint8 {
+	if len(t.tape) > 0 {
+		key := t.tape[0]
+		t.tape = t.tape[1:]
+		return key
+	}
+	if len(t.console.keys) == 0 {
+		return 0
+	}
+	key, ok := t.console.read()
+	if !ok {
+		t.ended = true
+	}
+	return key
+}
+
+// sendable - The Teletype takes characters as fast as they are sent
+func (t *teletype) sendable() bool {
+	return true
+}
+
+// write - Prints a character. The Teletype ignores the parity bit
+func (t *teletype) write(character uint8) {
+	t.console.out.Write([]byte{character & 0x7F})
+}
+
+// sio88 - The 88-SIO serial board: status at its first port and data at the
+// second. The status bits are active low: bit 0 is clear when a character has
+// been received and bit 7 when one can be sent
+type sio88 struct {
+	base uint8
+	tty  serialTerminal
+}
+
+func (s *sio88) input(port uint8) uint8 {
+	if port == s.base {
+		return uint8(boolToInt(!s.tty.ready())) | uint8(boolToInt(!s.tty.sendable()))<<7
+	}
+	return s.tty.read()
+}
+
+func (s *sio88) output(port uint8, value uint8) {
+	if port == s.base+1 {
+		s.tty.write(value)
+	} // Writes to the control port set up interrupts, which aren't used
+}
+
+// sio2 - A port of the 88-2SIO, a Motorola 6850 ACIA: status and
+// control at its first port and data at the second. Status bit 0 (RDRF) is
+// set when a character has been received and bit 1 (TDRE) when one can be sent
+type sio2 struct {
+	base uint8
+	tty  serialTerminal
+}
+
+func (s *sio2) input(port uint8) uint8 {
+	if port == s.base {
+		return uint8(boolToInt(s.tty.sendable()))<<1 | uint8(boolToInt(s.tty.ready()))
+	}
+	return s.tty.read()
+}
+
+func (s *sio2) output(port uint8, value uint8) {
+	if port == s.base+1 {
+		s.tty.write(value)
+	} // The control register sets the word format, which doesn't matter here
+}
+
+// frontPanel - The switches and lights of the front panel. Its methods are the
+// control switches: EXAMINE, EXAMINE NEXT, DEPOSIT, DEPOSIT NEXT, RESET, RUN,
+// STOP and SINGLE STEP. It is also the sense switches device on port FF
+type frontPanel struct {
+	mc         *microcontroller
+	switches   uint16 // A15-A0. A7-A0 are also the data to deposit
+	address    uint16 // The address lights
+	data       uint8  // The data lights
+	programmed uint8  // Set with OUT 0FFH (the programmed output lights of the 8800b)
+	running    bool   // Set by run() until the machine halts or is stopped
+	stopped    func() bool
+}
+
+func newFrontPanel(mc *microcontroller) *frontPanel {
+	return &frontPanel{mc: mc, stopped: func() bool { return false }}
+}
+
+func (p *frontPanel) input(port uint8) uint8 {
+	return uint8(p.switches >> 8)
+}
+
+func (p *frontPanel) output(port uint8, value uint8) {
+	p.programmed = value
+}
+
+// show - Shows an address and what is in memory there on the lights
+func (p *frontPanel) show(address uint16) {
+	p.address, p.data = address, (*p.mc.memory)[address]
+}
+
+// examine - Goes to the address on the switches
+func (p *frontPanel) examine() {
+	p.mc.programCounter = p.switches
+	p.show(p.mc.programCounter)
+}
+
+func (p *frontPanel) examineNext() {
+	p.mc.programCounter++
+	p.show(p.mc.programCounter)
+}
+
+// deposit - Stores the data switches (A7-A0) at the address on the lights
+func (p *frontPanel) deposit() {
+	(*p.mc.memory)[p.mc.programCounter] = uint8(p.switches)
+	p.show(p.mc.programCounter)
+}
+
+func (p *frontPanel) depositNext() {
+	p.mc.programCounter++
+	p.deposit()
+}
+
+// reset - Resets the CPU, which starts again from 0
+func (p *frontPanel) reset() {
+	p.mc.programCounter, p.mc.halted, p.mc.inte = 0, false, false
+	p.show(0)
+}
+
+// run - Runs the program until it halts or stop() is called
+func (p *frontPanel) run() {
+	p.running = true
+	for p.running && !p.mc.halted && !p.mc.stopped && !p.stopped() {
+		p.mc.run()
+	}
+	p.running = false
+	p.show(p.mc.programCounter)
+}
+
+func (p *frontPanel) stop() {
+	p.running = false
+}
+
+func (p *frontPanel) singleStep() {
+	p.mc.run()
+	p.show(p.mc.programCounter)
+}
+
+// lights - The state of the lights. The address and data are in octal, like
+// the Altair's manuals
+func (p *frontPanel) lights() string {
+	return fmt.Sprintf("A15-A0 %06o  D7-D0 %03o  INTE %d WAIT %d HLTA %d",
+		p.address, p.data, boolToInt(p.mc.inte), boolToInt(!p.running), boolToInt(p.mc.halted))
+}
+
+// command - Carries out an operation written as a command:
+//
+//	switches <n>      Sets the 16 address and data switches
+//	examine [n]       EXAMINE the address n (or the one on the switches)
+//	next              EXAMINE NEXT
+//	deposit [n]       DEPOSIT n (or the data switches) at the address on the lights
+//	deposit-next [n]  DEPOSIT NEXT
+//	reset             RESET
+//	run               RUN until the program halts
+//	step [n]          SINGLE STEP n instructions (default 1)
+//	show              Print the lights
+//
+// Numbers are octal when they start with 0 (as in MITS listings), hex with 0x
+// and otherwise decimal
+func (p *frontPanel) command(line string, out io.Writer) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil
+	}
+	value, hasValue := uint64(0), len(fields) > 1
+	if hasValue {
+		var err error
+		if value, err = strconv.ParseUint(fields[1], 0, 16); err != nil {
+			return fmt.Errorf("invalid number %s", fields[1])
+		}
+	}
+	setSwitches := func(bits uint16) {
+		if hasValue {
+			p.switches = p.switches&^bits | uint16(value)&bits
+		}
+	}
+	if strings.HasPrefix(fields[0], "deposit") && value > 0xFF {
+		return fmt.Errorf("%s is more than the 8 data switches can hold", fields[1])
+	}
+	switch fields[0] {
+	case "switches":
+		setSwitches(0xFFFF)
+	case "examine":
+		setSwitches(0xFFFF)
+		p.examine()
+	case "next":
+		p.examineNext()
+	case "deposit":
+		setSwitches(0x00FF)
+		p.deposit()
+	case "deposit-next":
+		setSwitches(0x00FF)
+		p.depositNext()
+	case "reset":
+		p.reset()
+	case "run":
+		p.run()
+	case "step":
+		if !hasValue {
+			value = 1
+		}
+		for i := uint64(0); i < value; i++ {
+			p.singleStep()
+		}
+	case "show":
+		fmt.Fprintln(out, p.lights())
+	default:
+		return fmt.Errorf("unknown front panel operation %s", fields[0])
+	}
+	return nil
+}
+
+// loadMITSTape - Loads a paper tape in the format of the MITS checksum loader
+// into memory and returns the address to start at. The tape is made of records
+//
+//	3C <n> <address low> <address high> <n bytes> <checksum>   Data
+//	78 <address low> <address high>                             The end, with the start address
+//
+// where the checksum is the sum of the address and the data. Anything before
+// the first record (the leader and the loader itself, which is read by the
+// bootstrap) and between records is skipped. The loader can contain 3C bytes
+// too, so a 3C is only taken to be the first record when a good record
+// follows it; a bad checksum after that is an error
+func loadMITSTape(tape []uint8, memory []uint8) (uint16, error) {
+	for start := 0; start < len(tape); start++ {
+		if tape[start] != 0x3C {
+			continue
+		}
+		address, records, err := readMITSRecords(tape[start:], memory)
+		if err == nil {
+			return address, nil
+		} else if records > 0 {
+			return 0, err
+		}
+	}
+	return 0, errors.New("no records in the MITS checksum format on the tape")
+}
+
+// readMITSRecords - Loads the records from the start of the tape up to the end
+// record, returning the start address and how many good records were read.
+// Nothing is stored unless the whole tape is good
+func readMITSRecords(tape []uint8, memory []uint8) (uint16, int, error) {
+	type record struct {
+		address uint16
+		data    []uint8
+	}
+	records := []record{}
+	for i := 0; i < len(tape); {
+		switch tape[i] {
+		case 0x3C:
+			if i+4 > len(tape) || i+4+int(tape[i+1]) >= len(tape) {
+				return 0, len(records), errors.New("the tape ends in the middle of a record")
+			}
+			count := int(tape[i+1])
+			address := uint16(tape[i+2]) | uint16(tape[i+3])<<8
+			data := tape[i+4 : i+4+count]
+			checksum := tape[i+2] + tape[i+3]
+			for _, b := range data {
+				checksum += b
+			}
+			if checksum != tape[i+4+count] {
+				return 0, len(records), fmt.Errorf("checksum error in the record for %04X", address)
+			}
+			records = append(records, record{address, data})
+			i += 5 + count
+		case 0x78:
+			if i+2 >= len(tape) {
+				return 0, len(records), errors.New("the tape ends in the middle of the end record")
+			}
+			for _, r := range records {
+				for j, b := range r.data {
+					memory[r.address+uint16(j)] = b
+				}
+			}
+			return uint16(tape[i+1]) | uint16(tape[i+2])<<8, len(records), nil
+		default:
+			i++ // Leader or a program name between records
+		}
+	}
+	return 0, len(records), errors.New("there is no end record")
+}
+
+// altair - The machine
+type altair struct {
+	mc     *microcontroller
+	panel  *frontPanel
+	tty    *teletype
+	bus    *portBus
+	sio    *sio88
+	twoSIO *sio2
+}
+
+// altairSerialDevices - The serial ports which can be bound with -serial: the
+// 88-SIO, the 88-2SIO and the second port of the 88-2SIO (12-13), which is
+// only fitted when it is bound
+var altairSerialDevices = []string{"sio", "2sio", "2sio-b"}
+
+func newAltair(console *cpmConsole) *altair {
+	memory := make([]uint8, 0x10000)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	tty := &teletype{console: console, mc: mc}
+	panel := newFrontPanel(mc)
+	panel.stopped = func() bool { return tty.ended }
+	bus := newPortBus()
+	machine := &altair{mc: mc, panel: panel, tty: tty, bus: bus}
+	machine.sio = &sio88{base: 0x00, tty: tty}
+	machine.twoSIO = &sio2{base: 0x10, tty: tty}
+	bus.attach(0x00, 2, machine.sio)
+	bus.attach(0x10, 2, machine.twoSIO)
+	bus.attach(0xFF, 1, panel)
+	mc.io = bus
+	return machine
+}
+
+// connect - Puts the lines bound with -serial on the other end of the serial
+// ports instead of the Teletype
+func (a *altair) connect(lines map[string]*serialLine) {
+	if line, ok := lines["sio"]; ok {
+		a.sio.tty = &lineTerminal{line, a.mc}
+	}
+	if line, ok := lines["2sio"]; ok {
+		a.twoSIO.tty = &lineTerminal{line, a.mc}
+	}
+	if line, ok := lines["2sio-b"]; ok {
+		a.bus.attach(0x12, 2, &sio2{base: 0x12, tty: &lineTerminal{line, a.mc}})
+	}
+}
+
+// runAltair - Implements -machine altair: loads the tapes, carries out the front
+// panel operations and then runs until the program halts or the input ends
+func runAltair() error {
+	console, closeConsole, err := openConsole()
+	if err != nil {
+		return err
+	}
+	defer closeConsole()
+	machine := newAltair(console)
+	lines, err := openSerialLines(altairSerialDevices...)
+	if err != nil {
+		return err
+	}
+	defer closeSerialLines(lines)
+	machine.connect(lines)
+	var deck *cassette
+	if ALTAIRCASSETTE != "" || ALTAIRRECORD != "" {
+		var tape []kcs.Byte
+		if ALTAIRCASSETTE != "" {
+			if tape, err = loadCassette(ALTAIRCASSETTE); err != nil {
+				return err
+			}
+		}
+		deck = newCassette(machine.mc, tape, ALTAIRRECORD != "")
+		machine.bus.attach(0x06, 2, &sio88{base: 0x06, tty: deck})
+	}
+	name := "altair"
+	if ALTAIRTAPE != "" {
+		tape, err := ioutil.ReadFile(ALTAIRTAPE)
+		if err != nil {
+			return err
+		}
+		start, err := loadMITSTape(tape, *machine.mc.memory)
+		if err != nil {
+			return fmt.Errorf("%s: %s", ALTAIRTAPE, err)
+		}
+		machine.mc.programCounter, name = start, ALTAIRTAPE
+	}
+	if err := loadFiles(machine.mc); err != nil {
+		return err
+	}
+	if ALTAIRREADER != "" {
+		if machine.tty.tape, err = ioutil.ReadFile(ALTAIRREADER); err != nil {
+			return err
+		}
+	}
+
+	startTrace(machine.mc, TRACEFILE)
+	defer stopTrace()
+	startProfile(machine.mc, PPROFFILE, name)
+	defer stopProfile()
+	startCoverage(machine.mc, COVERAGEFILE, 0, 0xFFFF)
+	defer stopCoverage()
+	startDebugger(machine.mc, DEBUGGER)
+	if ALTAIRPANEL != "" {
+		file, err := os.Open(ALTAIRPANEL)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			if err := machine.panel.command(scanner.Text(), os.Stdout); err != nil {
+				return fmt.Errorf("%s:%d: %s", ALTAIRPANEL, line, err)
+			}
+		}
+	}
+	if SENSESWITCHES >= 0 {
+		machine.panel.switches = machine.panel.switches&0x00FF | uint16(SENSESWITCHES)<<8
+	}
+	machine.panel.run()
+	if machine.mc.halted {
+		fmt.Printf("\r\nHalted: %s\r\n", machine.panel.lights())
+	}
+	if ALTAIRRECORD != "" {
+		if err := deck.save(ALTAIRRECORD); err != nil {
+			return fmt.Errorf("%s: %s", ALTAIRRECORD, err)
+		}
+	}
+	return console.err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestFrontPanel : A program toggled in on the front panel reads the sense
+// switches, prints them on the 88-SIO and halts
+func TestFrontPanel(t *testing.T) {
+	output := &bytes.Buffer{}
+	machine := newAltair(newCPMConsole(strings.NewReader(""), output, false))
+	operations := []string{
+		"examine 0",
+		"deposit 0333", // IN 0FFH
+		"deposit-next 0377",
+		"deposit-next 0323", // OUT 01H
+		"deposit-next 01",
+		"deposit-next 0x76", // HLT
+		"examine 0",
+		"switches 0x4100",
+		"run",
+		"show",
+	}
+	lights := &bytes.Buffer{}
+	for _, operation := range operations {
+		if err := machine.panel.command(operation, lights); err != nil {
+			t.Fatalf("%s: %s", operation, err)
+		}
+	}
+	if output.String() != "A" {
+		t.Errorf("Expected the sense switches to be printed, got %q", output.String())
+	}
+	if expected := "A15-A0 000005  D7-D0 000  INTE 0 WAIT 1 HLTA 1\n"; lights.String() != expected {
+		t.Errorf("Expected the lights to be %q, got %q", expected, lights.String())
+	}
+
+	machine.panel.command("examine 4", lights)
+	if machine.panel.data != 0x76 || machine.panel.address != 4 {
+		t.Errorf("Expected to examine the HLT at 4, got %04X %02X", machine.panel.address, machine.panel.data)
+	}
+	machine.panel.command("reset", lights)
+	if machine.mc.halted || machine.mc.programCounter != 0 {
+		t.Errorf("Expected RESET to restart the CPU at 0")
+	}
+	if err := machine.panel.command("deposit 0400", lights); err == nil {
+		t.Errorf("Expected a number too big for the switches to be rejected")
+	}
+}
+
+// TestSerialEcho : A program which echoes the 88-2SIO stops once it has echoed
+// all of the input and is waiting for more
+func TestSerialEcho(t *testing.T) {
+	output := &bytes.Buffer{}
+	machine := newAltair(newCPMConsole(strings.NewReader("PRINT 2\n"), output, false))
+	machine.tty.tape = []uint8("10 ")
+	program := []uint8{
+		0xDB, 0x10, // IN 10H
+		0x0F,             // RRC
+		0xD2, 0x00, 0x00, // JNC 0
+		0xDB, 0x11, // IN 11H
+		0xD3, 0x11, // OUT 11H
+		0xC3, 0x00, 0x00, // JMP 0
+	}
+	copy(*machine.mc.memory, program)
+	machine.panel.run()
+	if !machine.tty.ended || machine.mc.halted {
+		t.Errorf("Expected the program to be stopped waiting for a key")
+	}
+	if output.String() != "10 PRINT 2\r" {
+		t.Errorf("Expected the tape and then the keys to be echoed, got %q", output.String())
+	}
+}
+
+func TestLoadMITSTape(t *testing.T) {
+	tape := []uint8{0x00, 0x00, 0xAE, 0xFD} // Leader and some of a loader
+	tape = append(tape, 0x3C, 3, 0x00, 0x01, 0x3E, 0x41, 0x76, (0x01+0x3E+0x41+0x76)&0xFF)
+	tape = append(tape, 0x00, 0x3C, 1, 0xFF, 0x01, 0xC9, (0xFF+0x01+0xC9)&0xFF)
+	tape = append(tape, 0x78, 0x00, 0x01, 0x00)
+	memory := make([]uint8, 0x10000)
+	start, err := loadMITSTape(tape, memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 0x100 || !bytes.Equal(memory[0x100:0x103], []uint8{0x3E, 0x41, 0x76}) || memory[0x1FF] != 0xC9 {
+		t.Errorf("Unexpected load: start %04X, %X %02X", start, memory[0x100:0x103], memory[0x1FF])
+	}
+
+	tape[18]++ // The checksum of the second record
+	memory = make([]uint8, 0x10000)
+	if _, err := loadMITSTape(tape, memory); err == nil {
+		t.Errorf("Expected a bad checksum to be reported")
+	}
+	if memory[0x1FF] != 0 {
+		t.Errorf("Expected nothing to be loaded from a bad tape")
+	}
+	if _, err := loadMITSTape(tape[:12], memory); err == nil {
+		t.Errorf("Expected a tape without an end record to be reported")
+	}
+}
+
+func TestPortBus(t *testing.T) {
+	bus := newPortBus()
+	panel := newFrontPanel(nil)
+	panel.switches = 0x8000
+	bus.attach(0xFF, 1, panel)
+	if bus.input(0xFF) != 0x80 || bus.input(0x10) != 0xFF {
+		t.Errorf("Expected the sense switches on FF and nothing on 10")
+	}
+	bus.output(0xFF, 0x12)
+	if panel.programmed != 0x12 {
+		t.Errorf("Expected OUT 0FFH to set the programmed output")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected attaching a second device to a port to panic")
+		}
+	}()
+	bus.attach(0xFE, 2, &sio88{base: 0xFE})
+}
@@ -0,0 +1,240 @@
+package main
+
+import "testing"
+
+// A gate level model of the 8080's ALU used to check the flags of every
+// arithmetic and logical operation for every possible input. It does not share
+// any code with math.go or the instruction handlers (or the lookup tables that
+// they use): additions are done one bit at a time by a chain of full adders
+// and subtraction by adding the complement, the way the 8080 does it.
+
+// aluFlags - The result of an operation and the flags it leaves behind
+type aluFlags struct {
+	result                              uint8
+	sign, zero, auxCarry, parity, carry bool
+}
+
+// rippleAdd - Adds a, b and carryIn one bit at a time. Returns the sum and the
+// carries out of bit 3 (the aux carry) and bit 7 (the carry)
+func rippleAdd(a uint8, b uint8, carryIn bool) (sum uint8, carry3 bool, carry7 bool) {
+	carry := carryIn
+	for bit := uint(0); bit < 8; bit++ {
+		x := a>>bit&1 == 1
+		y := b>>bit&1 == 1
+		if x != y != carry {
+			sum |= 1 << bit
+		}
+		carry = (x && y) || (carry && (x != y))
+		if bit == 3 {
+			carry3 = carry
+		}
+	}
+	return sum, carry3, carry
+}
+
+// withResult - Sets the sign, zero and parity flags from the result
+func withResult(result uint8, auxCarry bool, carry bool) aluFlags {
+	parity := true
+	for bit := uint(0); bit < 8; bit++ {
+		parity = parity != (result>>bit&1 == 1)
+	}
+	return aluFlags{result, result&0x80 != 0, result == 0, auxCarry, parity, carry}
+}
+
+// modelALU - The 8 operations selected by bits 3-5 of the ALU opcodes:
+// ADD ADC SUB SBB ANA XRA ORA CMP
+func modelALU(operation uint8, a uint8, b uint8, carry bool) aluFlags {
+	switch operation {
+	case 0, 1: // ADD, ADC
+		sum, carry3, carry7 := rippleAdd(a, b, operation == 1 && carry)
+		return withResult(sum, carry3, carry7)
+	case 2, 3, 7: // SUB, SBB, CMP: A + ~B + 1 (or + 0 for a borrow). The carry flag is a borrow
+		difference, carry3, carry7 := rippleAdd(a, ^b, !(operation == 3 && carry))
+		flags := withResult(difference, carry3, !carry7)
+		if operation == 7 {
+			flags.result = a
+		}
+		return flags
+	case 4: // ANA: the aux carry is the OR of bit 3 of both operands
+		return withResult(a&b, (a|b)&0x08 != 0, false)
+	case 5: // XRA
+		return withResult(a^b, false, false)
+	}
+	return withResult(a|b, false, false) // ORA
+}
+
+// modelDAA - The correction for the low digit is decided from A and the aux carry
+// and the one for the high digit from A and the carry, then both are added at once
+func modelDAA(a uint8, auxCarry bool, carry bool) aluFlags {
+	correction := uint8(0)
+	low, high := a&0x0F, a>>4
+	if low > 9 || auxCarry {
+		correction |= 0x06
+	}
+	if high > 9 || carry || (high == 9 && low > 9) {
+		correction |= 0x60
+		carry = true
+	}
+	sum, carry3, _ := rippleAdd(a, correction, false)
+	return withResult(sum, carry3, carry)
+}
+
+func microcontrollerFlags(mc *microcontroller) aluFlags {
+	return aluFlags{mc.ra, mc.sign, mc.zero, mc.auxCarry, mc.parity, mc.carry}
+}
+
+// executeALU - Runs a single instruction on a fresh microcontroller with A, B and the flags set
+func executeALU(opcode uint8, a uint8, b uint8, carry bool, auxCarry bool) aluFlags {
+	memory := make([]uint8, 16)
+	memory[0] = opcode
+	memory[1] = b // Operand of the immediate instructions
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	mc.ra, mc.rb, mc.carry, mc.auxCarry = a, b, carry, auxCarry
+	mc.run()
+	return microcontrollerFlags(mc)
+}
+
+// TestAddExhaustive : Add() against the model for every a, b and carry
+func TestAddExhaustive(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			for carry := uint8(0); carry < 2; carry++ {
+				mc := newMicrocontroller()
+				mc.ra = Add(uint8(a), uint8(b), mc, carry)
+				if got, expected := microcontrollerFlags(mc), modelALU(1, uint8(a), uint8(b), carry == 1); got != expected {
+					t.Fatalf("%02X + %02X + %d: expected %+v, got %+v", a, b, carry, expected, got)
+				}
+			}
+		}
+	}
+}
+
+// TestSubExhaustive : Sub() against the model for every a, b and borrow
+func TestSubExhaustive(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			for borrow := uint8(0); borrow < 2; borrow++ {
+				mc := newMicrocontroller()
+				mc.ra = Sub(uint8(a), uint8(b), mc, borrow)
+				if got, expected := microcontrollerFlags(mc), modelALU(3, uint8(a), uint8(b), borrow == 1); got != expected {
+					t.Fatalf("%02X - %02X - %d: expected %+v, got %+v", a, b, borrow, expected, got)
+				}
+			}
+		}
+	}
+}
+
+// TestALUInstructionsExhaustive : All 8 ALU operations, with a register and with
+// immediate data, for every a, b and incoming carry and aux carry
+func TestALUInstructionsExhaustive(t *testing.T) {
+	for operation := uint8(0); operation < 8; operation++ {
+		// ADD B .. CMP B, ADI .. CPI
+		for _, opcode := range []uint8{0x80 | operation<<3, 0xC6 | operation<<3} {
+			for a := 0; a < 256; a++ {
+				for b := 0; b < 256; b++ {
+					for flags := 0; flags < 4; flags++ {
+						carry, auxCarry := flags&1 == 1, flags&2 == 2
+						got := executeALU(opcode, uint8(a), uint8(b), carry, auxCarry)
+						if expected := modelALU(operation, uint8(a), uint8(b), carry); got != expected {
+							t.Fatalf("%02X with A=%02X B=%02X CY=%t AC=%t: expected %+v, got %+v",
+								opcode, a, b, carry, auxCarry, expected, got)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestDAAExhaustive : DAA for every value of A, carry and aux carry
+func TestDAAExhaustive(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for flags := 0; flags < 4; flags++ {
+			carry, auxCarry := flags&1 == 1, flags&2 == 2
+			got := executeALU(0x27, uint8(a), 0, carry, auxCarry)
+			if expected := modelDAA(uint8(a), auxCarry, carry); got != expected {
+				t.Fatalf("DAA with A=%02X CY=%t AC=%t: expected %+v, got %+v", a, carry, auxCarry, expected, got)
+			}
+		}
+	}
+}
+
+// TestModelAgainstKnownValues : Spot checks of the model itself against the 8080 manual
+func TestModelAgainstKnownValues(t *testing.T) {
+	tests := []struct {
+		operation uint8
+		a, b      uint8
+		expected  aluFlags
+	}{
+		{0, 0x2E, 0x74, aluFlags{0xA2, true, false, true, false, false}},  // ADD: manual pg 4-7
+		{2, 0x3E, 0x3E, aluFlags{0x00, false, true, true, true, false}},   // SUB A: manual pg 4-8
+		{4, 0xFC, 0x0F, aluFlags{0x0C, false, false, true, true, false}},  // ANA
+		{6, 0x33, 0x0F, aluFlags{0x3F, false, false, false, true, false}}, // ORA
+		{7, 0x02, 0x05, aluFlags{0x02, true, false, false, false, true}},  // CMP: A < operand
+	}
+	for _, test := range tests {
+		if got := modelALU(test.operation, test.a, test.b, false); got != test.expected {
+			t.Errorf("Operation %d on %02X, %02X: expected %+v, got %+v", test.operation, test.a, test.b, test.expected, got)
+		}
+	}
+	if got := modelDAA(0x9B, false, false); got.result != 0x01 || !got.carry || !got.auxCarry {
+		t.Errorf("DAA of 9B: expected 01 with both carries (manual pg 4-8), got %+v", got)
+	}
+}
+
+// FuzzALUSequence : Runs a sequence of ALU operations (and DAA) on the same
+// microcontroller, so that the flags each one leaves behind are used by the
+// next, and compares every step with the model
+func FuzzALUSequence(f *testing.F) {
+	f.Add([]byte{0x00, 0x99, 0x01, 0x27, 0x02, 0x42})
+	f.Add([]byte{0x8F, 0xFF, 0x9F, 0x01, 0xBF, 0x80, 0x27, 0x00})
+	f.Fuzz(func(t *testing.T, program []byte) {
+		mc := newMicrocontroller()
+		memory := make([]uint8, 16)
+		mc.memory = &memory
+		state := aluFlags{}
+		for i := 0; i+1 < len(program); i += 2 {
+			// Each step is a pair of bytes: which operation (bits 0-2, or DAA if
+			// bit 3 is set) and the operand
+			operation, operand := program[i]&0x07, program[i+1]
+			opcode := 0xC6 | operation<<3
+			expected := modelALU(operation, state.result, operand, state.carry)
+			if program[i]&0x08 != 0 {
+				opcode = 0x27
+				expected = modelDAA(state.result, state.auxCarry, state.carry)
+			}
+			memory[0], memory[1] = opcode, operand
+			mc.programCounter = 0
+			mc.run()
+			if got := microcontrollerFlags(mc); got != expected {
+				t.Fatalf("Step %d (%02X %02X) after %+v: expected %+v, got %+v", i/2, opcode, operand, state, expected, got)
+			}
+			state = expected
+		}
+	})
+}
+
+// FuzzAddSub : Add() and Sub() with any inputs and any flags already set
+func FuzzAddSub(f *testing.F) {
+	f.Add(uint8(0x4A), uint8(0x40), true, false)
+	f.Add(uint8(0xFF), uint8(0x01), false, true)
+	f.Fuzz(func(t *testing.T, a uint8, b uint8, carry bool, auxCarry bool) {
+		c := uint8(0)
+		if carry {
+			c = 1
+		}
+		for _, operation := range []uint8{1, 3} {
+			mc := newMicrocontroller()
+			mc.auxCarry, mc.carry, mc.zero, mc.sign, mc.parity = auxCarry, !carry, true, true, true
+			if operation == 1 {
+				mc.ra = Add(a, b, mc, c)
+			} else {
+				mc.ra = Sub(a, b, mc, c)
+			}
+			if got, expected := microcontrollerFlags(mc), modelALU(operation, a, b, carry); got != expected {
+				t.Fatalf("Operation %d on %02X, %02X, %t: expected %+v, got %+v", operation, a, b, carry, expected, got)
+			}
+		}
+	})
+}
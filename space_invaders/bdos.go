@@ -0,0 +1,759 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Insood/8080/cpmfs"
+)
+
+// A high level emulation of the CP/M 2.2 BDOS. Instead of running the real
+// BDOS, calls to it are trapped and carried out in Go, with each drive mapped
+// onto a directory of the host. This is enough to run most CP/M programs
+// (MBASIC, ED, ASM, ...) which only use the BDOS and not the BIOS or the disk.
+//
+// Files are looked up by name for every call, so the state of an open file
+// is only what is in its FCB (the current record in EX, S2 and CR) and programs
+// can copy FCBs around as they like. Host files whose names don't fit CP/M's
+// 8.3 upper case names are not visible.
+
+// bdosAddress - Where the JMP at 5 goes to. The BDOS is trapped when the
+// program counter reaches it; the RET stored there returns to the program.
+// Everything from 0x100 up to the stack below it is free for the program (the TPA)
+const bdosAddress = 0xFE06
+
+// Addresses of the disk parameter block and allocation vector returned by
+// functions 31 and 27. They describe a standard 8" single density disk (ibm-3740)
+const dpbAddress = 0xFE10
+const allocationAddress = 0xFE20
+
+// biosStubAddress - The BIOS jump table the warm boot vector at 0 points into.
+// Some programs call the BIOS directly for console I/O (see callBIOS)
+const biosStubAddress = 0xFF00
+
+// ccpStack - The stack pointer a program starts with. Like the CCP's stack, it
+// holds a return address, which is 0 so that a program which returns ends
+const ccpStack = 0xFDFE
+
+// recordSize - CP/M reads and writes files in records of 128 bytes
+const recordSize = 128
+
+// cpmConsole - The console device used by the BDOS. Input is read from the
+// host in the background so that the program can poll for a key press
+type cpmConsole struct {
+	out    io.Writer
+	keys   chan byte
+	ended  chan struct{} // Closed once all of the input has been put into keys
+	echo   bool          // Echo typed characters (the host doesn't when input isn't a terminal)
+	column int           // For expanding tabs
+	err    error         // Why the input ended, if it wasn't the end of the file. Set before ended is closed
+}
+
+func newCPMConsole(in io.Reader, out io.Writer, echo bool) *cpmConsole {
+	c := &cpmConsole{out: out, keys: make(chan byte, 4096), ended: make(chan struct{}), echo: echo}
+	go func() {
+		buffer := make([]byte, 256)
+		last := byte(0)
+		for {
+			n, err := in.Read(buffer)
+			for _, key := range buffer[:n] {
+				// CP/M ends lines with a carriage return instead of a line feed
+				if key == '\n' {
+					if last == '\r' {
+						continue
+					}
+					key = '\r'
+				}
+				last = key
+				c.keys <- key
+			}
+			if err != nil {
+				if err != io.EOF {
+					c.err = err
+				}
+				close(c.ended)
+				close(c.keys)
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// ready - Whether a key is waiting to be read. Also true once there is no more
+// input, so that the program goes on to read and is ended
+func (c *cpmConsole) ready() bool {
+	return len(c.keys) > 0 || c.finished()
+}
+
+// finished - Whether every key has been read and there won't be any more
+func (c *cpmConsole) finished() bool {
+	select {
+	case <-c.ended:
+		return len(c.keys) == 0
+	default:
+		return false
+	}
+}
+
+// read - Waits for a key. ok is false once there is no more input
+func (c *cpmConsole) read() (key byte, ok bool) {
+	key, ok = <-c.keys
+	return key, ok
+}
+
+// write - Outputs a character, expanding tabs to every 8th column
+func (c *cpmConsole) write(character byte) {
+	character &= 0x7F
+	switch character {
+	case '\t':
+		for {
+			c.write(' ')
+			if c.column%8 == 0 {
+				return
+			}
+		}
+	case '\r':
+		c.column = 0
+	case '\b':
+		if c.column > 0 {
+			c.column--
+		}
+	default:
+		if character >= ' ' {
+			c.column++
+		}
+	}
+	c.out.Write([]byte{character})
+}
+
+// isTerminal - Whether the file is a terminal rather than a pipe or a file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// cpmFile - A host file which is visible to CP/M
+type cpmFile struct {
+	name string // As it is stored in an FCB: 8 characters of name and 3 of type, padded with spaces
+	path string
+}
+
+// cpmName - The FCB form of a host file name, ie: "mbasic.com" -> "MBASIC  COM"
+func cpmName(hostName string) (string, bool) {
+	name, extension := hostName, ""
+	if dot := strings.LastIndex(hostName, "."); dot >= 0 {
+		name, extension = hostName[:dot], hostName[dot+1:]
+	}
+	if name == "" || len(name) > 8 || len(extension) > 3 {
+		return "", false
+	}
+	for _, c := range name + extension {
+		if c <= ' ' || c >= 0x7F || strings.ContainsRune(`.,;:=?*[]<>|"/\`, c) {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%-8s%-3s", strings.ToUpper(name), strings.ToUpper(extension)), true
+}
+
+// hostName - The name to create a host file with, ie: "MBASIC  COM" -> "MBASIC.COM"
+func hostName(name string) string {
+	base, extension := strings.TrimRight(name[:8], " "), strings.TrimRight(name[8:], " ")
+	if extension == "" {
+		return base
+	}
+	return base + "." + extension
+}
+
+// matchName - Whether the name matches a pattern, where ? matches any character
+func matchName(pattern string, name string) bool {
+	for i := 0; i < 11; i++ {
+		if pattern[i] != '?' && pattern[i] != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// bdos - The state of the emulated BDOS
+type bdos struct {
+	drives  []string // The host directory of A:, B:, ...
+	console *cpmConsole
+	list    io.Writer   // The printer
+	aux     *serialLine // The reader and punch, when they are bound with -serial
+	drive   uint8
+	user    uint8
+	dma     uint16
+	iobyte  uint8
+	files   map[string]*os.File // Host files which are open, by path
+	found   []cpmFile           // What is left to be returned by search next
+}
+
+// cpmSerialDevices - The serial devices of -cpm and -boot which can be bound with
+// -serial: the reader and punch (the AUX: device of later versions of CP/M)
+var cpmSerialDevices = []string{"aux"}
+
+func newBDOS(drives []string, console *cpmConsole) *bdos {
+	return &bdos{drives: drives, console: console, list: ioutil.Discard, dma: 0x80, files: map[string]*os.File{}}
+}
+
+// install - Sets up page zero the way CP/M leaves it for a program: the warm
+// boot vector at 0 and the BDOS entry point at 5, with the stack holding a
+// return address of 0. The program is then run until the program counter reaches
+// bdosAddress, where call() must be called, or the BIOS, where callBIOS() must be
+func (b *bdos) install(mc *microcontroller) {
+	memory := *mc.memory
+	wboot := biosStubAddress + 3
+	memory[0], memory[1], memory[2] = 0xC3, uint8(wboot&0xFF), uint8(wboot>>8)             // JMP WBOOT
+	memory[5], memory[6], memory[7] = 0xC3, uint8(bdosAddress&0xFF), uint8(bdosAddress>>8) // JMP BDOS
+	memory[bdosAddress] = 0xC9                                                             // RET
+	copy(memory[dpbAddress:], cpmfs.Formats["ibm-3740"].DPB())
+	for i := 0; i < biosFunctions; i++ {
+		memory[biosStubAddress+3*i] = 0xC9 // RET
+	}
+	memory[3], memory[4] = b.iobyte, 0 // IOBYTE, drive A:
+	mc.stackPointer = ccpStack
+	memory[ccpStack], memory[ccpStack+1] = 0, 0
+}
+
+// isBIOS - Whether the program has called an entry of the BIOS jump table
+func isBIOS(address uint16) bool {
+	return address >= biosStubAddress && address < biosStubAddress+3*biosFunctions && (address-biosStubAddress)%3 == 0
+}
+
+// callBIOS - Carries out a call to the BIOS. Only the character devices are
+// supported; the disk functions do nothing as the drives are host directories.
+// BOOT and WBOOT end the program
+func (b *bdos) callBIOS(mc *microcontroller) {
+	switch (mc.programCounter - biosStubAddress) / 3 {
+	case 0, 1: // BOOT, WBOOT
+		mc.programCounter = 0
+	case 2: // CONST
+		mc.ra = uint8(boolToInt(b.console.ready()) * 0xFF)
+	case 3: // CONIN
+		key, ok := b.console.read()
+		if !ok {
+			mc.programCounter = 0
+			return
+		}
+		mc.ra = key
+	case 4: // CONOUT
+		b.console.write(mc.rc)
+	case 5: // LIST
+		b.list.Write([]byte{mc.rc})
+	case 6: // PUNCH
+		if b.aux != nil {
+			b.aux.writeWaiting(mc, mc.rc)
+		}
+	case 7: // READER
+		mc.ra = 0x1A
+		if b.aux != nil {
+			mc.ra = b.aux.readWaiting(mc, b.console.ended)
+		}
+	case 9: // SELDSK: there is no disk parameter header
+		mc.rh, mc.rl = 0, 0
+	case 13, 14: // READ, WRITE
+		mc.ra = 1
+	case 15: // LISTST
+		mc.ra = 0xFF
+	case 16: // SECTRAN
+		mc.rh, mc.rl = mc.rb, mc.rc
+	}
+}
+
+// close - Closes any files the program left open
+func (b *bdos) close() {
+	for path, file := range b.files {
+		file.Close()
+		delete(b.files, path)
+	}
+}
+
+// result - Returns a value the way the BDOS does: in A and L, with B and H set to the high byte
+func result(mc *microcontroller, value uint16) {
+	mc.ra, mc.rl = uint8(value), uint8(value)
+	mc.rb, mc.rh = uint8(value>>8), uint8(value>>8)
+}
+
+// call - Carries out the BDOS function in C with the parameter in E or DE.
+// Function 0 (and running out of console input) jumps to 0, which ends the program
+func (b *bdos) call(mc *microcontroller) {
+	de := uint16(mc.rd)<<8 | uint16(mc.re)
+	memory := *mc.memory
+	switch mc.rc {
+	case 0: // System reset
+		mc.programCounter = 0
+	case 1: // Console input
+		key, ok := b.console.read()
+		if !ok {
+			mc.programCounter = 0
+			return
+		}
+		if b.console.echo && (key >= ' ' || key == '\r' || key == '\t') {
+			b.console.write(key)
+		}
+		result(mc, uint16(key))
+	case 2: // Console output
+		b.console.write(mc.re)
+	case 3: // Reader input: without a reader, it is always at the end
+		if b.aux != nil {
+			result(mc, uint16(b.aux.readWaiting(mc, b.console.ended)))
+		} else {
+			result(mc, 0x1A)
+		}
+	case 4: // Punch output
+		if b.aux != nil {
+			b.aux.writeWaiting(mc, mc.re)
+		}
+	case 5: // List output
+		b.list.Write([]byte{mc.re})
+	case 6: // Direct console I/O
+		switch mc.re {
+		case 0xFF:
+			key := byte(0)
+			if b.console.finished() {
+				mc.programCounter = 0
+				return
+			} else if len(b.console.keys) > 0 {
+				key, _ = b.console.read()
+			}
+			result(mc, uint16(key))
+		case 0xFE:
+			result(mc, uint16(boolToInt(b.console.ready())*0xFF))
+		default:
+			b.console.write(mc.re)
+		}
+	case 7: // Get I/O byte
+		result(mc, uint16(b.iobyte))
+	case 8: // Set I/O byte
+		b.iobyte = mc.re
+	case 9: // Print string
+		for _, c := range dollarString(memory, de) {
+			b.console.write(c)
+		}
+	case 10: // Read console buffer
+		if !b.readLine(memory, de) {
+			mc.programCounter = 0
+		}
+	case 11: // Get console status
+		result(mc, uint16(boolToInt(b.console.ready())*0xFF))
+	case 12: // Return version number: CP/M 2.2
+		result(mc, 0x0022)
+	case 13: // Reset disk system
+		b.drive, b.dma = 0, 0x80
+		result(mc, 0)
+	case 14: // Select disk
+		if int(mc.re) >= len(b.drives) {
+			result(mc, 0xFF)
+			return
+		}
+		b.drive = mc.re
+		result(mc, 0)
+	case 15: // Open file
+		result(mc, b.openFile(memory, de))
+	case 16: // Close file
+		result(mc, b.closeFile(memory, de))
+	case 17: // Search for first
+		b.found = b.search(memory, de)
+		result(mc, b.searchNext(memory))
+	case 18: // Search for next
+		result(mc, b.searchNext(memory))
+	case 19: // Delete file
+		result(mc, b.deleteFile(memory, de))
+	case 20: // Read sequential
+		record := fcbRecord(memory, de)
+		code := b.readRecord(memory, de, record)
+		if code == 0 {
+			setFCBRecord(memory, de, record+1)
+		}
+		result(mc, code)
+	case 21: // Write sequential
+		record := fcbRecord(memory, de)
+		code := b.writeRecord(memory, de, record)
+		if code == 0 {
+			setFCBRecord(memory, de, record+1)
+		}
+		result(mc, code)
+	case 22: // Make file
+		result(mc, b.makeFile(memory, de))
+	case 23: // Rename file
+		result(mc, b.renameFile(memory, de))
+	case 24: // Return login vector
+		result(mc, uint16(1)<<uint(len(b.drives))-1)
+	case 25: // Return current disk
+		result(mc, uint16(b.drive))
+	case 26: // Set DMA address
+		b.dma = de
+	case 27: // Get allocation vector address
+		result(mc, allocationAddress)
+	case 28: // Write protect disk
+	case 29: // Get read only vector
+		result(mc, 0)
+	case 30: // Set file attributes
+		result(mc, 0)
+	case 31: // Get disk parameter block address
+		result(mc, dpbAddress)
+	case 32: // Get or set user code
+		if mc.re == 0xFF {
+			result(mc, uint16(b.user))
+		} else {
+			b.user = mc.re & 0x0F
+		}
+	case 33: // Read random
+		record, code := randomRecord(memory, de)
+		if code == 0 {
+			if code = b.readRecord(memory, de, record); code == 0 {
+				setFCBRecord(memory, de, record)
+			}
+		}
+		result(mc, code)
+	case 34, 40: // Write random, write random with zero fill (the host fills the gap with zeros anyway)
+		record, code := randomRecord(memory, de)
+		if code == 0 {
+			if code = b.writeRecord(memory, de, record); code == 0 {
+				setFCBRecord(memory, de, record)
+			}
+		}
+		result(mc, code)
+	case 35: // Compute file size
+		setRandomRecord(memory, de, 0)
+		result(mc, 0xFF)
+		if file, ok := b.find(memory, de); ok {
+			if info, err := os.Stat(file.path); err == nil {
+				setRandomRecord(memory, de, (info.Size()+recordSize-1)/recordSize)
+				result(mc, 0)
+			}
+		}
+	case 36: // Set random record
+		setRandomRecord(memory, de, fcbRecord(memory, de))
+	default:
+		debugPrintLn(fmt.Sprintf("BDOS function %d is not supported", mc.rc))
+		result(mc, 0xFF)
+	}
+}
+
+// dollarString - Function 9: the string at address up to the '$' which ends it.
+// Without a '$', it ends after all 64K of memory
+func dollarString(memory []uint8, address uint16) []uint8 {
+	text := []uint8{}
+	for i := 0; i < len(memory) && memory[address] != '$'; i++ {
+		text = append(text, memory[address])
+		address++
+	}
+	return text
+}
+
+// readLine - Function 10: reads a line into the buffer at address, which holds
+// the maximum length, the length read and the characters. Returns false if
+// there is no more input
+func (b *bdos) readLine(memory []uint8, address uint16) bool {
+	maximum := int(memory[address])
+	line := []byte{}
+	for {
+		key, ok := b.console.read()
+		if !ok {
+			return false
+		}
+		switch {
+		case key == '\r':
+			if b.console.echo {
+				b.console.write('\r')
+			}
+			memory[address+1] = uint8(len(line))
+			copy(memory[address+2:], line)
+			return true
+		case key == 0x08 || key == 0x7F: // Backspace, delete
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				if b.console.echo {
+					b.console.write('\b')
+					b.console.write(' ')
+					b.console.write('\b')
+				}
+			}
+		case key == 0x03 && len(line) == 0: // ^C at the start of a line reboots
+			return false
+		case len(line) < maximum:
+			line = append(line, key)
+			if b.console.echo {
+				b.console.write(key)
+			}
+		}
+	}
+}
+
+// fcbName - The drive (0 = current) and the name in the FCB with the
+// attribute bits removed
+func fcbName(memory []uint8, address uint16) (uint8, string) {
+	name := make([]byte, 11)
+	for i := range name {
+		name[i] = memory[address+1+uint16(i)] & 0x7F
+		if name[i] >= 'a' && name[i] <= 'z' {
+			name[i] -= 'a' - 'A'
+		}
+	}
+	return memory[address], string(name)
+}
+
+// directory - The host directory of the drive given in an FCB, or "" if there is no such drive
+func (b *bdos) directory(drive uint8) string {
+	if drive == 0 || drive == '?' {
+		drive = b.drive + 1
+	}
+	if int(drive) > len(b.drives) {
+		return ""
+	}
+	return b.drives[drive-1]
+}
+
+// listFiles - The visible files of a drive, in alphabetical order
+func (b *bdos) listFiles(directory string) []cpmFile {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil
+	}
+	files := []cpmFile{}
+	for _, entry := range entries {
+		if name, ok := cpmName(entry.Name()); ok && entry.Mode().IsRegular() {
+			files = append(files, cpmFile{name, filepath.Join(directory, entry.Name())})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files
+}
+
+// search - The files matching the name in the FCB
+func (b *bdos) search(memory []uint8, address uint16) []cpmFile {
+	drive, pattern := fcbName(memory, address)
+	found := []cpmFile{}
+	for _, file := range b.listFiles(b.directory(drive)) {
+		if matchName(pattern, file.name) {
+			found = append(found, file)
+		}
+	}
+	return found
+}
+
+// find - The first file matching the name in the FCB
+func (b *bdos) find(memory []uint8, address uint16) (cpmFile, bool) {
+	if found := b.search(memory, address); len(found) > 0 {
+		return found[0], true
+	}
+	return cpmFile{}, false
+}
+
+// searchNext - Puts the directory entry of the next file found into the DMA buffer
+func (b *bdos) searchNext(memory []uint8) uint16 {
+	if len(b.found) == 0 {
+		return 0xFF
+	}
+	file := b.found[0]
+	b.found = b.found[1:]
+	entry := make([]uint8, 32)
+	entry[0] = b.user
+	copy(entry[1:12], file.name)
+	if info, err := os.Stat(file.path); err == nil {
+		// EX and RC of the last extent
+		records := (info.Size() + recordSize - 1) / recordSize
+		extent, count := records/128, records%128
+		if count == 0 && extent > 0 {
+			extent, count = extent-1, 128
+		}
+		entry[12], entry[15] = uint8(extent&0x1F), uint8(count)
+	}
+	writeMemory(memory, b.dma, entry)
+	return 0
+}
+
+// fcbRecord - The record that sequential reads and writes are at: S2, EX and CR
+func fcbRecord(memory []uint8, address uint16) int64 {
+	return int64(memory[address+14]&0x3F)<<12 | int64(memory[address+12]&0x1F)<<7 | int64(memory[address+32]&0x7F)
+}
+
+func setFCBRecord(memory []uint8, address uint16, record int64) {
+	memory[address+32] = uint8(record & 0x7F)
+	memory[address+12] = uint8(record >> 7 & 0x1F)
+	memory[address+14] = uint8(record >> 12)
+}
+
+// randomRecord - The record in R0-R2 used by the random access functions.
+// Returns error code 6 if it is past the end of the largest possible file
+func randomRecord(memory []uint8, address uint16) (int64, uint16) {
+	if memory[address+35] != 0 {
+		return 0, 6
+	}
+	return int64(memory[address+33]) | int64(memory[address+34])<<8, 0
+}
+
+func setRandomRecord(memory []uint8, address uint16, record int64) {
+	memory[address+33], memory[address+34], memory[address+35] = uint8(record), uint8(record>>8), uint8(record>>16)
+}
+
+// setRecordCount - Sets RC to the number of records of the file in the current extent
+func setRecordCount(memory []uint8, address uint16, file *os.File) {
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	records := (info.Size()+recordSize-1)/recordSize - fcbRecord(memory, address)&^0x7F
+	if records < 0 {
+		records = 0
+	} else if records > 128 {
+		records = 128
+	}
+	memory[address+15] = uint8(records)
+}
+
+// open - The host file for an FCB, which is opened the first time it is used
+func (b *bdos) open(memory []uint8, address uint16) (*os.File, bool) {
+	found, ok := b.find(memory, address)
+	if !ok {
+		return nil, false
+	}
+	if file, ok := b.files[found.path]; ok {
+		return file, true
+	}
+	file, err := os.OpenFile(found.path, os.O_RDWR, 0)
+	if err != nil {
+		if file, err = os.Open(found.path); err != nil {
+			return nil, false
+		}
+	}
+	b.files[found.path] = file
+	return file, true
+}
+
+func (b *bdos) openFile(memory []uint8, address uint16) uint16 {
+	file, ok := b.open(memory, address)
+	if !ok {
+		return 0xFF
+	}
+	memory[address+14] = 0 // S2
+	setRecordCount(memory, address, file)
+	return 0
+}
+
+func (b *bdos) closeFile(memory []uint8, address uint16) uint16 {
+	found, ok := b.find(memory, address)
+	if !ok {
+		return 0xFF
+	}
+	if file, ok := b.files[found.path]; ok {
+		file.Close()
+		delete(b.files, found.path)
+	}
+	return 0
+}
+
+func (b *bdos) makeFile(memory []uint8, address uint16) uint16 {
+	drive, name := fcbName(memory, address)
+	directory := b.directory(drive)
+	if directory == "" || strings.Contains(name, "?") {
+		return 0xFF
+	}
+	if found, ok := b.find(memory, address); ok {
+		if file, ok := b.files[found.path]; ok {
+			file.Close()
+			delete(b.files, found.path)
+		}
+		os.Remove(found.path)
+	}
+	path := filepath.Join(directory, hostName(name))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0xFF
+	}
+	b.files[path] = file
+	memory[address+14], memory[address+15] = 0, 0 // S2, RC
+	return 0
+}
+
+func (b *bdos) deleteFile(memory []uint8, address uint16) uint16 {
+	found := b.search(memory, address)
+	if len(found) == 0 {
+		return 0xFF
+	}
+	for _, file := range found {
+		if open, ok := b.files[file.path]; ok {
+			open.Close()
+			delete(b.files, file.path)
+		}
+		os.Remove(file.path)
+	}
+	return 0
+}
+
+// renameFile - The FCB holds the current name and, 16 bytes further on, the new one
+func (b *bdos) renameFile(memory []uint8, address uint16) uint16 {
+	found, ok := b.find(memory, address)
+	if !ok {
+		return 0xFF
+	}
+	_, name := fcbName(memory, address+16)
+	if strings.Contains(name, "?") {
+		return 0xFF
+	}
+	if file, ok := b.files[found.path]; ok {
+		file.Close()
+		delete(b.files, found.path)
+	}
+	if err := os.Rename(found.path, filepath.Join(filepath.Dir(found.path), hostName(name))); err != nil {
+		return 0xFF
+	}
+	return 0
+}
+
+// readMemory - Copies memory from address into buffer. Like the CPU's accesses,
+// it wraps around from FFFF to 0, so a DMA buffer at the top of memory works
+func readMemory(memory []uint8, address uint16, buffer []uint8) {
+	for i := range buffer {
+		buffer[i] = memory[address+uint16(i)]
+	}
+}
+
+// writeMemory - Copies data into memory at address, wrapping around at 64K
+func writeMemory(memory []uint8, address uint16, data []uint8) {
+	for i, value := range data {
+		memory[address+uint16(i)] = value
+	}
+}
+
+// readRecord - Reads a record into the DMA buffer. A short last record is padded
+// with ^Z. Returns 1 when reading past the end of the file
+func (b *bdos) readRecord(memory []uint8, address uint16, record int64) uint16 {
+	file, ok := b.open(memory, address)
+	if !ok {
+		return 0xFF
+	}
+	buffer := make([]uint8, recordSize)
+	n, _ := file.ReadAt(buffer, record*recordSize)
+	if n == 0 {
+		return 1
+	}
+	for i := n; i < recordSize; i++ {
+		buffer[i] = 0x1A
+	}
+	writeMemory(memory, b.dma, buffer)
+	setRecordCount(memory, address, file)
+	return 0
+}
+
+// writeRecord - Writes the DMA buffer to a record. Returns 2 if the disk is full
+func (b *bdos) writeRecord(memory []uint8, address uint16, record int64) uint16 {
+	file, ok := b.open(memory, address)
+	if !ok {
+		return 0xFF
+	}
+	buffer := make([]uint8, recordSize)
+	readMemory(memory, b.dma, buffer)
+	if _, err := file.WriteAt(buffer, record*recordSize); err != nil {
+		return 2
+	}
+	setRecordCount(memory, address, file)
+	return 0
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testFCB = 0x5C
+
+// callBDOS - Calls a BDOS function the way a program does and returns A
+func callBDOS(system *bdos, mc *microcontroller, function uint8, de uint16) uint8 {
+	mc.programCounter = bdosAddress
+	mc.rc, mc.rd, mc.re = function, uint8(de>>8), uint8(de)
+	system.call(mc)
+	return mc.ra
+}
+
+// setFCB - Clears the FCB at address and puts the name (ie: "OUT     DAT") in it
+func setFCB(memory []uint8, address uint16, name string) {
+	for i := uint16(0); i < 36; i++ {
+		memory[address+i] = 0
+	}
+	copy(memory[address+1:], name)
+}
+
+func newBDOSTest(t *testing.T, input string) (*bdos, *microcontroller, *bytes.Buffer, string) {
+	directory := t.TempDir()
+	output := &bytes.Buffer{}
+	system := newBDOS([]string{directory}, newCPMConsole(strings.NewReader(input), output, true))
+	memory := make([]uint8, 0x10000)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	system.install(mc)
+	return system, mc, output, directory
+}
+
+// TestBDOSFiles : Sequential and random access, search, rename and delete
+func TestBDOSFiles(t *testing.T) {
+	system, mc, _, directory := newBDOSTest(t, "")
+	defer system.close()
+	memory := *mc.memory
+	hello := bytes.Repeat([]byte("0123456789"), 20)
+	ioutil.WriteFile(filepath.Join(directory, "hello.txt"), hello, 0666)
+	ioutil.WriteFile(filepath.Join(directory, "too-long-name.txt"), hello, 0666)
+
+	setFCB(memory, testFCB, "????????TXT")
+	if code := callBDOS(system, mc, 17, testFCB); code != 0 || string(memory[0x81:0x8C]) != "HELLO   TXT" || memory[0x8F] != 2 {
+		t.Errorf("Search first returned %02X with the entry %q", code, memory[0x80:0xA0])
+	}
+	if code := callBDOS(system, mc, 18, testFCB); code != 0xFF {
+		t.Errorf("Search next should not have found anything else, returned %02X", code)
+	}
+
+	setFCB(memory, testFCB, "HELLO   TXT")
+	if code := callBDOS(system, mc, 15, testFCB); code != 0 || memory[testFCB+15] != 2 {
+		t.Errorf("Open returned %02X with RC=%d", code, memory[testFCB+15])
+	}
+	if code := callBDOS(system, mc, 20, testFCB); code != 0 || !bytes.Equal(memory[0x80:0x100], hello[:128]) {
+		t.Errorf("The first record read returned %02X: %q", code, memory[0x80:0x100])
+	}
+	if code := callBDOS(system, mc, 20, testFCB); code != 0 || !bytes.Equal(memory[0x80:0x80+72], hello[128:]) ||
+		memory[0x80+72] != 0x1A || memory[testFCB+32] != 2 {
+		t.Errorf("The second record read returned %02X: %q", code, memory[0x80:0x100])
+	}
+	if code := callBDOS(system, mc, 20, testFCB); code != 1 {
+		t.Errorf("Reading past the end returned %02X", code)
+	}
+
+	// Write two records sequentially, then record 5 at random
+	setFCB(memory, testFCB, "OUT     DAT")
+	if code := callBDOS(system, mc, 22, testFCB); code != 0 {
+		t.Errorf("Make file returned %02X", code)
+	}
+	callBDOS(system, mc, 26, 0x1000)
+	for i := 0; i < 3; i++ {
+		copy(memory[0x1000:0x1080], bytes.Repeat([]byte{byte('A' + i)}, 128))
+		if i < 2 {
+			callBDOS(system, mc, 21, testFCB)
+		} else {
+			memory[testFCB+33] = 5
+			callBDOS(system, mc, 34, testFCB)
+		}
+	}
+	callBDOS(system, mc, 16, testFCB)
+	data, _ := ioutil.ReadFile(filepath.Join(directory, "OUT.DAT"))
+	if len(data) != 6*128 || data[0] != 'A' || data[128] != 'B' || data[256] != 0 || data[5*128] != 'C' {
+		t.Errorf("OUT.DAT has the wrong contents: %d bytes", len(data))
+	}
+	memory[testFCB+33] = 0
+	if code := callBDOS(system, mc, 35, testFCB); code != 0 || memory[testFCB+33] != 6 {
+		t.Errorf("Compute file size returned %02X and gave %d records", code, memory[testFCB+33])
+	}
+
+	copy(memory[testFCB+17:], "NEW     DAT")
+	if code := callBDOS(system, mc, 23, testFCB); code != 0 {
+		t.Errorf("Rename returned %02X", code)
+	}
+	setFCB(memory, testFCB, "???     DAT")
+	if code := callBDOS(system, mc, 19, testFCB); code != 0 {
+		t.Errorf("Delete returned %02X", code)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "NEW.DAT")); !os.IsNotExist(err) {
+		t.Errorf("NEW.DAT was not deleted: %v", err)
+	}
+	if code := callBDOS(system, mc, 15, testFCB); code != 0xFF {
+		t.Errorf("Opening a deleted file returned %02X", code)
+	}
+	memory[testFCB+33] = 5
+	if code := callBDOS(system, mc, 35, testFCB); code != 0xFF || memory[testFCB+33] != 0 {
+		t.Errorf("Compute file size of a deleted file returned %02X and gave %d records", code, memory[testFCB+33])
+	}
+}
+
+// TestBDOSHighDMA : A DMA buffer near the top of memory wraps around to 0, as
+// the CPU's accesses do
+func TestBDOSHighDMA(t *testing.T) {
+	system, mc, _, directory := newBDOSTest(t, "")
+	defer system.close()
+	memory := *mc.memory
+	hello := bytes.Repeat([]byte("0123456789"), 20)
+	ioutil.WriteFile(filepath.Join(directory, "hello.txt"), hello, 0666)
+
+	callBDOS(system, mc, 26, 0xFFF8)
+	setFCB(memory, testFCB, "HELLO   TXT")
+	if code := callBDOS(system, mc, 17, testFCB); code != 0 || string(memory[0xFFF9:])+string(memory[:4]) != "HELLO   TXT" {
+		t.Errorf("Search first returned %02X with the entry %q", code, append(memory[0xFFF8:], memory[:0x18]...))
+	}
+
+	callBDOS(system, mc, 26, 0xFFC0)
+	setFCB(memory, testFCB, "HELLO   TXT")
+	callBDOS(system, mc, 15, testFCB)
+	if code := callBDOS(system, mc, 20, testFCB); code != 0 || !bytes.Equal(append(memory[0xFFC0:], memory[:0x40]...), hello[:128]) {
+		t.Errorf("The record read at FFC0 returned %02X: %q", code, append(memory[0xFFC0:], memory[:0x40]...))
+	}
+
+	setFCB(memory, testFCB, "OUT     DAT")
+	callBDOS(system, mc, 22, testFCB)
+	if code := callBDOS(system, mc, 21, testFCB); code != 0 {
+		t.Errorf("The record written from FFC0 returned %02X", code)
+	}
+	callBDOS(system, mc, 16, testFCB)
+	if data, _ := ioutil.ReadFile(filepath.Join(directory, "OUT.DAT")); !bytes.Equal(data, hello[:128]) {
+		t.Errorf("OUT.DAT has the wrong contents: %q", data)
+	}
+}
+
+// TestBDOSConsole : Line input, character input and output and the end of the input
+func TestBDOSConsole(t *testing.T) {
+	system, mc, output, _ := newBDOSTest(t, "hellp\x7Fo\nx")
+	memory := *mc.memory
+
+	memory[0x200] = 20
+	callBDOS(system, mc, 10, 0x200)
+	if memory[0x201] != 5 || string(memory[0x202:0x207]) != "hello" {
+		t.Errorf("Read %d characters: %q", memory[0x201], memory[0x202:0x202+int(memory[0x201])])
+	}
+	if key := callBDOS(system, mc, 1, 0); key != 'x' {
+		t.Errorf("Expected x, got %02X", key)
+	}
+	if callBDOS(system, mc, 1, 0); mc.programCounter != 0 {
+		t.Errorf("Reading past the end of the input should end the program")
+	}
+
+	copy(memory[0x300:], "A\tB\r\n$")
+	callBDOS(system, mc, 9, 0x300)
+	if expected := "hellp\b \bo\rxA      B\r\n"; output.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, output.String())
+	}
+	if callBDOS(system, mc, 12, 0); mc.rh != 0 || mc.rl != 0x22 {
+		t.Errorf("Wrong version number %02X%02X", mc.rh, mc.rl)
+	}
+
+	// Without a '$' the string ends after all of memory
+	for i := range memory {
+		memory[i] = 'x'
+	}
+	output.Reset()
+	if callBDOS(system, mc, 9, 0x300); output.Len() != 0x10000 {
+		t.Errorf("Expected 64K to be printed without a $, got %d bytes", output.Len())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Insood/8080/kcs"
+)
+
+// ALTAIRCASSETTE - A tape (a WAV file in the Kansas City Standard) to play
+// into the 88-ACR
+var ALTAIRCASSETTE = ""
+
+// ALTAIRRECORD - Where to save a tape of what is sent to the 88-ACR
+var ALTAIRRECORD = ""
+
+// cassette - The 88-ACR audio cassette interface: an 88-SIO at ports 06-07
+// with a 300 baud KCS modem, and a cassette recorder on the end of it. The
+// tape starts playing when the program first asks for a byte (the user
+// pressing PLAY once CLOAD is waiting). After that the bytes arrive when they
+// are on the tape, whatever the program is doing, so one which isn't read
+// before the next arrives is lost as it would be on the real board
+type cassette struct {
+	mc       *microcontroller
+	tape     []kcs.Byte
+	next     int   // The next byte on the tape
+	playing  bool  // The tape has been started
+	start    int64 // The cycles when the tape was at 0 seconds
+	received uint8
+	full     bool // A byte has been received and not read
+
+	recorder *kcs.Encoder
+	recorded bool  // Something has been recorded
+	nextTx   int64 // The cycles when the byte being sent has gone
+}
+
+// cassetteLeader - The seconds of leader before the first byte recorded, and
+// the longest gap between bytes which is recorded
+const (
+	cassetteLeader = 2
+	cassetteGap    = 5
+)
+
+// loadCassette - Reads the bytes on a tape
+func loadCassette(fileName string) ([]kcs.Byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	samples, rate, err := kcs.ReadWAV(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	tape := kcs.Decode(samples, rate, kcs.KCS)
+	if len(tape) == 0 {
+		return nil, fmt.Errorf("%s: there is nothing in the Kansas City Standard on the tape", fileName)
+	}
+	return tape, nil
+}
+
+// newCassette - The 88-ACR with a tape to play (or nil) and, if record is set,
+// a recorder
+func newCassette(mc *microcontroller, tape []kcs.Byte, record bool) *cassette {
+	c := &cassette{mc: mc, tape: tape}
+	if record {
+		c.recorder = kcs.NewEncoder(kcs.KCS, kcs.DefaultRate)
+	}
+	return c
+}
+
+func (c *cassette) cycles(seconds float64) int64 {
+	return int64(seconds * CPUFREQUENCY)
+}
+
+func (c *cassette) ready() bool {
+	if len(c.tape) == 0 {
+		return false
+	}
+	if !c.playing {
+		c.playing, c.start = true, c.mc.cycles-c.cycles(c.tape[0].Time)
+	}
+	// A byte is received once its stop bits have gone past
+	for ; c.next < len(c.tape); c.next++ {
+		if c.start+c.cycles(c.tape[c.next].Time+kcs.ByteSeconds(kcs.KCS)) > c.mc.cycles {
+			break
+		}
+		c.received, c.full = c.tape[c.next].Value, true
+	}
+	return c.full
+}
+
+func (c *cassette) read() uint8 {
+	c.ready()
+	c.full = false
+	return c.received
+}
+
+func (c *cassette) sendable() bool {
+	return c.mc.cycles >= c.nextTx
+}
+
+// write - Records a byte, after the time since the last one (up to a few
+// seconds) of mark tone
+func (c *cassette) write(character uint8) {
+	if c.recorder != nil {
+		gap := float64(cassetteLeader)
+		if c.recorded {
+			gap = float64(c.mc.cycles-c.nextTx) / CPUFREQUENCY
+		}
+		if gap > cassetteGap {
+			gap = cassetteGap
+		}
+		c.recorder.Mark(gap)
+		c.recorder.WriteByte(character)
+		c.recorded = true
+	}
+	c.nextTx = c.mc.cycles + c.cycles(kcs.ByteSeconds(kcs.KCS))
+}
+
+// save - Writes what was recorded to a WAV file
+func (c *cassette) save(fileName string) error {
+	if !c.recorded {
+		return errors.New("nothing was recorded on the cassette")
+	}
+	c.recorder.Mark(1)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := kcs.WriteWAV(file, c.recorder.Samples(), c.recorder.Rate); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Insood/8080/kcs"
+)
+
+// TestCassettePlayback : A program reads a tape through the 88-ACR at 300 baud
+// and prints it on the Teletype
+func TestCassettePlayback(t *testing.T) {
+	output := &bytes.Buffer{}
+	machine := newAltair(newCPMConsole(strings.NewReader(""), output, false))
+	audio := kcs.Encode([]byte("CLOAD\x00"), kcs.KCS, kcs.DefaultRate, 3)
+	tape := kcs.Decode(audio, kcs.DefaultRate, kcs.KCS)
+	deck := newCassette(machine.mc, tape, false)
+	machine.bus.attach(0x06, 2, &sio88{base: 0x06, tty: deck})
+	copy(*machine.mc.memory, []uint8{
+		0xDB, 0x06, // IN 06H
+		0x0F,             // RRC
+		0xDA, 0x00, 0x00, // JC 0 (active low)
+		0xDB, 0x07, // IN 07H
+		0xB7,             // ORA A
+		0xCA, 0x11, 0x00, // JZ 0011H
+		0xD3, 0x01, // OUT 01H
+		0xC3, 0x00, 0x00, // JMP 0
+	})
+	(*machine.mc.memory)[0x11] = 0x76 // HLT
+	machine.panel.run()
+	if output.String() != "CLOAD" {
+		t.Errorf("Expected CLOAD from the tape, got %q", output.String())
+	}
+	// Six bytes at 300 baud take 0.22 seconds, and the leader is skipped
+	if seconds := float64(machine.mc.cycles) / CPUFREQUENCY; seconds < 0.21 || seconds > 0.25 {
+		t.Errorf("Expected the tape to take 0.22 seconds, not %.3f", seconds)
+	}
+}
+
+// TestCassetteRecord : What a program sends to the 88-ACR is recorded at 300
+// baud, and a byte which isn't read in time is lost
+func TestCassetteRecord(t *testing.T) {
+	machine := newAltair(newCPMConsole(strings.NewReader(""), &bytes.Buffer{}, false))
+	deck := newCassette(machine.mc, nil, true)
+	machine.bus.attach(0x06, 2, &sio88{base: 0x06, tty: deck})
+	copy(*machine.mc.memory, []uint8{
+		0x21, 0x20, 0x00, // LXI H,0020H
+		0xDB, 0x06, // IN 06H
+		0x07,             // RLC
+		0xDA, 0x03, 0x00, // JC 0003H (active low)
+		0x7E,       // MOV A,M
+		0xD3, 0x07, // OUT 07H
+		0x23,             // INX H
+		0xB7,             // ORA A
+		0xC2, 0x03, 0x00, // JNZ 0003H
+		0x76, // HLT
+	})
+	copy((*machine.mc.memory)[0x20:], "SAVE\x00")
+	machine.panel.run()
+	found := kcs.Decode(deck.recorder.Samples(), kcs.DefaultRate, kcs.KCS)
+	recorded := []byte{}
+	for _, b := range found {
+		recorded = append(recorded, b.Value)
+	}
+	if string(recorded) != "SAVE\x00" {
+		t.Errorf("Expected SAVE on the tape, got %q", recorded)
+	}
+
+	machine.mc.cycles = 0
+	lost := newCassette(machine.mc, kcs.Decode(kcs.Encode([]byte("AB"), kcs.KCS, kcs.DefaultRate, 1), kcs.DefaultRate, kcs.KCS), false)
+	lost.ready()
+	machine.mc.cycles = 2 * CPUFREQUENCY
+	if !lost.ready() || lost.read() != 'B' || lost.ready() {
+		t.Error("Expected A to be lost")
+	}
+}
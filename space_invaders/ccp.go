@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+)
+
+// What the CP/M 2.2 CCP does before it jumps to a program at 0x100: the
+// command line after the program's name is upper cased and stored at 0x80 as
+// the command tail, and the first two file names in it are parsed into the
+// default FCBs at 0x5C and 0x6C. "STAT B:*.COM $S" gives
+//
+//	0x5C: 02 '????????' 'COM' 00 00 00 00
+//	0x6C: 00 '$S      ' '   ' 00 00 00 00
+//	0x80: 0B ' B:*.COM $S' 00
+
+// defaultFCB - The FCB the first file name in the command line is put in. The
+// second is put 16 bytes after it, at 0x6C
+const defaultFCB = 0x5C
+
+// commandTail - Where the command line is stored: its length then the text
+const commandTail = 0x80
+
+// fcbDelimiter - Whether the CCP ends a file name at c
+func fcbDelimiter(c byte) bool {
+	return c == 0 || strings.IndexByte(" \t=_.:;<>,", c) >= 0
+}
+
+// parseFileName - Fills in the drive, name and type of the FCB at address from
+// the first file name in line, the way the CCP does: A: to P: give drives 1 to
+// 16 and * fills the rest of the name or type with ?. Returns the text after
+// the file name
+func parseFileName(memory []uint8, address uint16, line string) string {
+	line = strings.TrimLeft(line, " \t")
+	memory[address] = 0
+	if len(line) >= 2 && line[1] == ':' && line[0] >= 'A' && line[0] <= 'P' {
+		memory[address] = line[0] - 'A' + 1
+		line = line[2:]
+	}
+	for i := uint16(1); i < 12; i++ {
+		memory[address+i] = ' '
+	}
+	field := func(offset uint16, length int) {
+		for i := 0; len(line) > 0 && !fcbDelimiter(line[0]); i, line = i+1, line[1:] {
+			if i >= length {
+				continue // The CCP skips the rest of a name which is too long
+			}
+			if line[0] == '*' {
+				for ; i < length; i++ {
+					memory[address+offset+uint16(i)] = '?'
+				}
+				continue
+			}
+			memory[address+offset+uint16(i)] = line[0]
+		}
+	}
+	field(1, 8)
+	if len(line) > 0 && line[0] == '.' {
+		line = line[1:]
+		field(9, 3)
+	}
+	for i := uint16(12); i < 16; i++ { // EX, S1, S2 and RC
+		memory[address+i] = 0
+	}
+	return line
+}
+
+// setCommandLine - Puts the arguments given to a program into the command tail
+// and the default FCBs
+func setCommandLine(memory []uint8, args []string) {
+	line := strings.ToUpper(strings.Join(args, " "))
+	if line != "" {
+		line = " " + line
+	}
+	if len(line) > 126 { // Leaves room for the 0 at the end below 0x100
+		line = line[:126]
+	}
+	memory[commandTail] = uint8(len(line))
+	copy(memory[commandTail+1:], line)
+	memory[commandTail+1+len(line)] = 0
+
+	rest := parseFileName(memory, defaultFCB, line)
+	parseFileName(memory, defaultFCB+16, rest)
+	memory[defaultFCB+32] = 0 // The current record of the first FCB
+}
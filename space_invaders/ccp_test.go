@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestCommandLine : The command tail and default FCBs for a few command lines
+func TestCommandLine(t *testing.T) {
+	tests := []struct {
+		args   []string
+		tail   string
+		first  string // Drive (as a digit), name and type
+		second string
+	}{
+		{nil, "", "0           ", "0           "},
+		{[]string{"hello.txt"}, " HELLO.TXT", "0HELLO   TXT", "0           "},
+		{[]string{"b:*.com", "$s"}, " B:*.COM $S", "2????????COM", "0$S         "},
+		{[]string{"verylongname.text", "a:x.*"}, " VERYLONGNAME.TEXT A:X.*", "0VERYLONGTEX", "1X       ???"},
+		{[]string{"out.dat=in.dat"}, " OUT.DAT=IN.DAT", "0OUT     DAT", "0           "},
+	}
+	for _, test := range tests {
+		memory := make([]uint8, 0x10000)
+		for i := range memory[:0x100] {
+			memory[i] = 0xAA
+		}
+		setCommandLine(memory, test.args)
+		if tail := string(memory[0x81 : 0x81+int(memory[0x80])]); tail != test.tail || memory[0x81+len(tail)] != 0 {
+			t.Errorf("%v: the command tail is %q", test.args, tail)
+		}
+		for i, expected := range []string{test.first, test.second} {
+			fcb := memory[0x5C+16*i:]
+			if name := string('0'+fcb[0]) + string(fcb[1:12]); name != expected {
+				t.Errorf("%v: FCB %d is %q, expected %q", test.args, i+1, name, expected)
+			}
+			if fcb[12] != 0 || fcb[13] != 0 || fcb[14] != 0 || fcb[15] != 0 {
+				t.Errorf("%v: FCB %d has EX, S1, S2, RC % X", test.args, i+1, fcb[12:16])
+			}
+		}
+		if memory[0x7C] != 0 {
+			t.Errorf("%v: the current record is %d", test.args, memory[0x7C])
+		}
+	}
+}
+
+// TestPageZero : The vectors a CP/M program finds in page zero, and calling the BIOS through them
+func TestPageZero(t *testing.T) {
+	system, mc, output, _ := newBDOSTest(t, "k")
+	defer system.close()
+	memory := *mc.memory
+
+	wboot := uint16(memory[1]) | uint16(memory[2])<<8
+	top := uint16(memory[6]) | uint16(memory[7])<<8
+	if memory[0] != 0xC3 || memory[5] != 0xC3 || top != bdosAddress || mc.stackPointer >= top {
+		t.Errorf("Page zero is % X with SP=%04X", memory[:8], mc.stackPointer)
+	}
+	if memory[mc.stackPointer] != 0 || memory[mc.stackPointer+1] != 0 {
+		t.Errorf("Returning from the program doesn't go to 0")
+	}
+
+	// CONOUT and CONIN are the 4th and 3rd entries after WBOOT
+	mc.programCounter, mc.rc = wboot+9, 'X'
+	if !isBIOS(mc.programCounter) {
+		t.Fatalf("%04X is not in the BIOS", mc.programCounter)
+	}
+	system.callBIOS(mc)
+	mc.programCounter = wboot + 6
+	if system.callBIOS(mc); mc.ra != 'k' || output.String() != "X" {
+		t.Errorf("CONIN returned %02X and CONOUT printed %q", mc.ra, output.String())
+	}
+	mc.programCounter = wboot
+	if system.callBIOS(mc); mc.programCounter != 0 {
+		t.Errorf("WBOOT should end the program")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+// clockedDevice - A device with timing of its own (ie: a timer or a serial
+// port), which is brought up to date with the CPU's clock
+type clockedDevice interface {
+	update(cycles int64)
+}
+
+// deviceClock - A hook which updates devices after every instruction, so that
+// their timing follows the CPU's clock
+type deviceClock struct {
+	devices []clockedDevice
+}
+
+// clockDevices - Updates the devices after every instruction the CPU executes
+func clockDevices(mc *microcontroller, devices ...clockedDevice) {
+	mc.addHook(&deviceClock{devices})
+}
+
+func (c *deviceClock) beforeInstruction(mc *microcontroller) {}
+
+func (c *deviceClock) afterInstruction(mc *microcontroller) {
+	for _, device := range c.devices {
+		device.update(mc.cycles)
+	}
+}
+
+// chipClock - The clock input of a chip, which runs at a different rate to the
+// CPU's. It turns CPU cycles into the number of pulses of the chip's clock
+type chipClock struct {
+	cpuRate  int64 // Reduced so that the products don't overflow
+	chipRate int64
+	pulses   int64 // The pulses up to the last update
+}
+
+// newChipClock - A chip clocked at chipHz by a CPU running at cpuHz
+func newChipClock(cpuHz int64, chipHz int64) chipClock {
+	a, b := cpuHz, chipHz
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return chipClock{cpuRate: cpuHz / a, chipRate: chipHz / a}
+}
+
+// advance - How many pulses there have been since the last call, now that the
+// CPU has run for cycles
+func (c *chipClock) advance(cycles int64) int64 {
+	total := cycles * c.chipRate / c.cpuRate
+	pulses := total - c.pulses
+	c.pulses = total
+	return pulses
+}
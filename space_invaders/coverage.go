@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Tracks which instructions of a program were executed, and which opcodes of
+// the core were exercised with which flag results, so that it is possible to
+// tell what a test ROM actually tests.
+
+// Flag bits as they appear in the PSW
+const (
+	flagS  = 0x80
+	flagZ  = 0x40
+	flagAC = 0x10
+	flagP  = 0x04
+	flagC  = 0x01
+)
+
+var coverageFlagNames = []struct {
+	name string
+	bit  uint8
+}{{"S", flagS}, {"Z", flagZ}, {"AC", flagAC}, {"P", flagP}, {"C", flagC}}
+
+// possibleFlags - The flags each opcode can leave either set or reset. A flag
+// which an opcode always sets or always resets (ie: C after ANA, or after STC)
+// can't be seen both ways, so it isn't expected to be
+var possibleFlags = func() (table [256]uint8) {
+	all := uint8(flagS | flagZ | flagAC | flagP | flagC)
+	for i := range table {
+		opcode := uint8(i)
+		switch {
+		case opcode >= 0x80 && opcode <= 0xBF, opcode&0xC7 == 0xC6: // ALU
+			table[i] = aluPossibleFlags(opcode)
+		case opcode == 0x27, opcode == 0xF1: // DAA, POP PSW
+			table[i] = all
+		case opcode&0xC6 == 0x04: // INR, DCR
+			table[i] = flagS | flagZ | flagAC | flagP
+		case opcode&0xCF == 0x09, opcode&0xE7 == 0x07, opcode == 0x3F: // DAD, rotates, CMC
+			table[i] = flagC
+		}
+	}
+	return table
+}()
+
+// aluPossibleFlags - The flags an ALU operation (on a register, M or immediate
+// data) can leave either set or reset
+func aluPossibleFlags(opcode uint8) uint8 {
+	operation := (opcode >> 3) & 0x7
+	self := opcode < 0xC0 && opcode&0x7 == 0x7 // The operand is A itself
+	switch {
+	case self && (operation == 2 || operation == 5 || operation == 7): // SUB A, XRA A, CMP A always give 0
+		return 0
+	case self && operation == 3: // SBB A gives 0 or FF, which both have even parity
+		return flagS | flagZ | flagAC | flagC
+	case operation == 4: // ANA, ANI always reset C
+		return flagS | flagZ | flagAC | flagP
+	case operation == 5 || operation == 6: // XRA, ORA, XRI, ORI always reset C and AC
+		return flagS | flagZ | flagP
+	}
+	return flagS | flagZ | flagAC | flagP | flagC
+}
+
+// isConditionalBranch - Jcc, Ccc or Rcc
+func isConditionalBranch(opcode uint8) bool {
+	return opcode&0xC7 == 0xC2 || isConditionalCall(opcode) || isConditionalReturn(opcode)
+}
+
+// coverage - An instructionHook which records executed addresses and opcodes
+type coverage struct {
+	executed [65536]bool
+	opcodes  [256]int64
+	flagSet  [256]uint8   // Flags seen set after each opcode
+	flagZero [256]uint8   // Flags seen reset after each opcode
+	branches [256][2]bool // Conditional branches seen not taken / taken
+}
+
+func newCoverage() *coverage {
+	return &coverage{}
+}
+
+func (c *coverage) beforeInstruction(mc *microcontroller) {}
+
+func (c *coverage) afterInstruction(mc *microcontroller) {
+	opcode := mc.lastOpcode
+	if mc.interruptBus == nil { // An interrupt doesn't execute anything at the PC
+		c.executed[mc.lastPC] = true
+	}
+	c.opcodes[opcode]++
+	psw := pswByte(mc)
+	c.flagSet[opcode] |= psw
+	c.flagZero[opcode] |= ^psw
+
+	if isConditionalBranch(opcode) {
+		taken := mc.lastBranchTaken
+		if opcode&0xC7 == 0xC2 { // Jcc doesn't touch the stack
+			taken = mc.programCounter != mc.lastPC+3
+		}
+		c.branches[opcode][boolToInt(taken)] = true
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// missingOutcomes - Describes the results an executed opcode has not had yet.
+// Returns nothing if it is fully covered
+func (c *coverage) missingOutcomes(opcode uint8) []string {
+	missing := []string{}
+	affected := possibleFlags[opcode]
+	for _, flag := range coverageFlagNames {
+		if affected&flag.bit == 0 {
+			continue
+		}
+		if c.flagSet[opcode]&flag.bit == 0 {
+			missing = append(missing, flag.name+"=1")
+		}
+		if c.flagZero[opcode]&flag.bit == 0 {
+			missing = append(missing, flag.name+"=0")
+		}
+	}
+	if isConditionalBranch(opcode) {
+		if !c.branches[opcode][0] {
+			missing = append(missing, "not taken")
+		}
+		if !c.branches[opcode][1] {
+			missing = append(missing, "taken")
+		}
+	}
+	return missing
+}
+
+// writeOpcodeMatrix - A 16x16 table of all opcodes: '*' fully covered,
+// '+' executed but not with every flag result or branch outcome, '.' never executed
+func (c *coverage) writeOpcodeMatrix(out io.Writer) {
+	executed, complete := 0, 0
+	fmt.Fprintf(out, "Opcode coverage (* = all flag results and branch outcomes seen, + = partial, . = not executed)\n\n")
+	fmt.Fprintf(out, "    ")
+	for low := 0; low < 16; low++ {
+		fmt.Fprintf(out, " %X", low)
+	}
+	fmt.Fprintln(out)
+	for high := 0; high < 16; high++ {
+		fmt.Fprintf(out, "%X0 |", high)
+		for low := 0; low < 16; low++ {
+			opcode := uint8(high<<4 | low)
+			mark := "."
+			if c.opcodes[opcode] > 0 {
+				executed++
+				mark = "+"
+				if len(c.missingOutcomes(opcode)) == 0 {
+					complete++
+					mark = "*"
+				}
+			}
+			fmt.Fprintf(out, " %s", mark)
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintf(out, "\n%d of 256 opcodes executed, %d fully covered\n\n", executed, complete)
+
+	memory := make([]uint8, 65536)
+	for opcode := 0; opcode < 256; opcode++ {
+		if c.opcodes[opcode] == 0 {
+			continue
+		}
+		if missing := c.missingOutcomes(uint8(opcode)); len(missing) > 0 {
+			memory[0] = uint8(opcode)
+			fmt.Fprintf(out, "  %02X %-5s %10d times, never: %s\n", opcode,
+				disassemble(memory, 0).mnemonic, c.opcodes[opcode], strings.Join(missing, ", "))
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+// writeAnnotatedDisassembly - Disassembles memory from start to end, marking
+// each instruction with '>' if it was executed. Bytes which can't be an
+// instruction because they overlap one which was executed are shown as DB
+func (c *coverage) writeAnnotatedDisassembly(out io.Writer, memory []uint8, start uint16, end uint16) {
+	total, executed := 0, 0
+	lines := []string{}
+	for address := int(start); address < int(end); {
+		d := disassemble(memory, uint16(address))
+		length := int(d.length)
+		text := d.String()
+		overlaps := !c.executed[address] && address+length > int(end)
+		for i := 1; i < length && !c.executed[address]; i++ {
+			overlaps = overlaps || c.executed[(address+i)&0xFFFF]
+		}
+		if overlaps {
+			length = 1
+			text = fmt.Sprintf("DB   %s", intelNumber(operand{value: uint16(memory[address]), width: 1}))
+		} else {
+			total++
+		}
+		mark := " "
+		if c.executed[address] {
+			mark = ">"
+			executed++
+		}
+		opcodeBytes := ""
+		for i := 0; i < length; i++ {
+			opcodeBytes += fmt.Sprintf("%02X ", memory[(address+i)&0xFFFF])
+		}
+		if label, ok := SYMBOLS.lookup(uint16(address)); ok {
+			lines = append(lines, label+":")
+		}
+		lines = append(lines, fmt.Sprintf("%s %04X: %-9s %s", mark, address, opcodeBytes, text))
+		address += length
+	}
+	fmt.Fprintf(out, "Code coverage %04X-%04X: %d of %d instructions executed (> = executed)\n\n", start, end-1, executed, total)
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+}
+
+var coverageHook *coverage
+var coverageFile string
+var coverageMemory *[]uint8
+var coverageStart, coverageEnd uint16
+
+// startCoverage - Attaches coverage tracking to the microcontroller if -coverage
+// was given. The program is expected to be in memory from start to end
+func startCoverage(mc *microcontroller, fileName string, start uint16, end uint16) {
+	if fileName == "" {
+		return
+	}
+	coverageHook = newCoverage()
+	coverageFile, coverageMemory, coverageStart, coverageEnd = fileName, mc.memory, start, end
+	mc.addHook(coverageHook)
+}
+
+// stopCoverage - Writes the report started by startCoverage()
+func stopCoverage() {
+	if coverageHook == nil {
+		return
+	}
+	file, err := os.Create(coverageFile)
+	if err == nil {
+		out := bufio.NewWriter(file)
+		coverageHook.writeOpcodeMatrix(out)
+		coverageHook.writeAnnotatedDisassembly(out, *coverageMemory, coverageStart, coverageEnd)
+		err = out.Flush()
+		file.Close()
+	}
+	if err != nil {
+		fmt.Printf("Error while writing the coverage report: %s\n", err)
+	}
+	coverageHook = nil
+}
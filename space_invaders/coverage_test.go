@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestCoverage : Executed instructions, flag results and branch outcomes are reported
+func TestCoverage(t *testing.T) {
+	memory := make([]uint8, 65536)
+	copy(memory, []uint8{
+		0x3E, 0x02, // 0000 MVI A, 2
+		0x3D,             // 0002 DCR A
+		0xC2, 0x02, 0x00, // 0003 JNZ 0002
+		0xC3, 0x0A, 0x00, // 0006 JMP 000A
+		0x00, // 0009 NOP (never executed)
+		0x76, // 000A HLT
+	})
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	c := newCoverage()
+	mc.addHook(c)
+	for mc.programCounter != 0x0A {
+		mc.run()
+	}
+
+	if missing := strings.Join(c.missingOutcomes(0xC2), ","); missing != "" {
+		t.Errorf("Expected JNZ to be fully covered, missing: %s", missing)
+	}
+	if missing := strings.Join(c.missingOutcomes(0x3D), ","); missing != "S=1,AC=0" {
+		t.Errorf("Unexpected missing DCR outcomes: %s", missing)
+	}
+
+	out := &bytes.Buffer{}
+	c.writeOpcodeMatrix(out)
+	c.writeAnnotatedDisassembly(out, memory, 0, 0x0B)
+	for _, expected := range []string{
+		"30 | . . . . . . . . . . . . . + * .",
+		"C0 | . . * * . . . . . . . . . . . .",
+		"4 of 256 opcodes executed, 3 fully covered",
+		"4 of 6 instructions executed",
+		"> 0003: C2 02 00  JNZ  0002H",
+		"  0009: 00        NOP",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected the report to contain '%s':\n%s", expected, out.String())
+		}
+	}
+}
+
+// TestCoverageReachable : Every ALU operation, STC and CMC can be fully
+// covered, and no flag changes which possibleFlags leaves out
+func TestCoverageReachable(t *testing.T) {
+	memory := make([]uint8, 65536)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	c := newCoverage()
+	mc.addHook(c)
+	opcodes := []uint8{0x37, 0x3F} // STC, CMC
+	for opcode := 0x80; opcode <= 0xBF; opcode++ {
+		opcodes = append(opcodes, uint8(opcode))
+	}
+	for opcode := 0xC6; opcode <= 0xFE; opcode += 8 {
+		opcodes = append(opcodes, uint8(opcode))
+	}
+	for _, opcode := range opcodes {
+		for a := 0; a < 256; a++ {
+			for operand := 0; operand < 256; operand++ {
+				for carry := 0; carry < 2; carry++ {
+					memory[0], memory[1], memory[0x1000] = opcode, uint8(operand), uint8(operand)
+					mc.ra, mc.carry, mc.programCounter = uint8(a), carry == 1, 0
+					mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl = uint8(operand), uint8(operand),
+						uint8(operand), uint8(operand), uint8(operand), uint8(operand)
+					if opcode&0xC7 == 0x86 { // M
+						mc.rh, mc.rl = 0x10, 0x00
+					}
+					mc.run()
+				}
+			}
+		}
+		if missing := c.missingOutcomes(opcode); len(missing) > 0 {
+			t.Errorf("%02X can't be fully covered, never: %s", opcode, strings.Join(missing, ", "))
+		}
+		if varied := c.flagSet[opcode] & c.flagZero[opcode] &^ possibleFlags[opcode]; varied&(flagS|flagZ|flagAC|flagP|flagC) != 0 {
+			t.Errorf("%02X changed flags %02X which aren't expected to change", opcode, varied)
+		}
+	}
+}
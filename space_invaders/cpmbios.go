@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/Insood/8080/cpmfs"
+)
+
+// Boots a genuine CP/M 2.2 (the CCP and BDOS from the system tracks of the
+// disk in drive A:) on the microcontroller. Only the BIOS is emulated: each
+// entry of its jump table is an OUT instruction followed by a RET
+//
+//	BIOS+0:  OUT E0H  RET    ; BOOT
+//	BIOS+3:  OUT E1H  RET    ; WBOOT
+//	...
+//	BIOS+48: OUT F0H  RET    ; SECTRAN
+//
+// so calling it traps into cpmBIOS.output(), which does the work in Go.
+// The disk parameter headers and the buffers the BDOS needs follow the table.
+
+// biosPort - The port of BIOS function 0. Function n uses biosPort+n
+const biosPort = 0xE0
+
+const biosFunctions = 17
+
+// cpmSystemSize - The size of the CCP (0x800 bytes) and BDOS (0xE00 bytes)
+// which are loaded from the system tracks. The BIOS starts right after them
+const cpmSystemSize = 0x1600
+
+// cpmBIOS - The emulated BIOS and disk controller
+type cpmBIOS struct {
+	mc      *microcontroller
+	console *cpmConsole
+	list    io.Writer   // The printer
+	aux     *serialLine // The reader and punch, when they are bound with -serial
+	disks   []*cpmfs.Image
+	system  []uint8 // The CCP and BDOS, reloaded by every warm boot
+	ccp     uint16  // Where the CCP is loaded
+	dph     []uint16
+	drive   int
+	track   int
+	sector  int
+	dma     uint16
+	halted  bool // Set when there is no more console input
+}
+
+// findCCP - Looks for the CCP in the system tracks. It starts with JMP to its
+// command processor (at +35CH) and to the entry which clears the command line
+// (at +358H), which gives the address it was built for
+func findCCP(tracks []uint8) (uint16, []uint8, error) {
+	for offset := 0; offset+cpmSystemSize <= len(tracks); offset += 128 {
+		code := tracks[offset:]
+		first := uint16(code[1]) | uint16(code[2])<<8
+		second := uint16(code[4]) | uint16(code[5])<<8
+		if code[0] == 0xC3 && code[3] == 0xC3 && first-0x35C == second-0x358 && (first-0x35C)&0xFF == 0 {
+			return first - 0x35C, code[:cpmSystemSize], nil
+		}
+	}
+	return 0, nil, errors.New("no CP/M 2.2 system (CCP and BDOS) on the system tracks of drive A:")
+}
+
+// newCPMBIOS - Reads the system from the disk in drive A:. Drives without a
+// disk can be left nil
+func newCPMBIOS(disks []*cpmfs.Image, console *cpmConsole) (*cpmBIOS, error) {
+	if len(disks) == 0 || disks[0] == nil {
+		return nil, errors.New("there is no disk in drive A:")
+	}
+	a := disks[0]
+	if a.Format.BootTracks == 0 {
+		return nil, fmt.Errorf("%s has no system tracks (format %s)", a.Name, a.Format.Name)
+	}
+	tracks, err := a.ReadSystem()
+	if err != nil {
+		return nil, err
+	}
+	ccp, system, err := findCCP(tracks)
+	if err != nil {
+		return nil, err
+	}
+	return &cpmBIOS{console: console, list: ioutil.Discard, disks: disks, system: system, ccp: ccp}, nil
+}
+
+func (b *cpmBIOS) biosAddress() uint16 {
+	return b.ccp + cpmSystemSize
+}
+
+// install - Puts the system, the BIOS jump table and the disk tables into memory,
+// attaches the BIOS to the I/O ports and cold boots
+func (b *cpmBIOS) install(mc *microcontroller) error {
+	b.mc = mc
+	mc.io = b
+	memory := *mc.memory
+	bios := int(b.biosAddress())
+	for i := 0; i < biosFunctions; i++ {
+		memory[bios+3*i], memory[bios+3*i+1], memory[bios+3*i+2] = 0xD3, uint8(biosPort+i), 0xC9
+	}
+
+	// The directory buffer shared by all drives, then for each drive the disk
+	// parameter header, the disk parameter block, the directory check vector and
+	// the allocation vector
+	directoryBuffer := bios + 3*biosFunctions
+	next := directoryBuffer + 128
+	b.dph = make([]uint16, len(b.disks))
+	for drive, disk := range b.disks {
+		if disk == nil {
+			continue
+		}
+		dpb := disk.Format.DPB()
+		dph, dpbStart := next, next+16
+		csv := dpbStart + len(dpb)
+		alv := csv + disk.Format.DirectoryEntries/4
+		next = alv + disk.Format.Blocks()/8 + 1
+		if next > len(memory) {
+			return fmt.Errorf("not enough memory above %04X for the tables of drive %c:", bios, 'A'+drive)
+		}
+		header := []uint16{0, 0, 0, 0, uint16(directoryBuffer), uint16(dpbStart), uint16(csv), uint16(alv)}
+		for i, value := range header {
+			memory[dph+2*i], memory[dph+2*i+1] = uint8(value), uint8(value>>8)
+		}
+		copy(memory[dpbStart:], dpb)
+		b.dph[drive] = uint16(dph)
+	}
+	memory[3], memory[4] = 0, 0 // IOBYTE, current drive
+	b.boot(true)
+	return nil
+}
+
+// boot - Loads the CCP and BDOS, sets up page zero and starts the CCP. A cold
+// boot starts it with the command line that is stored in it (normally empty)
+func (b *cpmBIOS) boot(cold bool) {
+	memory := *b.mc.memory
+	copy(memory[b.ccp:], b.system)
+	wboot, bdos := b.biosAddress()+3, b.ccp+0x806
+	memory[0], memory[1], memory[2] = 0xC3, uint8(wboot), uint8(wboot>>8)
+	memory[5], memory[6], memory[7] = 0xC3, uint8(bdos), uint8(bdos>>8)
+	b.dma = 0x80
+	b.mc.rc = memory[4]
+	b.mc.stackPointer = 0x80
+	b.mc.programCounter = b.ccp + 3
+	if cold {
+		// The memory size the system was built for, as MOVCPM works it out
+		fmt.Fprintf(b.console.out, "\r\n%dK CP/M 2.2 with an emulated BIOS\r\n", (int(b.ccp)-0x3400)/1024+20)
+		b.mc.programCounter = b.ccp
+	}
+}
+
+// returnHL - Returns a 16 bit value in HL (and the low byte in A)
+func (b *cpmBIOS) returnHL(value uint16) {
+	b.mc.rh, b.mc.rl, b.mc.ra = uint8(value>>8), uint8(value), uint8(value)
+}
+
+func (b *cpmBIOS) input(port uint8) uint8 {
+	return 0xFF // Nothing is connected
+}
+
+// output - Carries out BIOS function port-biosPort with the parameters in C or BC
+func (b *cpmBIOS) output(port uint8, value uint8) {
+	mc := b.mc
+	bc := uint16(mc.rb)<<8 | uint16(mc.rc)
+	switch port - biosPort {
+	case 0: // BOOT
+		b.boot(true)
+	case 1: // WBOOT
+		b.boot(false)
+	case 2: // CONST
+		mc.ra = uint8(boolToInt(b.console.ready()) * 0xFF)
+	case 3: // CONIN
+		key, ok := b.console.read()
+		if !ok {
+			b.halted = true
+			key = 0x1A
+		}
+		mc.ra = key
+	case 4: // CONOUT
+		b.console.out.Write([]byte{mc.rc & 0x7F})
+	case 5: // LIST
+		b.list.Write([]byte{mc.rc})
+	case 6: // PUNCH
+		if b.aux != nil {
+			b.aux.writeWaiting(mc, mc.rc)
+		}
+	case 7: // READER
+		mc.ra = 0x1A
+		if b.aux != nil {
+			mc.ra = b.aux.readWaiting(mc, b.console.ended)
+		}
+	case 8: // HOME
+		b.track = 0
+	case 9: // SELDSK
+		if int(mc.rc) >= len(b.disks) || b.disks[mc.rc] == nil {
+			b.returnHL(0)
+			return
+		}
+		b.drive = int(mc.rc)
+		b.returnHL(b.dph[b.drive])
+	case 10: // SETTRK
+		b.track = int(bc)
+	case 11: // SETSEC
+		b.sector = int(bc)
+	case 12: // SETDMA
+		b.dma = bc
+	case 13: // READ
+		mc.ra = 0
+		record := make([]uint8, 128) // Copied into memory with wrap-around (see readMemory)
+		if err := b.disks[b.drive].ReadRecord(b.track, b.sector, record); err != nil {
+			debugPrintLn(err.Error())
+			mc.ra = 1
+		} else {
+			writeMemory(*mc.memory, b.dma, record)
+		}
+	case 14: // WRITE
+		mc.ra = 0
+		record := make([]uint8, 128)
+		readMemory(*mc.memory, b.dma, record)
+		if err := b.disks[b.drive].WriteRecord(b.track, b.sector, record); err != nil {
+			debugPrintLn(err.Error())
+			mc.ra = 1
+		}
+	case 15: // LISTST
+		mc.ra = 0xFF
+	case 16: // SECTRAN: the skew is applied by the disk image, so there is no translation
+		b.returnHL(bc)
+	default:
+		debugPrintLn(fmt.Sprintf("OUT %02X, %02X: nothing is connected", port, value))
+	}
+}
+
+// bootCPM - Implements -boot: boots CP/M from the disk images and runs it until
+// there is no more console input
+func bootCPM(specs []string) error {
+	disks := make([]*cpmfs.Image, len(specs))
+	for i, spec := range specs {
+		if spec == "" {
+			continue // An empty drive
+		}
+		disk, err := cpmfs.OpenImage(spec)
+		if err != nil {
+			return err
+		}
+		defer disk.Close()
+		disks[i] = disk
+	}
+	console, closeConsole, err := openConsole()
+	if err != nil {
+		return err
+	}
+	defer closeConsole()
+	bios, err := newCPMBIOS(disks, console)
+	if err != nil {
+		return err
+	}
+	lines, err := openSerialLines(cpmSerialDevices...)
+	if err != nil {
+		return err
+	}
+	defer closeSerialLines(lines)
+	bios.aux = lines["aux"]
+	memory := make([]uint8, 0x10000)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	if err := bios.install(mc); err != nil {
+		return err
+	}
+
+	startTrace(mc, TRACEFILE)
+	defer stopTrace()
+	startProfile(mc, PPROFFILE, disks[0].Name)
+	defer stopProfile()
+	startCoverage(mc, COVERAGEFILE, 0x100, 0xFFFF)
+	defer stopCoverage()
+	startDebugger(mc, DEBUGGER)
+	for !bios.halted && !mc.halted && !mc.stopped {
+		mc.run()
+	}
+	return console.err
+}
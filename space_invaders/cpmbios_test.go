@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Insood/8080/cpmfs"
+)
+
+// makeBootDisk - Makes an 8" disk with cpmfs whose system tracks hold a 64K
+// system (the CCP at E400, the BIOS at FA00). The "CCP" is code at the entry
+// of its command processor, which calls the BIOS directly
+func makeBootDisk(t *testing.T, ccp []uint8, files map[string][]uint8) string {
+	system := make([]uint8, cpmSystemSize)
+	copy(system, []uint8{0xC3, 0x5C, 0xE7, 0xC3, 0x58, 0xE7})
+	copy(system[0x358:], []uint8{0xC3, 0x5C, 0xE7})
+	copy(system[0x35C:], ccp)
+
+	path := filepath.Join(t.TempDir(), "boot.dsk")
+	image, err := cpmfs.CreateImage(path, cpmfs.Formats["ibm-3740"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	fs, _ := cpmfs.NewFileSystem(image)
+	if err := image.WriteSystem(append(make([]uint8, 128), system...)); err != nil { // After the boot sector
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := fs.WriteFile(0, name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// bootDisk - Boots the disk at path and runs it until it halts or there is no
+// more input
+func bootDisk(t *testing.T, path string, input string) (*cpmfs.Image, *microcontroller, string) {
+	disk, err := cpmfs.OpenImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	bios, err := newCPMBIOS([]*cpmfs.Image{disk}, newCPMConsole(strings.NewReader(input), output, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bios.ccp != 0xE400 {
+		t.Fatalf("Found the CCP at %04X", bios.ccp)
+	}
+	memory := make([]uint8, 0x10000)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	if err := bios.install(mc); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !bios.halted && !mc.halted && i < 100000; i++ {
+		mc.run()
+	}
+	return disk, mc, output.String()
+}
+
+// TestBootCPM : Boots an image made by cpmfs with a "CCP" which prints OK, the
+// first byte of the file on the disk (track 2 record 16, after the directory),
+// overwrites it, echoes a key and warm boots, which runs it again until there
+// is no more input
+func TestBootCPM(t *testing.T) {
+	ccp := []uint8{
+		0x31, 0x00, 0x01, // LXI SP,0100H
+		0x0E, 'O', 0xCD, 0x0C, 0xFA, // MVI C,'O'  CALL CONOUT
+		0x0E, 'K', 0xCD, 0x0C, 0xFA, // MVI C,'K'  CALL CONOUT
+		0x0E, 0x00, 0xCD, 0x1B, 0xFA, // MVI C,0    CALL SELDSK
+		0x22, 0x40, 0x00, // SHLD 0040H
+		0x01, 0x02, 0x00, 0xCD, 0x1E, 0xFA, // LXI B,2    CALL SETTRK
+		0x01, 0x10, 0x00, 0xCD, 0x21, 0xFA, // LXI B,16   CALL SETSEC
+		0x01, 0x00, 0x10, 0xCD, 0x24, 0xFA, // LXI B,1000H CALL SETDMA
+		0xCD, 0x27, 0xFA, 0x32, 0x42, 0x00, // CALL READ  STA 0042H
+		0x3A, 0x00, 0x10, 0x4F, 0xCD, 0x0C, 0xFA, // LDA 1000H  MOV C,A  CALL CONOUT
+		0x3E, 'W', 0x32, 0x00, 0x10, 0xCD, 0x2A, 0xFA, // MVI A,'W'  STA 1000H  CALL WRITE
+		0xCD, 0x09, 0xFA, 0x4F, 0xCD, 0x0C, 0xFA, // CALL CONIN MOV C,A  CALL CONOUT
+		0xC3, 0x00, 0x00, // JMP 0 (warm boot)
+	}
+	disk, mc, output := bootDisk(t, makeBootDisk(t, ccp, map[string][]uint8{"x.txt": []uint8("X")}), "y")
+	defer disk.Close()
+
+	if expected := "\r\n64K CP/M 2.2 with an emulated BIOS\r\nOKXyOKW"; output != expected {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+	memory := *mc.memory
+	dph := uint16(memory[0x40]) | uint16(memory[0x41])<<8
+	dpb := uint16(memory[dph+10]) | uint16(memory[dph+11])<<8
+	if memory[0x42] != 0 || !bytes.Equal(memory[dpb:dpb+15], cpmfs.Formats["ibm-3740"].DPB()) {
+		t.Errorf("READ returned %d and SELDSK gave the DPB % X", memory[0x42], memory[dpb:dpb+15])
+	}
+	if memory[0] != 0xC3 || memory[1] != 0x03 || memory[2] != 0xFA || memory[6] != 0x06 || memory[7] != 0xEC {
+		t.Errorf("Page zero doesn't jump to WBOOT and the BDOS: % X", memory[:8])
+	}
+	if fs, _ := cpmfs.NewFileSystem(disk); fs != nil {
+		if data, err := fs.ReadFile(0, "X.TXT"); err != nil || data[0] != 'W' || data[1] != 0x1A {
+			t.Errorf("The write through the BIOS isn't in X.TXT: %v %q", err, data)
+		}
+	}
+}
+
+// TestBootLoader : Boots an image made by cpmfs with a "CCP" which loads the
+// program in the first directory entry the way the CCP would: it reads the
+// directory from track 2, works out where the file's first block is, loads its
+// records (which run on to track 3) at 0100H and jumps to it. The program
+// prints a byte from its second and last records and halts
+func TestBootLoader(t *testing.T) {
+	// Variables in page zero: 40H the DPH, 42H the track, 44H the record on the
+	// track, 46H the DMA address, 48H the records left to load
+	ccp := []uint8{
+		0x31, 0x00, 0xE0, // LXI SP,0E000H
+		0x0E, 0x00, 0xCD, 0x1B, 0xFA, // MVI C,0  CALL SELDSK
+		0x22, 0x40, 0x00, // SHLD 0040H
+		0xAF, 0x32, 0x44, 0x00, // XRA A  STA 0044H  ; the record on the track
+		0x3E, 0x02, 0x32, 0x42, 0x00, // MVI A,2  STA 0042H  ; the track
+		0x21, 0x80, 0x00, 0x22, 0x46, 0x00, // LXI H,0080H  SHLD 0046H  ; the DMA address
+		0xCD, 0xC5, 0xE7, // CALL READREC
+		0x3A, 0x90, 0x00, 0x6F, 0x26, 0x00, // LDA 0090H  MOV L,A  MVI H,0
+		0x29, 0x29, 0x29, // DAD H  DAD H  DAD H
+		0x7C, 0xB7, 0xC2, 0x8D, 0xE7, // SKIP: MOV A,H  ORA A  JNZ SUB
+		0x7D, 0xFE, 0x1A, 0xDA, 0x9B, 0xE7, // MOV A,L  CPI 26  JC FOUND
+		0x11, 0xE6, 0xFF, 0x19, // SUB: LXI D,-26  DAD D
+		0x3A, 0x42, 0x00, 0x3C, 0x32, 0x42, 0x00, // LDA 0042H  INR A  STA 0042H
+		0xC3, 0x82, 0xE7, // JMP SKIP
+		0x7D, 0x32, 0x44, 0x00, // FOUND: MOV A,L  STA 0044H
+		0x21, 0x00, 0x01, 0x22, 0x46, 0x00, // LXI H,0100H  SHLD 0046H
+		0x3A, 0x8F, 0x00, 0x32, 0x48, 0x00, // LDA 008FH  STA 0048H  ; the record count
+		0xCD, 0xC5, 0xE7, // LOAD: CALL READREC
+		0x2A, 0x46, 0x00, 0x11, 0x80, 0x00, 0x19, 0x22, 0x46, 0x00, // LHLD 0046H  LXI D,128  DAD D  SHLD 0046H
+		0x3A, 0x48, 0x00, 0x3D, 0x32, 0x48, 0x00, 0xC2, 0xAB, 0xE7, // LDA 0048H  DCR A  STA 0048H  JNZ LOAD
+		0xC3, 0x00, 0x01, // JMP 0100H
+		0x3A, 0x42, 0x00, 0x4F, 0x06, 0x00, 0xCD, 0x1E, 0xFA, // READREC: LDA 0042H  MOV C,A  MVI B,0  CALL SETTRK
+		0x2A, 0x40, 0x00, 0x5E, 0x23, 0x56, // LHLD 0040H  MOV E,M  INX H  MOV D,M  ; the XLT
+		0x3A, 0x44, 0x00, 0x4F, 0x06, 0x00, 0xCD, 0x30, 0xFA, // LDA 0044H  MOV C,A  MVI B,0  CALL SECTRAN
+		0x44, 0x4D, 0xCD, 0x21, 0xFA, // MOV B,H  MOV C,L  CALL SETSEC
+		0x2A, 0x46, 0x00, 0x44, 0x4D, 0xCD, 0x24, 0xFA, // LHLD 0046H  MOV B,H  MOV C,L  CALL SETDMA
+		0xCD, 0x27, 0xFA, 0xB7, 0xCA, 0xF2, 0xE7, 0x76, // CALL READ  ORA A  JZ NEXT  HLT
+		0x3A, 0x44, 0x00, 0x3C, 0xFE, 0x1A, 0xDA, 0x03, 0xE8, // NEXT: LDA 0044H  INR A  CPI 26  JC SAVE
+		0x3A, 0x42, 0x00, 0x3C, 0x32, 0x42, 0x00, 0xAF, // LDA 0042H  INR A  STA 0042H  XRA A
+		0x32, 0x44, 0x00, 0xC9, // SAVE: STA 0044H  RET
+	}
+	hello := make([]uint8, 12*128)
+	copy(hello, []uint8{
+		0x3A, 0x80, 0x01, 0x4F, 0xCD, 0x0C, 0xFA, // LDA 0180H  MOV C,A  CALL CONOUT
+		0x3A, 0x80, 0x06, 0x4F, 0xCD, 0x0C, 0xFA, // LDA 0680H  MOV C,A  CALL CONOUT
+		0x76, // HLT
+	})
+	hello[128], hello[11*128] = 'H', 'I'
+	disk, mc, output := bootDisk(t, makeBootDisk(t, ccp, map[string][]uint8{"hello.com": hello}), "")
+	defer disk.Close()
+
+	if expected := "\r\n64K CP/M 2.2 with an emulated BIOS\r\nHI"; output != expected || !mc.halted || mc.programCounter != 0x010F {
+		t.Errorf("Expected %q, got %q with PC at %04X", expected, output, mc.programCounter)
+	}
+}
+
+// TestBIOSHighDMA : READ and WRITE with the DMA buffer at FFC0, which wraps
+// around to 0
+func TestBIOSHighDMA(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dma.dsk")
+	disk, err := cpmfs.CreateImage(path, cpmfs.Formats["ibm-3740"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	record := bytes.Repeat([]uint8("0123456789ABCDEF"), 8)
+	disk.WriteRecord(2, 1, record)
+
+	memory := make([]uint8, 0x10000)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	bios := &cpmBIOS{mc: mc, disks: []*cpmfs.Image{disk}}
+	call := func(function uint8, bc uint16) uint8 {
+		mc.rb, mc.rc = uint8(bc>>8), uint8(bc)
+		bios.output(biosPort+function, 0)
+		return mc.ra
+	}
+	call(10, 2)
+	call(11, 1)
+	call(12, 0xFFC0)
+	if code := call(13, 0); code != 0 || !bytes.Equal(append(memory[0xFFC0:], memory[:0x40]...), record) {
+		t.Errorf("READ at FFC0 returned %d: %q", code, append(memory[0xFFC0:], memory[:0x40]...))
+	}
+
+	memory[0xFFC0], memory[0x3F] = 'W', 'Z'
+	call(11, 2)
+	if code := call(14, 0); code != 0 {
+		t.Errorf("WRITE at FFC0 returned %d", code)
+	}
+	written := make([]uint8, 128)
+	disk.ReadRecord(2, 2, written)
+	if written[0] != 'W' || written[127] != 'Z' || written[64] != '0' {
+		t.Errorf("WRITE from FFC0 wrote %q", written)
+	}
+}
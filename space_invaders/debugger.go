@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// debugger - A minimal command line debugger for the emulated program. It is
+// an instructionHook which stops before an instruction is executed when a
+// breakpoint is hit or while stepping, and then reads commands until told to
+// carry on. The call stack for backtraces is kept by a profiler.
+type debugger struct {
+	in          *bufio.Scanner
+	out         io.Writer
+	breakpoints map[uint16]bool
+	steps       int // Number of instructions to run before stopping again (0 = don't stop)
+	calls       *profiler
+}
+
+func newDebugger(in io.Reader, out io.Writer) *debugger {
+	return &debugger{in: bufio.NewScanner(in), out: out, breakpoints: map[uint16]bool{},
+		steps: 1, calls: newProfiler()}
+}
+
+const debuggerHelp = `Commands:
+  b <addr|name>    Set a breakpoint
+  d <addr|name>    Delete a breakpoint
+  l                List the breakpoints
+  s [n]            Execute n instructions (default 1)
+  c                Continue until a breakpoint is hit
+  r                Show the registers
+  bt               Show the call stack
+  x <addr> [n]     Show n bytes of memory (default 64)
+  u [addr] [n]     Disassemble n instructions (default 10) from addr (default PC)
+  q                Quit
+`
+
+func (d *debugger) beforeInstruction(mc *microcontroller) {
+	d.calls.beforeInstruction(mc)
+	if mc.stopped {
+		return
+	}
+	if d.breakpoints[mc.programCounter] && mc.interruptBus == nil {
+		fmt.Fprintf(d.out, "Breakpoint at %s\n", SYMBOLS.describe(mc.programCounter))
+		d.steps = 1
+	}
+	if d.steps == 0 {
+		return
+	}
+	d.steps--
+	if d.steps == 0 {
+		d.prompt(mc)
+	}
+}
+
+func (d *debugger) afterInstruction(mc *microcontroller) {
+	d.calls.afterInstruction(mc)
+}
+
+// showInstruction - The next instruction, the registers and the source line if there is one
+func (d *debugger) showInstruction(mc *microcontroller) {
+	instruction := disassemble(*mc.memory, mc.programCounter).String()
+	if mc.interruptBus != nil {
+		instruction = "INT " + disassemble([]uint8{mc.fetch(0), mc.fetch(1), mc.fetch(2)}, 0).String()
+	}
+	fmt.Fprintf(d.out, "%-16s %04X: %-16s ", SYMBOLS.describe(mc.programCounter), mc.programCounter, instruction)
+	d.showRegisters(mc)
+	if source, ok := SOURCES.lookup(mc.programCounter); ok {
+		fmt.Fprintf(d.out, "    %s\n", source)
+	}
+}
+
+func (d *debugger) showRegisters(mc *microcontroller) {
+	fmt.Fprintf(d.out, "A=%02X BC=%02X%02X DE=%02X%02X HL=%02X%02X SP=%04X SZ-X-P-C=%08b\n",
+		mc.ra, mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl, mc.stackPointer, pswByte(mc))
+}
+
+// backtrace - The current instruction followed by the calls which led to it
+func (d *debugger) backtrace(mc *microcontroller) {
+	fmt.Fprintf(d.out, "#0  %04X in %s\n", mc.programCounter, SYMBOLS.describe(mc.programCounter))
+	for i := len(d.calls.stack) - 1; i > 0; i-- {
+		node := d.calls.stack[i].node
+		fmt.Fprintf(d.out, "#%-2d %04X in %s\n", len(d.calls.stack)-i, node.callSite, SYMBOLS.describe(node.callSite))
+	}
+}
+
+func (d *debugger) address(text string) (uint16, bool) {
+	address, err := SYMBOLS.resolve(text)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return 0, false
+	}
+	return address, true
+}
+
+// count - An optional numeric argument
+func count(args []string, index int, otherwise int) int {
+	if len(args) > index {
+		if n, err := strconv.Atoi(args[index]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return otherwise
+}
+
+// prompt - Reads and runs commands until one of them resumes execution
+func (d *debugger) prompt(mc *microcontroller) {
+	d.showInstruction(mc)
+	for {
+		fmt.Fprint(d.out, "(dbg) ")
+		if !d.in.Scan() { // No more commands, so let the program run to the end
+			fmt.Fprintln(d.out)
+			d.steps = 0
+			d.breakpoints = map[uint16]bool{}
+			return
+		}
+		args := strings.Fields(d.in.Text())
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "b", "break":
+			if len(args) > 1 {
+				if address, ok := d.address(args[1]); ok {
+					d.breakpoints[address] = true
+					fmt.Fprintf(d.out, "Breakpoint set at %04X (%s)\n", address, SYMBOLS.describe(address))
+				}
+			}
+		case "d", "delete":
+			if len(args) > 1 {
+				if address, ok := d.address(args[1]); ok {
+					delete(d.breakpoints, address)
+				}
+			}
+		case "l":
+			addresses := []int{}
+			for address := range d.breakpoints {
+				addresses = append(addresses, int(address))
+			}
+			sort.Ints(addresses)
+			for _, address := range addresses {
+				fmt.Fprintf(d.out, "  %04X %s\n", address, SYMBOLS.describe(uint16(address)))
+			}
+		case "s", "step":
+			d.steps = count(args, 1, 1)
+			return
+		case "c", "continue":
+			d.steps = 0
+			return
+		case "r", "regs":
+			d.showRegisters(mc)
+		case "bt", "backtrace":
+			d.backtrace(mc)
+		case "x":
+			if len(args) > 1 {
+				if address, ok := d.address(args[1]); ok {
+					n := count(args, 2, 64)
+					for i := 0; i < n; i++ {
+						if i%16 == 0 {
+							fmt.Fprintf(d.out, "%04X:", address+uint16(i))
+						}
+						fmt.Fprintf(d.out, " %02X", (*mc.memory)[address+uint16(i)])
+						if i%16 == 15 || i == n-1 {
+							fmt.Fprintln(d.out)
+						}
+					}
+				}
+			}
+		case "u":
+			address := mc.programCounter
+			if len(args) > 1 {
+				var ok bool
+				if address, ok = d.address(args[1]); !ok {
+					continue
+				}
+			}
+			for i := count(args, 2, 10); i > 0; i-- {
+				if label, ok := SYMBOLS.lookup(address); ok {
+					fmt.Fprintf(d.out, "%s:\n", label)
+				}
+				instruction := disassemble(*mc.memory, address)
+				text := instruction.String()
+				if source, ok := SOURCES.lookup(address); ok {
+					text = fmt.Sprintf("%-16s ; %s", text, source)
+				}
+				fmt.Fprintf(d.out, "  %04X: %s\n", address, text)
+				address += uint16(instruction.length)
+			}
+		case "q", "quit":
+			// The machine's run loop ends, so the trace, profile and terminal are cleaned up
+			mc.stopped, d.steps = true, 0
+			return
+		default:
+			fmt.Fprint(d.out, debuggerHelp)
+		}
+	}
+}
+
+// startDebugger - Attaches the debugger to the microcontroller if -debug was given
+func startDebugger(mc *microcontroller, enabled bool) {
+	if enabled {
+		mc.addHook(newDebugger(os.Stdin, os.Stdout))
+	}
+}
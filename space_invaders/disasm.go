@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// operand - A single operand of a disassembled instruction. It is either a
+// register (or register pair) name or a number taken from the immediate data
+type operand struct {
+	register string // Empty if the operand is a number
+	value    uint16
+	width    int  // Size of the number in bytes (1 or 2)
+	address  bool // The number is a memory address (ie: a jump target)
+}
+
+// disassembly - A decoded instruction
+type disassembly struct {
+	pc       uint16
+	mnemonic string
+	operands []operand
+	length   uint8
+}
+
+var registerNames = []string{"B", "C", "D", "E", "H", "L", "M", "A"}
+var pairNames = []string{"B", "D", "H", "SP"}
+var pushPairNames = []string{"B", "D", "H", "PSW"}
+var aluNames = []string{"ADD", "ADC", "SUB", "SBB", "ANA", "XRA", "ORA", "CMP"}
+var aluImmediateNames = []string{"ADI", "ACI", "SUI", "SBI", "ANI", "XRI", "ORI", "CPI"}
+var conditionNames = []string{"NZ", "Z", "NC", "C", "PO", "PE", "P", "M"}
+
+// disassemble - Decodes the instruction at pc
+func disassemble(memory []uint8, pc uint16) disassembly {
+	opcode := memory[pc]
+	d := disassembly{pc: pc, length: lengthTable[opcode]}
+	data8 := operand{value: uint16(memory[pc+1]), width: 1}
+	data16 := operand{value: uint16(memory[pc+1]) | uint16(memory[pc+2])<<8, width: 2}
+	address := data16
+	address.address = true
+	dst := (opcode >> 3) & 0x7
+	src := opcode & 0x7
+	pair := (opcode >> 4) & 0x3
+	reg := func(name string) operand { return operand{register: name} }
+
+	switch {
+	case opcode == 0x76:
+		d.mnemonic = "HLT"
+	case opcode>>6 == 1:
+		d.mnemonic = "MOV"
+		d.operands = []operand{reg(registerNames[dst]), reg(registerNames[src])}
+	case opcode>>6 == 2:
+		d.mnemonic = aluNames[dst]
+		d.operands = []operand{reg(registerNames[src])}
+	case opcode&0xC7 == 0xC6:
+		d.mnemonic = aluImmediateNames[dst]
+		d.operands = []operand{data8}
+	case opcode&0xC7 == 0x00:
+		d.mnemonic = "NOP"
+	case opcode&0xCF == 0x01:
+		d.mnemonic = "LXI"
+		d.operands = []operand{reg(pairNames[pair]), data16}
+	case opcode&0xCF == 0x09:
+		d.mnemonic = "DAD"
+		d.operands = []operand{reg(pairNames[pair])}
+	case opcode&0xCF == 0x03:
+		d.mnemonic = "INX"
+		d.operands = []operand{reg(pairNames[pair])}
+	case opcode&0xCF == 0x0B:
+		d.mnemonic = "DCX"
+		d.operands = []operand{reg(pairNames[pair])}
+	case opcode&0xC7 == 0x04:
+		d.mnemonic = "INR"
+		d.operands = []operand{reg(registerNames[dst])}
+	case opcode&0xC7 == 0x05:
+		d.mnemonic = "DCR"
+		d.operands = []operand{reg(registerNames[dst])}
+	case opcode&0xC7 == 0x06:
+		d.mnemonic = "MVI"
+		d.operands = []operand{reg(registerNames[dst]), data8}
+	case opcode == 0x02 || opcode == 0x12:
+		d.mnemonic = "STAX"
+		d.operands = []operand{reg(pairNames[pair])}
+	case opcode == 0x0A || opcode == 0x1A:
+		d.mnemonic = "LDAX"
+		d.operands = []operand{reg(pairNames[pair])}
+	case opcode == 0x22:
+		d.mnemonic = "SHLD"
+		d.operands = []operand{address}
+	case opcode == 0x2A:
+		d.mnemonic = "LHLD"
+		d.operands = []operand{address}
+	case opcode == 0x32:
+		d.mnemonic = "STA"
+		d.operands = []operand{address}
+	case opcode == 0x3A:
+		d.mnemonic = "LDA"
+		d.operands = []operand{address}
+	case opcode&0xC7 == 0x07: // The rotates and the other single byte ops in column 7/F
+		d.mnemonic = []string{"RLC", "RRC", "RAL", "RAR", "DAA", "CMA", "STC", "CMC"}[dst]
+	case opcode&0xCF == 0xC1:
+		d.mnemonic = "POP"
+		d.operands = []operand{reg(pushPairNames[pair])}
+	case opcode&0xCF == 0xC5:
+		d.mnemonic = "PUSH"
+		d.operands = []operand{reg(pushPairNames[pair])}
+	case opcode == 0xC3 || opcode == 0xCB:
+		d.mnemonic = "JMP"
+		d.operands = []operand{address}
+	case opcode&0xC7 == 0xC2:
+		d.mnemonic = "J" + conditionNames[dst]
+		d.operands = []operand{address}
+	case opcode == 0xCD || opcode == 0xDD || opcode == 0xED || opcode == 0xFD:
+		d.mnemonic = "CALL"
+		d.operands = []operand{address}
+	case opcode&0xC7 == 0xC4:
+		d.mnemonic = "C" + conditionNames[dst]
+		d.operands = []operand{address}
+	case opcode == 0xC9 || opcode == 0xD9:
+		d.mnemonic = "RET"
+	case opcode&0xC7 == 0xC0:
+		d.mnemonic = "R" + conditionNames[dst]
+	case opcode&0xC7 == 0xC7:
+		d.mnemonic = "RST"
+		d.operands = []operand{{value: uint16(dst), width: 0}}
+	case opcode == 0xD3:
+		d.mnemonic = "OUT"
+		d.operands = []operand{data8}
+	case opcode == 0xDB:
+		d.mnemonic = "IN"
+		d.operands = []operand{data8}
+	default:
+		d.mnemonic = map[uint8]string{0xE3: "XTHL", 0xE9: "PCHL", 0xEB: "XCHG", 0xF3: "DI", 0xF9: "SPHL", 0xFB: "EI"}[opcode]
+	}
+	return d
+}
+
+// target - Returns the memory address used by the instruction, if it has one
+func (d disassembly) target() (uint16, bool) {
+	for _, o := range d.operands {
+		if o.address {
+			return o.value, true
+		}
+	}
+	return 0, false
+}
+
+// intelNumber - Formats a number the way the Intel assembler expects: in hex
+// with an H suffix and a leading 0 if it would otherwise start with a letter
+func intelNumber(o operand) string {
+	if o.width == 0 {
+		return fmt.Sprintf("%d", o.value)
+	}
+	text := fmt.Sprintf("%0*XH", 2*o.width, o.value)
+	if text[0] >= 'A' {
+		text = "0" + text
+	}
+	return text
+}
+
+// operandStrings - The operands formatted in Intel syntax, with
+// addresses replaced by their names when there is a symbol for them
+func (d disassembly) operandStrings() []string {
+	operands := make([]string, len(d.operands))
+	for i, o := range d.operands {
+		name, named := SYMBOLS.lookup(o.value)
+		if o.register != "" {
+			operands[i] = o.register
+		} else if o.address && named {
+			operands[i] = name
+		} else {
+			operands[i] = intelNumber(o)
+		}
+	}
+	return operands
+}
+
+// String - The instruction in Intel syntax, ie: MVI A,01H
+func (d disassembly) String() string {
+	if len(d.operands) == 0 {
+		return d.mnemonic
+	}
+	return fmt.Sprintf("%-4s %s", d.mnemonic, strings.Join(d.operandStrings(), ","))
+}
+
+// mameString - The instruction the way MAME's i8085 disassembler shows it, ie: mvi  a,$01
+func (d disassembly) mameString() string {
+	operands := make([]string, len(d.operands))
+	for i, o := range d.operands {
+		switch {
+		case o.register != "":
+			operands[i] = strings.ToLower(o.register)
+		case o.width == 0:
+			operands[i] = fmt.Sprintf("%d", o.value)
+		default:
+			operands[i] = fmt.Sprintf("$%0*x", 2*o.width, o.value)
+		}
+	}
+	if len(operands) == 0 {
+		return strings.ToLower(d.mnemonic)
+	}
+	return fmt.Sprintf("%-4s %s", strings.ToLower(d.mnemonic), strings.Join(operands, ","))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestDisassemble : Instructions are shown in Intel and MAME syntax
+func TestDisassemble(t *testing.T) {
+	tests := []struct {
+		bytes []uint8
+		intel string
+		mame  string
+	}{
+		{[]uint8{0x00}, "NOP", "nop"},
+		{[]uint8{0x3E, 0x01}, "MVI  A,01H", "mvi  a,$01"},
+		{[]uint8{0x31, 0x00, 0x02}, "LXI  SP,0200H", "lxi  sp,$0200"},
+		{[]uint8{0xC3, 0xAB, 0xC5}, "JMP  0C5ABH", "jmp  $c5ab"},
+		{[]uint8{0x7E}, "MOV  A,M", "mov  a,m"},
+		{[]uint8{0xF5}, "PUSH PSW", "push psw"},
+		{[]uint8{0xDC, 0x00, 0x10}, "CC   1000H", "cc   $1000"},
+		{[]uint8{0xFF}, "RST  7", "rst  7"},
+		{[]uint8{0xFE, 0xFF}, "CPI  0FFH", "cpi  $ff"},
+	}
+	for _, test := range tests {
+		memory := make([]uint8, 65536)
+		copy(memory, test.bytes)
+		d := disassemble(memory, 0)
+		if d.String() != test.intel || d.mameString() != test.mame || int(d.length) != len(test.bytes) {
+			t.Errorf("% X: expected %s / %s, got %s / %s (length %d)",
+				test.bytes, test.intel, test.mame, d.String(), d.mameString(), d.length)
+		}
+	}
+}
+
+// TestTraceFormats : The MAME and i8080-core formats can be read back by tracediff
+func TestTraceFormats(t *testing.T) {
+	memory := make([]uint8, 65536)
+	copy(memory[0x100:], []uint8{0x3E, 0x01})
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	mc.programCounter = 0x100
+	mc.ra, mc.rh, mc.stackPointer = 0x12, 0x34, 0x2000
+
+	parsers := map[string]func(string, *traceStep) bool{"mame": parseMAMELine, "i8080core": parseI8080CoreLine}
+	for name, parse := range parsers {
+		line := traceFormats[name].format(mc, "MVI", 1)
+		step := traceStep{}
+		if !parse(strings.TrimSpace(line), &step) || step.pc != 0x100 ||
+			step.registers[stepA] != 0x12 || step.registers[stepH] != 0x34 || step.registers[stepSP] != 0x2000 {
+			t.Errorf("%s: could not read back '%s': %+v", name, line, step)
+		}
+	}
+	if line := traceFormats["jsonl"].format(mc, "MVI", 1); !strings.Contains(line, `"mnemonic":"MVI","operands":["A","01H"]`) {
+		t.Errorf("Unexpected JSON line: %s", line)
+	}
+}
+
+// TestJSONLinesEscaping : Symbols with quotes and backslashes in them still
+// make valid JSON, in the symbol, the operands and the text
+func TestJSONLinesEscaping(t *testing.T) {
+	SYMBOLS = newSymbolTable()
+	defer func() { SYMBOLS = newSymbolTable() }()
+	SYMBOLS.add(0x0100, `A"B\C`)
+	memory := make([]uint8, 65536)
+	copy(memory[0x100:], []uint8{0xC3, 0x00, 0x01}) // JMP 0100H
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	mc.programCounter = 0x100
+
+	line := traceFormats["jsonl"].format(mc, "JMP", 2)
+	record := struct {
+		Symbol   string
+		Operands []string
+		Text     string
+	}{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("Invalid JSON line %s: %v", line, err)
+	}
+	if record.Symbol != `A"B\C` || len(record.Operands) != 1 || record.Operands[0] != `A"B\C` ||
+		!strings.Contains(record.Text, `A"B\C`) {
+		t.Errorf("Unexpected JSON line: %s", line)
+	}
+}
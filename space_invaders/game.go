@@ -49,6 +49,8 @@ type Game struct {
 
 	soundBitMap1 map[uint8]string
 	soundBitMap2 map[uint8]string
+
+	rst uint8 // The RST which the video hardware puts on the bus, 0 when it isn't interrupting
 }
 
 func loadWavSound(context *audio.Context, fileName string) *audio.Player {
@@ -256,12 +258,19 @@ func (g *Game) out() {
 }
 
 func (g *Game) tick() {
+	if g.mc.stopped {
+		return
+	}
 	instruction := (*g.mc.memory)[g.mc.programCounter]
 	switch {
 	case instruction == 0xD3:
+		g.mc.beginInstruction()
 		g.out()
+		g.mc.endInstruction()
 	case instruction == 0xDB:
+		g.mc.beginInstruction()
 		g.in()
+		g.mc.endInstruction()
 	default:
 		g.mc.run()
 	}
@@ -301,28 +310,30 @@ func (g *Game) render(display *image.RGBA, top bool) error {
 	return nil
 }
 
+// scanLine - Raises the interrupt which the video hardware gives at scanline
+// 96 (RST 1) and 224 (RST 2). The CPU takes it through mc.interrupts once
+// interrupts are enabled, like the other machines' interrupts
 func (g *Game) scanLine(scanline int) {
-	if !g.mc.inte { // Interrupts are disabled
-		return
-	}
-
-	// First save the current program counter on the stack
-	g.mc.stackPointer -= 2
-	(*g.mc.memory)[g.mc.stackPointer] = uint8(g.mc.programCounter & 0xFF)
-	(*g.mc.memory)[g.mc.stackPointer+1] = uint8(g.mc.programCounter >> 8)
-
-	// Then set the program counter to the RST instruction
-
 	switch scanline {
 	case 96:
-		g.mc.programCounter = 0x8
+		g.rst = 0xCF
 	case 224:
-		g.mc.programCounter = 0x10
+		g.rst = 0xD7
 	default:
 		panic("Unhandled scanline() call. 96 and 224 are the only valid values")
 	}
 }
 
+func (g *Game) interruptRequested() bool {
+	return g.rst != 0
+}
+
+func (g *Game) acknowledgeInterrupt() []uint8 {
+	rst := g.rst
+	g.rst = 0
+	return []uint8{rst}
+}
+
 // keyUp() provides functionality for detecting a keyup event
 // based on the previous & current state of a specific key
 // This function will also update the previous state
@@ -406,6 +417,9 @@ func (g *Game) run() {
 			return err
 		}
 
+		if g.mc.stopped {
+			return errors.New("Exiting because the debugger was told to quit")
+		}
 		return checkKeyboard(g)
 	}
 
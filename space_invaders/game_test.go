@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestScanLineInterrupt : The video hardware's RST 1 and RST 2 are taken by the
+// CPU like any other interrupt: traced as an instruction of their own, with
+// interrupts disabled, and held until interrupts are enabled again
+func TestScanLineInterrupt(t *testing.T) {
+	memory := make([]uint8, 0x10000)
+	copy(memory, []uint8{
+		0x31, 0x00, 0x20, // LXI SP,2000H
+		0xFB, // EI
+		0x00, // NOP
+		0x00, // NOP
+	})
+	copy(memory[0x08:], []uint8{
+		0x00, // NOP
+		0xFB, // EI
+		0x00, // NOP
+		0x00, // NOP
+	})
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	g := &Game{mc: mc}
+	mc.interrupts = g
+	fileName := filepath.Join(t.TempDir(), "scanline.trc")
+	recorder, err := newTraceRecorder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.addHook(recorder)
+
+	for i := 0; i < 3; i++ {
+		g.tick()
+	}
+	g.scanLine(96)
+	g.tick()
+	if mc.programCounter != 0x0008 || mc.inte || memory[0x1FFE] != 0x05 {
+		t.Fatalf("Expected RST 1 to be taken with interrupts disabled, at %04X", mc.programCounter)
+	}
+	g.tick() // NOP
+	g.scanLine(224)
+	g.tick() // EI
+	g.tick() // NOP
+	if mc.programCounter != 0x000B {
+		t.Fatalf("RST 2 was taken before interrupts were enabled, at %04X", mc.programCounter)
+	}
+	g.tick()
+	if mc.programCounter != 0x0010 || memory[0x1FFC] != 0x0B {
+		t.Errorf("Expected RST 2 to be taken once interrupts were enabled, at %04X", mc.programCounter)
+	}
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := openTrace(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.close()
+	var record traceRecord
+	reader.seek(3)
+	reader.next(&record)
+	if !record.interrupt || record.pc != 0x0005 || record.bytes[0] != 0xCF {
+		t.Errorf("Unexpected record for RST 1: %+v", record)
+	}
+	reader.seek(7)
+	reader.next(&record)
+	if !record.interrupt || record.pc != 0x000B || record.bytes[0] != 0xD7 {
+		t.Errorf("Unexpected record for RST 2: %+v", record)
+	}
+}
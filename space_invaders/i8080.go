@@ -16,11 +16,53 @@ type microcontroller struct {
 	carry                      bool
 	auxCarry                   bool
 	inte                       bool // Whether or not interrupts are enabled
+	interruptDelay             bool // EI was just executed: interrupts are accepted after the next instruction
+	halted                     bool // HLT was executed. Nothing more is executed until the CPU is reset
 
 	// The following are not part of the microcontroller spec, but are here to help
 	// with the emulation
 	instructionsExecuted int64
+	cycles               int64 // Total number of clock cycles executed so far
 	success              bool
+	stopped              bool // The debugger was told to quit. Nothing more is executed and the run loop ends
+
+	// State of the instruction currently being executed. This is
+	// filled in by beginInstruction() for the benefit of the hooks
+	lastPC          uint16
+	lastOpcode      uint8
+	lastSP          uint16
+	lastCycles      uint8
+	lastBranchTaken bool
+	interruptBus    []uint8 // The instruction came from an interrupt source on the data bus, not memory (see interrupt())
+
+	hooks      []instructionHook
+	io         ioBus           // Devices on the I/O ports. When nil, IN and OUT are left to the caller (see Game.tick())
+	interrupts interruptSource // What drives the INT line, if anything
+}
+
+// ioBus - The devices which the IN and OUT instructions talk to. The program
+// counter already points to the next instruction when these are called, so a
+// device may change it (ie: to trap a call into an emulated BIOS)
+type ioBus interface {
+	input(port uint8) uint8
+	output(port uint8, value uint8)
+}
+
+// interruptSource - Something which drives the CPU's INT line (ie: an 8259).
+// When the line is raised and interrupts are enabled, the CPU acknowledges the
+// interrupt and executes the instruction the source puts on the data bus:
+// an RST, or the CALL of an 8259
+type interruptSource interface {
+	interruptRequested() bool
+	acknowledgeInterrupt() []uint8
+}
+
+// instructionHook - Something which wants to be told about every instruction
+// that is executed (ie: tracing). beforeInstruction() is called before any
+// state has been changed and afterInstruction() once the instruction is done
+type instructionHook interface {
+	beforeInstruction(mc *microcontroller)
+	afterInstruction(mc *microcontroller)
 }
 
 func pswByte(mc *microcontroller) uint8 {
@@ -45,6 +87,15 @@ func pswByte(mc *microcontroller) uint8 {
 	return data
 }
 
+// setPSWByte - Sets the flags from a byte laid out the way pswByte() returns them
+func setPSWByte(mc *microcontroller, data uint8) {
+	mc.sign = ((data >> 7) & 0x1) == 0x1
+	mc.zero = ((data >> 6) & 0x1) == 0x1
+	mc.auxCarry = ((data >> 4) & 0x1) == 0x1
+	mc.parity = ((data >> 2) & 0x1) == 0x1
+	mc.carry = (data & 0x1) == 0x1 // LSB
+}
+
 func newMicrocontroller() *microcontroller {
 	mc := new(microcontroller)
 	// the 7th element is nil because some instructions have a memory reference
@@ -53,11 +104,58 @@ func newMicrocontroller() *microcontroller {
 	return mc
 }
 
+func (mc *microcontroller) addHook(hook instructionHook) {
+	mc.hooks = append(mc.hooks, hook)
+}
+
+// beginInstruction - Remembers the state of the processor before an instruction
+// is executed and notifies all hooks. Must be paired with endInstruction()
+func (mc *microcontroller) beginInstruction() {
+	mc.lastPC = mc.programCounter
+	mc.lastOpcode = mc.fetch(0)
+	mc.lastSP = mc.stackPointer
+	for _, hook := range mc.hooks {
+		hook.beforeInstruction(mc)
+	}
+}
+
+// endInstruction - Counts the cycles used by the instruction that was just
+// executed and notifies all hooks
+func (mc *microcontroller) endInstruction() {
+	mc.lastCycles = cycleTable[mc.lastOpcode]
+	mc.lastBranchTaken = false
+	if isConditionalCall(mc.lastOpcode) || isConditionalReturn(mc.lastOpcode) {
+		// A conditional CALL or RET only touches the stack when it is taken
+		if mc.stackPointer != mc.lastSP {
+			mc.lastBranchTaken = true
+			mc.lastCycles += 6
+		}
+	}
+	mc.cycles += int64(mc.lastCycles)
+	mc.instructionsExecuted++
+	for _, hook := range mc.hooks {
+		hook.afterInstruction(mc)
+	}
+}
+
+// fetch - Byte i of the instruction being executed: from memory at the program
+// counter, or from the data bus while an interrupt is acknowledged. A byte the
+// interrupt source doesn't give reads as FF, which is what a floating bus gives
+func (mc *microcontroller) fetch(i uint16) uint8 {
+	if mc.interruptBus == nil {
+		return (*mc.memory)[mc.programCounter+i]
+	}
+	if int(i) < len(mc.interruptBus) {
+		return mc.interruptBus[i]
+	}
+	return 0xFF
+}
+
 func (mc *microcontroller) data16bit() uint16 {
 	// This functions creates a 16-bit value from the low & high bits
 	// of the currently active instruction. This is used in many places
 	// <instruction> <low bits> <high bits> -> returns (high << 8) | low
-	return uint16((*mc.memory)[mc.programCounter+1]) | uint16((*mc.memory)[mc.programCounter+2])<<8
+	return uint16(mc.fetch(1)) | uint16(mc.fetch(2))<<8
 }
 
 func (mc *microcontroller) memoryReference() uint16 {
@@ -77,7 +175,7 @@ func (mc *microcontroller) aci() {
 	if mc.carry {
 		carry = 1
 	}
-	mc.ra = Add(mc.ra, data+carry, mc, 0)
+	mc.ra = Add(mc.ra, data, mc, carry)
 	mc.programCounter += 2
 }
 
@@ -532,8 +630,10 @@ func (mc *microcontroller) dcr() {
 
 func (mc *microcontroller) ei() {
 	debugPrint(mc, "EI", 0)
-	// Enable Interrupt
+	// Enable Interrupt. An interrupt isn't accepted until after the next
+	// instruction, so that EI RET returns before another one comes in
 	mc.inte = true
+	mc.interruptDelay = true
 	mc.programCounter++
 }
 
@@ -554,8 +654,26 @@ func (mc *microcontroller) inr() {
 }
 
 func (mc *microcontroller) halt() {
-	fmt.Printf("halt() is not yet implemented. Caled from %x\n", mc.programCounter)
-	panic("Not yet implemented")
+	// Stop until the CPU is reset. The program counter is left at the next instruction
+	debugPrint(mc, "HLT", 0)
+	mc.halted = true
+	mc.programCounter++
+}
+
+func (mc *microcontroller) in() {
+	// Read a byte from the I/O port given in the immediate data into A
+	debugPrint(mc, "IN", 1)
+	port := (*mc.memory)[mc.programCounter+1]
+	mc.programCounter += 2
+	mc.ra = mc.io.input(port)
+}
+
+func (mc *microcontroller) out() {
+	// Write A to the I/O port given in the immediate data
+	debugPrint(mc, "OUT", 1)
+	port := (*mc.memory)[mc.programCounter+1]
+	mc.programCounter += 2
+	mc.io.output(port, mc.ra)
 }
 
 func (mc *microcontroller) inx() {
@@ -712,11 +830,7 @@ func (mc *microcontroller) pop() {
 		mc.rl = low
 	case 3: // flags & A (POP PSW)
 		debugPrint(mc, "POP PSW", 0)
-		mc.sign = ((low >> 7) & 0x1) == 0x1
-		mc.zero = ((low >> 6) & 0x1) == 0x1
-		mc.auxCarry = ((low >> 4) & 0x1) == 0x1
-		mc.carry = (low & 0x1) == 0x1 // LSB
-		mc.parity = ((low >> 2) & 0x1) == 0x1
+		setPSWByte(mc, low)
 		mc.ra = high
 	}
 	mc.programCounter++
@@ -890,10 +1004,11 @@ func (mc *microcontroller) rst() {
 	// Restart
 	debugPrint(mc, "RST", 0)
 	exp := ((*mc.memory)[mc.programCounter] >> 3) & 0x7
+	next := mc.programCounter + 1 // Return to the instruction after the RST
 
-	(*mc.memory)[mc.stackPointer-2] = uint8(mc.programCounter)      // L
-	(*mc.memory)[mc.stackPointer-1] = uint8(mc.programCounter >> 8) // H
-	mc.stackPointer -= 2                                            // The manual says (SP) <- (SP)+2, but this is probably wrong
+	(*mc.memory)[mc.stackPointer-2] = uint8(next)      // L
+	(*mc.memory)[mc.stackPointer-1] = uint8(next >> 8) // H
+	mc.stackPointer -= 2                               // The manual says (SP) <- (SP)+2, but this is probably wrong
 
 	mc.programCounter = uint16(exp << 3)
 }
@@ -1068,7 +1183,62 @@ func (mc *microcontroller) xthl() {
 	mc.programCounter++
 }
 
+// interrupt - Executes the instruction given when an interrupt is acknowledged,
+// which pushes the program counter (the address after HLT, if the CPU was
+// halted). It is fetched from the bus (see fetch()) between beginInstruction()
+// and endInstruction(), so the hooks see it like any other instruction.
+// Anything but an RST or a CALL is taken as RST 7 (FF, a floating bus).
+// Interrupts are disabled until the program enables them again
+func (mc *microcontroller) interrupt(instruction []uint8) {
+	debugPrintLn(fmt.Sprintf("Interrupt: % X", instruction))
+	rst := len(instruction) == 1 && instruction[0]&0xC7 == 0xC7
+	call := len(instruction) == 3 && instruction[0] == 0xCD
+	if !rst && !call {
+		instruction = []uint8{0xFF}
+	}
+	mc.interruptBus = instruction
+	mc.beginInstruction()
+	if mc.stopped { // The debugger was told to quit before the interrupt
+		mc.interruptBus = nil
+		return
+	}
+	mc.inte, mc.halted = false, false
+	target := uint16(instruction[0] & 0x38)
+	if call {
+		target = mc.data16bit()
+	}
+	mc.stackPointer -= 2
+	(*mc.memory)[mc.stackPointer] = uint8(mc.programCounter)
+	(*mc.memory)[mc.stackPointer+1] = uint8(mc.programCounter >> 8)
+	mc.programCounter = target
+	mc.endInstruction()
+	mc.interruptBus = nil
+}
+
+// run - Executes a single instruction, or takes an interrupt instead if one is
+// waiting and interrupts are enabled
 func (mc *microcontroller) run() {
+	if mc.stopped {
+		return
+	}
+	if mc.interrupts != nil && mc.inte && !mc.interruptDelay && mc.interrupts.interruptRequested() {
+		mc.interrupt(mc.interrupts.acknowledgeInterrupt())
+		return
+	}
+	mc.interruptDelay = false
+	if mc.halted {
+		mc.cycles += 4 // The CPU idles in the halt state
+		return
+	}
+	mc.beginInstruction()
+	if mc.stopped { // The debugger was told to quit before the instruction
+		return
+	}
+	mc.execute()
+	mc.endInstruction()
+}
+
+func (mc *microcontroller) execute() {
 	instruction := (*mc.memory)[mc.programCounter]
 	switch {
 	case instruction == 0xCE:
@@ -1225,10 +1395,13 @@ func (mc *microcontroller) run() {
 		mc.xri()
 	case instruction == 0xE3:
 		mc.xthl()
+	case instruction == 0xDB && mc.io != nil:
+		mc.in()
+	case instruction == 0xD3 && mc.io != nil:
+		mc.out()
 	default:
 		err := fmt.Sprintf("[%d] Unknown instruction: %X ", mc.programCounter, instruction)
 		fmt.Println(err)
 		panic(err)
 	}
-	mc.instructionsExecuted++
 }
@@ -0,0 +1,196 @@
+package main
+
+// usart8251 - The Intel 8251 USART in asynchronous mode. The data register is
+// at its first port and the mode, command and status registers are at the
+// second. Its transmit and receive clocks (TxC and RxC, which are the same
+// here) run off the CPU's cycles (see update), so a character takes as long to
+// send and receive as it would on the real line.
+//
+// After a reset the first write to the control port is the mode word and the
+// following ones are commands. What it sends goes to transmit and what the
+// other end sends comes in with receive. Synchronous mode isn't emulated: a
+// mode word asking for it is taken as asynchronous x1
+type usart8251 struct {
+	clock      chipClock
+	expectMode bool // The next control write is a mode word
+	mode       uint8
+	command    uint8
+	errors     uint8 // PE, OE and FE, as in the status
+
+	txBuffer uint8
+	txFull   bool // A character is waiting for the transmitter
+	txShift  uint8
+	txBusy   bool  // A character is being sent
+	txPulses int64 // Until the character being sent is done
+
+	rxData   uint8
+	rxReady  bool
+	rxQueue  []uint8 // What the other end has sent, which hasn't been received yet
+	rxBusy   bool    // The first character in the queue is being received
+	rxPulses int64
+
+	dsr bool // The modem inputs, high unless set otherwise
+	cts bool
+
+	transmit       func(value uint8)
+	txReadyChanged func(level bool) // The TxRDY output, which can be an interrupt
+	rxReadyChanged func(level bool) // The RxRDY output
+	txReady        bool
+	rxReadyPin     bool
+}
+
+// Bits of the command word
+const (
+	usartTxEnable   = 0x01
+	usartDTR        = 0x02
+	usartRxEnable   = 0x04
+	usartBreak      = 0x08
+	usartErrorReset = 0x10
+	usartRTS        = 0x20
+	usartReset      = 0x40
+	usartHunt       = 0x80
+)
+
+// Bits of the status
+const (
+	usartTxReady = 0x01
+	usartRxReady = 0x02
+	usartTxEmpty = 0x04
+	usartParity  = 0x08
+	usartOverrun = 0x10
+	usartFraming = 0x20
+	usartDSR     = 0x80
+)
+
+// newUSART8251 - An 8251 after reset, with TxC and RxC at clockHz
+func newUSART8251(cpuHz int64, clockHz int64) *usart8251 {
+	return &usart8251{clock: newChipClock(cpuHz, clockHz), expectMode: true, dsr: true, cts: true}
+}
+
+// dataBits - The number of bits in a character (5 to 8)
+func (u *usart8251) dataBits() uint {
+	return 5 + uint(u.mode>>2&3)
+}
+
+// characterPulses - How many clock pulses a character takes on the line: a
+// start bit, the data, the parity bit if there is one and the stop bits, each
+// of which is 1, 16 or 64 pulses
+func (u *usart8251) characterPulses() int64 {
+	factor := [4]int64{1, 1, 16, 64}[u.mode&3]
+	halfBits := 2 * (1 + int64(u.dataBits()) + int64(u.mode>>4&1))
+	halfBits += [4]int64{2, 2, 3, 4}[u.mode>>6] // Stop bits: 1, 1.5 or 2
+	return factor * halfBits / 2
+}
+
+func (u *usart8251) input(port uint8) uint8 {
+	if port&1 == 0 {
+		u.rxReady = false
+		u.updatePins()
+		return u.rxData
+	}
+	status := uint8(boolToInt(!u.txFull)) | uint8(boolToInt(u.rxReady))<<1
+	status |= uint8(boolToInt(!u.txFull && !u.txBusy)) << 2
+	status |= u.errors | uint8(boolToInt(u.dsr))<<7
+	return status
+}
+
+func (u *usart8251) output(port uint8, value uint8) {
+	switch {
+	case port&1 == 0:
+		u.txBuffer, u.txFull = value&(1<<u.dataBits()-1), true
+		u.startTransmitter()
+	case u.expectMode:
+		u.mode, u.expectMode = value, false
+	case value&usartReset != 0:
+		// Internal reset: the next control write is a mode word again
+		u.expectMode, u.command, u.errors = true, 0, 0
+		u.txFull, u.txBusy, u.rxReady, u.rxBusy = false, false, false, false
+	default:
+		u.command = value
+		if value&usartErrorReset != 0 {
+			u.errors = 0
+		}
+		u.startTransmitter()
+	}
+	u.updatePins()
+}
+
+// setCTS - Sets the CTS input. The transmitter only starts a character while
+// it is high
+func (u *usart8251) setCTS(level bool) {
+	u.cts = level
+	u.startTransmitter()
+	u.updatePins()
+}
+
+// setDSR - Sets the DSR input, which the program reads in the status
+func (u *usart8251) setDSR(level bool) {
+	u.dsr = level
+}
+
+// receive - A character from the other end. It is received over a character
+// time, once the receiver is enabled
+func (u *usart8251) receive(value uint8) {
+	u.rxQueue = append(u.rxQueue, value)
+}
+
+// startTransmitter - Moves the buffer into the shift register if it's free
+func (u *usart8251) startTransmitter() {
+	if u.txFull && !u.txBusy && u.command&usartTxEnable != 0 && u.cts {
+		u.txShift, u.txFull, u.txBusy = u.txBuffer, false, true
+		u.txPulses = u.characterPulses()
+	}
+}
+
+// updatePins - Tells the devices on TxRDY and RxRDY when they change
+func (u *usart8251) updatePins() {
+	txReady := !u.txFull && u.command&usartTxEnable != 0 && u.cts
+	if txReady != u.txReady {
+		u.txReady = txReady
+		if u.txReadyChanged != nil {
+			u.txReadyChanged(txReady)
+		}
+	}
+	if u.rxReady != u.rxReadyPin {
+		u.rxReadyPin = u.rxReady
+		if u.rxReadyChanged != nil {
+			u.rxReadyChanged(u.rxReady)
+		}
+	}
+}
+
+// update - Runs the transmitter and receiver up to the CPU's cycles
+func (u *usart8251) update(cycles int64) {
+	pulses := u.clock.advance(cycles)
+	if u.expectMode {
+		return
+	}
+	for remaining := pulses; u.txBusy && remaining > 0; {
+		if remaining < u.txPulses {
+			u.txPulses -= remaining
+			break
+		}
+		remaining -= u.txPulses
+		u.txBusy = false
+		if u.transmit != nil {
+			u.transmit(u.txShift)
+		}
+		u.startTransmitter()
+	}
+	for remaining := pulses; u.command&usartRxEnable != 0 && len(u.rxQueue) > 0 && remaining > 0; {
+		if !u.rxBusy {
+			u.rxBusy, u.rxPulses = true, u.characterPulses()
+		}
+		if remaining < u.rxPulses {
+			u.rxPulses -= remaining
+			break
+		}
+		remaining -= u.rxPulses
+		if u.rxReady {
+			u.errors |= usartOverrun // The last character wasn't read in time
+		}
+		u.rxData, u.rxReady, u.rxBusy = u.rxQueue[0]&(1<<u.dataBits()-1), true, false
+		u.rxQueue = u.rxQueue[1:]
+	}
+	u.updatePins()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestUSARTCharacterTime : A character takes the start, data, parity and stop
+// bits times the baud rate factor
+func TestUSARTCharacterTime(t *testing.T) {
+	tests := []struct {
+		mode   uint8
+		pulses int64
+	}{
+		{0x4D, 10},  // x1, 8 data bits, no parity, 1 stop bit
+		{0x4E, 160}, // x16
+		{0xFE, 192}, // x16, 8 data bits, even parity, 2 stop bits
+		{0x83, 480}, // x64, 5 data bits, no parity, 1.5 stop bits
+	}
+	for _, test := range tests {
+		u := newUSART8251(1, 1)
+		u.output(1, test.mode)
+		if got := u.characterPulses(); got != test.pulses {
+			t.Errorf("Mode %02X: expected %d pulses, got %d", test.mode, test.pulses, got)
+		}
+	}
+}
+
+// TestUSARTTransmit : Characters are sent a character time apart, with TxRDY
+// and TxEMPTY following the buffer and the shift register
+func TestUSARTTransmit(t *testing.T) {
+	u := newUSART8251(1, 1)
+	sent := bytes.Buffer{}
+	u.transmit = func(value uint8) { sent.WriteByte(value) }
+	u.output(1, 0x4D)
+	if u.input(1)&usartTxEmpty == 0 {
+		t.Error("Expected TxEMPTY before anything was sent")
+	}
+	u.output(1, usartRxEnable|usartTxEnable|usartRTS)
+	u.output(0, 'A')
+	u.output(0, 'B')
+	if got := u.input(1); got&(usartTxReady|usartTxEmpty) != 0 || u.txReady {
+		t.Errorf("Expected the buffer to be full, got a status of %02X", got)
+	}
+	u.update(9)
+	if sent.Len() != 0 {
+		t.Error("A character was sent early")
+	}
+	u.update(10)
+	if sent.String() != "A" || u.input(1)&usartTxReady == 0 {
+		t.Errorf("Expected A to be sent and the buffer free, got %q", sent.String())
+	}
+	u.update(100)
+	if sent.String() != "AB" || u.input(1)&usartTxEmpty == 0 {
+		t.Errorf("Expected AB to be sent, got %q", sent.String())
+	}
+
+	// Nothing is sent while CTS is high, and 7 bit characters lose their top bit
+	u.output(1, usartReset)
+	u.output(1, 0x49)
+	u.output(1, usartTxEnable)
+	u.setCTS(false)
+	u.output(0, 0xC3)
+	u.update(200)
+	if sent.Len() != 2 {
+		t.Error("A character was sent without CTS")
+	}
+	u.setCTS(true)
+	u.update(300)
+	if sent.String() != "ABC" {
+		t.Errorf("Expected C to be sent, got %q", sent.String())
+	}
+}
+
+// TestUSARTReceive : Characters arrive a character time apart once the
+// receiver is enabled, and one which isn't read in time is an overrun
+func TestUSARTReceive(t *testing.T) {
+	u := newUSART8251(1, 1)
+	ready := []bool{}
+	u.rxReadyChanged = func(level bool) { ready = append(ready, level) }
+	u.output(1, 0x4D)
+	u.receive('x')
+	u.receive('y')
+	u.receive('z')
+	u.update(50)
+	if u.input(1)&usartRxReady != 0 {
+		t.Error("A character was received before the receiver was enabled")
+	}
+	u.output(1, usartRxEnable)
+	u.update(59)
+	if u.input(1)&usartRxReady != 0 {
+		t.Error("A character was received early")
+	}
+	u.update(60)
+	if u.input(1)&usartRxReady == 0 || u.input(0) != 'x' || u.input(1)&usartRxReady != 0 {
+		t.Error("Expected to read x")
+	}
+	u.update(80)
+	if u.input(1)&usartOverrun == 0 || u.input(0) != 'z' {
+		t.Error("Expected z to overrun y")
+	}
+	u.output(1, usartRxEnable|usartErrorReset)
+	if u.input(1)&usartOverrun != 0 {
+		t.Error("The error reset didn't clear the overrun")
+	}
+	if len(ready) != 4 {
+		t.Errorf("Expected RxRDY to change 4 times: %v", ready)
+	}
+}
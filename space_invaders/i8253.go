@@ -0,0 +1,302 @@
+package main
+
+// pit8253 - The Intel 8253 programmable interval timer: three 16 bit down
+// counters at its first three ports and the control word at the fourth. The
+// counters run off a clock input of their own, which is timed by the CPU's
+// cycles (see update). Each counter has a gate input (high unless set with
+// setGate) and an output, which can be connected to an interrupt line with
+// outChanged
+type pit8253 struct {
+	counters [3]pitCounter
+	clock    chipClock
+}
+
+// pitCounter - One of the counters
+type pitCounter struct {
+	programmed bool // A control word has been written
+	mode       int
+	bcd        bool
+	access     uint8  // How the count is read and written: 1 LSB, 2 MSB, 3 LSB then MSB
+	reload     uint16 // The count register, which the program writes
+	count      uint16 // The counting element
+
+	writeMSB bool // The next byte written is the MSB
+	readMSB  bool // The next byte read is the MSB
+	latched  bool
+	latch    uint16
+
+	written   bool // A count has been written since the control word
+	loading   bool // The count is loaded into the counting element on the next pulse
+	counting  bool // The counting element has been loaded
+	armed     bool // The output changes when the count reaches 0 (modes 1, 4 and 5 do this once)
+	phase     int  // Mode 3: the pulses left in this half of the square wave
+	strobed   bool // Modes 4 and 5: the output is low for this pulse
+	gate      bool
+	triggered bool // The gate has risen since the last pulse
+
+	out        bool
+	outChanged func(level bool)
+}
+
+func newPIT8253(cpuHz int64, clockHz int64) *pit8253 {
+	p := &pit8253{clock: newChipClock(cpuHz, clockHz)}
+	for i := range p.counters {
+		p.counters[i].gate = true
+	}
+	return p
+}
+
+func (p *pit8253) input(port uint8) uint8 {
+	if port&3 == 3 {
+		return 0xFF // The control word can't be read
+	}
+	return p.counters[port&3].read()
+}
+
+func (p *pit8253) output(port uint8, value uint8) {
+	if port&3 != 3 {
+		p.counters[port&3].write(value)
+		return
+	}
+	selected := value >> 6
+	if selected == 3 {
+		return // Not used on the 8253 (the 8254's read back command)
+	}
+	p.counters[selected].control(value)
+}
+
+// setGate - Sets the gate input of a counter
+func (p *pit8253) setGate(counter int, level bool) {
+	p.counters[counter].setGate(level)
+}
+
+// update - Counts the clock pulses up to the CPU's cycles
+func (p *pit8253) update(cycles int64) {
+	for pulses := p.clock.advance(cycles); pulses > 0; pulses-- {
+		for i := range p.counters {
+			p.counters[i].pulse()
+		}
+	}
+}
+
+// control - A control word for this counter: SC1 SC0 RL1 RL0 M2 M1 M0 BCD
+func (c *pitCounter) control(value uint8) {
+	access := value >> 4 & 3
+	if access == 0 {
+		// Counter latch: the count is held for reading until it has been read
+		if !c.latched {
+			c.latch, c.latched = c.count, true
+		}
+		return
+	}
+	c.programmed, c.access, c.bcd = true, access, value&1 != 0
+	c.mode = int(value >> 1 & 7)
+	if c.mode > 5 {
+		c.mode -= 4 // 6 and 7 are 2 and 3
+	}
+	c.writeMSB, c.readMSB, c.latched = false, false, false
+	c.written, c.loading, c.counting, c.armed, c.strobed = false, false, false, false, false
+	c.setOut(c.mode != 0)
+}
+
+func (c *pitCounter) write(value uint8) {
+	if !c.programmed {
+		return
+	}
+	switch {
+	case c.access == 1:
+		c.reload = uint16(value)
+	case c.access == 2:
+		c.reload = uint16(value) << 8
+	case !c.writeMSB:
+		c.reload = c.reload&0xFF00 | uint16(value)
+		c.writeMSB = true
+		if c.mode == 0 {
+			c.counting = false // Writing the first byte stops the count
+		}
+		return
+	default:
+		c.reload = c.reload&0x00FF | uint16(value)<<8
+		c.writeMSB = false
+	}
+	c.written = true
+
+	switch c.mode {
+	case 0:
+		c.setOut(false)
+		c.loading = true
+	case 4:
+		c.loading = true
+	case 2, 3:
+		// A new count while counting is used from the next period
+		c.loading = !c.counting
+	}
+}
+
+func (c *pitCounter) read() uint8 {
+	value := c.count
+	if c.latched {
+		value = c.latch
+	}
+	if c.access == 3 && !c.readMSB {
+		c.readMSB = true
+		return uint8(value)
+	}
+	c.readMSB, c.latched = false, false
+	if c.access == 2 || c.access == 3 {
+		return uint8(value >> 8)
+	}
+	return uint8(value)
+}
+
+func (c *pitCounter) setGate(level bool) {
+	if level && !c.gate {
+		c.triggered = true
+	}
+	c.gate = level
+	if !level && (c.mode == 2 || c.mode == 3) {
+		c.setOut(true)
+	}
+}
+
+func (c *pitCounter) setOut(level bool) {
+	if level != c.out {
+		c.out = level
+		if c.outChanged != nil {
+			c.outChanged(level)
+		}
+	}
+}
+
+// initial - The count that was written, where 0 is the largest count
+func (c *pitCounter) initial() int {
+	switch {
+	case c.reload != 0:
+		if c.bcd {
+			n := 0
+			for shift := 12; shift >= 0; shift -= 4 {
+				n = n*10 + int(c.reload>>uint(shift)&0xF)
+			}
+			return n
+		}
+		return int(c.reload)
+	case c.bcd:
+		return 10000
+	}
+	return 0x10000
+}
+
+// decrement - Counts down by one, in binary or BCD
+func (c *pitCounter) decrement() {
+	if !c.bcd {
+		c.count--
+		return
+	}
+	for shift := uint(0); shift < 16; shift += 4 {
+		if c.count>>shift&0xF != 0 {
+			c.count -= 1 << shift
+			return
+		}
+		c.count |= 9 << shift // Borrow from the next digit
+	}
+}
+
+// pulse - A pulse of the clock input
+func (c *pitCounter) pulse() {
+	triggered := c.triggered
+	c.triggered = false
+	if !c.programmed {
+		return
+	}
+	if c.strobed {
+		c.strobed = false
+		c.setOut(true)
+	}
+
+	switch c.mode {
+	case 0, 4:
+		if c.loading {
+			c.count, c.loading, c.counting, c.armed = c.reload, false, true, true
+			return
+		}
+		if !c.counting || !c.gate {
+			return
+		}
+		c.decrement()
+		if c.count == 0 && c.armed {
+			if c.mode == 0 {
+				c.setOut(true)
+			} else {
+				c.setOut(false)
+				c.strobed = true
+			}
+			c.armed = false
+		}
+
+	case 1, 5:
+		// Started (or restarted) by the gate rising, whatever the gate is now
+		if triggered && c.written {
+			c.count, c.counting, c.armed = c.reload, true, true
+			if c.mode == 1 {
+				c.setOut(false)
+			}
+			return
+		}
+		if !c.counting {
+			return
+		}
+		c.decrement()
+		if c.count == 0 && c.armed {
+			if c.mode == 1 {
+				c.setOut(true)
+			} else {
+				c.setOut(false)
+				c.strobed = true
+			}
+			c.armed = false
+		}
+
+	case 2:
+		if c.loading || triggered && c.counting {
+			c.count, c.loading, c.counting = c.reload, false, true
+			c.setOut(true)
+			return
+		}
+		if !c.counting || !c.gate {
+			return
+		}
+		if c.count == 1 {
+			// The output was low for one pulse; start the next period
+			c.count = c.reload
+			c.setOut(true)
+			return
+		}
+		c.decrement()
+		if c.count == 1 {
+			c.setOut(false)
+		}
+
+	case 3:
+		// High for half of the count (rounded up) and low for the rest
+		if c.loading || triggered && c.counting {
+			c.count, c.loading, c.counting = c.reload, false, true
+			c.phase = (c.initial() + 1) / 2
+			c.setOut(true)
+			return
+		}
+		if !c.counting || !c.gate {
+			return
+		}
+		c.phase--
+		c.count = uint16(c.phase * 2)
+		if c.phase == 0 {
+			c.setOut(!c.out)
+			if c.out {
+				c.phase = (c.initial() + 1) / 2
+			} else if c.phase = c.initial() / 2; c.phase == 0 {
+				c.phase = 1 // A count of 1
+			}
+			c.count = c.reload
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import "testing"
+
+// pitOutputs - The output of a counter after each of a number of clock pulses
+func pitOutputs(p *pit8253, counter int, pulses int) []bool {
+	levels := make([]bool, pulses)
+	for i := range levels {
+		p.update(int64(i + 1))
+		levels[i] = p.counters[counter].out
+	}
+	return levels
+}
+
+func levelString(levels []bool) string {
+	s := make([]byte, len(levels))
+	for i, level := range levels {
+		s[i] = "LH"[boolToInt(level)]
+	}
+	return string(s)
+}
+
+// TestPITModes : The outputs follow the waveforms in the datasheet. The count is
+// written just before the first pulse, which loads it into the counter
+func TestPITModes(t *testing.T) {
+	tests := []struct {
+		control uint8
+		count   uint8
+		want    string
+	}{
+		{0x10, 4, "LLLLHHHH"},     // Mode 0: high N+1 pulses after the count is written
+		{0x14, 3, "HHLHHLHHL"},    // Mode 2: low for the last pulse of each period
+		{0x14, 4, "HHHLHHHLHH"},   // Mode 2
+		{0x16, 4, "HHLLHHLLHH"},   // Mode 3: a square wave
+		{0x16, 5, "HHHLLHHHLLHH"}, // Mode 3 with an odd count: high for one more pulse
+		{0x18, 3, "HHHLHHHH"},     // Mode 4: a strobe N+1 pulses after the count is written
+	}
+	for _, test := range tests {
+		p := newPIT8253(1, 1)
+		p.output(3, test.control)
+		p.output(0, test.count)
+		if got := levelString(pitOutputs(p, 0, len(test.want))); got != test.want {
+			t.Errorf("Control %02X count %d: expected %s, got %s", test.control, test.count, test.want, got)
+		}
+	}
+}
+
+// TestPITGate : Modes 1 and 5 wait for the gate to rise, and a low gate stops
+// the count in mode 0
+func TestPITGate(t *testing.T) {
+	p := newPIT8253(1, 1)
+	p.output(3, 0x52) // Counter 1, mode 1
+	p.output(1, 3)
+	p.setGate(1, false)
+	if got := levelString(pitOutputs(p, 1, 2)); got != "HH" {
+		t.Errorf("Mode 1 started without a trigger: %s", got)
+	}
+	p.setGate(1, true)
+	p.clock = newChipClock(1, 1)
+	if got := levelString(pitOutputs(p, 1, 5)); got != "LLLHH" {
+		t.Errorf("Mode 1: expected a one shot of LLLHH, got %s", got)
+	}
+
+	p = newPIT8253(1, 1)
+	p.output(3, 0x10)
+	p.output(0, 3)
+	p.update(2)
+	p.setGate(0, false)
+	p.update(10)
+	if p.counters[0].out || p.counters[0].count != 2 {
+		t.Errorf("Mode 0 counted while the gate was low: %d", p.counters[0].count)
+	}
+	p.setGate(0, true)
+	p.update(12)
+	if !p.counters[0].out {
+		t.Error("Mode 0 didn't finish once the gate was high")
+	}
+}
+
+// TestPITReadWrite : Counts are read and written in the order the control word
+// asks for, can be latched and can be BCD
+func TestPITReadWrite(t *testing.T) {
+	p := newPIT8253(1, 1)
+	p.output(3, 0xB0) // Counter 2, LSB then MSB, mode 0
+	p.output(2, 0x34)
+	p.output(2, 0x12)
+	p.update(1) // Loaded
+	p.update(4)
+	p.output(3, 0x80) // Latch counter 2
+	p.update(10)
+	if lsb, msb := p.input(2), p.input(2); lsb != 0x31 || msb != 0x12 {
+		t.Errorf("Expected the latched count of 1231, got %02X%02X", msb, lsb)
+	}
+	if lsb, msb := p.input(2), p.input(2); lsb != 0x2B || msb != 0x12 {
+		t.Errorf("Expected the count of 122B once the latch was read, got %02X%02X", msb, lsb)
+	}
+
+	p.output(3, 0x21) // Counter 0, MSB only, mode 0, BCD
+	p.output(0, 0x10)
+	p.update(11)
+	p.update(12)
+	if p.input(0) != 0x09 || p.counters[0].count != 0x0999 {
+		t.Errorf("Expected a BCD count of 0999, got %04X", p.counters[0].count)
+	}
+	if p.input(3) != 0xFF {
+		t.Error("The control word could be read")
+	}
+}
+
+// TestPITInterrupt : The output drives an interrupt line when it changes
+func TestPITInterrupt(t *testing.T) {
+	p := newPIT8253(2000000, 1000000)
+	changes := []bool{}
+	p.counters[0].outChanged = func(level bool) { changes = append(changes, level) }
+	p.output(3, 0x34) // Mode 2
+	p.output(0, 100)
+	p.output(0, 0)
+	p.update(2 * 1000)
+	if len(changes) != 20 {
+		t.Errorf("Expected 10 periods of 100 pulses in 1000 microseconds, got %d changes", len(changes))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+// ppi8255 - The Intel 8255 programmable peripheral interface. It has three 8
+// bit ports, A, B and C, at its first three ports and the control register at
+// the fourth.
+//
+// In mode 0 (basic input and output) port C is split into two halves which are
+// set to input or output separately. What is on the pins of an input port is
+// read with its read function and an output port calls its write function when
+// it is written. A port without a read function reads back its output latch.
+//
+// In mode 1 (strobed input and output, ports A and B) and mode 2 (bidirectional,
+// port A only) some of port C's bits are the handshake for the port. The
+// device on the other side latches input into the 8255 with strobe() and tells
+// it that it has taken the output with acknowledge(). Either can raise the
+// port's INTR output, which interrupt is told about
+type ppi8255 struct {
+	control uint8    // The last mode set
+	latches [3]uint8 // The outputs of ports A, B and C
+
+	read  [3]func() uint8
+	write [3]func(value uint8)
+
+	// The handshake of ports A and B in modes 1 and 2
+	inputs    [2]uint8 // What was latched by the strobe
+	ibf       [2]bool  // Input buffer full
+	obf       [2]bool  // Output buffer full
+	intr      [2]bool
+	inte      [2]bool // Interrupts enabled (for port A in mode 2, the output's)
+	inteInput bool    // Port A in mode 2: the input's interrupt enable
+	interrupt [2]func(level bool)
+}
+
+// Bits of the mode set control word
+const (
+	ppiModeSet    = 0x80
+	ppiModeA      = 0x60 // Group A: mode 0, 1 or 2 (either value of bit 5)
+	ppiInputA     = 0x10
+	ppiInputCHigh = 0x08
+	ppiModeB      = 0x04 // Group B: mode 0 or 1
+	ppiInputB     = 0x02
+	ppiInputCLow  = 0x01
+)
+
+// newPPI8255 - An 8255 after reset, with all of its ports as inputs in mode 0
+func newPPI8255() *ppi8255 {
+	return &ppi8255{control: ppiModeSet | ppiInputA | ppiInputCHigh | ppiInputB | ppiInputCLow}
+}
+
+// mode - The mode of port A (0) or B (1)
+func (p *ppi8255) mode(port int) int {
+	if port == 1 {
+		return int(p.control&ppiModeB) >> 2
+	}
+	if mode := int(p.control&ppiModeA) >> 5; mode < 2 {
+		return mode
+	}
+	return 2
+}
+
+// handshakeBits - The bits of port C used for handshaking by ports A and B
+func (p *ppi8255) handshakeBits() uint8 {
+	bits := uint8(0)
+	switch {
+	case p.mode(0) == 2:
+		bits |= 0xF8
+	case p.mode(0) == 1 && p.control&ppiInputA != 0:
+		bits |= 0x38
+	case p.mode(0) == 1:
+		bits |= 0xC8
+	}
+	if p.mode(1) == 1 {
+		bits |= 0x07
+	}
+	return bits
+}
+
+// inputMask - Which bits of a port are inputs. For port C, the handshake bits
+// aren't included
+func (p *ppi8255) inputMask(port int) uint8 {
+	switch port {
+	case 0:
+		return uint8(boolToInt(p.control&ppiInputA != 0) * 0xFF)
+	case 1:
+		return uint8(boolToInt(p.control&ppiInputB != 0) * 0xFF)
+	}
+	mask := uint8(boolToInt(p.control&ppiInputCHigh != 0)*0xF0 | boolToInt(p.control&ppiInputCLow != 0)*0x0F)
+	return mask &^ p.handshakeBits()
+}
+
+// status - The handshake bits of port C: for port A, INTR on PC3, and IBF and
+// INTE on PC5 and PC4 (input) or OBF (active low) and INTE on PC7 and PC6
+// (output); for port B, INTE, IBF or OBF, and INTR on PC2-PC0
+func (p *ppi8255) status() uint8 {
+	status := uint8(0)
+	if p.mode(0) != 0 {
+		status |= uint8(boolToInt(p.intr[0])) << 3
+		if p.mode(0) == 2 || p.control&ppiInputA != 0 {
+			status |= uint8(boolToInt(p.ibf[0]))<<5 | uint8(boolToInt(p.inputInterruptEnabled()))<<4
+		}
+		if p.mode(0) == 2 || p.control&ppiInputA == 0 {
+			status |= uint8(boolToInt(!p.obf[0]))<<7 | uint8(boolToInt(p.inte[0]))<<6
+		}
+	}
+	if p.mode(1) == 1 {
+		buffer := !p.obf[1]
+		if p.control&ppiInputB != 0 {
+			buffer = p.ibf[1]
+		}
+		status |= uint8(boolToInt(p.inte[1]))<<2 | uint8(boolToInt(buffer))<<1 | uint8(boolToInt(p.intr[1]))
+	}
+	return status & p.handshakeBits()
+}
+
+// inputInterruptEnabled - INTE of port A's input: INTE 2 in mode 2
+func (p *ppi8255) inputInterruptEnabled() bool {
+	if p.mode(0) == 2 {
+		return p.inteInput
+	}
+	return p.inte[0]
+}
+
+// setINTR - Sets the INTR output of port A or B
+func (p *ppi8255) setINTR(port int, level bool) {
+	if level != p.intr[port] {
+		p.intr[port] = level
+		if p.interrupt[port] != nil {
+			p.interrupt[port](level)
+		}
+	}
+}
+
+func (p *ppi8255) input(port uint8) uint8 {
+	index := int(port & 3)
+	switch {
+	case index == 3:
+		return 0xFF // The control register can't be read
+	case index < 2 && p.mode(index) != 0 && (p.mode(index) == 2 || p.inputMask(index) != 0):
+		// Reading the strobed input empties the buffer
+		p.ibf[index] = false
+		p.setINTR(index, p.mode(index) == 2 && !p.obf[0] && p.inte[0])
+		return p.inputs[index]
+	}
+	pins := p.latches[index]
+	if p.read[index] != nil {
+		pins = p.read[index]()
+	}
+	mask := p.inputMask(index)
+	value := pins&mask | p.latches[index]&^mask
+	if index == 2 {
+		value = value&^p.handshakeBits() | p.status()
+	}
+	return value
+}
+
+func (p *ppi8255) output(port uint8, value uint8) {
+	index := int(port & 3)
+	if index < 3 {
+		p.latch(index, value)
+		if index < 2 && p.mode(index) != 0 && (p.mode(index) == 2 || p.inputMask(index) == 0) {
+			// The output buffer is full until the device acknowledges it
+			p.obf[index] = true
+			p.setINTR(index, p.mode(index) == 2 && p.ibf[0] && p.inteInput)
+		}
+		return
+	}
+	if value&ppiModeSet != 0 {
+		// Setting the mode clears all of the outputs and the handshake
+		p.control = value
+		p.ibf, p.obf, p.inte, p.inteInput = [2]bool{}, [2]bool{}, [2]bool{}, false
+		p.setINTR(0, false)
+		p.setINTR(1, false)
+		for i := range p.latches {
+			p.latch(i, 0)
+		}
+		return
+	}
+
+	// Bit set/reset of port C: bits 3-1 are the bit and bit 0 is the new value.
+	// On a handshake bit it sets the interrupt enable of the port instead
+	number, set := value>>1&7, value&1 != 0
+	bit := uint8(1) << number
+	if p.handshakeBits()&bit == 0 {
+		if set {
+			p.latch(2, p.latches[2]|bit)
+		} else {
+			p.latch(2, p.latches[2]&^bit)
+		}
+		return
+	}
+	switch {
+	case number == 2:
+		p.inte[1] = set
+		p.setINTR(1, set && (p.ibf[1] || p.control&ppiInputB == 0 && !p.obf[1]))
+	case number == 4 && p.mode(0) == 2:
+		p.inteInput = set
+	case number == 4 || number == 6:
+		p.inte[0] = set
+	}
+}
+
+// latch - Sets the output latch of a port. Its write function is called if any
+// of it is an output
+func (p *ppi8255) latch(index int, value uint8) {
+	p.latches[index] = value
+	if p.inputMask(index) != 0xFF && p.write[index] != nil {
+		p.write[index](value)
+	}
+}
+
+// strobe - The device puts data into the input buffer of port A (0) or B (1)
+// with STB, in mode 1 or 2. INTR is raised if it is enabled
+func (p *ppi8255) strobe(port int, value uint8) {
+	p.inputs[port], p.ibf[port] = value, true
+	p.setINTR(port, p.inputInterruptEnabledFor(port))
+}
+
+// acknowledge - The device has taken the output of port A (0) or B (1) with
+// ACK, in mode 1 or 2. INTR is raised if it is enabled
+func (p *ppi8255) acknowledge(port int) {
+	p.obf[port] = false
+	p.setINTR(port, p.inte[port])
+}
+
+func (p *ppi8255) inputInterruptEnabledFor(port int) bool {
+	if port == 0 {
+		return p.inputInterruptEnabled()
+	}
+	return p.inte[1]
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+// TestPPIMode0 : Inputs are read from the pins, outputs from the latches, and
+// port C's bits can be set and reset one at a time
+func TestPPIMode0(t *testing.T) {
+	p := newPPI8255()
+	written := []uint8{}
+	p.read[1] = func() uint8 { return 0x5A }
+	p.read[2] = func() uint8 { return 0xF0 }
+	p.write[2] = func(value uint8) { written = append(written, value) }
+	p.output(3, ppiModeSet|ppiInputB|ppiInputCHigh) // A and C low are outputs
+	p.output(0, 0x33)
+	if p.input(0) != 0x33 || p.input(1) != 0x5A {
+		t.Errorf("Expected to read 33 and 5A, got %02X and %02X", p.input(0), p.input(1))
+	}
+	p.output(3, 0x05) // Set PC2
+	p.output(3, 0x0F) // Set PC7, which is an input
+	if got := p.input(2); got != 0xF4 {
+		t.Errorf("Expected port C to be F4, got %02X", got)
+	}
+	if len(written) != 3 || written[2] != 0x84 {
+		t.Errorf("Expected port C to be written 3 times, ending with 84: % X", written)
+	}
+}
+
+// TestPPIMode1 : A strobed input and output with their handshakes on port C
+func TestPPIMode1(t *testing.T) {
+	p := newPPI8255()
+	interrupts := [2][]bool{}
+	p.interrupt[0] = func(level bool) { interrupts[0] = append(interrupts[0], level) }
+	p.interrupt[1] = func(level bool) { interrupts[1] = append(interrupts[1], level) }
+	p.output(3, ppiModeSet|0x20|ppiInputA|ppiModeB) // A is a mode 1 input, B a mode 1 output
+	if got := p.input(2) & 0x3F; got != 0x02 {
+		t.Errorf("Expected OBFB (active low) after the mode set, got %02X", got)
+	}
+	p.output(3, 0x09) // INTE A
+	p.output(3, 0x05) // INTE B
+	p.strobe(0, 0x41)
+	if got := p.input(2) & 0x38; got != 0x38 {
+		t.Errorf("Expected INTRA, INTEA and IBFA, got %02X", got)
+	}
+	if p.input(0) != 0x41 || p.ibf[0] || p.intr[0] {
+		t.Error("Reading port A didn't empty the buffer")
+	}
+	p.output(1, 0x42)
+	if got := p.input(2) & 0x07; got != 0x04 {
+		t.Errorf("Expected OBFB low and INTRB low while the output was full, got %02X", got)
+	}
+	p.acknowledge(1)
+	if got := p.input(2) & 0x07; got != 0x07 {
+		t.Errorf("Expected INTRB once the output was taken, got %02X", got)
+	}
+	if len(interrupts[0]) != 2 || len(interrupts[1]) != 3 {
+		t.Errorf("Unexpected interrupts: %v", interrupts)
+	}
+}
+
+// TestPPIMode2 : Port A as a bidirectional bus, with a separate interrupt
+// enable for each direction
+func TestPPIMode2(t *testing.T) {
+	p := newPPI8255()
+	p.output(3, ppiModeSet|0x40)
+	p.output(3, 0x09) // INTE 2 (input)
+	p.output(0, 0x11)
+	if p.intr[0] || p.input(2)&0x80 != 0 {
+		t.Error("Expected OBFA to be low (full) without an interrupt")
+	}
+	p.strobe(0, 0x22)
+	if !p.intr[0] {
+		t.Error("The input didn't interrupt")
+	}
+	if p.input(0) != 0x22 || p.intr[0] {
+		t.Error("Expected to read the input and drop INTRA")
+	}
+	p.acknowledge(0)
+	if p.intr[0] || p.input(2)&0xF8 != 0x90 {
+		t.Errorf("Expected OBFA and INTE 2 without an interrupt, got %02X", p.input(2))
+	}
+}
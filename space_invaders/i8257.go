@@ -0,0 +1,100 @@
+package main
+
+// dma8257 - The Intel 8257 DMA controller. Each of its four channels has an
+// address register (at port 2n) and a terminal count register (at port 2n+1)
+// which are written and read a byte at a time, low byte first. The mode set
+// register is at port 8 and the status register is read there. Only the
+// transfers which read memory are modelled: a device asks its channel for the
+// next byte with transfer()
+type dma8257 struct {
+	memory   *[]uint8
+	address  [4]uint16
+	count    [4]uint16 // Bits 13-0 are the number of bytes less 1, bits 15-14 the kind of transfer
+	mode     uint8
+	status   uint8 // The terminal count of each channel has been reached (bits 3-0)
+	highByte bool  // The next byte of a register is the high one
+}
+
+// Bits of the mode set register. Bits 3-0 enable the channels
+const (
+	dmaRotatingPriority = 0x10
+	dmaExtendedWrite    = 0x20
+	dmaTCStop           = 0x40 // Disable a channel when it reaches its terminal count
+	dmaAutoload         = 0x80 // Reload channel 2 from channel 3 when it reaches its terminal count
+)
+
+func newDMA8257(memory *[]uint8) *dma8257 {
+	return &dma8257{memory: memory}
+}
+
+// register - The register a byte written to port goes to, and which byte
+func (d *dma8257) register(port uint8) *uint16 {
+	if port&1 == 0 {
+		return &d.address[port>>1&3]
+	}
+	return &d.count[port>>1&3]
+}
+
+func (d *dma8257) input(port uint8) uint8 {
+	port &= 0x0F
+	if port >= 8 {
+		// Reading the status clears the terminal count flags
+		status := d.status
+		d.status = 0
+		return status
+	}
+	value := *d.register(port)
+	d.highByte = !d.highByte
+	if !d.highByte {
+		return uint8(value >> 8)
+	}
+	return uint8(value)
+}
+
+func (d *dma8257) output(port uint8, value uint8) {
+	port &= 0x0F
+	if port >= 8 {
+		d.mode = value
+		d.highByte = false
+		return
+	}
+	channels := []uint8{port}
+	if d.mode&dmaAutoload != 0 && port>>1 == 2 {
+		channels = append(channels, port+2) // Channel 3 keeps what channel 2 is reloaded with
+	}
+	for _, channel := range channels {
+		register := d.register(channel)
+		if d.highByte {
+			*register = *register&0x00FF | uint16(value)<<8
+		} else {
+			*register = *register&0xFF00 | uint16(value)
+		}
+	}
+	d.highByte = !d.highByte
+}
+
+// enabled - Whether a channel can transfer
+func (d *dma8257) enabled(channel int) bool {
+	return d.mode&(1<<uint(channel)) != 0
+}
+
+// transfer - Reads the next byte of memory for a channel. Returns false when
+// the channel is disabled
+func (d *dma8257) transfer(channel int) (uint8, bool) {
+	if !d.enabled(channel) {
+		return 0, false
+	}
+	value := (*d.memory)[d.address[channel]]
+	d.address[channel]++
+	if d.count[channel]&0x3FFF != 0 {
+		d.count[channel]--
+		return value, true
+	}
+	d.status |= 1 << uint(channel)
+	if channel == 2 && d.mode&dmaAutoload != 0 {
+		d.address[2], d.count[2] = d.address[3], d.count[3]
+	} else if d.mode&dmaTCStop != 0 {
+		d.mode &^= 1 << uint(channel)
+	}
+	return value, true
+}
@@ -0,0 +1,229 @@
+package main
+
+// pic8259 - The Intel 8259 programmable interrupt controller, as used with the
+// 8080. Devices raise its eight interrupt request inputs (IR0-IR7) with setIRQ
+// and it drives the CPU's INT line (set mc.interrupts to it). When the CPU
+// acknowledges an interrupt, the 8259 answers with a CALL to the routine for
+// the highest priority request, whose address is made from ICW1 and ICW2.
+//
+// The program initializes it with ICW1 (port 0 with bit 4 set) followed by
+// ICW2, ICW3 (only when cascaded) and ICW4 (only when ICW1 asks for it) at
+// port 1. After that port 1 is the interrupt mask (OCW1) and port 0 takes the
+// end of interrupt and priority commands (OCW2) and selects what it reads
+// (OCW3). Cascading isn't emulated, and the 8086 mode of ICW4 is ignored: the
+// 8080's CALL is always given
+type pic8259 struct {
+	initialized bool
+	icw1        uint8
+	icw2        uint8 // A15-A8 of the CALL
+	icw4        uint8
+	nextICW     int // The initialization command word expected at port 1 next (2, 3 or 4), or 0
+
+	irr    uint8 // The interrupt requests
+	isr    uint8 // The interrupts in service
+	imr    uint8 // The interrupts which are masked
+	inputs uint8 // The levels of IR0-IR7
+
+	lowest      int  // The level with the lowest priority (7 unless rotated)
+	rotateAEOI  bool // Rotate the priorities on an automatic end of interrupt
+	specialMask bool // Special mask mode: levels which aren't masked can interrupt whatever is in service
+	readISR     bool // Port 0 reads the ISR instead of the IRR
+	poll        bool // The next read of port 0 is a poll
+}
+
+// Bits of ICW1
+const (
+	picICW4Needed = 0x01
+	picSingle     = 0x02 // Not cascaded, so there is no ICW3
+	picInterval4  = 0x04 // The routines are 4 bytes apart instead of 8
+	picLevel      = 0x08 // Level triggered instead of edge triggered
+	picICW1       = 0x10
+)
+
+// picAutoEOI - The bit of ICW4 which ends each interrupt as soon as it is acknowledged
+const picAutoEOI = 0x02
+
+// Bits of OCW3
+const (
+	picSMMEnable   = 0x40 // Set special mask mode to SMM
+	picSMM         = 0x20
+	picOCW3        = 0x08
+	picPollCommand = 0x04
+	picReadEnable  = 0x02 // Read the ISR (bit 0 set) or the IRR
+)
+
+func newPIC8259() *pic8259 {
+	return &pic8259{lowest: 7}
+}
+
+func (p *pic8259) input(port uint8) uint8 {
+	if port&1 != 0 {
+		return p.imr
+	}
+	if p.poll {
+		// The highest priority request is acknowledged as if by the CPU
+		p.poll = false
+		level := p.pending()
+		if level < 0 {
+			return 0
+		}
+		p.acknowledge(level)
+		return 0x80 | uint8(level)
+	}
+	if p.readISR {
+		return p.isr
+	}
+	return p.irr
+}
+
+func (p *pic8259) output(port uint8, value uint8) {
+	switch {
+	case port&1 == 0 && value&picICW1 != 0:
+		p.icw1, p.icw4, p.nextICW = value, 0, 2
+		p.initialized = false
+		p.imr, p.isr, p.lowest = 0, 0, 7
+		p.specialMask, p.readISR, p.poll, p.rotateAEOI = false, false, false, false
+		p.irr = 0
+		if p.icw1&picLevel != 0 {
+			p.irr = p.inputs
+		}
+	case port&1 == 0 && value&picOCW3 != 0:
+		if value&picSMMEnable != 0 {
+			p.specialMask = value&picSMM != 0
+		}
+		p.poll = value&picPollCommand != 0
+		if value&picReadEnable != 0 {
+			p.readISR = value&1 != 0
+		}
+	case port&1 == 0:
+		p.ocw2(value)
+	case p.nextICW == 2:
+		p.icw2 = value
+		p.nextICW = 3
+		if p.icw1&picSingle != 0 {
+			p.nextICW = 4
+		}
+		p.finishICW()
+	case p.nextICW == 3:
+		p.nextICW = 4 // Cascading isn't emulated
+		p.finishICW()
+	case p.nextICW == 4:
+		p.icw4 = value
+		p.nextICW = 0
+		p.initialized = true
+	default:
+		p.imr = value
+	}
+}
+
+// finishICW - Ends the initialization if no more words are expected
+func (p *pic8259) finishICW() {
+	if p.nextICW == 4 && p.icw1&picICW4Needed == 0 {
+		p.nextICW = 0
+		p.initialized = true
+	}
+}
+
+// ocw2 - End of interrupt and priority commands: R SL EOI 0 0 L2 L1 L0
+func (p *pic8259) ocw2(value uint8) {
+	level := int(value & 7)
+	switch value >> 5 {
+	case 1, 5: // Non-specific EOI, and rotate on it
+		if level = p.highestInService(); level < 0 {
+			return
+		}
+		fallthrough
+	case 3, 7: // Specific EOI, and rotate on it
+		p.isr &^= 1 << uint(level)
+		if value&0x80 != 0 {
+			p.lowest = level
+		}
+	case 4, 0: // Set and clear rotate in automatic EOI mode
+		p.rotateAEOI = value&0x80 != 0
+	case 6: // Set priority
+		p.lowest = level
+	}
+}
+
+// priority - The levels from the highest priority to the lowest
+func (p *pic8259) priority() [8]int {
+	levels := [8]int{}
+	for i := range levels {
+		levels[i] = (p.lowest + 1 + i) % 8
+	}
+	return levels
+}
+
+func (p *pic8259) highestInService() int {
+	for _, level := range p.priority() {
+		if p.isr&(1<<uint(level)) != 0 {
+			return level
+		}
+	}
+	return -1
+}
+
+// pending - The request which would interrupt the CPU, or -1 if there isn't
+// one. Normally a request can only interrupt a routine of lower priority
+func (p *pic8259) pending() int {
+	requests := p.irr &^ p.imr
+	for _, level := range p.priority() {
+		bit := uint8(1) << uint(level)
+		if p.isr&bit != 0 && !p.specialMask {
+			return -1
+		}
+		if requests&bit != 0 && p.isr&bit == 0 {
+			return level
+		}
+	}
+	return -1
+}
+
+// setIRQ - Sets the level of an interrupt request input. A request is made
+// when it rises (or while it is high, in level triggered mode)
+func (p *pic8259) setIRQ(level int, high bool) {
+	bit := uint8(1) << uint(level)
+	if high && p.inputs&bit == 0 || high && p.icw1&picLevel != 0 {
+		p.irr |= bit
+	}
+	if !high && p.icw1&picLevel != 0 {
+		p.irr &^= bit
+	}
+	p.inputs = p.inputs&^bit | uint8(boolToInt(high))<<uint(level)
+}
+
+// acknowledge - Puts a request in service
+func (p *pic8259) acknowledge(level int) {
+	bit := uint8(1) << uint(level)
+	if p.icw1&picLevel == 0 {
+		p.irr &^= bit
+	}
+	if p.icw4&picAutoEOI != 0 {
+		if p.rotateAEOI {
+			p.lowest = level
+		}
+		return
+	}
+	p.isr |= bit
+}
+
+func (p *pic8259) interruptRequested() bool {
+	return p.initialized && p.pending() >= 0
+}
+
+// acknowledgeInterrupt - The CALL to the routine for the highest priority
+// request. The routines are 4 or 8 bytes apart (ICW1 bit 2). If the request has
+// gone away, IR7's routine is called without putting it in service
+func (p *pic8259) acknowledgeInterrupt() []uint8 {
+	level := p.pending()
+	if level < 0 {
+		level = 7
+	} else {
+		p.acknowledge(level)
+	}
+	low := p.icw1&0xC0 | uint8(level)<<3
+	if p.icw1&picInterval4 != 0 {
+		low = p.icw1&0xE0 | uint8(level)<<2
+	}
+	return []uint8{0xCD, low, p.icw2}
+}
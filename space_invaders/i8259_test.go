@@ -0,0 +1,217 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestPIC - An 8259 initialized for a single 8080 system, with its
+// routines 4 bytes apart from 1000H
+func newTestPIC(icw4 bool) *pic8259 {
+	p := newPIC8259()
+	if icw4 {
+		p.output(0, picICW1|picSingle|picInterval4|picICW4Needed)
+		p.output(1, 0x10)
+		p.output(1, picAutoEOI)
+	} else {
+		p.output(0, picICW1|picSingle|picInterval4)
+		p.output(1, 0x10)
+	}
+	return p
+}
+
+// TestPICPriority : The highest priority request is called first, and lower
+// priority ones wait for its end of interrupt
+func TestPICPriority(t *testing.T) {
+	p := newTestPIC(false)
+	p.setIRQ(5, true)
+	p.setIRQ(2, true)
+	if !p.interruptRequested() {
+		t.Fatal("No interrupt was requested")
+	}
+	if call := p.acknowledgeInterrupt(); !reflect.DeepEqual(call, []uint8{0xCD, 0x08, 0x10}) {
+		t.Errorf("Expected CALL 1008H for IR2, got % X", call)
+	}
+	if p.interruptRequested() {
+		t.Error("IR5 interrupted the routine for IR2")
+	}
+	p.setIRQ(1, true)
+	if !p.interruptRequested() || p.pending() != 1 {
+		t.Error("IR1 didn't interrupt the routine for IR2")
+	}
+	p.acknowledgeInterrupt()
+	if p.isr != 0x06 {
+		t.Errorf("Expected IR1 and IR2 in service, got %02X", p.isr)
+	}
+	p.output(0, 0x20) // Non-specific EOI
+	p.output(0, 0x20)
+	if call := p.acknowledgeInterrupt(); call[1] != 0x14 {
+		t.Errorf("Expected CALL 1014H for IR5, got % X", call)
+	}
+
+	// Masked requests are held until they are unmasked
+	p.output(0, 0x20)
+	p.output(1, 0x08)
+	p.setIRQ(3, false)
+	p.setIRQ(3, true)
+	if p.interruptRequested() {
+		t.Error("IR3 was masked")
+	}
+	p.output(1, 0)
+	if p.pending() != 3 {
+		t.Error("IR3 was lost while it was masked")
+	}
+}
+
+// TestPICModes : Automatic EOI, rotation, polling and reading the registers
+func TestPICModes(t *testing.T) {
+	p := newTestPIC(true)
+	p.setIRQ(0, true)
+	p.acknowledgeInterrupt()
+	if p.isr != 0 {
+		t.Error("Automatic EOI left IR0 in service")
+	}
+
+	p = newTestPIC(false)
+	p.output(0, 0xC4) // IR4 has the lowest priority
+	p.setIRQ(0, true)
+	p.setIRQ(6, true)
+	if p.pending() != 6 {
+		t.Errorf("Expected IR6 to have priority after rotating, not IR%d", p.pending())
+	}
+	p.output(0, 0x0A) // Read the IRR
+	if p.input(0) != 0x41 {
+		t.Errorf("Expected an IRR of 41, got %02X", p.input(0))
+	}
+	p.output(0, 0x0C) // Poll
+	if got := p.input(0); got != 0x86 {
+		t.Errorf("Expected a poll to give IR6, got %02X", got)
+	}
+	p.output(0, 0x0B) // Read the ISR
+	if p.input(0) != 0x40 {
+		t.Errorf("Expected IR6 in service after the poll, got %02X", p.input(0))
+	}
+	p.output(0, 0xA0) // Rotate on a non-specific EOI
+	if p.lowest != 6 || p.pending() != 0 {
+		t.Errorf("Expected IR6 to have the lowest priority, not IR%d", p.lowest)
+	}
+
+	// Routines 8 bytes apart use A6 and A7 of ICW1
+	p.output(0, picICW1|picSingle|0xC0)
+	p.output(1, 0x20)
+	p.setIRQ(0, false)
+	p.setIRQ(0, true)
+	if call := p.acknowledgeInterrupt(); !reflect.DeepEqual(call, []uint8{0xCD, 0xC0, 0x20}) {
+		t.Errorf("Expected CALL 20C0H, got % X", call)
+	}
+	if call := p.acknowledgeInterrupt(); call[1] != 0xF8 {
+		t.Errorf("Expected a spurious interrupt to call IR7's routine, got % X", call)
+	}
+}
+
+// TestCPUInterrupt : The CPU takes an interrupt from the 8259 after the
+// instruction following EI, and wakes up from HLT for it
+func TestCPUInterrupt(t *testing.T) {
+	memory := make([]uint8, 0x10000)
+	copy(memory, []uint8{
+		0x31, 0x00, 0x20, // LXI SP,2000H
+		0xFB,       // EI
+		0x3E, 0x01, // MVI A,1
+		0x76, // HLT
+	})
+	copy(memory[0x1008:], []uint8{0x3E, 0x22, 0xC9}) // MVI A,22H; RET
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	p := newTestPIC(false)
+	mc.interrupts = p
+	p.setIRQ(2, true)
+
+	mc.run() // LXI SP
+	mc.run() // EI
+	mc.run() // MVI A,1
+	if mc.programCounter != 0x0006 || mc.ra != 0x01 {
+		t.Fatalf("The interrupt was taken straight after EI, at %04X", mc.programCounter)
+	}
+	mc.run()
+	if mc.programCounter != 0x1008 || mc.ra != 0x01 || mc.inte {
+		t.Fatalf("Expected to be at the routine with interrupts disabled, at %04X", mc.programCounter)
+	}
+	if memory[0x1FFE] != 0x06 || memory[0x1FFF] != 0x00 {
+		t.Errorf("Expected 0006 to be pushed, got %02X%02X", memory[0x1FFF], memory[0x1FFE])
+	}
+	mc.run() // MVI A,22H
+	mc.run() // RET
+	mc.run() // HLT
+	if !mc.halted {
+		t.Fatal("HLT didn't halt")
+	}
+	mc.inte = true
+	p.output(0, 0x20)
+	p.setIRQ(2, false)
+	p.setIRQ(2, true)
+	mc.run()
+	if mc.halted || mc.programCounter != 0x1008 {
+		t.Errorf("The interrupt didn't wake the CPU up, at %04X", mc.programCounter)
+	}
+	if memory[0x1FFE] != 0x07 {
+		t.Errorf("Expected the address after HLT to be pushed, got %02X", memory[0x1FFE])
+	}
+}
+
+// busInterrupt - An interrupt source which always puts the same bytes on the bus
+type busInterrupt []uint8
+
+func (b busInterrupt) interruptRequested() bool      { return true }
+func (b busInterrupt) acknowledgeInterrupt() []uint8 { return b }
+
+// TestInterruptTrace : An interrupt is traced as an instruction of its own,
+// with its stack writes, and an instruction other than RST or CALL on the bus
+// is taken as RST 7
+func TestInterruptTrace(t *testing.T) {
+	memory := make([]uint8, 0x10000)
+	copy(memory, []uint8{
+		0x31, 0x00, 0x20, // LXI SP,2000H
+		0xFB, // EI
+		0x00, // NOP
+		0x00, // NOP
+	})
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	mc.interrupts = busInterrupt{0x3E, 0x01} // MVI A,1
+	fileName := filepath.Join(t.TempDir(), "interrupt.trc")
+	recorder, err := newTraceRecorder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.addHook(recorder)
+	for i := 0; i < 5; i++ {
+		mc.run()
+	}
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+	if mc.programCounter != 0x0039 || mc.cycles != 10+4+4+11+4 {
+		t.Errorf("Expected RST 7 to be taken and the NOP at 0038 run, at %04X after %d cycles", mc.programCounter, mc.cycles)
+	}
+
+	reader, err := openTrace(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.close()
+	var record traceRecord
+	reader.seek(3)
+	reader.next(&record)
+	if !record.interrupt || record.pc != 0x0005 || record.bytes[0] != 0xFF || record.duration != 11 {
+		t.Errorf("Unexpected record for the interrupt: %+v", record)
+	}
+	if len(record.accesses) != 2 || record.accesses[0] != (memoryAccess{0x1FFE, 0x05, true}) ||
+		record.accesses[1] != (memoryAccess{0x1FFF, 0x00, true}) {
+		t.Errorf("Unexpected memory accesses for the interrupt: %+v", record.accesses)
+	}
+	reader.next(&record)
+	if record.interrupt || record.pc != 0x0038 {
+		t.Errorf("Expected the NOP at 0038 after the interrupt, got %+v", record)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+// crt8275 - The Intel 8275 CRT controller. Parameters are written to its first
+// port and commands to the second, where the status is read. Once the display
+// is started it fetches each frame through DMA (with fetch, a byte at a time)
+// and sets the interrupt request at the start of the vertical retrace, which
+// is when programs update the screen. Frames are timed by the CPU's clock
+//
+// A frame is made of rows of characters. Characters are 7 bits; bytes with
+// the top bit set are codes:
+//
+//	10UR GGBH  Field attribute: Underline, Reverse, General purpose, Blink, Highlight
+//	1111 000S  End of row (S: stop DMA for the rest of the row)
+//	1111 001S  End of screen
+//	11xx xxxx  Character attribute (line drawing), shown as a blank
+type crt8275 struct {
+	fetch       func() (uint8, bool) // The next byte of the frame from the DMA controller
+	framePeriod int64                // CPU cycles per frame
+	nextFrame   int64
+
+	command    uint8   // The command whose parameters are being written
+	parameters []uint8 // The parameters it has been given so far
+	status     uint8
+	displaying bool
+
+	charsPerRow  int
+	rowsPerFrame int
+	linesPerRow  int // Scan lines in each row of characters
+	underline    int // The scan line of the underline and of an underline cursor
+	transparent  bool
+	cursorFormat uint8
+	cursorX      int
+	cursorY      int
+
+	screen [][]crtCell // The last frame
+	frames int64
+}
+
+// crtCell - A character on the screen and its field attributes
+type crtCell struct {
+	char      uint8
+	underline bool
+	reverse   bool
+	blink     bool
+	highlight bool
+}
+
+// Commands
+const (
+	crtReset            = 0x00
+	crtStartDisplay     = 0x20
+	crtStopDisplay      = 0x40
+	crtReadLightPen     = 0x60
+	crtLoadCursor       = 0x80
+	crtEnableInterrupt  = 0xA0
+	crtDisableInterrupt = 0xC0
+	crtPresetCounters   = 0xE0
+)
+
+// Bits of the status register. All but IE and VE are cleared when it is read
+const (
+	crtInterruptEnable  = 0x40
+	crtInterruptRequest = 0x20
+	crtLightPen         = 0x10
+	crtImproperCommand  = 0x08
+	crtVideoEnable      = 0x04
+	crtDMAUnderrun      = 0x02
+	crtFIFOOverrun      = 0x01
+)
+
+// Cursor formats
+const (
+	crtBlinkingBlock     = 0
+	crtBlinkingUnderline = 1
+	crtBlock             = 2
+	crtUnderline         = 3
+)
+
+func newCRT8275(framePeriod int64, fetch func() (uint8, bool)) *crt8275 {
+	c := &crt8275{fetch: fetch, framePeriod: framePeriod, nextFrame: framePeriod}
+	c.output(1, crtReset)
+	c.output(0, 0x4F) // 80 characters
+	c.output(0, 0x18) // 25 rows
+	c.output(0, 0x99) // 10 lines per row, underline on line 9
+	c.output(0, 0xD9) // Non-transparent attributes, block cursor
+	return c
+}
+
+func (c *crt8275) input(port uint8) uint8 {
+	if port&1 == 0 {
+		return 0 // Light pen position, which isn't emulated
+	}
+	status := c.status
+	c.status &= crtInterruptEnable | crtVideoEnable
+	return status
+}
+
+func (c *crt8275) output(port uint8, value uint8) {
+	if port&1 == 0 {
+		c.parameter(value)
+		return
+	}
+	c.command, c.parameters = value&0xE0, c.parameters[:0]
+	switch c.command {
+	case crtStartDisplay:
+		c.displaying = true
+		c.status |= crtInterruptEnable | crtVideoEnable
+	case crtStopDisplay:
+		c.displaying = false
+		c.status &^= crtVideoEnable
+	case crtEnableInterrupt:
+		c.status |= crtInterruptEnable
+	case crtDisableInterrupt:
+		c.status &^= crtInterruptEnable
+	case crtReset:
+		c.displaying = false
+		c.status &^= crtInterruptEnable | crtVideoEnable
+	}
+}
+
+// parameter - A parameter of the last command. The reset command has four and
+// load cursor two; anything else is an improper command
+func (c *crt8275) parameter(value uint8) {
+	c.parameters = append(c.parameters, value)
+	switch {
+	case c.command == crtReset && len(c.parameters) <= 4:
+		switch len(c.parameters) {
+		case 1:
+			c.charsPerRow = int(value&0x7F) + 1
+		case 2:
+			c.rowsPerFrame = int(value&0x3F) + 1
+		case 3:
+			c.linesPerRow = int(value&0x0F) + 1
+			c.underline = int(value >> 4)
+		case 4:
+			c.transparent = value&0x40 == 0
+			c.cursorFormat = value >> 4 & 3
+		}
+	case c.command == crtLoadCursor && len(c.parameters) <= 2:
+		if len(c.parameters) == 1 {
+			c.cursorX = int(value & 0x7F)
+		} else {
+			c.cursorY = int(value & 0x3F)
+		}
+	default:
+		c.status |= crtImproperCommand
+	}
+}
+
+// update - Draws the frames which are due by the CPU's clock
+func (c *crt8275) update(cycles int64) {
+	for cycles >= c.nextFrame {
+		c.nextFrame += c.framePeriod
+		c.frames++
+		if c.displaying {
+			c.frame()
+			if c.status&crtInterruptEnable != 0 {
+				c.status |= crtInterruptRequest
+			}
+		}
+	}
+}
+
+// frame - Fetches a frame from the DMA controller into screen
+func (c *crt8275) frame() {
+	c.screen = make([][]crtCell, c.rowsPerFrame)
+	attributes := crtCell{}
+	endOfScreen := false
+	for y := range c.screen {
+		row := make([]crtCell, c.charsPerRow)
+		endOfRow := endOfScreen
+		for x := 0; x < len(row); x++ {
+			row[x] = crtCell{char: ' '}
+			if endOfRow {
+				continue
+			}
+			value, ok := c.fetch()
+			for ok && c.transparent && value&0xC0 == 0x80 {
+				attributes = fieldAttributes(value) // Transparent attributes don't take up a position
+				value, ok = c.fetch()
+			}
+			switch {
+			case !ok:
+				c.status |= crtDMAUnderrun
+				endOfRow, endOfScreen = true, true
+			case value < 0x80:
+				row[x] = attributes
+				row[x].char = value
+			case value&0xC0 == 0x80:
+				attributes = fieldAttributes(value)
+				row[x] = attributes
+				row[x].char = ' '
+			case value&0xFE == 0xF0:
+				endOfRow = true
+			case value&0xFE == 0xF2:
+				endOfRow, endOfScreen = true, true
+			}
+		}
+		c.screen[y] = row
+	}
+}
+
+func fieldAttributes(value uint8) crtCell {
+	return crtCell{underline: value&0x20 != 0, reverse: value&0x10 != 0, blink: value&0x02 != 0, highlight: value&0x01 != 0}
+}
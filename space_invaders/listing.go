@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Maps addresses back to the source code of the program using the listing
+// (.PRN or .LST) that the assembler wrote next to the binary.
+//
+// The listings written by the CP/M assemblers (ASM, MAC, RMAC, M80) all start
+// code lines with the address, optionally followed by a relocation mark, and
+// then the bytes that were generated, either run together (C3AB01) or one per
+// field (C3 AB 01). The source follows after a tab or several spaces:
+//
+//	0100 C3AB01    	JMP	CPU	;JUMP TO 8080 CPU DIAGNOSTIC
+//	  0100'   3E 01           start:  mvi a,1
+//
+// Lines with an address but no bytes (ie: EQU, DS, ORG) and page headers are
+// skipped. A line with bytes but no source continues the statement above it.
+
+// sourceLine - A line of the program's source
+type sourceLine struct {
+	file string
+	line int
+	text string
+}
+
+func (s *sourceLine) String() string {
+	return fmt.Sprintf("%s:%d: %s", filepath.Base(s.file), s.line, s.text)
+}
+
+// sourceMap - The source line for the first byte of each instruction
+type sourceMap struct {
+	lines map[uint16]*sourceLine
+}
+
+// SOURCES - The source lines loaded with -listing
+var SOURCES = &sourceMap{lines: map[uint16]*sourceLine{}}
+
+func (m *sourceMap) lookup(address uint16) (*sourceLine, bool) {
+	line, ok := m.lines[address]
+	return line, ok
+}
+
+// isHex - Whether text is made up of only hex digits
+func isHex(text string) bool {
+	for _, c := range strings.ToUpper(text) {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return false
+		}
+	}
+	return text != ""
+}
+
+// parseListingLine - Splits a listing line into its address, the number of
+// bytes generated and the source. ok is false for lines without an address
+func parseListingLine(line string) (address uint16, size int, source string, ok bool) {
+	rest := strings.TrimLeft(line, " ")
+	end := strings.IndexAny(rest, " \t")
+	if end < 0 {
+		end = len(rest)
+	}
+	field := strings.TrimRight(rest[:end], "'\"!*")
+	if len(field) != 4 || !isHex(field) {
+		return 0, 0, "", false
+	}
+	address, _ = parseAddress(field)
+	rest = rest[end:]
+
+	// The bytes are separated by single spaces; a tab or a run of spaces starts the source
+	for {
+		trimmed := strings.TrimLeft(rest, " ")
+		separator := rest[:len(rest)-len(trimmed)]
+		if strings.HasPrefix(trimmed, "\t") || trimmed == "" || (size > 0 && len(separator) > 1) {
+			break
+		}
+		end := strings.IndexAny(trimmed, " \t")
+		if end < 0 {
+			end = len(trimmed)
+		}
+		field := trimmed[:end]
+		if len(field)%2 != 0 || len(field) > 8 || !isHex(field) {
+			break
+		}
+		size += len(field) / 2
+		rest = trimmed[end:]
+	}
+	return address, size, strings.TrimSpace(rest), true
+}
+
+// findSourceFile - The assembler source next to a listing, ie: CPUDIAG.ASM for CPUDIAG.PRN
+func findSourceFile(listingName string) string {
+	directory := filepath.Dir(listingName)
+	base := strings.TrimSuffix(filepath.Base(listingName), filepath.Ext(listingName))
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return ""
+	}
+	for _, extension := range []string{".ASM", ".MAC", ".Z80", ".A80", ".S"} {
+		for _, file := range files {
+			if strings.EqualFold(file.Name(), base+extension) {
+				return filepath.Join(directory, file.Name())
+			}
+		}
+	}
+	return ""
+}
+
+func normalizeSource(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// matchSourceFile - Replaces the listing's line numbers with the ones in the
+// original source by finding each listed line in it. The listing is in the same
+// order as the source, so the search carries on from the previous match
+func matchSourceFile(lines []*sourceLine, fileName string) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	source := strings.Split(strings.Replace(string(data), "\r", "", -1), "\n")
+	next := 0
+	for _, line := range lines {
+		text := normalizeSource(line.text)
+		for i := next; i < len(source); i++ {
+			if normalizeSource(source[i]) == text {
+				line.file, line.line, line.text = fileName, i+1, strings.TrimSpace(source[i])
+				next = i + 1
+				break
+			}
+		}
+	}
+}
+
+// loadListing - Reads an assembler listing. If the source it was assembled from
+// is in the same directory, the lines refer to it instead of to the listing
+func loadListing(fileName string) (*sourceMap, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sources := &sourceMap{lines: map[uint16]*sourceLine{}}
+	statements := []*sourceLine{}
+	var current *sourceLine
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		text := strings.Replace(strings.TrimRight(scanner.Text(), "\r\x1A"), "\f", "", -1)
+		address, size, source, ok := parseListingLine(text)
+		if !ok || size == 0 {
+			continue
+		}
+		if source != "" {
+			current = &sourceLine{fileName, lineNumber, source}
+			statements = append(statements, current)
+		}
+		if current != nil {
+			for i := 0; i < size; i++ {
+				if _, exists := sources.lines[address+uint16(i)]; !exists {
+					sources.lines[address+uint16(i)] = current
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if sourceFile := findSourceFile(fileName); sourceFile != "" {
+		matchSourceFile(statements, sourceFile)
+	}
+	return sources, nil
+}
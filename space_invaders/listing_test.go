@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadListing : Addresses are mapped to the source named after the listing, or to the listing itself
+func TestLoadListing(t *testing.T) {
+	directory := t.TempDir()
+
+	source := ";TEST\r\n\tORG\t00100H\r\n\tJMP\tCPU\t;JUMP\r\n\tDB\t'AB'\r\n" +
+		"BDOS\tEQU\t00005H\r\nCPU:\tMVI\tC,9\r\n\tCALL\tBDOS\r\n"
+	listing := "              ;TEST\r\n 0100                 ORG     00100H\r\n" +
+		" 0100 C30501    \tJMP\tCPU\t;JUMP\r\n 0103 4142      \tDB\t'AB'\r\n" +
+		" 0005 =         BDOS\tEQU\t00005H\r\n 0105 0E09      CPU:\tMVI\tC,9\r\n" +
+		" 0107 CD0500    \tCALL\tBDOS\r\n\f\x1A"
+	ioutil.WriteFile(filepath.Join(directory, "TEST.ASM"), []byte(source), 0644)
+	ioutil.WriteFile(filepath.Join(directory, "TEST.PRN"), []byte(listing), 0644)
+
+	m80 := "MACRO-80 3.44\t09-Dec-81\tPAGE\t1\n\n\n" +
+		"  0100'   3E 01           start:  mvi a,1         ; test\n" +
+		"  0102'   41 42 43 44     msg:    db 'ABCDEFG'\n" +
+		"  0106'   45 46 47\n" +
+		"  0109'   FE 02                   cpi 2\n"
+	ioutil.WriteFile(filepath.Join(directory, "PRE.PRN"), []byte(m80), 0644)
+
+	tests := []struct {
+		listing string
+		address uint16
+		found   bool
+		where   string
+	}{
+		{"TEST.PRN", 0x100, true, "TEST.ASM:3: JMP\tCPU\t;JUMP"},
+		{"TEST.PRN", 0x104, true, "TEST.ASM:4: DB\t'AB'"},
+		{"TEST.PRN", 0x105, true, "TEST.ASM:6: CPU:\tMVI\tC,9"},
+		{"TEST.PRN", 0x107, true, "TEST.ASM:7: CALL\tBDOS"},
+		{"TEST.PRN", 0x005, false, ""},
+		{"PRE.PRN", 0x100, true, "PRE.PRN:4: start:  mvi a,1         ; test"},
+		{"PRE.PRN", 0x107, true, "PRE.PRN:5: msg:    db 'ABCDEFG'"},
+		{"PRE.PRN", 0x109, true, "PRE.PRN:7: cpi 2"},
+	}
+	for _, test := range tests {
+		sources, err := loadListing(filepath.Join(directory, test.listing))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, found := sources.lookup(test.address)
+		if found != test.found || (found && line.String() != test.where) {
+			t.Errorf("%s %04X: expected %t '%s', got %t %v", test.listing, test.address, test.found, test.where, found, line)
+		}
+	}
+}
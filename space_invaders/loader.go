@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/Insood/8080/intelhex"
+	"github.com/hajimehoshi/ebiten/ebitenutil"
+)
+
+// LOADFILES - Programs and data to put into memory, given with -load as
+// <file>[@<address>] (see programLoader.load)
+var LOADFILES = loadFlag{}
+
+// ENTRYPC - The address to start at, given with -pc. -1 leaves it to the start
+// address of a HEX file or the machine
+var ENTRYPC = -1
+
+// INITIALSP - The stack pointer to start with, given with -sp. -1 leaves it to
+// the machine
+var INITIALSP = -1
+
+// loadFlag - The -load flag, which can be given more than once
+type loadFlag []string
+
+func (f *loadFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *loadFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// loadedRange - Where a file was put in memory, to find files which overlap
+type loadedRange struct {
+	first, last int
+	source      string
+}
+
+// programLoader - Puts programs into memory from Intel HEX files (each of
+// which can have several segments) and raw binaries at an address
+type programLoader struct {
+	memory []uint8
+	loaded []loadedRange
+	entry  int // The start address of a HEX file, or -1
+}
+
+func newProgramLoader(memory []uint8) *programLoader {
+	return &programLoader{memory: memory, entry: -1}
+}
+
+// splitLoadSpec - Splits <file>[@<address>], where the address is in hex (see
+// parseAddress). It is -1 when it isn't given
+func splitLoadSpec(spec string) (string, int, error) {
+	at := strings.LastIndex(spec, "@")
+	if at < 0 {
+		return spec, -1, nil
+	}
+	address, ok := parseAddress(spec[at+1:])
+	if !ok {
+		return "", 0, fmt.Errorf("%s: invalid load address %s", spec, spec[at+1:])
+	}
+	return spec[:at], int(address), nil
+}
+
+// isHexFile - Whether a file is in the Intel HEX format, by its name
+func isHexFile(fileName string) bool {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	return extension == ".hex" || extension == ".ihx"
+}
+
+// load - Loads a file given as <file>[@<address>]. A HEX file (.hex or .ihx) is
+// loaded at its own addresses, and its start address, if it has one, becomes
+// the entry point. Anything else is a raw binary, loaded at the address given,
+// or at 100H for a .COM file, or else at defaultAddress. A file which doesn't
+// fit in memory or overlaps one loaded before is an error
+func (l *programLoader) load(spec string, defaultAddress int) error {
+	fileName, address, err := splitLoadSpec(spec)
+	if err != nil {
+		return err
+	}
+	data, err := readFile(fileName)
+	if err != nil {
+		return err
+	}
+	if !isHexFile(fileName) {
+		if address < 0 {
+			address = defaultAddress
+			if strings.EqualFold(filepath.Ext(fileName), ".com") {
+				address = 0x100
+			}
+		}
+		return l.place(fileName, address, data)
+	}
+
+	if address >= 0 {
+		return fmt.Errorf("%s: a HEX file is loaded at its own addresses", spec)
+	}
+	file, err := intelhex.Read(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %s", fileName, err)
+	}
+	for _, segment := range file.Segments {
+		if err := l.place(fileName, int(segment.Address), segment.Data); err != nil {
+			return err
+		}
+	}
+	if file.HasStart {
+		if file.Start > 0xFFFF {
+			return fmt.Errorf("%s: the start address %X is beyond 64K", fileName, file.Start)
+		}
+		l.entry = int(file.Start)
+	}
+	return nil
+}
+
+// place - Copies data into memory at address
+func (l *programLoader) place(source string, address int, data []uint8) error {
+	if len(data) == 0 {
+		return nil
+	}
+	last := address + len(data) - 1
+	if last >= len(l.memory) {
+		return fmt.Errorf("%s: %d bytes at %04X don't fit in memory", source, len(data), address)
+	}
+	for _, other := range l.loaded {
+		if address <= other.last && last >= other.first {
+			first := address
+			if other.first > first {
+				first = other.first
+			}
+			return fmt.Errorf("%s overlaps %s at %04X", source, other.source, first)
+		}
+	}
+	copy(l.memory[address:], data)
+	l.loaded = append(l.loaded, loadedRange{address, last, source})
+	return nil
+}
+
+// readFile - Reads a whole file (with ebitenutil, which also works in the browser).
+// A file in a zip archive is given as its path through the archive, ie:
+// roms.zip/TEST.COM (see findInZip)
+func readFile(fileName string) ([]uint8, error) {
+	if archive, name, ok := splitZipPath(fileName); ok {
+		return readZipMember(archive, name)
+	}
+	file, err := ebitenutil.OpenFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// loadFiles - Loads the files given with -load into the memory of a machine,
+// at address 0 unless they say otherwise, and sets where the program starts:
+// -pc, or the start address of a HEX file, or wherever the machine was going
+// to start. -sp sets the stack pointer
+func loadFiles(mc *microcontroller) error {
+	loader := newProgramLoader(*mc.memory)
+	for _, spec := range LOADFILES {
+		if err := loader.load(spec, 0); err != nil {
+			return err
+		}
+	}
+	startProgram(mc, loader.entry)
+	return nil
+}
+
+// startProgram - Sets the program counter and stack pointer from -pc and -sp,
+// or to entry if -pc wasn't given and it isn't -1
+func startProgram(mc *microcontroller, entry int) {
+	if ENTRYPC >= 0 {
+		entry = ENTRYPC
+	}
+	if entry >= 0 {
+		mc.programCounter = uint16(entry)
+	}
+	if INITIALSP >= 0 {
+		mc.stackPointer = uint16(INITIALSP)
+	}
+}
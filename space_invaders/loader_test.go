@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Insood/8080/intelhex"
+)
+
+// writeLoaderFile - Writes a file with the given name into a temporary directory
+func writeLoaderFile(t *testing.T, name string, data []uint8) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// TestLoadHex : A HEX file is loaded at its own addresses, segments above 64K
+// don't fit, and its start address becomes the entry point
+func TestLoadHex(t *testing.T) {
+	hex := &bytes.Buffer{}
+	intelhex.Write(hex, &intelhex.File{
+		Segments: []intelhex.Segment{{Address: 0x0100, Data: []uint8{0xC3, 0x00, 0x02}}, {Address: 0x0200, Data: []uint8{0x76}}},
+		Start:    0x0200, HasStart: true,
+	})
+	memory := make([]uint8, 0x10000)
+	loader := newProgramLoader(memory)
+	if err := loader.load(writeLoaderFile(t, "program.hex", hex.Bytes()), 0); err != nil {
+		t.Fatal(err)
+	}
+	if memory[0x100] != 0xC3 || memory[0x102] != 0x02 || memory[0x200] != 0x76 {
+		t.Errorf("Expected the segments at 0100 and 0200, got % X and %02X", memory[0x100:0x103], memory[0x200])
+	}
+	if loader.entry != 0x200 || len(loader.loaded) != 2 {
+		t.Errorf("Expected the entry at 0200 and two segments, got %04X and %d", loader.entry, len(loader.loaded))
+	}
+
+	hex.Reset()
+	intelhex.Write(hex, &intelhex.File{Segments: []intelhex.Segment{{Address: 0x10000, Data: []uint8{1}}}})
+	err := newProgramLoader(memory).load(writeLoaderFile(t, "high.ihx", hex.Bytes()), 0)
+	if err == nil || !strings.Contains(err.Error(), "don't fit") {
+		t.Errorf("Expected a segment above 64K not to fit, got %v", err)
+	}
+}
+
+// TestLoadBinary : Raw binaries go at @<address>, 100H for .COM files, or the
+// default address, and mustn't overlap each other
+func TestLoadBinary(t *testing.T) {
+	memory := make([]uint8, 0x10000)
+	loader := newProgramLoader(memory)
+	if err := loader.load(writeLoaderFile(t, "monitor.bin", []uint8{1, 2, 3, 4})+"@F800", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.load(writeLoaderFile(t, "PROGRAM.COM", []uint8{5, 6}), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.load(writeLoaderFile(t, "data.bin", []uint8{7}), 0x2000); err != nil {
+		t.Fatal(err)
+	}
+	if memory[0xF800] != 1 || memory[0xF803] != 4 || memory[0x100] != 5 || memory[0x2000] != 7 {
+		t.Errorf("Expected the files at F800, 0100 and 2000")
+	}
+	if loader.entry != -1 {
+		t.Errorf("Expected no entry point from raw binaries, got %04X", loader.entry)
+	}
+
+	err := loader.load(writeLoaderFile(t, "patch.bin", []uint8{0, 0})+"@F803", 0)
+	if err == nil || !strings.Contains(err.Error(), "overlaps") || !strings.HasSuffix(err.Error(), "at F803") {
+		t.Errorf("Expected the patch to overlap the monitor at F803, got %v", err)
+	}
+	err = loader.load(writeLoaderFile(t, "big.bin", []uint8{0, 0})+"@FFFF", 0)
+	if err == nil || !strings.Contains(err.Error(), "don't fit") {
+		t.Errorf("Expected two bytes at FFFF not to fit, got %v", err)
+	}
+	if err := loader.load("file.bin@10000", 0); err == nil {
+		t.Errorf("Expected an error for a load address above FFFF")
+	}
+	if err := loader.load("file.hex@0100", 0); err == nil {
+		t.Errorf("Expected an error for a load address on a HEX file")
+	}
+}
+
+// TestStartProgram : -pc wins over the start address of a HEX file, and -sp
+// sets the stack pointer
+func TestStartProgram(t *testing.T) {
+	defer func() { ENTRYPC, INITIALSP = -1, -1 }()
+	mc := newMicrocontroller()
+	mc.programCounter, mc.stackPointer = 0x100, 0xF000
+	startProgram(mc, -1)
+	if mc.programCounter != 0x100 || mc.stackPointer != 0xF000 {
+		t.Errorf("Expected the machine's PC and SP to be left alone")
+	}
+	startProgram(mc, 0x200)
+	if mc.programCounter != 0x200 {
+		t.Errorf("Expected the HEX start address, got %04X", mc.programCounter)
+	}
+	ENTRYPC, INITIALSP = 0x300, 0x8000
+	startProgram(mc, 0x200)
+	if mc.programCounter != 0x300 || mc.stackPointer != 0x8000 {
+		t.Errorf("Expected -pc and -sp, got %04X and %04X", mc.programCounter, mc.stackPointer)
+	}
+}
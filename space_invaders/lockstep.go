@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Runs two CPU implementations side by side on the same program, each with its
+// own copy of memory, and stops at the first instruction after which their
+// registers, flags or memory differ.
+//
+// The cores which can be compared are the microcontroller and the referenceCore.
+// The copy of the microcontroller in test/ cannot be linked into the same program
+// (both are package main), so it has to be compared over a socket with compare.
+
+// cpuState - Everything about a CPU which is compared after each instruction
+type cpuState struct {
+	pc, sp              uint16
+	a, b, c, d, e, h, l uint8
+	flags               uint8
+}
+
+// cpuCore - A CPU implementation which can be run in lockstep with another one
+type cpuCore interface {
+	name() string
+	// step executes one instruction and returns the addresses that it wrote to
+	step() []uint16
+	state() cpuState
+	memory() *[]uint8
+}
+
+// microcontrollerCore - Adapts the microcontroller to the cpuCore interface
+type microcontrollerCore struct {
+	mc       *microcontroller
+	accesses [maxMemoryAccesses]memoryAccess
+	writes   []uint16
+}
+
+func (c *microcontrollerCore) name() string {
+	return "microcontroller"
+}
+
+func (c *microcontrollerCore) step() []uint16 {
+	accesses := predictMemoryAccesses(c.mc, c.accesses[:])
+	c.mc.run()
+	c.writes = c.writes[:0]
+	for _, access := range completeMemoryAccesses(c.mc, accesses) {
+		if access.write {
+			c.writes = append(c.writes, access.address)
+		}
+	}
+	return c.writes
+}
+
+func (c *microcontrollerCore) state() cpuState {
+	mc := c.mc
+	return cpuState{mc.programCounter, mc.stackPointer, mc.ra, mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl, pswByte(mc)}
+}
+
+func (c *microcontrollerCore) memory() *[]uint8 {
+	return c.mc.memory
+}
+
+func (r *referenceCore) name() string {
+	return "reference"
+}
+
+func (r *referenceCore) state() cpuState {
+	return cpuState{r.pc, r.sp, r.a, r.b, r.c, r.d, r.e, r.h, r.l, r.flags()}
+}
+
+func (r *referenceCore) memory() *[]uint8 {
+	return r.mem
+}
+
+// referenceStep - The referenceCore's step() doesn't return the writes itself
+// so that it can stay independent of the lockstep code
+type referenceStep struct {
+	*referenceCore
+}
+
+func (r referenceStep) step() []uint16 {
+	r.referenceCore.step()
+	return r.writes
+}
+
+// lockstepHistory - An instruction which was executed before the divergence
+type lockstepHistory struct {
+	index int64
+	pc    uint16
+	bytes [3]uint8
+	state cpuState // State of the first core before the instruction
+}
+
+// divergence - Describes the first point where two cores disagreed
+type divergence struct {
+	index   int64 // Number of the instruction which caused the divergence
+	pc      uint16
+	bytes   [3]uint8
+	names   [2]string
+	before  cpuState
+	after   [2]cpuState
+	memory  []string // Memory differences
+	panics  [2]string
+	history []lockstepHistory
+}
+
+// stepSafely - Runs a single step, turning a panic (ie: an unknown instruction)
+// into an error message
+func stepSafely(core cpuCore) (writes []uint16, message string) {
+	defer func() {
+		if r := recover(); r != nil {
+			message = fmt.Sprint(r)
+		}
+	}()
+	return core.step(), ""
+}
+
+// lockstep - Runs both cores until they diverge, maxInstructions have been
+// executed (when not negative) or stop() returns true. stop() is called after
+// every instruction with the state that both cores agree on
+func lockstep(cores [2]cpuCore, maxInstructions int64, historySize int, stop func(state cpuState) bool) *divergence {
+	history := make([]lockstepHistory, 0, historySize)
+	for index := int64(0); maxInstructions < 0 || index < maxInstructions; index++ {
+		before := cores[0].state()
+		memory := *cores[0].memory()
+		current := lockstepHistory{index, before.pc,
+			[3]uint8{memory[before.pc], memory[before.pc+1], memory[before.pc+2]}, before}
+
+		result := divergence{index: index, pc: before.pc, bytes: current.bytes, before: before, history: history}
+		var writes [2][]uint16
+		for i, core := range cores {
+			result.names[i] = core.name()
+			writes[i], result.panics[i] = stepSafely(core)
+			result.after[i] = core.state()
+		}
+
+		different := result.panics[0] != "" || result.panics[1] != "" || result.after[0] != result.after[1]
+		checked := map[uint16]bool{}
+		for _, list := range writes {
+			for _, address := range list {
+				x := (*cores[0].memory())[address]
+				y := (*cores[1].memory())[address]
+				if x != y && !checked[address] {
+					result.memory = append(result.memory, fmt.Sprintf("memory %04X: %02X != %02X", address, x, y))
+					different = true
+				}
+				checked[address] = true
+			}
+		}
+		if different {
+			return &result
+		}
+
+		if historySize > 0 {
+			if len(history) == historySize {
+				history = append(history[:0], history[1:]...)
+			}
+			history = append(history, current)
+		}
+		if stop != nil && stop(result.after[0]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func formatState(state cpuState) string {
+	return fmt.Sprintf("%04X %02X %02X %02X %02X %02X %02X %02X %08b %04X",
+		state.pc, state.b, state.c, state.d, state.e, state.h, state.l, state.a, state.flags, state.sp)
+}
+
+// stateDifferences - Lists the registers and flags which are not the same
+func stateDifferences(x cpuState, y cpuState) []string {
+	differences := []string{}
+	compare16 := func(name string, a uint16, b uint16) {
+		if a != b {
+			differences = append(differences, fmt.Sprintf("%s: %04X != %04X", name, a, b))
+		}
+	}
+	compare8 := func(name string, a uint8, b uint8) {
+		if a != b {
+			differences = append(differences, fmt.Sprintf("%s: %02X != %02X", name, a, b))
+		}
+	}
+	compare16("PC", x.pc, y.pc)
+	compare16("SP", x.sp, y.sp)
+	compare8("A", x.a, y.a)
+	compare8("B", x.b, y.b)
+	compare8("C", x.c, y.c)
+	compare8("D", x.d, y.d)
+	compare8("E", x.e, y.e)
+	compare8("H", x.h, y.h)
+	compare8("L", x.l, y.l)
+	flagNames := []string{"C", "", "P", "", "AC", "", "Z", "S"}
+	for bit := uint(0); bit < 8; bit++ {
+		a := (x.flags >> bit) & 0x1
+		b := (y.flags >> bit) & 0x1
+		if a != b && flagNames[bit] != "" {
+			differences = append(differences, fmt.Sprintf("flag %s: %d != %d", flagNames[bit], a, b))
+		}
+	}
+	return differences
+}
+
+func (d *divergence) write(out io.Writer) {
+	fmt.Fprintf(out, "Divergence at instruction %d, PC=%04X (%02X %02X %02X)\n\n", d.index, d.pc, d.bytes[0], d.bytes[1], d.bytes[2])
+	fmt.Fprintf(out, "         N PC   B  C  D  E  H  L  A  SZ-X-P-C SP\n")
+	for _, h := range d.history {
+		fmt.Fprintf(out, "%10d %s\n", h.index, formatState(h.state))
+	}
+	fmt.Fprintf(out, "%10d %s <-- %02X %02X %02X\n\n", d.index, formatState(d.before), d.bytes[0], d.bytes[1], d.bytes[2])
+
+	for i, name := range d.names {
+		if d.panics[i] != "" {
+			fmt.Fprintf(out, "%-16s failed: %s\n", name, d.panics[i])
+		} else {
+			fmt.Fprintf(out, "%-16s %s\n", name, formatState(d.after[i]))
+		}
+	}
+	if d.panics[0] == "" && d.panics[1] == "" {
+		differences := stateDifferences(d.after[0], d.after[1])
+		for _, difference := range append(differences, d.memory...) {
+			fmt.Fprintf(out, "    %s\n", difference)
+		}
+	}
+}
+
+// lockstepCommand - Implements "space_invaders lockstep", which runs a test ROM
+// on both the microcontroller and the reference core at the same time
+func lockstepCommand(args []string) error {
+	flags := flag.NewFlagSet("lockstep", flag.ExitOnError)
+	maxInstructions := flags.Int64("max", -1, "Stop after this many instructions (-1 = run until the program exits)")
+	historySize := flags.Int("history", 10, "Number of instructions to show before the divergence")
+	quiet := flags.Bool("q", false, "Do not show the program's console output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s lockstep [options] <test rom>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("no program given")
+	}
+
+	DEBUGMODE = false
+	rom, err := loadTestROM(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	rom[5] = 0xC9 // RET after handling CALL 5 (conout)
+	referenceRAM := make([]uint8, len(rom))
+	copy(referenceRAM, rom)
+
+	mc := newMicrocontroller()
+	mc.memory = &rom
+	mc.programCounter = 0x100
+	reference := newReferenceCore(&referenceRAM)
+	reference.pc = 0x100
+
+	cores := [2]cpuCore{&microcontrollerCore{mc: mc}, referenceStep{reference}}
+	stop := func(state cpuState) bool {
+		if state.pc == 0x5 && !*quiet {
+			conout(mc)
+		}
+		return state.pc == 0
+	}
+	result := lockstep(cores, *maxInstructions, *historySize, stop)
+	fmt.Println()
+	if result != nil {
+		result.write(os.Stdout)
+		return fmt.Errorf("the cores diverged after %d instructions", result.index)
+	}
+	fmt.Printf("No differences found after %d instructions\n", mc.instructionsExecuted)
+	return nil
+}
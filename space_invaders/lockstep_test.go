@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// newLockstepCores - Loads the same program into the microcontroller and the reference core
+func newLockstepCores(program []uint8) [2]cpuCore {
+	first := make([]uint8, 65536)
+	second := make([]uint8, 65536)
+	copy(first, program)
+	copy(second, program)
+	mc := newMicrocontroller()
+	mc.memory = &first
+	return [2]cpuCore{&microcontrollerCore{mc: mc}, referenceStep{newReferenceCore(&second)}}
+}
+
+// TestLockstepAgrees : A program which uses the stack, ALU and RST runs the same on both cores
+func TestLockstepAgrees(t *testing.T) {
+	program := []uint8{
+		0x31, 0x00, 0x20, // 0000 LXI SP, 0x2000
+		0x3E, 0x99, // 0003 MVI A, 0x99
+		0xC6, 0x01, // 0005 ADI 0x01
+		0x27, // 0007 DAA
+		0xF5, // 0008 PUSH PSW
+		0xCF, // 0009 RST 1
+		0x76, // 000A HLT
+		0x00, 0x00, 0x00, 0x00, 0x00,
+		0xDE, 0x42, // 0010 SBI 0x42
+		0xC9, // 0012 RET
+	}
+	cores := newLockstepCores(program)
+	stop := func(state cpuState) bool { return state.pc == 0x0A }
+	if result := lockstep(cores, 100, 5, stop); result != nil {
+		out := &bytes.Buffer{}
+		result.write(out)
+		t.Errorf("Expected no divergence:\n%s", out.String())
+	}
+}
+
+// TestLockstepReportsDivergence : A difference in memory between the cores is found and reported
+func TestLockstepReportsDivergence(t *testing.T) {
+	program := []uint8{
+		0x21, 0x00, 0x10, // 0000 LXI H, 0x1000
+		0x7E, // 0003 MOV A, M
+		0x34, // 0004 INR M
+		0x76, // 0005 HLT
+	}
+	cores := newLockstepCores(program)
+	(*cores[1].memory())[0x1000] = 0x7F
+
+	result := lockstep(cores, 10, 5, nil)
+	if result == nil {
+		t.Fatal("Expected a divergence")
+	}
+	if result.index != 1 || result.pc != 0x0003 {
+		t.Errorf("Expected the divergence at instruction 1 (0003), got %d (%04X)", result.index, result.pc)
+	}
+	out := &bytes.Buffer{}
+	result.write(out)
+	for _, expected := range []string{"A: 00 != 7F", "PC=0003"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected the report to contain '%s':\n%s", expected, out.String())
+		}
+	}
+}
+
+// TestLockstepReportsPanic : An instruction that one core does not implement is reported
+func TestLockstepReportsPanic(t *testing.T) {
+	cores := newLockstepCores([]uint8{0xDB, 0x01}) // IN 1
+	result := lockstep(cores, 10, 5, nil)
+	if result == nil || result.panics[0] == "" || result.panics[1] == "" {
+		t.Fatalf("Expected both cores to fail on IN: %+v", result)
+	}
+}
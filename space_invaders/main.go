@@ -1,13 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"sort"
+	"strings"
 
-	"github.com/hajimehoshi/ebiten/ebitenutil"
+	"github.com/Insood/8080/cpmfs"
 )
 
 // DEBUGMODE - Whether or not the program is running in debug mode (ie: pretty print opcodes)
@@ -25,6 +27,28 @@ var CLIENTMODE = false
 // like tracking jumps to 0x0 and CALLs to 0x05
 var TESTMODE = false
 
+// TRACEFILE - When set, every executed instruction is recorded to this file
+// in the binary trace format (see trace.go)
+var TRACEFILE = ""
+
+// PPROFFILE - When set, a pprof profile of the emulated program is written to this file
+var PPROFFILE = ""
+
+// COVERAGEFILE - When set, a report of the instructions and opcodes which were
+// executed is written to this file (see coverage.go)
+var COVERAGEFILE = ""
+
+// DEBUGGER - When set, the program starts stopped in the debugger (see debugger.go)
+var DEBUGGER = false
+
+// CPMDRIVES - When set, test programs run under an emulated CP/M BDOS with
+// these host directories as drives A:, B:, ... (see bdos.go)
+var CPMDRIVES = []string{}
+
+// CONSOLESCRIPT - When set, the console input of -cpm and -boot is typed by this
+// script instead of being read from stdin (see script.go)
+var CONSOLESCRIPT = ""
+
 var connection net.Conn
 
 //var outputBuffer = ""
@@ -39,12 +63,6 @@ var BYTESPERLINE = 49
 var outputBuffer = make([]byte, LINESTOWRITE*BYTESPERLINE)
 var outputBufferLines = 0
 
-func debugPrintHeader(mc *microcontroller) {
-	if mc.instructionsExecuted%20 == 0 {
-		fmt.Printf("ADDR : instruction\t\t\tB  C  D  E  H  L  A  SZ-X-P-C PW SP\n")
-	}
-}
-
 // Outputs to stdout if DEBUGMODE is set
 func debugPrintLn(str string) {
 	if DEBUGMODE {
@@ -52,95 +70,33 @@ func debugPrintLn(str string) {
 	}
 }
 
+// debugPrint - Called by every instruction handler before it executes. Outputs the
+// instruction in the format selected with -format (see tracefmt.go) if DEBUGMODE
+// is set or stores it in the i8080-core format for the server in CLIENTMODE
 func debugPrint(mc *microcontroller, name string, values uint16) {
-	if DEBUGMODE || CLIENTMODE {
-		if !COMPAREFLAG && !CLIENTMODE { // Do not print headers in compare output mode or in client mode
-			debugPrintHeader(mc)
-		}
-		// Prints out the opcode and the immediate data (if any) based on values
-		// passed to this function
-		output := ""
-		if COMPAREFLAG || CLIENTMODE { // In compare output mode, print an easily computer parseable string
-			// PC, OPCODE, 2BYTES that follow the opcode
-			output += fmt.Sprintf("%04X %02X %02X %02X ", mc.programCounter,
-				(*mc.memory)[mc.programCounter],
-				(*mc.memory)[mc.programCounter+1],
-				(*mc.memory)[mc.programCounter+2])
-		} else {
-			output += fmt.Sprintf("%04X : %02X", mc.programCounter, (*mc.memory)[mc.programCounter])
-			for i := uint16(1); i < values+1; i++ {
-				output += fmt.Sprintf(" %02X", (*mc.memory)[mc.programCounter+i])
-			}
-			output += fmt.Sprintf("\t\t %-15s", name)
-		}
-		//   rb  rc   rd   re   rh   rl   ra   psw
-		output += fmt.Sprintf("%02X %02X %02X %02X %02X %02X %02X %08b %04X\n",
-			mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl, mc.ra, pswByte(mc), mc.stackPointer)
-
-		if CLIENTMODE {
-			//outputBuffer += output
-			for i := 0; i < len(output); i++ {
-				//index := BYTES_PER_LINE*outputBufferLines + i
-				//fmt.Printf("Output size: %d || String index: %d || Buffer index: %d || String character: %c", len(output), i, index, output[i])
-				//fmt.Println(output[i])
-				outputBuffer[BYTESPERLINE*outputBufferLines+i] = output[i]
-			}
-			outputBufferLines++
-		} else {
-			fmt.Print(output)
-		}
+	if CLIENTMODE {
+		output := i8080CoreFormat{}.format(mc, name, values)
+		copy(outputBuffer[BYTESPERLINE*outputBufferLines:], output)
+		outputBufferLines++
+	} else if DEBUGMODE {
+		fmt.Print(TRACEFORMAT.format(mc, name, values))
 	}
 }
 
-func loadTestROM(romName string) []uint8 {
-	fi, err := ebitenutil.OpenFile(romName)
-	if err != nil {
-		fmt.Println(romName, "is an invalid file. Could not open.")
-		panic(err)
-	}
-
-	memory := make([]uint8, 0, 65536)
-	testOffset := make([]uint8, 0x100) // The i8080-core test roms starts execution at 0x100
-	memory = append(memory, testOffset...)
-	buf := make([]byte, 1024)
-	for {
-		bytesRead, error := fi.Read(buf)
-		slice := buf[0:bytesRead]
-		memory = append(memory, slice...) // The ... mean to expand the second argument
-
-		if error == io.EOF {
-			break
-		}
+// loadTestROM - Loads a test program into 64K of memory: a raw binary at 100H
+// (or at the address given as <file>@<address>) or an Intel HEX file
+func loadTestROM(romName string) ([]uint8, error) {
+	memory := make([]uint8, 0x10000)
+	if err := newProgramLoader(memory).load(romName, 0x100); err != nil {
+		return nil, err
 	}
-	emptyRAM := make([]uint8, cap(memory)-len(memory))
-	memory = append(memory, emptyRAM...)
-	return memory
+	return memory, nil
 }
 
-func loadSpaceInvaders() []uint8 {
-	files := []string{"invaders_h.rom", "invaders_g.rom", "invaders_f.rom", "invaders_e.rom"}
-	memory := make([]uint8, 0, 65536)
-	for _, file := range files {
-		fi, err := ebitenutil.OpenFile(file)
-		if err != nil {
-			panic(err)
-		}
-		buf := make([]byte, 1024)
-		for {
-			bytesRead, error := fi.Read(buf)
-			slice := buf[0:bytesRead]
-			memory = append(memory, slice...) // The ... mean to expand the second argument
-
-			if error == io.EOF {
-				break
-			}
-		}
-
-		fi.Close()
-	}
-	emptyRAM := make([]uint8, cap(memory)-len(memory))
-	memory = append(memory, emptyRAM...)
-	return memory
+// loadSpaceInvaders - Loads and checks the game's ROMs (see invadersROMSet)
+func loadSpaceInvaders() ([]uint8, error) {
+	memory := make([]uint8, 0x10000)
+	return memory, loadROMSet(invadersROMSet, ROMPATH, memory, os.Stderr)
 }
 
 func memoryDump(mc *microcontroller, size uint16) {
@@ -166,22 +122,29 @@ func memoryDump(mc *microcontroller, size uint16) {
 
 }
 
+// bdosText - The text printed by a call to the BDOS console output functions:
+// 2 prints the character in E and 9 the string at DE up to a '$'
+func bdosText(mc *microcontroller) string {
+	if mc.rc == 9 {
+		start := (uint16(mc.rd) << 8) | uint16(mc.re)
+		return string(dollarString(*mc.memory, start))
+	} else if mc.rc == 2 {
+		return string(mc.re)
+	}
+	return ""
+}
+
 func conout(mc *microcontroller) {
 	if COMPAREFLAG { // Output nothing during CPU state comparison
 		return
 	}
 	if mc.rc == 9 {
-		start := (uint16(mc.rd) << 8) | uint16(mc.re)
-		message := string("")
-		for i := start; (*mc.memory)[i] != '$'; i++ {
-			message += string((*mc.memory)[i])
-		}
-		fmt.Printf("CONOUT (9): %s\n", message)
+		fmt.Printf("CONOUT (9): %s\n", bdosText(mc))
 	} else if mc.rc == 2 {
 		if DEBUGMODE {
 			fmt.Printf("CONOUT (2): %s\n", string(mc.re))
 		} else {
-			fmt.Printf(string(mc.re)) // No carriage return
+			fmt.Print(string(mc.re)) // No carriage return
 		}
 	}
 }
@@ -242,46 +205,100 @@ func finalWrite() {
 	// of the remaining data
 	remainingBuffer := outputBuffer[0 : outputBufferLines*BYTESPERLINE]
 	n, err := connection.Write(remainingBuffer)
-	if n != len(outputBuffer) {
+	if n != len(remainingBuffer) {
 		fmt.Println("Could not write the entire buffer")
 		panic("Buffer not written")
 	}
 	if err != nil {
 		fmt.Printf("Error writing to buffer: %s", err)
 	}
+	connection.Close() // Lets the server know that the program has finished
 }
 
 // Runs the emulator in test mode for one instruction
 // Checks jumps to 0x0 and also calls to 0x5 (print to scree)
-func runTestROM() {
+func runTestROM() error {
 	emulation := newMicrocontroller()
-	args := os.Args[1:]
+	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Printf("%s <program> - Runs the test program <program>", os.Args[0])
-		return
+		fmt.Printf("%s <program> [arguments] - Runs the test program <program>", os.Args[0])
+		return nil
 	}
 
-	romName := args[len(args)-1]
+	romName := args[0]
 
 	if CLIENTMODE {
 		connect(romName)
 	}
 
-	rom := []uint8{}
-
-	rom = loadTestROM(romName)
-	emulation.programCounter = 0x100 // Hardcoded because the test ROMs start at 0x100
+	rom := make([]uint8, 0x10000)
+	loader := newProgramLoader(rom)
+	if err := loader.load(romName, 0x100); err != nil {
+		return err
+	}
+	for _, spec := range LOADFILES {
+		if err := loader.load(spec, 0); err != nil {
+			return err
+		}
+	}
+	emulation.programCounter = 0x100 // The test ROMs and CP/M programs start at 0x100
 	emulation.memory = &rom
-	(*emulation.memory)[5] = 0xC9 // Call RET after handling CALL 5 (call conout)
+	var system *bdos
+	if len(CPMDRIVES) > 0 {
+		console, closeConsole, err := openConsole()
+		if err != nil {
+			return err
+		}
+		defer closeConsole()
+		system = newBDOS(CPMDRIVES, console)
+		lines, err := openSerialLines(cpmSerialDevices...)
+		if err != nil {
+			return err
+		}
+		defer closeSerialLines(lines)
+		system.aux = lines["aux"]
+		system.install(emulation)
+		defer system.close()
+	} else {
+		(*emulation.memory)[5] = 0xC9 // Call RET after handling CALL 5 (call conout)
+	}
+	setCommandLine(*emulation.memory, args[1:])
+	startProgram(emulation, loader.entry) // After the BDOS has set up its stack
+	startTrace(emulation, TRACEFILE)
+	defer stopTrace()
+	startProfile(emulation, PPROFFILE, romName)
+	defer stopProfile()
+	startDebugger(emulation, DEBUGGER)
+	if len(loader.loaded) > 0 {
+		program := loader.loaded[0] // The ROM, which is loaded first
+		startCoverage(emulation, COVERAGEFILE, uint16(program.first), uint16(program.last+1))
+		defer stopCoverage()
+	}
 
 	for {
 		startAddress := emulation.programCounter
 		readyToWrite()
 		emulation.run()
 		writeRemoteOutput()
+		if emulation.stopped {
+			break
+		}
+
+		if system != nil && emulation.programCounter == bdosAddress {
+			system.call(emulation)
+		} else if system != nil && isBIOS(emulation.programCounter) {
+			system.callBIOS(emulation)
+		}
+
+		if emulation.halted {
+			fmt.Printf("OUTPUT: HLT at %04X\n", startAddress)
+			break
+		}
 
 		if emulation.programCounter == 0 {
-			fmt.Printf("OUTPUT: Jump to 0x0 from %04X\n", startAddress)
+			if system == nil || DEBUGMODE { // A CP/M program has just ended normally
+				fmt.Printf("OUTPUT: Jump to 0x0 from %04X\n", startAddress)
+			}
 			if DEBUGMODE {
 				memoryDump(emulation, 0x400)
 			}
@@ -289,37 +306,205 @@ func runTestROM() {
 				finalWrite()
 			}
 			break
-		} else if emulation.programCounter == 0x5 { // Error function was called
+		} else if emulation.programCounter == 0x5 && system == nil { // Error function was called
 			conout(emulation)
 		}
 	}
-
+	if system != nil && system.console.finished() {
+		return system.console.err
+	}
+	return nil
 }
 
-func runSpaceInvaders() {
+// runSpaceInvaders - Runs the game. Files given with -load replace its ROMs
+func runSpaceInvaders() error {
+	rom := make([]uint8, 0x10000)
+	if len(LOADFILES) == 0 {
+		var err error
+		if rom, err = loadSpaceInvaders(); err != nil {
+			return err
+		}
+	}
 	spaceInvaders := newGame()
 	spaceInvaders.mc = newMicrocontroller()
-	rom := loadSpaceInvaders()
+	spaceInvaders.mc.interrupts = spaceInvaders
 	spaceInvaders.mc.memory = &rom
+	if err := loadFiles(spaceInvaders.mc); err != nil {
+		return err
+	}
+	startTrace(spaceInvaders.mc, TRACEFILE)
+	startProfile(spaceInvaders.mc, PPROFFILE, "invaders")
+	startCoverage(spaceInvaders.mc, COVERAGEFILE, 0, 0x2000) // The ROM is 0000-1FFF
+	startDebugger(spaceInvaders.mc, DEBUGGER)
 	spaceInvaders.run()
+	stopTrace()
+	stopProfile()
+	stopCoverage()
+	return nil
+}
+
+// machines - The machines which can be selected with -machine
+var machines = map[string]func() error{
+	"invaders": runSpaceInvaders,
+	"altair":   runAltair,
+	"radio86":  runRadio86,
+}
+
+// machineNames - The machines in alphabetical order
+func machineNames() []string {
+	names := []string{}
+	for name := range machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subcommands - Tools which are run as "space_invaders <command> [options]"
+// instead of starting the emulator
+var subcommands = map[string]func(args []string) error{
+	"trace":      traceCommand,
+	"lockstep":   lockstepCommand,
+	"tracediff":  traceDiffCommand,
+	"suite":      suiteCommand,
+	"singlestep": singleStepCommand,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Parse command line flags
 	verboseFlag := flag.Bool("v", false, "Show every instruction being executed (slow)")
 	compareFlag := flag.Bool("c", false, "Instructions are output in the format of the i8080-core emulator")
 	serverFlag := flag.Bool("s", false, "Connect to a local server and write debug data to it")
 	testFlag := flag.Bool("t", false, "Start program in i8080-core test rom mode")
+	traceFlag := flag.String("trace", "", "Record every executed instruction to this binary trace file")
+	pprofFlag := flag.String("pprof", "", "Write a pprof profile of the emulated program to this file")
+	coverageFlag := flag.String("coverage", "", "Write a report of the executed instructions and opcodes to this file")
+	symbolFlag := flag.String("sym", "", "Load names for addresses from this symbol file (ADDR NAME or CP/M .SYM)")
+	listingFlag := flag.String("listing", "", "Load an assembler listing (.PRN/.LST) to show the source of each instruction")
+	debugFlag := flag.Bool("debug", false, "Start the program stopped in the debugger")
+	bootFlag := flag.String("boot", "", "Boot CP/M from these comma separated disk images (file or file:format) in drives A:, B:, ...")
+	diskDefsFlag := flag.String("diskdefs", "", "Load more disk formats for -boot from this cpmtools diskdefs file")
+	cpmFlag := flag.String("cpm", "", "Run the program under CP/M with these comma separated directories as drives A:, B:, ...")
+	terminalFlag := flag.String("terminal", TERMINAL, "The terminal CP/M programs are written for: "+strings.Join(terminalNames(), ", "))
+	scriptFlag := flag.String("script", "", "Type the CP/M console input with this script instead of reading stdin")
+	machineFlag := flag.String("machine", "invaders", "The machine to emulate: "+strings.Join(machineNames(), ", "))
+	flag.StringVar(&ALTAIRTAPE, "tape", "", "Altair: load this paper tape in the MITS checksum format and start it")
+	flag.StringVar(&ALTAIRREADER, "reader", "", "Altair: put this paper tape in the Teletype's reader")
+	flag.StringVar(&ALTAIRPANEL, "panel", "", "Altair: carry out the front panel operations in this file before running")
+	flag.StringVar(&ALTAIRCASSETTE, "cassette", "", "Altair: play this tape (a KCS WAV file) into the 88-ACR cassette interface")
+	flag.StringVar(&ALTAIRRECORD, "record", "", "Altair: save what is sent to the 88-ACR to this WAV file")
+	flag.IntVar(&SENSESWITCHES, "sense", -1, "Altair: the setting of the sense switches (A15-A8) when the program is started")
+	flag.StringVar(&ROMPATH, "roms", ".", "Where the Space Invaders ROMs are: a directory, which can have zip archives of them in it, or a zip archive")
+	flag.StringVar(&RADIO86ROM, "rom", "", "Radio-86RK: the monitor ROM")
+	flag.StringVar(&RADIO86CHARGEN, "chargen", "", "Radio-86RK: the character generator ROM, for -screenshot")
+	flag.StringVar(&SCREENSHOT, "screenshot", "", "Radio-86RK: write the screen to this PNG file at the end")
+	flag.Var(&LOADFILES, "load", "Load this file into memory first: Intel HEX (.hex or .ihx), or <file>[@<address>] for a raw binary (can be given more than once)")
+	flag.Func("pc", "The address to start the program at", func(text string) error {
+		address, ok := parseAddress(text)
+		if !ok {
+			return errors.New("not a hex address")
+		}
+		ENTRYPC = int(address)
+		return nil
+	})
+	flag.Func("sp", "The stack pointer to start the program with", func(text string) error {
+		address, ok := parseAddress(text)
+		if !ok {
+			return errors.New("not a hex address")
+		}
+		INITIALSP = int(address)
+		return nil
+	})
+	flag.Var(SERIALPORTS, "serial", "Bind a serial device to a TCP port or a pty: <device>=tcp:[host:]port|pty[,baud=<n>][,flow=none|xonxoff|rtscts][,raw][,wait]")
+	formatFlag := flag.String("format", "human", "Format of the -v output: "+strings.Join(traceFormatNames(), ", "))
 	flag.Parse()
 
-	COMPAREFLAG = *compareFlag
+	if *compareFlag {
+		*formatFlag = "i8080core"
+	}
+	if err := selectTraceFormat(*formatFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if SENSESWITCHES > 0xFF {
+		fmt.Fprintln(os.Stderr, "-sense must be 0 to 255")
+		os.Exit(2)
+	}
+	if *bootFlag != "" && (len(LOADFILES) > 0 || ENTRYPC >= 0 || INITIALSP >= 0) {
+		fmt.Fprintln(os.Stderr, "-load, -pc and -sp can't be used with -boot")
+		os.Exit(2)
+	}
+	if len(SERIALPORTS) > 0 && *bootFlag == "" && *cpmFlag == "" && *machineFlag != "altair" {
+		fmt.Fprintln(os.Stderr, "-serial is only for -machine altair, -cpm and -boot")
+		os.Exit(2)
+	}
+	if err := selectTerminal(*terminalFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	DEBUGMODE = *verboseFlag
 	CLIENTMODE = *serverFlag
 	TESTMODE = *testFlag
+	TRACEFILE = *traceFlag
+	PPROFFILE = *pprofFlag
+	COVERAGEFILE = *coverageFlag
+	DEBUGGER = *debugFlag
+	CONSOLESCRIPT = *scriptFlag
+	if *cpmFlag != "" {
+		CPMDRIVES = strings.Split(*cpmFlag, ",")
+		TESTMODE = true
+	}
+	if *symbolFlag != "" {
+		symbols, err := loadSymbols(*symbolFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		SYMBOLS = symbols
+	}
+	if *listingFlag != "" {
+		sources, err := loadListing(*listingFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		SOURCES = sources
+	}
 
-	if TESTMODE {
-		runTestROM()
+	if *diskDefsFlag != "" {
+		if err := cpmfs.LoadDiskDefs(*diskDefsFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *bootFlag != "" {
+		if err := bootCPM(strings.Split(*bootFlag, ",")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if TESTMODE {
+		if err := runTestROM(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if machine, ok := machines[*machineFlag]; ok {
+		if err := machine(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	} else {
-		runSpaceInvaders()
+		fmt.Fprintf(os.Stderr, "unknown machine %s (available: %s)\n", *machineFlag, strings.Join(machineNames(), ", "))
+		os.Exit(2)
 	}
 }
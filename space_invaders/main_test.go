@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain : The tests run with DEBUGMODE off, so the machines they run don't
+// print every instruction
+func TestMain(m *testing.M) {
+	DEBUGMODE = false
+	os.Exit(m.Run())
+}
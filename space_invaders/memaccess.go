@@ -0,0 +1,92 @@
+package main
+
+// memoryAccess - A single read or write of a byte of memory made by an instruction
+// (instruction fetches are not counted)
+type memoryAccess struct {
+	address uint16
+	value   uint8
+	write   bool
+}
+
+// maxMemoryAccesses - The most memory accesses any one instruction can make (XTHL)
+const maxMemoryAccesses = 4
+
+// predictMemoryAccesses - Works out which memory locations the instruction at the
+// program counter is going to touch. This must be called before the instruction is
+// executed because the addresses depend on the current register values.
+// Reads are filled in with the current memory contents; the values of writes are
+// only known once the instruction has run (see completeMemoryAccesses())
+func predictMemoryAccesses(mc *microcontroller, accesses []memoryAccess) []memoryAccess {
+	accesses = accesses[:0]
+	opcode := mc.fetch(0)
+	hl := mc.memoryReference()
+	sp := mc.stackPointer
+	read := func(address uint16) {
+		accesses = append(accesses, memoryAccess{address, (*mc.memory)[address], false})
+	}
+	write := func(address uint16) {
+		accesses = append(accesses, memoryAccess{address, 0, true})
+	}
+
+	switch {
+	case opcode == 0x76: // HLT
+	case opcode>>6 == 0x1: // MOV
+		if opcode&0x7 == 6 {
+			read(hl)
+		} else if (opcode>>3)&0x7 == 6 {
+			write(hl)
+		}
+	case opcode>>6 == 0x2 && opcode&0x7 == 6: // ADD M ... CMP M
+		read(hl)
+	case opcode == 0x34 || opcode == 0x35: // INR M, DCR M
+		read(hl)
+		write(hl)
+	case opcode == 0x36: // MVI M
+		write(hl)
+	case opcode == 0x0A: // LDAX B
+		read(uint16(mc.rb)<<8 | uint16(mc.rc))
+	case opcode == 0x1A: // LDAX D
+		read(uint16(mc.rd)<<8 | uint16(mc.re))
+	case opcode == 0x02: // STAX B
+		write(uint16(mc.rb)<<8 | uint16(mc.rc))
+	case opcode == 0x12: // STAX D
+		write(uint16(mc.rd)<<8 | uint16(mc.re))
+	case opcode == 0x3A: // LDA
+		read(mc.data16bit())
+	case opcode == 0x32: // STA
+		write(mc.data16bit())
+	case opcode == 0x2A: // LHLD
+		read(mc.data16bit())
+		read(mc.data16bit() + 1)
+	case opcode == 0x22: // SHLD
+		write(mc.data16bit())
+		write(mc.data16bit() + 1)
+	case opcode == 0xE3: // XTHL
+		read(sp)
+		read(sp + 1)
+		write(sp)
+		write(sp + 1)
+	case opcode&0xCF == 0xC1, opcode == 0xC9, isConditionalReturn(opcode): // POP, RET, Rcc
+		read(sp)
+		read(sp + 1)
+	case opcode&0xCF == 0xC5, opcode == 0xCD, isConditionalCall(opcode), opcode&0xC7 == 0xC7: // PUSH, CALL, Ccc, RST
+		write(sp - 2)
+		write(sp - 1)
+	}
+	return accesses
+}
+
+// completeMemoryAccesses - Fills in the values of the writes predicted by
+// predictMemoryAccesses() once the instruction has been executed. The stack accesses
+// of a conditional CALL or RET which wasn't taken are removed
+func completeMemoryAccesses(mc *microcontroller, accesses []memoryAccess) []memoryAccess {
+	if (isConditionalCall(mc.lastOpcode) || isConditionalReturn(mc.lastOpcode)) && !mc.lastBranchTaken {
+		return accesses[:0]
+	}
+	for i := range accesses {
+		if accesses[i].write {
+			accesses[i].value = (*mc.memory)[accesses[i].address]
+		}
+	}
+	return accesses
+}
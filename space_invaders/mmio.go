@@ -0,0 +1,102 @@
+package main
+
+// memoryDevice - A device which is read and written through the memory
+// address space instead of with IN and OUT. It is passed the address as it is,
+// so a device with several registers works them out from the low bits (which
+// also mirrors them across the rest of its range)
+type memoryDevice interface {
+	read(address uint16) uint8
+	write(address uint16, value uint8)
+}
+
+// portsInMemory - Maps an I/O device (ie: one of the peripheral chips) into
+// memory. It is passed the low byte of the address as its port
+type portsInMemory struct {
+	device ioBus
+}
+
+func (p portsInMemory) read(address uint16) uint8 {
+	return p.device.input(uint8(address))
+}
+
+func (p portsInMemory) write(address uint16, value uint8) {
+	p.device.output(uint8(address), value)
+}
+
+// memoryMap - Memory mapped I/O and ROM for machines which need more than the
+// flat 64K of RAM the CPU reads and writes directly. It is a hook: before each
+// instruction the memory it is going to read is filled in from the devices
+// mapped there, and afterwards what it wrote is passed to the devices and
+// anything written to ROM is put back. Devices are mapped in 256 byte pages.
+// It must be added before any other hooks, so that they see what the devices
+// returned
+type memoryMap struct {
+	readers  [256]memoryDevice
+	writers  [256]memoryDevice
+	readOnly [256]bool
+
+	buffer   [maxMemoryAccesses]memoryAccess
+	accesses []memoryAccess
+	saved    [maxMemoryAccesses]uint8 // What was in ROM before the instruction wrote to it
+}
+
+func newMemoryMap(mc *microcontroller) *memoryMap {
+	m := &memoryMap{}
+	mc.addHook(m)
+	return m
+}
+
+// mapReads - Reads from first to last (inclusive) go to the device
+func (m *memoryMap) mapReads(first uint16, last uint16, device memoryDevice) {
+	for page := int(first >> 8); page <= int(last>>8); page++ {
+		m.readers[page] = device
+	}
+}
+
+// mapWrites - Writes from first to last (inclusive) go to the device
+func (m *memoryMap) mapWrites(first uint16, last uint16, device memoryDevice) {
+	for page := int(first >> 8); page <= int(last>>8); page++ {
+		m.writers[page] = device
+	}
+}
+
+// mapDevice - Both reads and writes from first to last go to the device
+func (m *memoryMap) mapDevice(first uint16, last uint16, device memoryDevice) {
+	m.mapReads(first, last, device)
+	m.mapWrites(first, last, device)
+}
+
+// protect - Makes first to last ROM. Writes there can still go to a device
+func (m *memoryMap) protect(first uint16, last uint16) {
+	for page := int(first >> 8); page <= int(last>>8); page++ {
+		m.readOnly[page] = true
+	}
+}
+
+func (m *memoryMap) beforeInstruction(mc *microcontroller) {
+	m.accesses = predictMemoryAccesses(mc, m.buffer[:])
+	for i, access := range m.accesses {
+		page := access.address >> 8
+		if access.write {
+			m.saved[i] = (*mc.memory)[access.address]
+		} else if device := m.readers[page]; device != nil {
+			(*mc.memory)[access.address] = device.read(access.address)
+		}
+	}
+}
+
+func (m *memoryMap) afterInstruction(mc *microcontroller) {
+	m.accesses = completeMemoryAccesses(mc, m.accesses)
+	for i, access := range m.accesses {
+		if !access.write {
+			continue
+		}
+		page := access.address >> 8
+		if device := m.writers[page]; device != nil {
+			device.write(access.address, access.value)
+		}
+		if m.readOnly[page] {
+			(*mc.memory)[access.address] = m.saved[i]
+		}
+	}
+}
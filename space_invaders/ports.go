@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+)
+
+// portBus - An ioBus for a machine made of several devices. Each device is
+// attached to a range of ports and is passed the port number as it is, so a
+// device with several registers works out which one from the port. Reading a
+// port which nothing is attached to gives 0xFF, as the data bus floats high
+type portBus struct {
+	devices [256]ioBus
+}
+
+func newPortBus() *portBus {
+	return &portBus{}
+}
+
+// attach - Connects a device to count ports from first
+func (b *portBus) attach(first uint8, count int, device ioBus) {
+	for port := int(first); port < int(first)+count; port++ {
+		if b.devices[port] != nil {
+			panic(fmt.Sprintf("port %02X already has a device", port))
+		}
+		b.devices[port] = device
+	}
+}
+
+func (b *portBus) input(port uint8) uint8 {
+	if device := b.devices[port]; device != nil {
+		return device.input(port)
+	}
+	return 0xFF
+}
+
+func (b *portBus) output(port uint8, value uint8) {
+	if device := b.devices[port]; device != nil {
+		device.output(port, value)
+	}
+}
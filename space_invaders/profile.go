@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Profiles the emulated program (not the emulator) and writes the result in
+// the pprof format so that it can be looked at with "go tool pprof".
+//
+// Every subroutine entry point becomes a function and every instruction a
+// location in that function. The call stack is rebuilt from the CALL, RST and
+// RET instructions (and from interrupts, which push the program counter
+// without executing an instruction). A subroutine is considered to have
+// returned once the stack pointer is back at or above where it was before the
+// call, so code which pops its return address and jumps somewhere else does
+// not leave stale frames behind.
+
+// CPUFREQUENCY - Clock speed used to turn cycles into time in the profile
+const CPUFREQUENCY = 2000000
+
+// profileNode - A unique call stack: a subroutine called from a specific
+// instruction of its caller's call stack
+type profileNode struct {
+	entry    uint16 // Address of the subroutine
+	callSite uint16 // Address of the CALL in the parent
+	parent   *profileNode
+	children map[[2]uint16]*profileNode // Keyed by call site and entry
+	leaves   map[uint16]*[2]int64       // Instructions and cycles by address
+}
+
+func newProfileNode(parent *profileNode, callSite uint16, entry uint16) *profileNode {
+	return &profileNode{entry: entry, callSite: callSite, parent: parent,
+		children: map[[2]uint16]*profileNode{}, leaves: map[uint16]*[2]int64{}}
+}
+
+// profileFrame - An active subroutine call
+type profileFrame struct {
+	node     *profileNode
+	returnSP uint16 // Stack pointer before the return address was pushed
+}
+
+// profiler - An instructionHook which counts the instructions and cycles
+// executed for each call stack
+type profiler struct {
+	root   *profileNode
+	stack  []profileFrame
+	lastSP uint16 // Stack pointer after the previous instruction
+}
+
+func newProfiler() *profiler {
+	return &profiler{}
+}
+
+func isCallInstruction(opcode uint8) bool {
+	return opcode == 0xCD || opcode == 0xDD || opcode == 0xED || opcode == 0xFD ||
+		isConditionalCall(opcode) || opcode&0xC7 == 0xC7
+}
+
+func (p *profiler) top() *profileFrame {
+	return &p.stack[len(p.stack)-1]
+}
+
+func (p *profiler) push(mc *microcontroller, callSite uint16, returnSP uint16) {
+	parent := p.top().node
+	key := [2]uint16{callSite, mc.programCounter}
+	node, ok := parent.children[key]
+	if !ok {
+		node = newProfileNode(parent, callSite, mc.programCounter)
+		parent.children[key] = node
+	}
+	p.stack = append(p.stack, profileFrame{node, returnSP})
+}
+
+// popReturned - Removes the frames of subroutines which the stack pointer shows have returned
+func (p *profiler) popReturned(sp uint16) {
+	// The stack grows down and may wrap around, so compare the distance
+	for len(p.stack) > 1 && int16(sp-p.top().returnSP) >= 0 {
+		p.stack = p.stack[:len(p.stack)-1]
+	}
+}
+
+func (p *profiler) beforeInstruction(mc *microcontroller) {
+	if p.root == nil {
+		p.root = newProfileNode(nil, 0, mc.programCounter)
+		p.stack = []profileFrame{{p.root, mc.stackPointer}}
+		p.lastSP = mc.stackPointer
+	}
+	switch {
+	case mc.stackPointer == p.lastSP-2: // An interrupt pushed the program counter
+		memory := *mc.memory
+		returnAddress := uint16(memory[mc.stackPointer]) | uint16(memory[mc.stackPointer+1])<<8
+		p.push(mc, returnAddress, p.lastSP)
+	case mc.stackPointer != p.lastSP:
+		p.popReturned(mc.stackPointer)
+	}
+}
+
+func (p *profiler) afterInstruction(mc *microcontroller) {
+	counts, ok := p.top().node.leaves[mc.lastPC]
+	if !ok {
+		counts = &[2]int64{}
+		p.top().node.leaves[mc.lastPC] = counts
+	}
+	counts[0]++
+	counts[1] += int64(mc.lastCycles)
+
+	if isCallInstruction(mc.lastOpcode) && mc.stackPointer == mc.lastSP-2 {
+		p.push(mc, mc.lastPC, mc.lastSP)
+	} else if mc.stackPointer != mc.lastSP {
+		p.popReturned(mc.stackPointer)
+	}
+	p.lastSP = mc.stackPointer
+}
+
+// profileLocation - An instruction in a subroutine
+type profileLocation struct {
+	function uint16
+	address  uint16
+}
+
+// samples - Calls f for every instruction of every call stack that was executed.
+// stack starts with the instruction itself, followed by the calls leading to it
+func (p *profiler) samples(f func(stack []profileLocation, instructions int64, cycles int64)) {
+	var walk func(node *profileNode)
+	walk = func(node *profileNode) {
+		addresses := make([]int, 0, len(node.leaves))
+		for address := range node.leaves {
+			addresses = append(addresses, int(address))
+		}
+		sort.Ints(addresses)
+		for _, address := range addresses {
+			stack := []profileLocation{{node.entry, uint16(address)}}
+			for n := node; n.parent != nil; n = n.parent {
+				stack = append(stack, profileLocation{n.parent.entry, n.callSite})
+			}
+			counts := node.leaves[uint16(address)]
+			f(stack, counts[0], counts[1])
+		}
+		keys := make([][2]uint16, 0, len(node.children))
+		for key := range node.children {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+		})
+		for _, key := range keys {
+			walk(node.children[key])
+		}
+	}
+	if p.root != nil {
+		walk(p.root)
+	}
+}
+
+// addressName - The name of the function starting at address
+func addressName(address uint16) string {
+	if name, ok := SYMBOLS.lookup(address); ok {
+		return name
+	}
+	return fmt.Sprintf("%04X", address)
+}
+
+// protoBuffer - Just enough of the protocol buffer wire format to write a profile.proto
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(value uint64) {
+	for value >= 0x80 {
+		*b = append(*b, uint8(value)|0x80)
+		value >>= 7
+	}
+	*b = append(*b, uint8(value))
+}
+
+func (b *protoBuffer) uint64Field(field int, value uint64) {
+	if value != 0 {
+		b.varint(uint64(field) << 3)
+		b.varint(value)
+	}
+}
+
+func (b *protoBuffer) bytesField(field int, value []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(value)))
+	*b = append(*b, value...)
+}
+
+func (b *protoBuffer) packedField(field int, values []uint64) {
+	packed := protoBuffer{}
+	for _, value := range values {
+		packed.varint(value)
+	}
+	b.bytesField(field, packed)
+}
+
+// writeProfile - Writes the profile as a gzipped profile.proto (see
+// https://github.com/google/pprof/blob/master/proto/profile.proto)
+func (p *profiler) writeProfile(out io.Writer, programName string) error {
+	profile := protoBuffer{}
+	strings := []string{""}
+	stringIndex := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		index, ok := stringIndex[s]
+		if !ok {
+			index = uint64(len(strings))
+			strings = append(strings, s)
+			stringIndex[s] = index
+		}
+		return index
+	}
+	valueType := func(kind string, unit string) protoBuffer {
+		message := protoBuffer{}
+		message.uint64Field(1, str(kind))
+		message.uint64Field(2, str(unit))
+		return message
+	}
+
+	profile.bytesField(1, valueType("instructions", "count")) // sample_type
+	profile.bytesField(1, valueType("cycles", "count"))
+
+	functions := map[uint16]uint64{}
+	functionBuffer := protoBuffer{}
+	locations := map[profileLocation]uint64{}
+	totalCycles := int64(0)
+	p.samples(func(stack []profileLocation, instructions int64, cycles int64) {
+		ids := make([]uint64, len(stack))
+		for i, location := range stack {
+			functionID, ok := functions[location.function]
+			if !ok {
+				functionID = uint64(len(functions) + 1)
+				functions[location.function] = functionID
+				function := protoBuffer{}
+				function.uint64Field(1, functionID)
+				function.uint64Field(2, str(addressName(location.function)))
+				function.uint64Field(4, str(programName))
+				function.uint64Field(5, uint64(location.function))
+				functionBuffer.bytesField(5, function)
+			}
+			id, ok := locations[location]
+			if !ok {
+				id = uint64(len(locations) + 1)
+				locations[location] = id
+				line := protoBuffer{}
+				line.uint64Field(1, functionID)
+				line.uint64Field(2, uint64(location.address))
+				message := protoBuffer{}
+				message.uint64Field(1, id)
+				message.uint64Field(2, 1) // mapping
+				message.uint64Field(3, uint64(location.address))
+				message.bytesField(4, line)
+				profile.bytesField(4, message)
+			}
+			ids[i] = id
+		}
+		sample := protoBuffer{}
+		sample.packedField(1, ids)
+		sample.packedField(2, []uint64{uint64(instructions), uint64(cycles)})
+		profile.bytesField(2, sample)
+		totalCycles += cycles
+	})
+	profile = append(profile, functionBuffer...)
+
+	mapping := protoBuffer{}
+	mapping.uint64Field(1, 1)
+	mapping.uint64Field(3, 0x10000)
+	mapping.uint64Field(5, str(programName))
+	mapping.uint64Field(7, 1)  // has_functions
+	mapping.uint64Field(9, 1)  // has_line_numbers
+	mapping.uint64Field(10, 1) // has_inline_frames
+	profile.bytesField(3, mapping)
+
+	profile.uint64Field(10, uint64(totalCycles*1000000000/CPUFREQUENCY)) // duration_nanos
+	profile.bytesField(11, valueType("cycles", "count"))                 // period_type
+	profile.uint64Field(12, 1)                                           // period
+	profile.uint64Field(14, str("cycles"))                               // default_sample_type
+	for _, s := range strings {
+		profile.bytesField(6, []byte(s))
+	}
+
+	compressed := gzip.NewWriter(out)
+	if _, err := compressed.Write(profile); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+var profilerHook *profiler
+var profileFile, profileProgram string
+
+// startProfile - Attaches a profiler to the microcontroller if -pprof was given
+func startProfile(mc *microcontroller, fileName string, programName string) {
+	if fileName == "" {
+		return
+	}
+	profilerHook = newProfiler()
+	profileFile, profileProgram = fileName, programName
+	mc.addHook(profilerHook)
+}
+
+// stopProfile - Writes the profile started by startProfile()
+func stopProfile() {
+	if profilerHook == nil {
+		return
+	}
+	file, err := os.Create(profileFile)
+	if err == nil {
+		out := bufio.NewWriter(file)
+		err = profilerHook.writeProfile(out, profileProgram)
+		if err == nil {
+			err = out.Flush()
+		}
+		file.Close()
+	}
+	if err != nil {
+		fmt.Printf("Error while writing the profile: %s\n", err)
+	}
+	profilerHook = nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+// TestProfilerCallStacks : Cycles are attributed to the subroutine that executed them and its callers
+func TestProfilerCallStacks(t *testing.T) {
+	memory := make([]uint8, 65536)
+	copy(memory, []uint8{
+		0x31, 0x00, 0x20, // 0000 LXI SP, 0x2000
+		0xCD, 0x10, 0x00, // 0003 CALL 0x0010
+		0xCD, 0x10, 0x00, // 0006 CALL 0x0010
+		0x76, // 0009 HLT
+	})
+	copy(memory[0x10:], []uint8{
+		0xCD, 0x20, 0x00, // 0010 CALL 0x0020
+		0xC9, // 0013 RET
+	})
+	copy(memory[0x20:], []uint8{
+		0xE1, // 0020 POP H (the return address is dropped...)
+		0xE9, // 0021 PCHL (...and jumped to instead of using RET)
+	})
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	p := newProfiler()
+	mc.addHook(p)
+	for mc.programCounter != 0x9 {
+		mc.run()
+	}
+
+	cycles := map[string]int64{}
+	p.samples(func(stack []profileLocation, instructions int64, count int64) {
+		key := ""
+		for _, location := range stack {
+			key += addressName(location.function) + ":" + addressName(location.address) + " "
+		}
+		cycles[key] += count
+	})
+	expected := map[string]int64{
+		"0000:0000 ":                     10,
+		"0000:0003 ":                     17,
+		"0000:0006 ":                     17,
+		"0010:0010 0000:0003 ":           17,
+		"0010:0013 0000:0003 ":           10,
+		"0010:0010 0000:0006 ":           17,
+		"0010:0013 0000:0006 ":           10,
+		"0020:0020 0010:0010 0000:0003 ": 10,
+		"0010:0021 0000:0003 ":           5, // Counts as returned once its return address is popped
+		"0020:0020 0010:0010 0000:0006 ": 10,
+		"0010:0021 0000:0006 ":           5,
+	}
+	for key, value := range expected {
+		if cycles[key] != value {
+			t.Errorf("%s: expected %d cycles, got %d", key, value, cycles[key])
+		}
+	}
+	if len(cycles) != len(expected) {
+		t.Errorf("Unexpected call stacks: %v", cycles)
+	}
+
+	out := &bytes.Buffer{}
+	if err := p.writeProfile(out, "test"); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(reader); err != nil || len(data) == 0 {
+		t.Errorf("Could not read back the profile: %s", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPty - Creates a pseudo-terminal. The emulator uses the master and the
+// slave (/dev/pts/N) is what a terminal program opens. The slave is kept open
+// too, so that the master doesn't see the end of the input each time a program
+// closes it, and is put into raw mode so that the characters get through as
+// they are
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, number := int32(0), uint32(0)
+	if err := ptyIoctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if err := ptyIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var settings syscall.Termios
+	if err := termios(slave, ioctlGetTermios, &settings); err == nil {
+		settings.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		settings.Oflag &^= syscall.OPOST
+		settings.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		settings.Cflag = settings.Cflag&^(syscall.CSIZE|syscall.PARENB) | syscall.CS8
+		settings.Cc[syscall.VMIN], settings.Cc[syscall.VTIME] = 1, 0
+		err = termios(slave, ioctlSetTermios, &settings)
+	}
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func ptyIoctl(file *os.File, request uintptr, argument unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(argument))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openPty - Pseudo-terminals are only supported on Linux
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pseudo-terminals are only supported on Linux")
+}
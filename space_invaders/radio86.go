@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// The Radio-86RK, a Soviet home computer built around the KR580VM80A (the 8080
+// clone this emulator was written for). Its memory map is
+//
+//	0000-7FFF  RAM. The screen is at 76D0-7FF3 (78x30, of which 64x25 are visible)
+//	8000-9FFF  8255 keyboard interface (4 registers, repeated)
+//	C000-DFFF  8275 CRT controller (2 registers, repeated)
+//	E000-FFFF  8257 DMA controller (writes only). The monitor ROM is read at the top
+//
+// The 8275 gets the screen through channel 2 of the 8257, which the monitor
+// sets up to reload itself every frame. The CPU starts in the monitor: the
+// hardware maps the ROM at 0 after a reset until its first jump into it.
+
+// RADIO86ROM - The monitor ROM (2K at F800, or 4K at F000)
+var RADIO86ROM = ""
+
+// RADIO86CHARGEN - The character generator ROM, used for -screenshot
+var RADIO86CHARGEN = ""
+
+// SCREENSHOT - A PNG file to write the screen to when the emulation ends
+var SCREENSHOT = ""
+
+const (
+	radio86Clock       = 1777777           // CPU cycles per second
+	radio86FramePeriod = radio86Clock / 50 // CPU cycles per frame
+	radio86KeyHold     = radio86Clock / 20 // How long a key is held down once the program has seen it, and up
+	radio86IdleFrames  = 50                // Frames to keep running after the last key, once the input has ended
+	radio86PaintFrames = 5                 // How often the screen is drawn on the host's terminal
+	radio86CharWidth   = 6                 // The width of a character in pixels
+)
+
+// radio86Key - Where a key is in the keyboard matrix: its line is the bit of
+// port A which selects it and its bit is the one it pulls low in port B.
+// Shift (СС) and control (УС) are read on port C
+type radio86Key struct {
+	line    int
+	bit     int
+	shift   bool
+	control bool
+}
+
+// radio86Specials - The keys in the first two lines of the matrix, by the
+// code the monitor returns for them
+var radio86Specials = map[uint8]radio86Key{
+	0x0C: {0, 0, false, false}, // Home (\)
+	0x1F: {0, 1, false, false}, // Clear screen (СТР)
+	0x1B: {0, 2, false, false}, // AR2
+	0x09: {1, 0, false, false}, // Tab
+	0x0A: {1, 1, false, false}, // Line feed (ПС)
+	0x0D: {1, 2, false, false}, // Return (ВК)
+	0x7F: {1, 3, false, false}, // Rubout (ЗБ)
+	0x08: {1, 4, false, false}, // Left
+	0x19: {1, 5, false, false}, // Up
+	0x18: {1, 6, false, false}, // Right
+	0x1A: {1, 7, false, false}, // Down
+	' ':  {7, 7, false, false},
+}
+
+// radio86KeyFor - The key which types a character. Lines 2 to 7 hold 0-9 :;,-./
+// @A-Z[\]^ in order, and shift gives the characters 10 hex below the digits
+// and punctuation. Lower case letters are typed as upper case
+func radio86KeyFor(char uint8) (radio86Key, bool) {
+	if key, ok := radio86Specials[char]; ok {
+		return key, true
+	}
+	shift, control := false, false
+	switch {
+	case char >= 'a' && char <= 'z':
+		char -= 0x20
+	case char > ' ' && char < '0':
+		char, shift = char^0x10, true
+	case char >= 0x01 && char <= 0x1A:
+		char, control = char+0x40, true
+	}
+	if char < '0' || char > '^' {
+		return radio86Key{}, false
+	}
+	code := int(char) - 0x20
+	return radio86Key{line: code / 8, bit: code % 8, shift: shift, control: control}, true
+}
+
+// radio86Keyboard - The keyboard matrix, typing the console input. Each key is
+// held down until the program has scanned it for radio86KeyHold cycles and then
+// released for as long, so that keys typed ahead aren't lost while it is busy
+type radio86Keyboard struct {
+	console *cpmConsole
+	mc      *microcontroller
+	lines   uint8 // The lines selected by port A (active low)
+	key     radio86Key
+	pressed bool
+	seen    int64 // When the program first scanned the key (or no key) as it is now. -1 if it hasn't
+}
+
+func newRadio86Keyboard(console *cpmConsole, mc *microcontroller) *radio86Keyboard {
+	return &radio86Keyboard{console: console, mc: mc, lines: 0xFF, seen: -1}
+}
+
+// next - The next key typed which is on the keyboard
+func (k *radio86Keyboard) next() (radio86Key, bool) {
+	for len(k.console.keys) > 0 {
+		char, ok := k.console.read()
+		if !ok {
+			break
+		}
+		if key, ok := radio86KeyFor(char); ok {
+			return key, true
+		}
+	}
+	return radio86Key{}, false
+}
+
+// rows - Port B: the keys pressed in the selected lines (active low)
+func (k *radio86Keyboard) rows() uint8 {
+	now := k.mc.cycles
+	if k.seen >= 0 && now-k.seen >= radio86KeyHold {
+		if k.pressed {
+			k.pressed, k.seen = false, -1
+		} else if key, ok := k.next(); ok {
+			k.key, k.pressed, k.seen = key, true, -1
+		}
+	}
+	rows := uint8(0xFF)
+	if k.pressed && k.lines&(1<<uint(k.key.line)) == 0 {
+		rows &^= 1 << uint(k.key.bit)
+		if k.seen < 0 {
+			k.seen = now
+		}
+	} else if !k.pressed && k.seen < 0 {
+		k.seen = now
+	}
+	return rows
+}
+
+// modifiers - Port C: shift (bit 5), control (bit 6) and РУС/ЛАТ (bit 7), active low
+func (k *radio86Keyboard) modifiers() uint8 {
+	modifiers := uint8(0xFF)
+	if k.pressed && k.key.shift {
+		modifiers &^= 0x20
+	}
+	if k.pressed && k.key.control {
+		modifiers &^= 0x40
+	}
+	return modifiers
+}
+
+// idle - Whether every key has been typed and the input has ended
+func (k *radio86Keyboard) idle() bool {
+	return !k.pressed && k.console.finished()
+}
+
+// radio86 - The machine
+type radio86 struct {
+	mc       *microcontroller
+	keyboard *radio86Keyboard
+	ppi      *ppi8255
+	crt      *crt8275
+	dma      *dma8257
+}
+
+func newRadio86(rom []uint8, console *cpmConsole) (*radio86, error) {
+	if len(rom) == 0 || len(rom) > 0x1000 {
+		return nil, fmt.Errorf("the monitor ROM is %d bytes; expected 2K or 4K", len(rom))
+	}
+	memory := make([]uint8, 0x10000)
+	start := uint16(0x10000 - len(rom))
+	copy(memory[start:], rom)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	mc.programCounter = start
+
+	r := &radio86{mc: mc, ppi: newPPI8255(), dma: newDMA8257(&memory)}
+	r.keyboard = newRadio86Keyboard(console, mc)
+	r.ppi.write[0] = func(value uint8) { r.keyboard.lines = value }
+	r.ppi.read[1] = r.keyboard.rows
+	r.ppi.read[2] = r.keyboard.modifiers
+	r.crt = newCRT8275(radio86FramePeriod, func() (uint8, bool) { return r.dma.transfer(2) })
+
+	memoryMap := newMemoryMap(mc)
+	memoryMap.mapDevice(0x8000, 0x9FFF, portsInMemory{r.ppi})
+	memoryMap.mapDevice(0xC000, 0xDFFF, portsInMemory{r.crt})
+	memoryMap.mapWrites(0xE000, 0xFFFF, portsInMemory{r.dma})
+	memoryMap.protect(start, 0xFFFF)
+	return r, nil
+}
+
+// runFrame - Runs the CPU until the next frame has been drawn
+func (r *radio86) runFrame() {
+	frames := r.crt.frames
+	for r.crt.frames == frames && !r.mc.stopped {
+		r.mc.run()
+		r.crt.update(r.mc.cycles)
+	}
+}
+
+// radio86Cyrillic - Characters 60-7F: the upper case Cyrillic letters of KOI-7
+var radio86Cyrillic = []rune("ЮАБЦДЕФГХИЙКЛМНОПЯРСТУЖВЬЫЗШЭЩЧ█")
+
+// screenText - The rows of the last frame as text. The graphics characters
+// (00-1F) are shown as spaces
+func (r *radio86) screenText() []string {
+	lines := []string{}
+	for _, row := range r.crt.screen {
+		line := make([]rune, len(row))
+		for x, cell := range row {
+			switch {
+			case cell.char < 0x20:
+				line[x] = ' '
+			case cell.char < 0x60:
+				line[x] = rune(cell.char)
+			default:
+				line[x] = radio86Cyrillic[cell.char-0x60]
+			}
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// renderScreen - Draws the last frame with the character generator, which has
+// 8 bytes for each character with its pixels in bits 5-0, where 0 is lit
+func (r *radio86) renderScreen(chargen []uint8) *image.Gray {
+	crt := r.crt
+	lines := crt.linesPerRow
+	screen := image.NewGray(image.Rect(0, 0, crt.charsPerRow*radio86CharWidth, len(crt.screen)*lines))
+	for y, row := range crt.screen {
+		for x, cell := range row {
+			cursor := x == crt.cursorX && y == crt.cursorY
+			for line := 0; line < lines; line++ {
+				pixels := uint8(0)
+				if line < 8 && int(cell.char)*8+line < len(chargen) {
+					pixels = ^chargen[int(cell.char)*8+line] & 0x3F
+				}
+				if (cell.underline || cursor && crt.cursorFormat&1 != 0) && line == crt.underline {
+					pixels = 0x3F
+				}
+				if cell.reverse != (cursor && crt.cursorFormat&1 == 0) {
+					pixels ^= 0x3F
+				}
+				for bit := 0; bit < radio86CharWidth; bit++ {
+					if pixels&(0x20>>uint(bit)) != 0 {
+						screen.SetGray(x*radio86CharWidth+bit, y*lines+line, color.Gray{0xFF})
+					}
+				}
+			}
+		}
+	}
+	return screen
+}
+
+// screenPainter - Draws the screen on an ANSI terminal, sending only the parts
+// which have changed (so that a script only sees new text)
+type screenPainter struct {
+	out    io.Writer
+	last   [][]rune
+	cursor [2]int
+}
+
+func (p *screenPainter) paint(lines []string, cursorX int, cursorY int) {
+	output := &strings.Builder{}
+	if p.last == nil {
+		output.WriteString("\x1b[H\x1b[2J")
+	}
+	for y, line := range lines {
+		runes := []rune(line)
+		previous := []rune{}
+		if y < len(p.last) {
+			previous = p.last[y]
+		}
+		first, last := -1, -1
+		for x := range runes {
+			if x >= len(previous) || runes[x] != previous[x] {
+				if first < 0 {
+					first = x
+				}
+				last = x
+			}
+		}
+		if first >= 0 {
+			fmt.Fprintf(output, "\x1b[%d;%dH%s", y+1, first+1, string(runes[first:last+1]))
+		}
+		if y < len(p.last) {
+			p.last[y] = runes
+		} else {
+			p.last = append(p.last, runes)
+		}
+	}
+	if output.Len() > 0 || p.cursor != [2]int{cursorX, cursorY} {
+		fmt.Fprintf(output, "\x1b[%d;%dH", cursorY+1, cursorX+1)
+		p.cursor = [2]int{cursorX, cursorY}
+		io.WriteString(p.out, output.String())
+	}
+}
+
+// runRadio86 - Implements -machine radio86: runs the monitor ROM with the screen
+// drawn on the terminal, until the program halts or the input has ended. When
+// stdout isn't a terminal, the last screen is printed as text instead
+func runRadio86() error {
+	if RADIO86ROM == "" {
+		return errors.New("the Radio-86RK needs its monitor ROM, given with -rom <file>")
+	}
+	rom, err := readFile(RADIO86ROM)
+	if err != nil {
+		return err
+	}
+	chargen := []uint8{}
+	if RADIO86CHARGEN != "" {
+		if chargen, err = readFile(RADIO86CHARGEN); err != nil {
+			return err
+		}
+	} else if SCREENSHOT != "" {
+		return errors.New("-screenshot needs the character generator ROM, given with -chargen <file>")
+	}
+
+	live := isTerminal(os.Stdout)
+	output := io.Writer(os.Stdout)
+	if !live {
+		output = ioutil.Discard // Drawn for the script only
+	}
+	console, closeConsole, err := openConsoleOn(output, "ansi")
+	if err != nil {
+		return err
+	}
+	defer closeConsole()
+	machine, err := newRadio86(rom, console)
+	if err != nil {
+		return fmt.Errorf("%s: %s", RADIO86ROM, err)
+	}
+	if err := loadFiles(machine.mc); err != nil {
+		return err
+	}
+
+	startTrace(machine.mc, TRACEFILE)
+	defer stopTrace()
+	startProfile(machine.mc, PPROFFILE, RADIO86ROM)
+	defer stopProfile()
+	startCoverage(machine.mc, COVERAGEFILE, 0, 0xFFFF)
+	defer stopCoverage()
+	startDebugger(machine.mc, DEBUGGER)
+
+	painter := &screenPainter{out: console.out}
+	realTime := live && CONSOLESCRIPT == "" && isTerminal(os.Stdin)
+	started := time.Now()
+	for frame, idle := int64(1), 0; !machine.mc.halted && !machine.mc.stopped && idle < radio86IdleFrames; frame++ {
+		machine.runFrame()
+		if frame%radio86PaintFrames == 0 {
+			painter.paint(machine.screenText(), machine.crt.cursorX, machine.crt.cursorY)
+		}
+		if machine.keyboard.idle() {
+			idle++
+		} else {
+			idle = 0
+		}
+		if realTime {
+			time.Sleep(time.Until(started.Add(time.Duration(frame) * time.Second / 50)))
+		}
+	}
+	painter.paint(machine.screenText(), machine.crt.cursorX, machine.crt.cursorY)
+	if live {
+		fmt.Printf("\x1b[%d;1H\r\n", len(painter.last)+1)
+	} else {
+		text := strings.TrimRight(strings.Join(machine.screenText(), "\n"), " \n")
+		for _, line := range strings.Split(text, "\n") {
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+	}
+
+	if SCREENSHOT != "" {
+		file, err := os.Create(SCREENSHOT)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := png.Encode(file, machine.renderScreen(chargen)); err != nil {
+			return err
+		}
+	}
+	return console.err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// radio86Init - Sets up the screen the way the monitor does, writes HIЮ at the
+// top left of the visible part and then writes to the ROM
+var radio86Init = []uint8{
+	0x21, 0x01, 0xC0, // LXI H,0C001H
+	0x36, 0x00, // MVI M,0 (reset)
+	0x2B,       // DCX H
+	0x36, 0x4D, // MVI M,4DH (78 characters)
+	0x36, 0x1D, // MVI M,1DH (30 rows)
+	0x36, 0x99, // MVI M,99H
+	0x36, 0x93, // MVI M,93H (transparent attributes)
+	0x23,       // INX H
+	0x36, 0x27, // MVI M,27H (start display)
+	0x7E,       // MOV A,M (wait for the vertical retrace)
+	0xE6, 0x20, // ANI 20H
+	0xCA, 0x11, 0x00, // JZ 0011H
+	0x21, 0x08, 0xE0, // LXI H,0E008H
+	0x36, 0x80, // MVI M,80H (autoload)
+	0x2E, 0x04, // MVI L,4
+	0x36, 0xD0, // MVI M,0D0H
+	0x36, 0x76, // MVI M,76H (channel 2 from 76D0)
+	0x2C,       // INR L
+	0x36, 0x23, // MVI M,23H
+	0x36, 0x49, // MVI M,49H (read 924H bytes)
+	0x2E, 0x08, // MVI L,8
+	0x36, 0xA4, // MVI M,0A4H (enable channel 2)
+	0x21, 0xC2, 0x77, // LXI H,77C2H
+	0x36, 'H', // MVI M,'H'
+	0x23,      // INX H
+	0x36, 'I', // MVI M,'I'
+	0x23,       // INX H
+	0x36, 0x60, // MVI M,60H
+	0x3E, 0x55, // MVI A,55H
+	0x32, 0x00, 0xF9, // STA 0F900H
+	0x76, // HLT
+}
+
+func TestRadio86Screen(t *testing.T) {
+	rom := bytes.Repeat([]uint8{0xAA}, 0x800)
+	machine, err := newRadio86(rom, newCPMConsole(strings.NewReader(""), &bytes.Buffer{}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if machine.mc.programCounter != 0xF800 {
+		t.Errorf("Expected to start in the monitor at F800, not %04X", machine.mc.programCounter)
+	}
+	copy(*machine.mc.memory, radio86Init)
+	machine.mc.programCounter = 0
+	for frame := 0; frame < 5; frame++ {
+		machine.runFrame()
+	}
+	if !machine.mc.halted {
+		t.Fatalf("Expected the program to halt, it is at %04X", machine.mc.programCounter)
+	}
+	if (*machine.mc.memory)[0xF900] != 0xAA {
+		t.Errorf("Expected the ROM not to be written")
+	}
+
+	screen := machine.screenText()
+	if len(screen) != 30 || len([]rune(screen[0])) != 78 {
+		t.Fatalf("Expected a screen of 78x30, got %d rows", len(screen))
+	}
+	if expected := "        HIЮ"; strings.TrimRight(screen[3], " ") != expected {
+		t.Errorf("Expected row 3 to be %q, got %q", expected, screen[3])
+	}
+	if machine.crt.status&crtDMAUnderrun != 0 {
+		t.Errorf("Expected every frame to be fetched in full")
+	}
+
+	output := &bytes.Buffer{}
+	painter := &screenPainter{out: output}
+	painter.paint(screen, 0, 0)
+	output.Reset()
+	(*machine.mc.memory)[0x77C2] = 'W'
+	machine.runFrame()
+	painter.paint(machine.screenText(), 10, 3)
+	if expected := "\x1b[4;9HW\x1b[4;11H"; output.String() != expected {
+		t.Errorf("Expected only the change to be drawn, got %q", output.String())
+	}
+
+	chargen := make([]uint8, 1024)
+	for i := range chargen {
+		chargen[i] = 0x3F // Nothing is lit
+	}
+	chargen['W'*8+2] = 0x1E // The outside pixels of line 2
+	image := machine.renderScreen(chargen)
+	if image.Bounds().Dx() != 78*6 || image.Bounds().Dy() != 30*10 {
+		t.Fatalf("Unexpected size %s", image.Bounds())
+	}
+	for x, lit := range []bool{true, false, false, false, false, true} {
+		if (image.GrayAt(8*6+x, 3*10+2).Y != 0) != lit {
+			t.Errorf("Pixel %d of line 2 of the W should be lit: %t", x, lit)
+		}
+	}
+}
+
+func TestRadio86Keyboard(t *testing.T) {
+	console := newCPMConsole(strings.NewReader("a!"), &bytes.Buffer{}, false)
+	<-console.ended
+	machine, err := newRadio86(make([]uint8, 0x800), console)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppi := machine.ppi
+	ppi.output(3, 0x8B) // A output, B and C input
+	scan := func(lines uint8) (uint8, uint8) {
+		ppi.output(0, lines)
+		return ppi.input(1), ppi.input(2)
+	}
+	if rows, _ := scan(0x00); rows != 0xFF {
+		t.Errorf("Expected no key to be pressed at first, got %02X", rows)
+	}
+	machine.mc.cycles += radio86KeyHold
+	if rows, modifiers := scan(0x00); rows != 0xFD || modifiers&0x20 == 0 {
+		t.Errorf("Expected A (line 4, bit 1) to be pressed, got %02X %02X", rows, modifiers)
+	}
+	if rows, _ := scan(0xEF); rows != 0xFD {
+		t.Errorf("Expected A on line 4, got %02X", rows)
+	}
+	if rows, _ := scan(0xF7); rows != 0xFF {
+		t.Errorf("Expected nothing on line 3, got %02X", rows)
+	}
+	machine.mc.cycles += radio86KeyHold
+	if rows, _ := scan(0x00); rows != 0xFF {
+		t.Errorf("Expected A to be released, got %02X", rows)
+	}
+	machine.mc.cycles += radio86KeyHold
+	if rows, modifiers := scan(0xFB); rows != 0xFD || modifiers&0x20 != 0 {
+		t.Errorf("Expected shift and 1 (line 2, bit 1) for !, got %02X %02X", rows, modifiers)
+	}
+	if machine.keyboard.idle() {
+		t.Errorf("Expected the keyboard to be busy while a key is pressed")
+	}
+}
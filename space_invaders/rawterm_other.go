@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw - Raw mode is only supported on Unix. Input is then read a line at a
+// time and echoed by the host
+func makeRaw(file *os.File) (func(), error) {
+	return nil, errors.New("raw terminal input is not supported on this system")
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// makeRaw - Puts the terminal into raw mode so that every key is read as soon
+// as it is pressed, without being echoed or turned into a signal (^C goes to
+// the emulated program). Output processing is left on so that the host still
+// turns line feeds into new lines. Returns a function which restores the terminal
+func makeRaw(file *os.File) (func(), error) {
+	var saved syscall.Termios
+	if err := termios(file, ioctlGetTermios, &saved); err != nil {
+		return nil, err
+	}
+	raw := saved
+	raw.Iflag &^= syscall.ICRNL | syscall.INLCR | syscall.IGNCR | syscall.ISTRIP | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := termios(file, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() { termios(file, ioctlSetTermios, &saved) }, nil
+}
+
+func termios(file *os.File, request uintptr, settings *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(settings)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// referenceCore - A deliberately simple and slow model of the 8080, written
+// directly from the Intel 8080 Microcomputer Systems User's Manual without
+// sharing any code with microcontroller (not even math.go). It exists so that
+// the two can be run in lockstep (see lockstep.go) to find bugs in either one.
+//
+// Where the documentation is vague, this model follows what the i8080-core
+// emulator (and therefore the KR580VM80A) does:
+//   - ANA/ANI set the aux carry flag to bit 3 of (A | operand)
+//   - ORA/ORI/XRA/XRI reset the aux carry flag
+//   - SUB/SBB/CMP/DCR set the aux carry flag to the carry out of bit 3
+//     of A + ~operand + 1 (ie: it is set when there is NO borrow)
+type referenceCore struct {
+	a, b, c, d, e, h, l uint8
+	sp, pc              uint16
+	s, z, ac, p, cy     bool
+	inte                bool
+	halted              bool
+
+	mem    *[]uint8
+	writes []uint16 // Addresses written by the last step()
+}
+
+func newReferenceCore(memory *[]uint8) *referenceCore {
+	return &referenceCore{mem: memory}
+}
+
+func (r *referenceCore) read(address uint16) uint8 {
+	return (*r.mem)[address]
+}
+
+func (r *referenceCore) write(address uint16, value uint8) {
+	(*r.mem)[address] = value
+	r.writes = append(r.writes, address)
+}
+
+func (r *referenceCore) fetch() uint8 {
+	value := r.read(r.pc)
+	r.pc++
+	return value
+}
+
+func (r *referenceCore) fetch16() uint16 {
+	low := uint16(r.fetch())
+	return uint16(r.fetch())<<8 | low
+}
+
+// getRegister - Register number as encoded in the instruction: B C D E H L M A
+func (r *referenceCore) getRegister(n uint8) uint8 {
+	switch n {
+	case 0:
+		return r.b
+	case 1:
+		return r.c
+	case 2:
+		return r.d
+	case 3:
+		return r.e
+	case 4:
+		return r.h
+	case 5:
+		return r.l
+	case 6:
+		return r.read(r.getPair(2))
+	}
+	return r.a
+}
+
+func (r *referenceCore) setRegister(n uint8, value uint8) {
+	switch n {
+	case 0:
+		r.b = value
+	case 1:
+		r.c = value
+	case 2:
+		r.d = value
+	case 3:
+		r.e = value
+	case 4:
+		r.h = value
+	case 5:
+		r.l = value
+	case 6:
+		r.write(r.getPair(2), value)
+	case 7:
+		r.a = value
+	}
+}
+
+// getPair - Register pair as encoded in the instruction: BC DE HL SP
+func (r *referenceCore) getPair(n uint8) uint16 {
+	switch n {
+	case 0:
+		return uint16(r.b)<<8 | uint16(r.c)
+	case 1:
+		return uint16(r.d)<<8 | uint16(r.e)
+	case 2:
+		return uint16(r.h)<<8 | uint16(r.l)
+	}
+	return r.sp
+}
+
+func (r *referenceCore) setPair(n uint8, value uint16) {
+	switch n {
+	case 0:
+		r.b, r.c = uint8(value>>8), uint8(value)
+	case 1:
+		r.d, r.e = uint8(value>>8), uint8(value)
+	case 2:
+		r.h, r.l = uint8(value>>8), uint8(value)
+	case 3:
+		r.sp = value
+	}
+}
+
+func (r *referenceCore) flags() uint8 {
+	flags := uint8(0x02) // Bit 1 always reads as 1, bits 3 and 5 as 0
+	for i, set := range []bool{r.cy, false, r.p, false, r.ac, false, r.z, r.s} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+func (r *referenceCore) setFlags(flags uint8) {
+	r.cy = flags&0x01 != 0
+	r.p = flags&0x04 != 0
+	r.ac = flags&0x10 != 0
+	r.z = flags&0x40 != 0
+	r.s = flags&0x80 != 0
+}
+
+func (r *referenceCore) push(value uint16) {
+	r.sp--
+	r.write(r.sp, uint8(value>>8))
+	r.sp--
+	r.write(r.sp, uint8(value))
+}
+
+func (r *referenceCore) pop() uint16 {
+	low := uint16(r.read(r.sp))
+	r.sp++
+	high := uint16(r.read(r.sp))
+	r.sp++
+	return high<<8 | low
+}
+
+// condition - The condition encoded in bits 3-5: NZ Z NC C PO PE P M
+func (r *referenceCore) condition(n uint8) bool {
+	switch n {
+	case 0:
+		return !r.z
+	case 1:
+		return r.z
+	case 2:
+		return !r.cy
+	case 3:
+		return r.cy
+	case 4:
+		return !r.p
+	case 5:
+		return r.p
+	case 6:
+		return !r.s
+	}
+	return r.s
+}
+
+// setZSP - Sets the zero, sign and parity flags from a result
+func (r *referenceCore) setZSP(value uint8) {
+	r.z = value == 0
+	r.s = value&0x80 != 0
+	r.p = bits.OnesCount8(value)%2 == 0
+}
+
+func (r *referenceCore) add(value uint8, carry uint8) uint8 {
+	sum := uint16(r.a) + uint16(value) + uint16(carry)
+	r.ac = (r.a&0x0F)+(value&0x0F)+carry > 0x0F
+	r.cy = sum > 0xFF
+	r.setZSP(uint8(sum))
+	return uint8(sum)
+}
+
+func (r *referenceCore) sub(value uint8, borrow uint8) uint8 {
+	// Subtraction is done by adding the two's complement. The carry flag
+	// ends up being the inverse of the carry out of the adder (a borrow)
+	difference := uint16(r.a) + uint16(^value) + uint16(1-borrow)
+	r.ac = (r.a&0x0F)+(^value&0x0F)+(1-borrow) > 0x0F
+	r.cy = difference <= 0xFF
+	r.setZSP(uint8(difference))
+	return uint8(difference)
+}
+
+func (r *referenceCore) alu(operation uint8, value uint8) {
+	carry := uint8(0)
+	if r.cy {
+		carry = 1
+	}
+	switch operation {
+	case 0: // ADD
+		r.a = r.add(value, 0)
+	case 1: // ADC
+		r.a = r.add(value, carry)
+	case 2: // SUB
+		r.a = r.sub(value, 0)
+	case 3: // SBB
+		r.a = r.sub(value, carry)
+	case 4: // ANA
+		r.ac = (r.a|value)&0x08 != 0
+		r.a &= value
+		r.cy = false
+		r.setZSP(r.a)
+	case 5: // XRA
+		r.a ^= value
+		r.ac, r.cy = false, false
+		r.setZSP(r.a)
+	case 6: // ORA
+		r.a |= value
+		r.ac, r.cy = false, false
+		r.setZSP(r.a)
+	case 7: // CMP
+		r.sub(value, 0)
+	}
+}
+
+func (r *referenceCore) daa() {
+	correction := uint8(0)
+	carry := r.cy
+	if r.a&0x0F > 9 || r.ac {
+		correction |= 0x06
+	}
+	if r.a>>4 > 9 || r.cy || (r.a>>4 >= 9 && r.a&0x0F > 9) {
+		correction |= 0x60
+		carry = true
+	}
+	r.a = r.add(correction, 0)
+	r.cy = carry
+}
+
+// step - Executes one instruction. Panics on instructions which
+// this model does not handle (IN and OUT)
+func (r *referenceCore) step() {
+	r.writes = r.writes[:0]
+	if r.halted {
+		return
+	}
+	opcode := r.fetch()
+	dst := (opcode >> 3) & 0x7
+	src := opcode & 0x7
+	pair := (opcode >> 4) & 0x3
+
+	switch {
+	case opcode == 0x76: // HLT
+		r.halted = true
+	case opcode>>6 == 1: // MOV
+		r.setRegister(dst, r.getRegister(src))
+	case opcode>>6 == 2: // ALU with register or memory
+		r.alu(dst, r.getRegister(src))
+	case opcode&0xC7 == 0xC6: // ALU with immediate data
+		r.alu(dst, r.fetch())
+	case opcode&0xC7 == 0x00: // NOP (0x08-0x38 are undocumented NOPs)
+	case opcode&0xCF == 0x01: // LXI
+		r.setPair(pair, r.fetch16())
+	case opcode&0xCF == 0x09: // DAD
+		sum := uint32(r.getPair(2)) + uint32(r.getPair(pair))
+		r.cy = sum > 0xFFFF
+		r.setPair(2, uint16(sum))
+	case opcode&0xCF == 0x03: // INX
+		r.setPair(pair, r.getPair(pair)+1)
+	case opcode&0xCF == 0x0B: // DCX
+		r.setPair(pair, r.getPair(pair)-1)
+	case opcode&0xC7 == 0x04: // INR
+		value := r.getRegister(dst) + 1
+		r.ac = value&0x0F == 0
+		r.setZSP(value)
+		r.setRegister(dst, value)
+	case opcode&0xC7 == 0x05: // DCR
+		value := r.getRegister(dst) - 1
+		r.ac = value&0x0F != 0x0F
+		r.setZSP(value)
+		r.setRegister(dst, value)
+	case opcode&0xC7 == 0x06: // MVI
+		r.setRegister(dst, r.fetch())
+	case opcode == 0x02 || opcode == 0x12: // STAX
+		r.write(r.getPair(pair), r.a)
+	case opcode == 0x0A || opcode == 0x1A: // LDAX
+		r.a = r.read(r.getPair(pair))
+	case opcode == 0x22: // SHLD
+		address := r.fetch16()
+		r.write(address, r.l)
+		r.write(address+1, r.h)
+	case opcode == 0x2A: // LHLD
+		address := r.fetch16()
+		r.l = r.read(address)
+		r.h = r.read(address + 1)
+	case opcode == 0x32: // STA
+		r.write(r.fetch16(), r.a)
+	case opcode == 0x3A: // LDA
+		r.a = r.read(r.fetch16())
+	case opcode == 0x07: // RLC
+		r.cy = r.a&0x80 != 0
+		r.a = r.a<<1 | r.a>>7
+	case opcode == 0x0F: // RRC
+		r.cy = r.a&0x01 != 0
+		r.a = r.a>>1 | r.a<<7
+	case opcode == 0x17: // RAL
+		carry := r.cy
+		r.cy = r.a&0x80 != 0
+		r.a <<= 1
+		if carry {
+			r.a |= 0x01
+		}
+	case opcode == 0x1F: // RAR
+		carry := r.cy
+		r.cy = r.a&0x01 != 0
+		r.a >>= 1
+		if carry {
+			r.a |= 0x80
+		}
+	case opcode == 0x27: // DAA
+		r.daa()
+	case opcode == 0x2F: // CMA
+		r.a = ^r.a
+	case opcode == 0x37: // STC
+		r.cy = true
+	case opcode == 0x3F: // CMC
+		r.cy = !r.cy
+	case opcode&0xCF == 0xC1: // POP
+		value := r.pop()
+		if pair == 3 { // PSW
+			r.a = uint8(value >> 8)
+			r.setFlags(uint8(value))
+		} else {
+			r.setPair(pair, value)
+		}
+	case opcode&0xCF == 0xC5: // PUSH
+		if pair == 3 { // PSW
+			r.push(uint16(r.a)<<8 | uint16(r.flags()))
+		} else {
+			r.push(r.getPair(pair))
+		}
+	case opcode == 0xC3 || opcode == 0xCB: // JMP
+		r.pc = r.fetch16()
+	case opcode&0xC7 == 0xC2: // Jcc
+		address := r.fetch16()
+		if r.condition(dst) {
+			r.pc = address
+		}
+	case opcode == 0xCD || opcode == 0xDD || opcode == 0xED || opcode == 0xFD: // CALL
+		address := r.fetch16()
+		r.push(r.pc)
+		r.pc = address
+	case opcode&0xC7 == 0xC4: // Ccc
+		address := r.fetch16()
+		if r.condition(dst) {
+			r.push(r.pc)
+			r.pc = address
+		}
+	case opcode == 0xC9 || opcode == 0xD9: // RET
+		r.pc = r.pop()
+	case opcode&0xC7 == 0xC0: // Rcc
+		if r.condition(dst) {
+			r.pc = r.pop()
+		}
+	case opcode&0xC7 == 0xC7: // RST
+		r.push(r.pc)
+		r.pc = uint16(dst) << 3
+	case opcode == 0xE3: // XTHL
+		value := r.pop()
+		r.push(r.getPair(2))
+		r.setPair(2, value)
+	case opcode == 0xE9: // PCHL
+		r.pc = r.getPair(2)
+	case opcode == 0xEB: // XCHG
+		r.d, r.e, r.h, r.l = r.h, r.l, r.d, r.e
+	case opcode == 0xF9: // SPHL
+		r.sp = r.getPair(2)
+	case opcode == 0xF3: // DI
+		r.inte = false
+	case opcode == 0xFB: // EI
+		r.inte = true
+	default: // IN, OUT
+		r.pc--
+		panic(fmt.Sprintf("reference core: unsupported instruction %02X at %04X", opcode, r.pc))
+	}
+}
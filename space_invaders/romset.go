@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ROMPATH - Where the Space Invaders ROMs are looked for: a directory, which
+// can have zip archives of ROM sets in it, or a zip archive
+var ROMPATH = "."
+
+// romFile - One ROM of a set: where it goes and what a good dump looks like
+type romFile struct {
+	name    string
+	aliases []string // Other names it goes by, ie: in MAME's set
+	address int
+	size    int
+	crc     uint32
+	sha1    string
+}
+
+// romSet - The ROMs of a machine, which are checked as they are loaded
+type romSet struct {
+	name        string
+	description string
+	roms        []romFile
+}
+
+// invadersROMSet - Space Invaders, which fills 0000-1FFF with four 2K ROMs
+var invadersROMSet = &romSet{
+	name:        "invaders",
+	description: "Space Invaders (Midway)",
+	roms: []romFile{
+		{"invaders_h.rom", []string{"invaders.h"}, 0x0000, 0x800, 0x734f5ad8, "ff6200af4c9110d8181249cbcef1a8a40fa40b7f"},
+		{"invaders_g.rom", []string{"invaders.g"}, 0x0800, 0x800, 0x6bfaca4a, "16f48649b531bdef8c2d1446c429b5f414524350"},
+		{"invaders_f.rom", []string{"invaders.f"}, 0x1000, 0x800, 0x0ccead96, "537aef03468f63c5b9e11dd61e253f7ae17d9743"},
+		{"invaders_e.rom", []string{"invaders.e"}, 0x1800, 0x800, 0x14e538b0, "1d6ca0c99f9df71e2990b610deb9d7da0125e2d8"},
+	},
+}
+
+// checksums - The CRC and SHA1 of a dump, as MAME shows them
+func checksums(data []uint8) string {
+	sum := sha1.Sum(data)
+	return fmt.Sprintf("CRC(%08x) SHA1(%s)", crc32.ChecksumIEEE(data), hex.EncodeToString(sum[:]))
+}
+
+// matches - Whether data is a good dump of the ROM
+func (r *romFile) matches(data []uint8) bool {
+	return len(data) == r.size && checksums(data) == fmt.Sprintf("CRC(%08x) SHA1(%s)", r.crc, r.sha1)
+}
+
+// romCandidate - A file which might be a ROM, found by romFinder.list
+type romCandidate struct {
+	name   string // As it is reported, ie: invaders.zip/invaders.h
+	base   string // Without the directory or archive it's in
+	size   int64
+	crc    uint32
+	hasCRC bool // Zip archives record the CRC32s of their files
+	read   func() ([]uint8, error)
+}
+
+// romFinder - Finds the files of a ROM set in a directory, in zip archives in
+// the directory or in a zip archive
+type romFinder struct {
+	path       string
+	listed     bool
+	candidates []romCandidate
+}
+
+// list - Every file there is to look for ROMs in. This can't be done in the
+// browser, where only the ROMs' own names work
+func (f *romFinder) list() []romCandidate {
+	if f.listed {
+		return f.candidates
+	}
+	f.listed = true
+	if isZipFile(f.path) {
+		f.addZip(f.path, "")
+		return f.candidates
+	}
+	files, err := ioutil.ReadDir(f.path)
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		fileName := filepath.Join(f.path, file.Name())
+		switch {
+		case file.IsDir():
+		case isZipFile(fileName):
+			f.addZip(fileName, file.Name()+"/")
+		default:
+			f.candidates = append(f.candidates, romCandidate{
+				name: file.Name(), base: file.Name(), size: file.Size(),
+				read: func() ([]uint8, error) { return readFile(fileName) },
+			})
+		}
+	}
+	return f.candidates
+}
+
+// addZip - Adds the files in a zip archive to the candidates. An archive which
+// can't be read is left out
+func (f *romFinder) addZip(archive string, prefix string) {
+	reader, err := openZip(archive)
+	if err != nil {
+		return
+	}
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		file := file
+		f.candidates = append(f.candidates, romCandidate{
+			name: prefix + file.Name, base: path.Base(file.Name), size: int64(file.UncompressedSize64),
+			crc: file.CRC32, hasCRC: true,
+			read: func() ([]uint8, error) { return readZipFile(file) },
+		})
+	}
+}
+
+// read - Reads the ROM under its own name or one of its aliases, as a file or
+// in a zip archive. The name is "" when none of them are there
+func (f *romFinder) read(rom *romFile) ([]uint8, string) {
+	names := append([]string{rom.name}, rom.aliases...)
+	for _, name := range names {
+		if data, err := readFile(filepath.Join(f.path, name)); err == nil {
+			return data, name
+		}
+	}
+	for _, candidate := range f.list() {
+		for _, name := range names {
+			if strings.EqualFold(candidate.base, name) {
+				if data, err := candidate.read(); err == nil {
+					return data, candidate.name
+				}
+			}
+		}
+	}
+	return nil, ""
+}
+
+// search - Looks for a good dump of the ROM under any name. The name is "" if
+// there isn't one
+func (f *romFinder) search(rom *romFile) ([]uint8, string) {
+	for _, candidate := range f.list() {
+		if candidate.size != int64(rom.size) || candidate.hasCRC && candidate.crc != rom.crc {
+			continue
+		}
+		if data, err := candidate.read(); err == nil && rom.matches(data) {
+			return data, candidate.name
+		}
+	}
+	return nil, ""
+}
+
+// loadROMSet - Loads a ROM set into memory from a directory or zip archive (see
+// romFinder), checking each ROM and reporting problems the way MAME does. A ROM
+// which is missing, or isn't a good dump, is looked for by its checksums under
+// other names and in the other zip archives. The machine
+// can't be run without all of its ROMs at the right sizes; a wrong checksum is
+// only a warning, so modified ROMs can still be loaded
+func loadROMSet(set *romSet, romPath string, memory []uint8, report io.Writer) error {
+	finder := &romFinder{path: romPath}
+	loader := newProgramLoader(memory)
+	diagnostics := &bytes.Buffer{}
+	missing, bad := false, false
+	for i := range set.roms {
+		rom := &set.roms[i]
+		data, name := finder.read(rom)
+		if name == "" || !rom.matches(data) {
+			if good, other := finder.search(rom); other != "" {
+				fmt.Fprintf(diagnostics, "%-12s found as %s\n", rom.name, other)
+				data, name = good, other
+			}
+		}
+		switch {
+		case name == "":
+			fmt.Fprintf(diagnostics, "%-12s NOT FOUND (tried in %s)\n", rom.name, romPath)
+			missing = true
+			continue
+		case len(data) != rom.size:
+			fmt.Fprintf(diagnostics, "%-12s WRONG LENGTH (expected: %08x found: %08x)\n", name, rom.size, len(data))
+			missing = true
+			continue
+		case !rom.matches(data):
+			fmt.Fprintf(diagnostics, "%-12s WRONG CHECKSUMS:\n", name)
+			fmt.Fprintf(diagnostics, "    EXPECTED: CRC(%08x) SHA1(%s)\n", rom.crc, rom.sha1)
+			fmt.Fprintf(diagnostics, "       FOUND: %s\n", checksums(data))
+			bad = true
+		}
+		if err := loader.place(name, rom.address, data); err != nil {
+			return err
+		}
+	}
+	if diagnostics.Len() > 0 {
+		fmt.Fprintf(report, "%s (%s):\n%s", set.name, set.description, diagnostics)
+	}
+	if missing {
+		return fmt.Errorf("%s: required files are missing, the machine cannot be run", set.name)
+	}
+	if bad {
+		fmt.Fprintln(report, "WARNING: the machine might not run correctly.")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestInvadersROMSet : The ROMs in this directory are good dumps
+func TestInvadersROMSet(t *testing.T) {
+	memory := make([]uint8, 0x10000)
+	report := &bytes.Buffer{}
+	if err := loadROMSet(invadersROMSet, ".", memory, report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Len() > 0 {
+		t.Errorf("Expected no problems, got:\n%s", report)
+	}
+	for _, rom := range invadersROMSet.roms {
+		if !rom.matches(memory[rom.address : rom.address+rom.size]) {
+			t.Errorf("Expected %s at %04X", rom.name, rom.address)
+		}
+	}
+}
+
+// fakeROM - A ROM of the test set, which is its own index repeated
+func fakeROM(index int, size int) ([]uint8, romFile) {
+	data := bytes.Repeat([]uint8{uint8(index + 1)}, size)
+	sum := sha1.Sum(data)
+	name := string(rune('a'+index)) + ".rom"
+	return data, romFile{name, []string{name + ".alt"}, index * size, size, crc32.ChecksumIEEE(data), hex.EncodeToString(sum[:])}
+}
+
+// TestROMSetProblems : Missing ROMs and ROMs of the wrong size stop the
+// machine, ROMs with the wrong checksums only give a warning, and ROMs are
+// found under their aliases or by their checksums
+func TestROMSetProblems(t *testing.T) {
+	directory := t.TempDir()
+	set := &romSet{name: "test", description: "Test"}
+	contents := [][]uint8{}
+	for i := 0; i < 4; i++ {
+		data, rom := fakeROM(i, 16)
+		set.roms, contents = append(set.roms, rom), append(contents, data)
+	}
+	write := func(name string, data []uint8) {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() (string, error) {
+		report := &bytes.Buffer{}
+		err := loadROMSet(set, directory, make([]uint8, 0x10000), report)
+		return report.String(), err
+	}
+
+	write("a.rom", contents[0])
+	write("b.rom.alt", contents[1])
+	write("renamed.bin", contents[2])
+	write("d.rom", contents[3][:8])
+	report, err := load()
+	if err == nil || !strings.Contains(err.Error(), "required files are missing") {
+		t.Errorf("Expected the set not to run, got %v", err)
+	}
+	if !strings.Contains(report, "c.rom        found as renamed.bin\n") ||
+		!strings.Contains(report, "d.rom        WRONG LENGTH (expected: 00000010 found: 00000008)\n") ||
+		strings.Contains(report, "a.rom") || strings.Contains(report, "b.rom") {
+		t.Errorf("Expected c.rom to be found and d.rom to be too short, got:\n%s", report)
+	}
+
+	bad := append([]uint8{}, contents[3]...)
+	bad[0] = 0xFF
+	write("d.rom", bad)
+	report, err = load()
+	if err != nil {
+		t.Errorf("Expected a bad checksum not to stop the set, got %v", err)
+	}
+	if !strings.Contains(report, "d.rom        WRONG CHECKSUMS:\n    EXPECTED: CRC(") ||
+		!strings.Contains(report, "WARNING: the machine might not run correctly.") {
+		t.Errorf("Expected a warning about d.rom, got:\n%s", report)
+	}
+
+	write("d.rom.good", contents[3])
+	if report, err = load(); err != nil || strings.Contains(report, "WRONG") {
+		t.Errorf("Expected the good dump of d.rom to be found, got %v:\n%s", err, report)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scripted console input for running CP/M programs in automated tests. A
+// script types keys once the program has printed what it is waiting for:
+//
+//	# Comments and blank lines are ignored
+//	expect A>
+//	send dir\r
+//	expect A>
+//	timeout 60
+//	send mbasic test\r
+//
+// send types its text, where \r, \x1a, ... are escapes as in a Go string.
+// expect waits until the text has been printed since the last expect matched,
+// for up to the timeout (10 seconds unless set with timeout). When the script
+// ends so does the console input, which ends the program.
+
+// maxScriptOutput - How much output is kept for expect when it isn't waiting
+const maxScriptOutput = 64 * 1024
+
+// scriptStep - A line of a script
+type scriptStep struct {
+	line    int
+	command string // send, expect or timeout
+	text    string
+}
+
+// consoleScript - The console input given by a script. The console output
+// must also be written to it so that expect can see it
+type consoleScript struct {
+	name    string
+	steps   []scriptStep
+	timeout time.Duration
+	pending string // What is left of the text being sent
+
+	lock    sync.Mutex
+	output  []byte        // What has been printed since the last expect matched
+	changed chan struct{} // Signalled when output is written
+}
+
+// parseConsoleScript - Reads a script. name is used in error messages
+func parseConsoleScript(name string, reader io.Reader) (*consoleScript, error) {
+	script := &consoleScript{name: name, timeout: 10 * time.Second, changed: make(chan struct{}, 1)}
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		command, text := line, ""
+		if space := strings.IndexAny(line, " \t"); space >= 0 {
+			command, text = line[:space], line[space+1:]
+		}
+		switch command {
+		case "send", "expect":
+			unquoted, err := strconv.Unquote(`"` + strings.Replace(text, `"`, `\"`, -1) + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid escape in %q", name, lineNumber, text)
+			}
+			text = unquoted
+		case "timeout":
+			if seconds, err := strconv.ParseFloat(text, 64); err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("%s:%d: the timeout must be a number of seconds", name, lineNumber)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown command %s (expected send, expect or timeout)", name, lineNumber, command)
+		}
+		script.steps = append(script.steps, scriptStep{line: lineNumber, command: command, text: text})
+	}
+	return script, scanner.Err()
+}
+
+// loadConsoleScript - Reads the script in a file
+func loadConsoleScript(fileName string) (*consoleScript, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseConsoleScript(fileName, file)
+}
+
+// Write - Records the console output
+func (s *consoleScript) Write(data []byte) (int, error) {
+	s.lock.Lock()
+	s.output = append(s.output, data...)
+	if len(s.output) > maxScriptOutput {
+		s.output = s.output[len(s.output)-maxScriptOutput/2:]
+	}
+	s.lock.Unlock()
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return len(data), nil
+}
+
+// Read - Returns the keys typed by the next send, after waiting for the expects
+// before it. Returns io.EOF at the end of the script
+func (s *consoleScript) Read(buffer []byte) (int, error) {
+	for s.pending == "" {
+		if len(s.steps) == 0 {
+			return 0, io.EOF
+		}
+		step := s.steps[0]
+		s.steps = s.steps[1:]
+		switch step.command {
+		case "send":
+			s.pending = step.text
+		case "expect":
+			if !s.wait(step.text) {
+				return 0, fmt.Errorf("%s:%d: %q was not printed within %s", s.name, step.line, step.text, s.timeout)
+			}
+		case "timeout":
+			seconds, _ := strconv.ParseFloat(step.text, 64)
+			s.timeout = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	n := copy(buffer, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// wait - Waits until text has been printed. The output up to the end of it is
+// then discarded so that the next expect only looks at what is printed after it
+func (s *consoleScript) wait(text string) bool {
+	deadline := time.NewTimer(s.timeout)
+	defer deadline.Stop()
+	for {
+		s.lock.Lock()
+		index := strings.Index(string(s.output), text)
+		if index >= 0 {
+			s.output = s.output[index+len(text):]
+		}
+		s.lock.Unlock()
+		if index >= 0 {
+			return true
+		}
+		select {
+		case <-s.changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
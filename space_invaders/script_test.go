@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConsoleScript : Keys are only typed once the program has printed what the script expects
+func TestConsoleScript(t *testing.T) {
+	script, err := parseConsoleScript("test", strings.NewReader(`
+# Wait for the prompt
+expect A>
+send dir\r
+expect "quoted"
+send \x03`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	console := newCPMConsole(script, output, true)
+	time.Sleep(10 * time.Millisecond)
+	if console.ready() {
+		t.Errorf("A key was typed before the prompt was printed")
+	}
+	script.Write([]byte("\r\nA"))
+	script.Write([]byte(">"))
+	for _, expected := range "dir\r" {
+		if key, ok := console.read(); !ok || key != byte(expected) {
+			t.Errorf("Expected %q, got %q", expected, key)
+		}
+	}
+	script.Write([]byte(`"quoted"`))
+	if key, ok := console.read(); !ok || key != 0x03 {
+		t.Errorf("Expected ^C, got %q", key)
+	}
+	if _, ok := console.read(); ok || console.err != nil {
+		t.Errorf("The input should end with the script, err=%v", console.err)
+	}
+
+	script, _ = parseConsoleScript("test", strings.NewReader("timeout 0.01\nexpect never\nsend x"))
+	console = newCPMConsole(script, output, true)
+	if _, ok := console.read(); ok || console.err == nil || !strings.Contains(console.err.Error(), "test:2") {
+		t.Errorf("A timed out expect should end the input with an error, got %v", console.err)
+	}
+	for _, bad := range []string{"type x", "timeout -1", `send \q`} {
+		if _, err := parseConsoleScript("test", strings.NewReader(bad)); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+// TestConsoleWithDebugger : With -debug the console input has to come from a
+// script, since the debugger reads stdin
+func TestConsoleWithDebugger(t *testing.T) {
+	DEBUGGER = true
+	defer func() { DEBUGGER = false }()
+	if _, _, err := openConsoleOn(&bytes.Buffer{}, "ansi"); err == nil {
+		t.Error("Expected the console not to read stdin with -debug")
+	}
+	CONSOLESCRIPT = filepath.Join(t.TempDir(), "input.txt")
+	defer func() { CONSOLESCRIPT = "" }()
+	ioutil.WriteFile(CONSOLESCRIPT, []byte("send x"), 0666)
+	if _, _, err := openConsoleOn(&bytes.Buffer{}, "ansi"); err != nil {
+		t.Errorf("Expected a script to be allowed with -debug, got %v", err)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SERIALPORTS - The serial devices bound with -serial, by name, to what they are
+// connected to (see openSerialLine)
+var SERIALPORTS = serialFlag{}
+
+// serialFlag - The -serial flag, which can be given once for each device:
+// <device>=<endpoint>[,<option>...]
+type serialFlag map[string]string
+
+func (f serialFlag) String() string {
+	bindings := []string{}
+	for name, spec := range f {
+		bindings = append(bindings, name+"="+spec)
+	}
+	sort.Strings(bindings)
+	return strings.Join(bindings, " ")
+}
+
+func (f serialFlag) Set(value string) error {
+	fields := strings.SplitN(value, "=", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return errors.New("expected <device>=<endpoint>[,<option>...]")
+	}
+	if _, ok := f[fields[0]]; ok {
+		return fmt.Errorf("%s is bound more than once", fields[0])
+	}
+	f[fields[0]] = fields[1]
+	return nil
+}
+
+// Flow control, which stops a side from sending while the other can't keep up
+const (
+	flowNone    = iota // Characters are lost when the other side falls behind
+	flowXonXoff        // ^S (XOFF) and ^Q (XON) are sent in the data
+	flowRTSCTS         // Hardware handshaking: the TCP connection or pty itself holds the data back
+)
+
+const (
+	xon  = 0x11
+	xoff = 0x13
+)
+
+// Telnet commands (RFC 854) and the options offered to clients, so that they
+// send every key as it is typed and leave the echo to the emulated program
+const (
+	telnetIAC  = 0xFF
+	telnetDont = 0xFE
+	telnetDo   = 0xFD
+	telnetWont = 0xFC
+	telnetWill = 0xFB
+	telnetSB   = 0xFA
+	telnetSE   = 0xF0
+
+	telnetEcho = 0x01
+	telnetSGA  = 0x03 // Suppress go ahead
+)
+
+// serialLineBuffer - How many characters each direction holds
+const serialLineBuffer = 256
+
+// serialLine - An emulated serial device's connection to the host: a TCP port
+// which a telnet client (or a test script) connects to, or a pseudo-terminal
+// which a terminal program opens. Characters go through buffers in both
+// directions, so the CPU never waits for the host.
+//
+// The baud rate paces the line in CPU cycles: a character can only be read or
+// written once the one before it would have gone over the wire
+type serialLine struct {
+	name       string // Where to connect to, for messages
+	flow       int
+	charCycles int64 // The CPU cycles a character takes (10 bits at the baud rate), or 0 for no pacing
+	telnet     bool  // Telnet commands are answered and stripped (TCP without the raw option)
+
+	in     chan uint8
+	out    chan uint8
+	nextRx int64 // The cycles when the next character can be read
+	nextTx int64 // and sent
+
+	mutex     sync.Mutex
+	conn      io.ReadWriteCloser // The client, or nil while there isn't one
+	paused    bool               // The client sent XOFF
+	sentXOFF  bool               // The client has been sent XOFF
+	connected chan struct{}      // Closed when the first client connects
+	once      sync.Once
+	closers   []io.Closer
+}
+
+// openSerialLine - Opens what a serial device is bound to:
+//
+//	tcp:[host:]port   Listen for one client at a time (on localhost unless a host is given)
+//	pty               Create a pseudo-terminal (Linux only)
+//
+// followed by any of these options, separated by commas:
+//
+//	baud=<n>                   Pace the line at this baud rate
+//	flow=none|xonxoff|rtscts   Flow control (default none)
+//	raw                        Don't treat a TCP client as telnet
+//	wait                       Wait for a client to connect before starting
+func openSerialLine(spec string, cpuHz int64) (*serialLine, error) {
+	fields := strings.Split(spec, ",")
+	l := &serialLine{
+		in:        make(chan uint8, serialLineBuffer),
+		out:       make(chan uint8, serialLineBuffer),
+		connected: make(chan struct{}),
+	}
+	raw, wait := false, false
+	for _, option := range fields[1:] {
+		name, value := option, ""
+		if equals := strings.Index(option, "="); equals >= 0 {
+			name, value = option[:equals], option[equals+1:]
+		}
+		switch name {
+		case "baud":
+			baud, err := strconv.Atoi(value)
+			if err != nil || baud <= 0 {
+				return nil, fmt.Errorf("invalid baud rate %s", value)
+			}
+			l.charCycles = cpuHz * 10 / int64(baud)
+		case "flow":
+			flows := map[string]int{"none": flowNone, "xonxoff": flowXonXoff, "rtscts": flowRTSCTS}
+			flow, ok := flows[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown flow control %s (none, xonxoff or rtscts)", value)
+			}
+			l.flow = flow
+		case "raw":
+			raw = true
+		case "wait":
+			wait = true
+		default:
+			return nil, fmt.Errorf("unknown serial option %s", option)
+		}
+	}
+
+	endpoint := fields[0]
+	switch {
+	case strings.HasPrefix(endpoint, "tcp:"):
+		address := strings.TrimPrefix(endpoint, "tcp:")
+		if !strings.Contains(address, ":") {
+			address = "localhost:" + address
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		l.name, l.closers = listener.Addr().String(), append(l.closers, listener)
+		l.telnet = !raw
+		go l.accept(listener)
+	case endpoint == "pty":
+		master, slave, err := openPty()
+		if err != nil {
+			return nil, err
+		}
+		l.name, l.closers = slave.Name(), append(l.closers, master, slave)
+		l.connect(master)
+		go l.serve(master)
+	default:
+		return nil, fmt.Errorf("unknown serial endpoint %s (tcp:[host:]port or pty)", endpoint)
+	}
+	go l.send()
+	if wait {
+		fmt.Fprintf(os.Stderr, "Waiting for a connection to %s\n", l.name)
+		<-l.connected
+	}
+	return l, nil
+}
+
+// close - Stops listening and disconnects the client
+func (l *serialLine) close() {
+	l.mutex.Lock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.mutex.Unlock()
+	for _, closer := range l.closers {
+		closer.Close()
+	}
+}
+
+// accept - Takes clients one at a time. Another one is turned away while there
+// is a client
+func (l *serialLine) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !l.connect(conn) {
+			conn.Write([]byte("The port is in use\r\n"))
+			conn.Close()
+			continue
+		}
+		if l.telnet {
+			conn.Write([]byte{telnetIAC, telnetWill, telnetEcho, telnetIAC, telnetWill, telnetSGA})
+		}
+		go l.serve(conn)
+	}
+}
+
+func (l *serialLine) connect(conn io.ReadWriteCloser) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conn != nil {
+		return false
+	}
+	l.conn, l.paused, l.sentXOFF = conn, false, false
+	l.once.Do(func() { close(l.connected) })
+	return true
+}
+
+func (l *serialLine) client() io.ReadWriteCloser {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.conn
+}
+
+// serve - Receives from a client until it disconnects
+func (l *serialLine) serve(conn io.ReadWriteCloser) {
+	decoder := telnetDecoder{conn: conn}
+	buffer := make([]byte, 256)
+	for {
+		n, err := conn.Read(buffer)
+		for _, b := range buffer[:n] {
+			if l.telnet && !decoder.decode(b) {
+				continue
+			}
+			l.receive(b)
+		}
+		if err != nil {
+			break
+		}
+	}
+	conn.Close()
+	l.mutex.Lock()
+	l.conn, l.paused, l.sentXOFF = nil, false, false // An XOFF doesn't outlast the client
+	l.mutex.Unlock()
+}
+
+// receive - A character from the client. Without flow control it is lost if
+// the buffer is full, as it would be when a UART overruns
+func (l *serialLine) receive(b uint8) {
+	switch {
+	case l.flow == flowXonXoff && (b == xon || b == xoff):
+		l.mutex.Lock()
+		l.paused = b == xoff
+		l.mutex.Unlock()
+		return
+	case l.flow == flowNone:
+		select {
+		case l.in <- b:
+		default:
+		}
+		return
+	case l.flow == flowXonXoff && len(l.in) >= cap(l.in)*3/4:
+		l.sendXOFF(true)
+	}
+	l.in <- b
+}
+
+// sendXOFF - Asks the client to stop (XOFF) or to carry on (XON)
+func (l *serialLine) sendXOFF(stop bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conn == nil || l.sentXOFF == stop {
+		return
+	}
+	l.sentXOFF = stop
+	if stop {
+		l.conn.Write([]byte{xoff})
+	} else {
+		l.conn.Write([]byte{xon})
+	}
+}
+
+// send - Writes what the CPU sends to the client. Without hardware flow control
+// it is lost while there isn't a client
+func (l *serialLine) send() {
+	for b := range l.out {
+		conn := l.client()
+		for conn == nil && l.flow == flowRTSCTS {
+			time.Sleep(10 * time.Millisecond)
+			conn = l.client()
+		}
+		if conn == nil {
+			continue
+		}
+		if l.telnet && b == telnetIAC {
+			conn.Write([]byte{telnetIAC, telnetIAC})
+		} else {
+			conn.Write([]byte{b})
+		}
+	}
+}
+
+func (l *serialLine) isPaused() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.paused
+}
+
+// received - Whether a character can be read once the CPU has run for cycles
+func (l *serialLine) received(cycles int64) bool {
+	return len(l.in) > 0 && cycles >= l.nextRx
+}
+
+// read - The next character, or 0 if there isn't one
+func (l *serialLine) read(cycles int64) uint8 {
+	select {
+	case b := <-l.in:
+		l.took(cycles)
+		return b
+	default:
+		return 0
+	}
+}
+
+func (l *serialLine) took(cycles int64) {
+	l.nextRx = cycles + l.charCycles
+	if l.flow == flowXonXoff && len(l.in) <= cap(l.in)/4 {
+		l.sendXOFF(false)
+	}
+}
+
+// sendable - Whether a character can be sent once the CPU has run for cycles.
+// Without a client CTS is taken as asserted (see writeWaiting)
+func (l *serialLine) sendable(cycles int64) bool {
+	return cycles >= l.nextTx && !l.isPaused() && (l.flow != flowRTSCTS || len(l.out) < cap(l.out) || l.client() == nil)
+}
+
+// write - Sends a character. It is lost if the buffer is full and there is
+// no flow control
+func (l *serialLine) write(cycles int64, b uint8) {
+	l.nextTx = cycles + l.charCycles
+	select {
+	case l.out <- b:
+	default:
+	}
+}
+
+// readWaiting - Waits for a character, as a program polling the device would.
+// The CPU's cycles are moved on if the baud rate makes it wait. Nothing more
+// will come while there isn't a client or once the console input has ended (when
+// ended is closed), so then it gives ^Z, the end of the file
+func (l *serialLine) readWaiting(mc *microcontroller, ended <-chan struct{}) uint8 {
+	if mc.cycles < l.nextRx {
+		mc.cycles = l.nextRx
+	}
+	for {
+		select {
+		case b := <-l.in:
+			l.took(mc.cycles)
+			return b
+		case <-ended:
+		case <-time.After(10 * time.Millisecond):
+			if l.client() != nil {
+				continue
+			}
+		}
+		if len(l.in) == 0 {
+			return 0x1A
+		}
+	}
+}
+
+// writeWaiting - Sends a character once the line is ready for it, as a program
+// polling the device would. With hardware flow control it waits while a client
+// holds the data back, but without a client CTS is taken as asserted, so the
+// character is lost once the buffer is full rather than waiting forever
+func (l *serialLine) writeWaiting(mc *microcontroller, b uint8) {
+	if mc.cycles < l.nextTx {
+		mc.cycles = l.nextTx
+	}
+	for l.isPaused() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.nextTx = mc.cycles + l.charCycles
+	if l.flow != flowRTSCTS {
+		l.write(mc.cycles, b)
+		return
+	}
+	for {
+		select {
+		case l.out <- b:
+			return
+		case <-time.After(10 * time.Millisecond):
+			if l.client() == nil {
+				return
+			}
+		}
+	}
+}
+
+// telnetDecoder - Strips the telnet commands from what a client sends. Options
+// the client offers are refused, apart from the ones it was offered. Enter
+// arrives as CR NUL or CR LF, which is turned back into CR
+type telnetDecoder struct {
+	conn    io.Writer
+	state   int
+	command uint8
+	cr      bool
+}
+
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSubnegotiation
+	telnetSubnegotiationIAC
+)
+
+// decode - Whether b is data rather than part of a command
+func (d *telnetDecoder) decode(b uint8) bool {
+	switch d.state {
+	case telnetCommand:
+		d.state, d.command = telnetData, b
+		switch b {
+		case telnetIAC:
+			return true // An escaped FF
+		case telnetWill, telnetWont, telnetDo, telnetDont:
+			d.state = telnetOption
+		case telnetSB:
+			d.state = telnetSubnegotiation
+		}
+		return false
+	case telnetOption:
+		d.state = telnetData
+		if d.command == telnetWill {
+			d.conn.Write([]byte{telnetIAC, telnetDont, b})
+		} else if d.command == telnetDo && b != telnetEcho && b != telnetSGA {
+			d.conn.Write([]byte{telnetIAC, telnetWont, b})
+		}
+		return false
+	case telnetSubnegotiation:
+		if b == telnetIAC {
+			d.state = telnetSubnegotiationIAC
+		}
+		return false
+	case telnetSubnegotiationIAC:
+		d.state = telnetSubnegotiation
+		if b == telnetSE {
+			d.state = telnetData
+		}
+		return false
+	}
+	if b == telnetIAC {
+		d.state = telnetCommand
+		return false
+	}
+	cr := d.cr
+	d.cr = b == '\r'
+	return !(cr && (b == 0 || b == '\n'))
+}
+
+// lineTerminal - A serial line as the terminal of a serial board
+type lineTerminal struct {
+	line *serialLine
+	mc   *microcontroller
+}
+
+func (t *lineTerminal) ready() bool {
+	return t.line.received(t.mc.cycles)
+}
+
+func (t *lineTerminal) read() uint8 {
+	return t.line.read(t.mc.cycles)
+}
+
+func (t *lineTerminal) sendable() bool {
+	return t.line.sendable(t.mc.cycles)
+}
+
+func (t *lineTerminal) write(character uint8) {
+	t.line.write(t.mc.cycles, character)
+}
+
+// openSerialLines - Opens the lines of the devices bound with -serial. devices
+// are the names of the serial devices of the machine being run
+func openSerialLines(devices ...string) (map[string]*serialLine, error) {
+	lines := map[string]*serialLine{}
+	for _, name := range sortedKeys(SERIALPORTS) {
+		if !containsString(devices, name) {
+			closeSerialLines(lines)
+			return nil, fmt.Errorf("there is no serial device %s (available: %s)", name, strings.Join(devices, ", "))
+		}
+		line, err := openSerialLine(SERIALPORTS[name], CPUFREQUENCY)
+		if err != nil {
+			closeSerialLines(lines)
+			return nil, fmt.Errorf("-serial %s: %s", name, err)
+		}
+		fmt.Fprintf(os.Stderr, "Serial device %s is on %s\n", name, line.name)
+		lines[name] = line
+	}
+	return lines, nil
+}
+
+func closeSerialLines(lines map[string]*serialLine) {
+	for _, line := range lines {
+		line.close()
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
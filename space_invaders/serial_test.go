@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitUntil - Waits up to a couple of seconds for the goroutines of a line to
+// catch up
+func waitUntil(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(2 * time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func dialSerialLine(t *testing.T, spec string) (*serialLine, net.Conn) {
+	line, err := openSerialLine(spec, 2000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", line.name)
+	if err != nil {
+		line.close()
+		t.Fatal(err)
+	}
+	waitUntil(t, "the connection", func() bool { return line.client() != nil })
+	return line, conn
+}
+
+func readAll(line *serialLine) []uint8 {
+	received := []uint8{}
+	for line.received(0) {
+		received = append(received, line.read(0))
+	}
+	return received
+}
+
+// TestSerialTelnet : Telnet commands are answered and stripped, FF is escaped
+// and Enter arrives as CR
+func TestSerialTelnet(t *testing.T) {
+	line, conn := dialSerialLine(t, "tcp:127.0.0.1:0")
+	defer line.close()
+	defer conn.Close()
+	offer := make([]byte, 6)
+	if _, err := io.ReadFull(conn, offer); err != nil || !bytes.Equal(offer, []byte{0xFF, 0xFB, 0x01, 0xFF, 0xFB, 0x03}) {
+		t.Fatalf("Expected WILL ECHO and WILL SGA, got % X (%v)", offer, err)
+	}
+	conn.Write([]byte{'A', 0xFF, 0xFF, 0xFF, 0xFB, 0x1F, 0xFF, 0xFA, 0x1F, 0, 80, 0, 24, 0xFF, 0xF0, '\r', 0, 'B', '\r', '\n'})
+	waitUntil(t, "the input", func() bool { return len(line.in) == 5 })
+	if got := readAll(line); !bytes.Equal(got, []uint8{'A', 0xFF, '\r', 'B', '\r'}) {
+		t.Errorf("Expected A FF CR B CR, got % X", got)
+	}
+	line.write(0, 0xFF)
+	line.write(0, 'x')
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, []byte{0xFF, 0xFE, 0x1F, 0xFF, 0xFF, 'x'}) {
+		t.Errorf("Expected DONT NAWS, an escaped FF and x, got % X (%v)", reply, err)
+	}
+}
+
+// TestSerialPacing : At 9600 baud a character takes 2083 cycles of a 2MHz CPU
+// in each direction
+func TestSerialPacing(t *testing.T) {
+	line, conn := dialSerialLine(t, "tcp:127.0.0.1:0,raw,baud=9600")
+	defer line.close()
+	defer conn.Close()
+	conn.Write([]byte("ab"))
+	waitUntil(t, "the input", func() bool { return len(line.in) == 2 })
+	if !line.received(0) || line.read(0) != 'a' {
+		t.Fatal("Expected to read a")
+	}
+	if line.received(2082) || !line.received(2083) {
+		t.Error("The second character wasn't paced")
+	}
+	line.write(0, 'x')
+	if line.sendable(2082) || !line.sendable(2083) {
+		t.Error("Sending wasn't paced")
+	}
+	received := make([]byte, 1)
+	if _, err := io.ReadFull(conn, received); err != nil || received[0] != 'x' {
+		t.Errorf("Expected x without any telnet commands, got %q", received)
+	}
+}
+
+// TestSerialXonXoff : The client stops the line with XOFF, and is sent XOFF
+// itself when the input is filling up
+func TestSerialXonXoff(t *testing.T) {
+	line, conn := dialSerialLine(t, "tcp:127.0.0.1:0,raw,flow=xonxoff")
+	defer line.close()
+	defer conn.Close()
+	conn.Write([]byte{xoff})
+	waitUntil(t, "XOFF", func() bool { return !line.sendable(0) })
+	conn.Write([]byte{xon})
+	waitUntil(t, "XON", func() bool { return line.sendable(0) })
+
+	conn.Write(bytes.Repeat([]byte{'.'}, 200))
+	control := make([]byte, 1)
+	if _, err := io.ReadFull(conn, control); err != nil || control[0] != xoff {
+		t.Fatalf("Expected XOFF when the buffer filled up, got % X", control)
+	}
+	waitUntil(t, "the input", func() bool { return len(line.in) == 200 })
+	if got := readAll(line); len(got) != 200 {
+		t.Errorf("Expected all 200 characters, got %d", len(got))
+	}
+	if _, err := io.ReadFull(conn, control); err != nil || control[0] != xon {
+		t.Errorf("Expected XON once the buffer was emptied, got % X", control)
+	}
+}
+
+// TestSerialWaiting : The CP/M reader gives ^Z instead of waiting forever
+// without a client or after the console input has ended, and an XOFF is
+// forgotten when the client that sent it disconnects
+func TestSerialWaiting(t *testing.T) {
+	mc := newMicrocontroller()
+	running := make(chan struct{})
+	line, err := openSerialLine("tcp:127.0.0.1:0,raw,flow=xonxoff", 2000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer line.close()
+	if b := line.readWaiting(mc, running); b != 0x1A {
+		t.Errorf("Expected ^Z without a client, got %02X", b)
+	}
+
+	conn, err := net.Dial("tcp", line.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the connection", func() bool { return line.client() != nil })
+	conn.Write([]byte{'A'})
+	if b := line.readWaiting(mc, running); b != 'A' {
+		t.Errorf("Expected A from the client, got %02X", b)
+	}
+	ended := make(chan struct{})
+	close(ended)
+	if b := line.readWaiting(mc, ended); b != 0x1A {
+		t.Errorf("Expected ^Z once the console input has ended, got %02X", b)
+	}
+
+	conn.Write([]byte{xoff})
+	waitUntil(t, "XOFF", func() bool { return line.isPaused() })
+	conn.Close()
+	waitUntil(t, "the disconnection", func() bool { return line.client() == nil })
+	done := make(chan struct{})
+	go func() {
+		line.writeWaiting(mc, 'B')
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the XOFF to be forgotten when the client disconnected")
+	}
+}
+
+// TestSerialWaitingRTSCTS : With hardware flow control and no client, the CP/M
+// punch doesn't wait forever once the buffer is full. A client which connects
+// later gets what is sent then
+func TestSerialWaitingRTSCTS(t *testing.T) {
+	mc := newMicrocontroller()
+	line, err := openSerialLine("tcp:127.0.0.1:0,raw,flow=rtscts", 2000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer line.close()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < serialLineBuffer+10; i++ {
+			line.writeWaiting(mc, 'A')
+		}
+		if !line.sendable(mc.cycles) {
+			t.Errorf("A polling program would wait forever without a client")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the characters to be lost without a client")
+	}
+
+	conn, err := net.Dial("tcp", line.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitUntil(t, "the connection", func() bool { return line.client() != nil })
+	line.writeWaiting(mc, 'B')
+	received := []byte{}
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for !bytes.HasSuffix(received, []byte("B")) {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Expected B after what was buffered, got %q: %s", received, err)
+		}
+		received = append(received, buffer[:n]...)
+	}
+}
+
+// TestSerialAltair : A program on the 88-2SIO talks to a TCP client
+func TestSerialAltair(t *testing.T) {
+	line, conn := dialSerialLine(t, "tcp:127.0.0.1:0,raw")
+	defer line.close()
+	defer conn.Close()
+	machine := newAltair(newCPMConsole(bytes.NewReader(nil), &bytes.Buffer{}, false))
+	machine.connect(map[string]*serialLine{"2sio": line})
+	copy(*machine.mc.memory, []uint8{
+		0xDB, 0x10, // IN 10H
+		0x0F,             // RRC
+		0xD2, 0x00, 0x00, // JNC 0
+		0xDB, 0x11, // IN 11H
+		0x3C,       // INR A
+		0xD3, 0x11, // OUT 11H
+		0x76, // HLT
+	})
+	conn.Write([]byte("A"))
+	for deadline := time.Now().Add(2 * time.Second); !machine.mc.halted && time.Now().Before(deadline); {
+		machine.mc.run()
+	}
+	received := make([]byte, 1)
+	if _, err := io.ReadFull(conn, received); err != nil || received[0] != 'B' {
+		t.Errorf("Expected B back, got %q (%v)", received, err)
+	}
+}
+
+// TestSerialPty : A terminal program can open the pseudo-terminal
+func TestSerialPty(t *testing.T) {
+	line, err := openSerialLine("pty", 2000000)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer line.close()
+	terminal, err := os.OpenFile(line.name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer terminal.Close()
+	terminal.Write([]byte("hi\r"))
+	waitUntil(t, "the input", func() bool { return len(line.in) == 3 })
+	if got := readAll(line); string(got) != "hi\r" {
+		t.Errorf("Expected hi CR unchanged, got %q", got)
+	}
+	line.write(0, '\n')
+	received := make([]byte, 1)
+	if _, err := io.ReadFull(terminal, received); err != nil || received[0] != '\n' {
+		t.Errorf("Expected LF unchanged, got %q (%v)", received, err)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Runs per instruction test vectors in the JSON format published by the
+// SingleStepTests project (github.com/SingleStepTests/8080). Each file holds
+// an array of tests for one opcode, each giving the state of the processor and
+// of the memory it uses before and after the instruction is executed:
+//
+//	{"name": "27 0000",
+//	 "initial": {"pc": 0, "sp": 0, "a": 155, "b": 0, ..., "f": 2, "ram": [[0, 39]]},
+//	 "final":   {"pc": 1, "sp": 0, "a": 1, "b": 0, ..., "f": 19, "ram": [[0, 39]]},
+//	 "cycles":  [[0, 39, "r--m"], ...],
+//	 "ports":   [[16, 255, "r"]]}
+//
+// "cycles" has one entry per clock cycle (a plain number is accepted too) and
+// "ports" lists the values read by IN and written by OUT.
+
+// singleStepState - The processor and memory before or after a test
+type singleStepState struct {
+	PC  uint16     `json:"pc"`
+	SP  uint16     `json:"sp"`
+	A   uint8      `json:"a"`
+	B   uint8      `json:"b"`
+	C   uint8      `json:"c"`
+	D   uint8      `json:"d"`
+	E   uint8      `json:"e"`
+	F   uint8      `json:"f"`
+	H   uint8      `json:"h"`
+	L   uint8      `json:"l"`
+	RAM [][2]int64 `json:"ram"`
+}
+
+// singleStepTest - One test vector
+type singleStepTest struct {
+	Name    string            `json:"name"`
+	Initial singleStepState   `json:"initial"`
+	Final   singleStepState   `json:"final"`
+	Cycles  json.RawMessage   `json:"cycles"`
+	Ports   []json.RawMessage `json:"ports"`
+}
+
+// cycleCount - The number of cycles the instruction should take, or -1 if the test doesn't say
+func (t *singleStepTest) cycleCount() int {
+	var perCycle []json.RawMessage
+	if err := json.Unmarshal(t.Cycles, &perCycle); err == nil {
+		return len(perCycle)
+	}
+	var total int
+	if err := json.Unmarshal(t.Cycles, &total); err == nil {
+		return total
+	}
+	return -1
+}
+
+// singleStepPort - A value read from or written to an I/O port
+type singleStepPort struct {
+	port, value uint8
+	write       bool
+}
+
+func (t *singleStepTest) ports() ([]singleStepPort, error) {
+	ports := make([]singleStepPort, 0, len(t.Ports))
+	for _, raw := range t.Ports {
+		var fields []interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: port access %s should be [port, value, \"r\" or \"w\"]", t.Name, raw)
+		}
+		port, portOk := fields[0].(float64)
+		value, valueOk := fields[1].(float64)
+		direction, directionOk := fields[2].(string)
+		if !portOk || !valueOk || !directionOk {
+			return nil, fmt.Errorf("%s: port access %s should be [port, value, \"r\" or \"w\"]", t.Name, raw)
+		}
+		ports = append(ports, singleStepPort{uint8(port), uint8(value), direction == "w"})
+	}
+	return ports, nil
+}
+
+// loadSingleStepTests - Reads a file of test vectors
+func loadSingleStepTests(fileName string) ([]singleStepTest, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	tests := []singleStepTest{}
+	if err := json.Unmarshal(data, &tests); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	return tests, nil
+}
+
+// singleStepResult - The outcome of one test vector
+type singleStepResult struct {
+	name        string
+	opcode      uint8
+	instruction string
+	problems    []string
+}
+
+// mismatch - Adds a problem to the result if a field doesn't have the expected value
+func (r *singleStepResult) mismatch(field string, got int, expected int, digits int) {
+	if got != expected {
+		r.problems = append(r.problems, fmt.Sprintf("%s=%0*X (expected %0*X)", field, digits, got, digits, expected))
+	}
+}
+
+// singleStepBus - Plays the part of the hardware for IN and OUT using the
+// port accesses listed in the test
+type singleStepBus struct {
+	ports  []singleStepPort
+	result *singleStepResult
+}
+
+// next - The next port access listed in the test, if it is the one being made
+func (b *singleStepBus) next(port uint8, write bool) (singleStepPort, bool) {
+	if len(b.ports) == 0 {
+		b.result.problems = append(b.result.problems, fmt.Sprintf("port %02X was used but the test has no port accesses", port))
+		return singleStepPort{}, false
+	}
+	expected := b.ports[0]
+	b.ports = b.ports[1:]
+	if expected.write != write || expected.port != port {
+		b.result.problems = append(b.result.problems, fmt.Sprintf("port %02X was used, expected port %02X", port, expected.port))
+		return singleStepPort{}, false
+	}
+	return expected, true
+}
+
+func (b *singleStepBus) input(port uint8) uint8 {
+	expected, _ := b.next(port, false)
+	return expected.value
+}
+
+func (b *singleStepBus) output(port uint8, value uint8) {
+	if expected, ok := b.next(port, true); ok {
+		b.result.mismatch("out", int(value), int(expected.value), 2)
+	}
+}
+
+// runSingleStep - Executes the instruction of a test vector on a fresh microcontroller
+// and compares every register, flag, memory location and the cycle count
+func runSingleStep(test *singleStepTest) (result singleStepResult) {
+	result.name = test.Name
+	memory := make([]uint8, 0x10000)
+	initial, final := &test.Initial, &test.Final
+	for _, location := range initial.RAM {
+		memory[uint16(location[0])] = uint8(location[1])
+	}
+	result.opcode = memory[initial.PC]
+	result.instruction = disassemble(memory, initial.PC).String()
+
+	ports, err := test.ports()
+	if err != nil {
+		result.problems = append(result.problems, err.Error())
+		return result
+	}
+
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	mc.io = &singleStepBus{ports, &result}
+	mc.programCounter, mc.stackPointer = initial.PC, initial.SP
+	mc.ra, mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl = initial.A, initial.B, initial.C, initial.D, initial.E, initial.H, initial.L
+	setPSWByte(mc, initial.F)
+
+	var buffer [maxMemoryAccesses]memoryAccess
+	accesses := predictMemoryAccesses(mc, buffer[:])
+	crashed := func() (reason interface{}) {
+		defer func() { reason = recover() }()
+		mc.run()
+		return nil
+	}()
+	if crashed != nil {
+		result.problems = append(result.problems, fmt.Sprintf("crashed: %v", crashed))
+		return result
+	}
+
+	result.mismatch("pc", int(mc.programCounter), int(final.PC), 4)
+	result.mismatch("sp", int(mc.stackPointer), int(final.SP), 4)
+	result.mismatch("a", int(mc.ra), int(final.A), 2)
+	result.mismatch("b", int(mc.rb), int(final.B), 2)
+	result.mismatch("c", int(mc.rc), int(final.C), 2)
+	result.mismatch("d", int(mc.rd), int(final.D), 2)
+	result.mismatch("e", int(mc.re), int(final.E), 2)
+	result.mismatch("h", int(mc.rh), int(final.H), 2)
+	result.mismatch("l", int(mc.rl), int(final.L), 2)
+	if flags := pswByte(mc); flags != final.F {
+		result.problems = append(result.problems, fmt.Sprintf("f=%08b (expected %08b, SZ-X-P-C)", flags, final.F))
+	}
+	if cycles := test.cycleCount(); cycles >= 0 {
+		if int(mc.lastCycles) != cycles {
+			result.problems = append(result.problems, fmt.Sprintf("cycles=%d (expected %d)", mc.lastCycles, cycles))
+		}
+	}
+
+	// Memory the test expects, including what the instruction must not have
+	// changed, plus anything the instruction wrote to that the test doesn't mention
+	expected := map[uint16]uint8{}
+	for _, location := range initial.RAM {
+		expected[uint16(location[0])] = uint8(location[1])
+	}
+	for _, location := range final.RAM {
+		expected[uint16(location[0])] = uint8(location[1])
+	}
+	for _, access := range completeMemoryAccesses(mc, accesses) {
+		if _, ok := expected[access.address]; !ok && access.write {
+			expected[access.address] = 0
+		}
+	}
+	addresses := make([]int, 0, len(expected))
+	for address := range expected {
+		addresses = append(addresses, int(address))
+	}
+	sort.Ints(addresses)
+	for _, address := range addresses {
+		result.mismatch(fmt.Sprintf("ram[%04X]", address), int(memory[address]), int(expected[uint16(address)]), 2)
+	}
+	return result
+}
+
+// opcodeSummary - The results of all the tests for one opcode
+type opcodeSummary struct {
+	opcode      uint8
+	instruction string
+	passed      int
+	failures    []singleStepResult
+}
+
+// singleStepFiles - The JSON files given on the command line, with directories
+// replaced by the .json files in them
+func singleStepFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// runSingleStepFiles - Runs every test in the files and groups the results by opcode
+func runSingleStepFiles(files []string, opcodes map[uint8]bool) (map[uint8]*opcodeSummary, error) {
+	summaries := map[uint8]*opcodeSummary{}
+	for _, fileName := range files {
+		tests, err := loadSingleStepTests(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for i := range tests {
+			result := runSingleStep(&tests[i])
+			if len(opcodes) > 0 && !opcodes[result.opcode] {
+				continue
+			}
+			summary, ok := summaries[result.opcode]
+			if !ok {
+				summary = &opcodeSummary{opcode: result.opcode, instruction: strings.Fields(result.instruction)[0]}
+				summaries[result.opcode] = summary
+			}
+			if len(result.problems) == 0 {
+				summary.passed++
+			} else {
+				summary.failures = append(summary.failures, result)
+			}
+		}
+	}
+	return summaries, nil
+}
+
+// singleStepCommand - Implements "space_invaders singlestep", which runs JSON
+// test vectors and prints the number of passed and failed tests for each opcode
+func singleStepCommand(args []string) error {
+	flags := flag.NewFlagSet("singlestep", flag.ExitOnError)
+	opcodeList := flags.String("op", "", "Comma separated list of opcodes (hex) to test, ie: 27,E3")
+	shown := flags.Int("show", 3, "Number of failed tests to show for each opcode (-1 = all)")
+	all := flags.Bool("all", false, "List the opcodes where every test passed too")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s singlestep [options] <file or directory>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no test files given")
+	}
+	opcodes, err := parseOpcodeList(*opcodeList)
+	if err != nil {
+		return err
+	}
+	files, err := singleStepFiles(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	DEBUGMODE = false
+	summaries, err := runSingleStepFiles(files, opcodes)
+	if err != nil {
+		return err
+	}
+	failedOpcodes, passed, failed := 0, 0, 0
+	fmt.Printf("%-6s %-6s %8s %8s\n", "OPCODE", "INSTR", "PASSED", "FAILED")
+	for opcode := 0; opcode < 256; opcode++ {
+		summary, ok := summaries[uint8(opcode)]
+		if !ok {
+			continue
+		}
+		passed += summary.passed
+		failed += len(summary.failures)
+		if len(summary.failures) == 0 && !*all {
+			continue
+		}
+		fmt.Printf("%02X     %-6s %8d %8d\n", opcode, summary.instruction, summary.passed, len(summary.failures))
+		if len(summary.failures) > 0 {
+			failedOpcodes++
+		}
+		for i, failure := range summary.failures {
+			if *shown >= 0 && i >= *shown {
+				fmt.Printf("    ... %d more\n", len(summary.failures)-i)
+				break
+			}
+			fmt.Printf("    %s (%s): %s\n", failure.name, failure.instruction, strings.Join(failure.problems, ", "))
+		}
+	}
+	fmt.Printf("%d opcodes, %d tests passed, %d failed\n", len(summaries), passed, failed)
+	if failedOpcodes > 0 {
+		return errors.New(strconv.Itoa(failedOpcodes) + " opcode(s) failed")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestSingleStepVectors : The vectors in testdata/singlestep all pass
+func TestSingleStepVectors(t *testing.T) {
+	files, err := singleStepFiles([]string{filepath.Join("testdata", "singlestep")})
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No test vectors found: %v", err)
+	}
+	for _, fileName := range files {
+		tests, err := loadSingleStepTests(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range tests {
+			if result := runSingleStep(&tests[i]); len(result.problems) > 0 {
+				t.Errorf("%s (%s): %v", result.name, result.instruction, result.problems)
+			}
+		}
+	}
+}
+
+// TestSingleStepMismatches : Every field which differs from the vector is reported
+func TestSingleStepMismatches(t *testing.T) {
+	tests, err := loadSingleStepTests(filepath.Join("testdata", "singlestep", "e3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := tests[0]
+	test.Final.H = 0x99
+	test.Final.F = 0x03
+	test.Final.RAM = [][2]int64{{0x200, 0xE3}, {0x1000, 0x34}, {0x1001, 0x00}}
+	test.Cycles = []byte("16")
+	result := runSingleStep(&test)
+	expected := []string{
+		"h=56 (expected 99)",
+		"f=00000010 (expected 00000011, SZ-X-P-C)",
+		"cycles=18 (expected 16)",
+		"ram[1001]=12 (expected 00)",
+	}
+	if result.opcode != 0xE3 || result.instruction != "XTHL" || !reflect.DeepEqual(result.problems, expected) {
+		t.Errorf("Unexpected result: %02X %s %q", result.opcode, result.instruction, result.problems)
+	}
+
+	// The undocumented opcodes aren't implemented, so they panic
+	test = singleStepTest{Name: "cb 0000", Initial: singleStepState{RAM: [][2]int64{{0, 0xCB}}}}
+	if result := runSingleStep(&test); len(result.problems) != 1 || result.opcode != 0xCB {
+		t.Errorf("Expected CB to be reported as a crash: %q", result.problems)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs the CP/M test ROMs without any output, captures what they print through
+// the BDOS and decides whether they passed. Used by both "space_invaders suite"
+// and the TestROMSuite go test.
+
+// testROM - A test program and how to tell whether it passed
+type testROM struct {
+	name      string
+	file      string
+	success   []string          // Must all be printed
+	failure   []string          // Must not be printed
+	crcs      map[string]uint32 // Expected CRC of each instruction exerciser test
+	maxCycles int64             // The program fails if it runs for longer than this
+	long      bool              // Skipped by go test -short
+}
+
+// exerciserCRCs - The CRCs a real 8080 produces for each test of the instruction
+// exerciser. The copy of 8080EXER.COM in test_roms has all of its expected CRCs
+// set to 0, so it reports every test as an error and prints the CRC it found.
+var exerciserCRCs = map[string]uint32{
+	"dad <b,d,h,sp>":           0x14474ba6,
+	"aluop nn":                 0x9e922f9e,
+	"aluop <b,c,d,e,h,l,m,a>":  0xcf762c86,
+	"<daa,cma,stc,cmc>":        0xbb3f030c,
+	"<inr,dcr> a":              0xadb6460e,
+	"<inr,dcr> b":              0x83ed1345,
+	"<inx,dcx> b":              0xf79287cd,
+	"<inr,dcr> c":              0xe5f6721b,
+	"<inr,dcr> d":              0x15b5579a,
+	"<inx,dcx> d":              0x7f4e2501,
+	"<inr,dcr> e":              0xcf2ab396,
+	"<inr,dcr> h":              0x12b2952c,
+	"<inx,dcx> h":              0x9f2b23c0,
+	"<inr,dcr> l":              0xff57d356,
+	"<inr,dcr> m":              0x92e963bd,
+	"<inx,dcx> sp":             0xd5702fab,
+	"lhld nnnn":                0xa9c3d5cb,
+	"shld nnnn":                0xe8864f26,
+	"lxi <b,d,h,sp>,nnnn":      0xfcf46e12,
+	"ldax <b,d>":               0x2b821d5f,
+	"mvi <b,c,d,e,h,l,m,a>,nn": 0xeaa72044,
+	"mov <bcdehla>,<bcdehla>":  0x10b58cee,
+	"sta nnnn / lda nnnn":      0xed57af72,
+	"<rlc,rrc,ral,rar>":        0xe0d89235,
+	"stax <b,d>":               0x2b0471e9,
+}
+
+var testROMs = []testROM{
+	{name: "TEST", file: "TEST.COM", success: []string{"CPU IS OPERATIONAL"},
+		failure: []string{"CPU HAS FAILED"}, maxCycles: 100000},
+	{name: "8080PRE", file: "8080PRE.COM", success: []string{"8080 Preliminary tests complete"},
+		failure: []string{"ERROR"}, maxCycles: 100000},
+	{name: "CPUTEST", file: "CPUTEST.COM", success: []string{"CPU TESTS OK"},
+		failure: []string{"CPU FAILED", "CHECKSUM ERROR"}, maxCycles: 400000000},
+	{name: "cpudiag", file: "cpudiag.bin", success: []string{"CPU IS OPERATIONAL"},
+		failure: []string{"CPU HAS FAILED"}, maxCycles: 100000},
+	{name: "8080EXER", file: "8080EXER.COM", success: []string{"Tests complete"},
+		crcs: exerciserCRCs, maxCycles: 50000000000, long: true},
+}
+
+// exerciserLine - A test of the instruction exerciser: its name, followed by
+// dots and then either OK or the expected and the actual CRC
+var exerciserLine = regexp.MustCompile(`([^\r\n.]+)\.{3,}\s*(OK|ERROR \*+ crc expected:([0-9a-fA-F]{8}) found:([0-9a-fA-F]{8}))`)
+
+// checkExerciser - Compares the CRCs printed by the instruction exerciser with the known ones
+func checkExerciser(output string, crcs map[string]uint32) []string {
+	problems := []string{}
+	seen := map[string]bool{}
+	for _, match := range exerciserLine.FindAllStringSubmatch(output, -1) {
+		name := strings.TrimSpace(match[1])
+		expected, known := crcs[name]
+		seen[name] = true
+		switch {
+		case !known:
+			problems = append(problems, fmt.Sprintf("unknown test '%s'", name))
+		case match[2] == "OK":
+		default:
+			found, _ := strconv.ParseUint(match[4], 16, 32)
+			if uint32(found) != expected {
+				problems = append(problems, fmt.Sprintf("%s: CRC %08x, expected %08x", name, found, expected))
+			}
+		}
+	}
+	for name := range crcs {
+		if !seen[name] {
+			problems = append(problems, fmt.Sprintf("%s: did not run", name))
+		}
+	}
+	return problems
+}
+
+// suiteResult - The outcome of running one test ROM
+type suiteResult struct {
+	rom          testROM
+	passed       bool
+	reason       string
+	output       string
+	cycles       int64
+	instructions int64
+	duration     time.Duration
+}
+
+// runHeadless - Runs a test ROM until it jumps to 0 (CP/M warm boot) or
+// exceeds its cycle limit. Calls to the BDOS at 5 are captured in output
+func runHeadless(rom testROM, directory string) (result suiteResult) {
+	result.rom = rom
+	start := time.Now()
+	output := &bytes.Buffer{}
+	mc := newMicrocontroller()
+	defer func() {
+		result.duration = time.Since(start)
+		result.output = output.String()
+		result.cycles, result.instructions = mc.cycles, mc.instructionsExecuted
+		if r := recover(); r != nil {
+			result.passed, result.reason = false, fmt.Sprintf("crashed: %v", r)
+		}
+	}()
+
+	memory, err := loadTestROM(filepath.Join(directory, rom.file))
+	if err != nil {
+		return suiteResult{rom: rom, reason: err.Error()}
+	}
+	memory[5] = 0xC9 // RET after handling CALL 5
+	mc.memory = &memory
+	mc.programCounter = 0x100
+	for mc.programCounter != 0 {
+		if mc.cycles > rom.maxCycles {
+			return suiteResult{rom: rom, reason: fmt.Sprintf("still running after %d cycles", rom.maxCycles)}
+		}
+		mc.run()
+		if mc.programCounter == 5 {
+			output.WriteString(bdosText(mc))
+		}
+	}
+
+	text := output.String()
+	problems := []string{}
+	for _, expected := range rom.success {
+		if !strings.Contains(text, expected) {
+			problems = append(problems, fmt.Sprintf("'%s' was not printed", expected))
+		}
+	}
+	for _, unexpected := range rom.failure {
+		if strings.Contains(text, unexpected) {
+			problems = append(problems, fmt.Sprintf("'%s' was printed", unexpected))
+		}
+	}
+	if rom.crcs != nil {
+		problems = append(problems, checkExerciser(text, rom.crcs)...)
+	}
+	return suiteResult{rom: rom, passed: len(problems) == 0, reason: strings.Join(problems, "; ")}
+}
+
+// suiteCommand - Implements "space_invaders suite", which runs the test ROMs
+// and prints a summary
+func suiteCommand(args []string) error {
+	flags := flag.NewFlagSet("suite", flag.ExitOnError)
+	directory := flags.String("dir", filepath.Join("test", "test_roms"), "Directory containing the test ROMs")
+	short := flags.Bool("short", false, "Skip the long running ROMs (8080EXER)")
+	run := flags.String("run", "", "Only run the ROMs whose name matches this regular expression")
+	verbose := flags.Bool("v", false, "Show what each ROM printed")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s suite [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		return err
+	}
+
+	DEBUGMODE = false
+	failed := 0
+	fmt.Printf("%-10s %-6s %14s %14s %10s\n", "ROM", "RESULT", "INSTRUCTIONS", "CYCLES", "TIME")
+	for _, rom := range testROMs {
+		if !filter.MatchString(rom.name) {
+			continue
+		}
+		if *short && rom.long {
+			fmt.Printf("%-10s %-6s\n", rom.name, "SKIP")
+			continue
+		}
+		result := runHeadless(rom, *directory)
+		status := "PASS"
+		if !result.passed {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%-10s %-6s %14d %14d %10s\n", rom.name, status, result.instructions, result.cycles,
+			result.duration.Round(time.Millisecond))
+		if !result.passed {
+			fmt.Printf("    %s\n", result.reason)
+		}
+		if *verbose {
+			fmt.Printf("%s\n", strings.TrimSpace(strings.Replace(result.output, "\r", "", -1)))
+		}
+	}
+	if failed > 0 {
+		return errors.New(strconv.Itoa(failed) + " test ROM(s) failed")
+	}
+	return nil
+}
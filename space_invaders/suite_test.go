@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestROMSuite : Every test ROM passes. 8080EXER takes minutes so it is skipped with -short
+func TestROMSuite(t *testing.T) {
+	for _, rom := range testROMs {
+		rom := rom
+		t.Run(rom.name, func(t *testing.T) {
+			if rom.long && testing.Short() {
+				t.Skip("long running ROM")
+			}
+			result := runHeadless(rom, filepath.Join("..", "test", "test_roms"))
+			if !result.passed {
+				t.Errorf("%s failed after %d cycles: %s\n%s", rom.file, result.cycles, result.reason, result.output)
+			}
+		})
+	}
+}
+
+// TestMissingROM : A ROM which can't be loaded fails with the loader's error
+// instead of crashing
+func TestMissingROM(t *testing.T) {
+	result := runHeadless(testROM{name: "missing", file: "MISSING.COM", maxCycles: 1000}, t.TempDir())
+	if result.passed || !strings.Contains(result.reason, "MISSING.COM") || strings.Contains(result.reason, "crashed") {
+		t.Errorf("Unexpected result for a missing ROM: %+v", result)
+	}
+}
+
+// TestCheckExerciser : A CRC which differs from the one a real 8080 gives is reported
+func TestCheckExerciser(t *testing.T) {
+	crcs := map[string]uint32{"dad <b,d,h,sp>": 0x14474ba6, "aluop nn": 0x9e922f9e}
+	output := "dad <b,d,h,sp>................  ERROR **** crc expected:00000000 found:14474ba6\r\n" +
+		"aluop nn......................  ERROR **** crc expected:00000000 found:12345678\r\n"
+	problems := checkExerciser(output, crcs)
+	if len(problems) != 1 || problems[0] != "aluop nn: CRC 12345678, expected 9e922f9e" {
+		t.Errorf("Unexpected problems: %v", problems)
+	}
+	if problems := checkExerciser("dad <b,d,h,sp>................  OK\r\n", crcs); len(problems) != 1 {
+		t.Errorf("Expected the missing aluop test to be reported: %v", problems)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// symbolTable - Names for addresses in the emulated program, loaded with -sym
+type symbolTable struct {
+	names     map[uint16]string
+	addresses map[string]uint16
+	sorted    []uint16 // Addresses with a name, in order
+}
+
+// SYMBOLS - The symbols used by the disassembler, trace formats, profiler and debugger
+var SYMBOLS = newSymbolTable()
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{names: map[uint16]string{}, addresses: map[string]uint16{}}
+}
+
+// add - Names an address. The first name given to an address is the one that is shown
+func (s *symbolTable) add(address uint16, name string) {
+	if _, exists := s.names[address]; !exists {
+		s.names[address] = name
+		index := sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i] >= address })
+		s.sorted = append(s.sorted, 0)
+		copy(s.sorted[index+1:], s.sorted[index:])
+		s.sorted[index] = address
+	}
+	s.addresses[strings.ToUpper(name)] = address
+}
+
+// lookup - The name of exactly this address
+func (s *symbolTable) lookup(address uint16) (string, bool) {
+	name, ok := s.names[address]
+	return name, ok
+}
+
+// describe - The address as NAME or NAME+offset using the closest name at or
+// before it, or as a hex number if there is no such name within 256 bytes
+func (s *symbolTable) describe(address uint16) string {
+	index := sort.Search(len(s.sorted), func(i int) bool { return s.sorted[i] > address }) - 1
+	if index < 0 || address-s.sorted[index] > 0xFF {
+		return fmt.Sprintf("%04X", address)
+	}
+	name := s.names[s.sorted[index]]
+	if offset := address - s.sorted[index]; offset != 0 {
+		return fmt.Sprintf("%s+%d", name, offset)
+	}
+	return name
+}
+
+// resolve - Turns a name or a hex address (1234, 1234H, 0x1234 or $1234) into an address
+func (s *symbolTable) resolve(text string) (uint16, error) {
+	if address, ok := s.addresses[strings.ToUpper(text)]; ok {
+		return address, nil
+	}
+	if address, ok := parseAddress(text); ok {
+		return address, nil
+	}
+	return 0, fmt.Errorf("unknown symbol or address '%s'", text)
+}
+
+// parseAddress - Parses a hex address written as 1234, 1234H, 0x1234 or $1234
+func parseAddress(text string) (uint16, bool) {
+	upper := strings.ToUpper(text)
+	upper = strings.TrimPrefix(upper, "0X")
+	upper = strings.TrimPrefix(upper, "$")
+	upper = strings.TrimSuffix(upper, "H")
+	if upper == "" || len(upper) > 5 {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(upper, 16, 32)
+	if err != nil || value > 0xFFFF {
+		return 0, false
+	}
+	return uint16(value), true
+}
+
+// loadSymbols - Reads a symbol file. Two layouts are understood, which can be told
+// apart per line:
+//   - ADDR NAME, one per line, as written by hand or exported from a listing
+//   - The .SYM files written by the CP/M assemblers and linkers (MAC, RMAC, LINK-80,
+//     M80/L80), which have several "ADDR NAME" pairs per line separated by tabs.
+//     Relocation marks after the address (ie: 0100') are ignored
+//
+// Anything after a ';' or '#' is a comment
+func loadSymbols(fileName string) (*symbolTable, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	symbols := newSymbolTable()
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, ";#\x1A"); index >= 0 { // 1A is the CP/M end of file
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("%s:%d: expected ADDR NAME pairs", fileName, lineNumber)
+		}
+		for i := 0; i < len(fields); i += 2 {
+			address, ok := parseAddress(strings.TrimRight(fields[i], "'\"!*"))
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: '%s' is not an address", fileName, lineNumber, fields[i])
+			}
+			symbols.add(address, fields[i+1])
+		}
+	}
+	return symbols, scanner.Err()
+}
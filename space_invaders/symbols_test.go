@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTempFile - Writes contents to a temporary file and returns its name
+func writeTempFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(contents)
+	file.Close()
+	return file.Name()
+}
+
+// TestLoadSymbols : Both the ADDR NAME and the CP/M .SYM layouts are read
+func TestLoadSymbols(t *testing.T) {
+	fileName := writeTempFile(t, "; Hand written\n0x0100 START\n0110H Loop # The main loop\n"+
+		"0200 PRINT\t0203' DONE\t0000 BOOT\n\x1A")
+	defer os.Remove(fileName)
+	symbols, err := loadSymbols(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[uint16]string{0x100: "START", 0x110: "Loop", 0x112: "Loop+2",
+		0x203: "DONE", 0x1F00: "1F00", 0x0010: "BOOT+16"} {
+		if name := symbols.describe(address); name != expected {
+			t.Errorf("%04X: expected %s, got %s", address, expected, name)
+		}
+	}
+	if address, err := symbols.resolve("loop"); err != nil || address != 0x110 {
+		t.Errorf("Expected loop to be 0110, got %04X (%v)", address, err)
+	}
+	if address, err := symbols.resolve("1234"); err != nil || address != 0x1234 {
+		t.Errorf("Expected 1234 to be an address, got %04X (%v)", address, err)
+	}
+}
+
+// TestDebuggerWithSymbols : Breakpoints can be set by name and backtraces show names
+func TestDebuggerWithSymbols(t *testing.T) {
+	SYMBOLS = newSymbolTable()
+	defer func() { SYMBOLS = newSymbolTable() }()
+	SYMBOLS.add(0x0000, "MAIN")
+	SYMBOLS.add(0x0010, "OUTER")
+	SYMBOLS.add(0x0020, "INNER")
+
+	memory := make([]uint8, 65536)
+	copy(memory, []uint8{0x31, 0x00, 0x20, 0xCD, 0x10, 0x00, 0x76}) // LXI SP, 2000; CALL OUTER; HLT
+	copy(memory[0x10:], []uint8{0x00, 0xCD, 0x20, 0x00, 0xC9})      // NOP; CALL INNER; RET
+	copy(memory[0x20:], []uint8{0x00, 0xC9})                        // NOP; RET
+	mc := newMicrocontroller()
+	mc.memory = &memory
+	out := &bytes.Buffer{}
+	mc.addHook(newDebugger(strings.NewReader("b inner\nc\nbt\nu outer 3\ns 2\nbt\nc\n"), out))
+	for mc.programCounter != 0x6 {
+		mc.run()
+	}
+
+	for _, expected := range []string{
+		"Breakpoint set at 0020 (INNER)",
+		"#0  0020 in INNER\n#1  0011 in OUTER+1\n#2  0003 in MAIN+3\n",
+		"  0011: CALL INNER",
+		"#0  0014 in OUTER+4\n#1  0003 in MAIN+3\n(dbg)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected the output to contain '%s':\n%s", expected, out.String())
+		}
+	}
+}
+
+// TestDebuggerQuit : Quitting the debugger ends the machine's run loop instead
+// of the emulator, so everything it was recording is closed properly. The
+// instruction it stopped at isn't executed
+func TestDebuggerQuit(t *testing.T) {
+	machine := newAltair(newCPMConsole(strings.NewReader(""), &bytes.Buffer{}, false))
+	copy(*machine.mc.memory, []uint8{0x00, 0xC3, 0x00, 0x00}) // NOP, JMP 0
+	out := &bytes.Buffer{}
+	machine.mc.addHook(newDebugger(strings.NewReader("s 3\nq\n"), out))
+	machine.panel.run()
+	if !machine.mc.stopped || machine.mc.instructionsExecuted != 3 {
+		t.Errorf("Expected the run to stop after 3 instructions, got %d", machine.mc.instructionsExecuted)
+	}
+	machine.mc.run()
+	if machine.mc.instructionsExecuted != 3 {
+		t.Errorf("Expected nothing to be executed after quitting")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Translates the output of CP/M programs written for an ADM-3A or VT52
+// terminal into the ANSI escape sequences the host's terminal understands.
+// Characters which aren't part of a control sequence are passed through.
+
+// TERMINAL - The terminal CP/M programs are written for (see terminalTypes)
+var TERMINAL = "adm3a"
+
+// terminalType - The control characters and escape sequences of a terminal.
+// Each is translated to the ANSI sequence it maps to. The ones in escapes are
+// ESC followed by the key; positions is the letter after ESC which is followed
+// by the row and column, each offset by 32
+type terminalType struct {
+	controls  map[byte]string
+	escapes   map[byte]string
+	positions byte
+}
+
+var terminalTypes = map[string]*terminalType{
+	// The Lear Siegler ADM-3A and the extra sequences of the Kaypro and ADM-3A+
+	"adm3a": {
+		controls: map[byte]string{
+			0x0B: "\x1b[A",        // ^K up
+			0x0C: "\x1b[C",        // ^L right
+			0x1A: "\x1b[H\x1b[2J", // ^Z clear the screen
+			0x1E: "\x1b[H",        // ^^ home
+		},
+		escapes: map[byte]string{
+			'T': "\x1b[K", // Clear to the end of the line
+			'Y': "\x1b[J", // Clear to the end of the screen
+			'*': "\x1b[H\x1b[2J",
+			'E': "\x1b[L", // Insert a line
+			'R': "\x1b[M", // Delete a line
+		},
+		positions: '=',
+	},
+	"vt52": {
+		controls: map[byte]string{},
+		escapes: map[byte]string{
+			'A': "\x1b[A",
+			'B': "\x1b[B",
+			'C': "\x1b[C",
+			'D': "\x1b[D",
+			'H': "\x1b[H",
+			'I': "\x1bM", // Reverse line feed
+			'J': "\x1b[J",
+			'K': "\x1b[K",
+		},
+		positions: 'Y',
+	},
+	// The output is passed through unchanged (ie: for an ANSI program)
+	"ansi": nil,
+}
+
+// terminalNames - The terminal types in alphabetical order
+func terminalNames() []string {
+	names := []string{}
+	for name := range terminalTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectTerminal - Sets TERMINAL, which must be one of terminalTypes
+func selectTerminal(name string) error {
+	if _, ok := terminalTypes[name]; !ok {
+		return fmt.Errorf("unknown terminal %s (available: %s)", name, strings.Join(terminalNames(), ", "))
+	}
+	TERMINAL = name
+	return nil
+}
+
+// terminalTranslator - An io.Writer which translates what is written to it
+// from the sequences of a terminal type to ANSI. Sequences can be split over
+// several writes
+type terminalTranslator struct {
+	out      io.Writer
+	terminal *terminalType
+	sequence []byte // The part of an escape sequence which has been written
+}
+
+// newTerminalTranslator - Translates from the terminal called name. For ansi
+// the output is returned unchanged
+func newTerminalTranslator(out io.Writer, name string) io.Writer {
+	if terminalTypes[name] == nil {
+		return out
+	}
+	return &terminalTranslator{out: out, terminal: terminalTypes[name]}
+}
+
+func (t *terminalTranslator) Write(data []byte) (int, error) {
+	output := []byte{}
+	for _, c := range data {
+		output = append(output, t.translate(c)...)
+	}
+	if _, err := t.out.Write(output); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// translate - The ANSI output for the next character
+func (t *terminalTranslator) translate(c byte) string {
+	if len(t.sequence) == 0 {
+		if c == 0x1B {
+			t.sequence = append(t.sequence, c)
+			return ""
+		}
+		if ansi, ok := t.terminal.controls[c]; ok {
+			return ansi
+		}
+		return string(c)
+	}
+
+	t.sequence = append(t.sequence, c)
+	if t.sequence[1] == t.terminal.positions {
+		if len(t.sequence) < 4 {
+			return ""
+		}
+		row, column := int(t.sequence[2])-32, int(t.sequence[3])-32
+		t.sequence = t.sequence[:0]
+		return fmt.Sprintf("\x1b[%d;%dH", row+1, column+1)
+	}
+	t.sequence = t.sequence[:0]
+	return t.terminal.escapes[c] // Sequences which aren't supported are dropped
+}
+
+// quitKey - Ends the console input when the terminal is in raw mode, where ^C
+// goes to the program (^\)
+const quitKey = 0x1C
+
+// quitReader - Reads the host's terminal until the quit key is pressed
+type quitReader struct {
+	in io.Reader
+}
+
+func (r quitReader) Read(buffer []byte) (int, error) {
+	n, err := r.in.Read(buffer)
+	if quit := bytes.IndexByte(buffer[:n], quitKey); quit >= 0 {
+		return quit, io.EOF
+	}
+	return n, err
+}
+
+// openConsole - The console of -cpm and -boot. Its input is the script given
+// with -script, or the host's terminal in raw mode, or whatever stdin is. Its
+// output goes to stdout, translated from TERMINAL. The function returned puts
+// the terminal back the way it was
+func openConsole() (*cpmConsole, func(), error) {
+	return openConsoleOn(os.Stdout, TERMINAL)
+}
+
+// openConsoleOn - Opens the console with its output going to output, translated
+// from the terminal type given. A script still sees all of the output
+func openConsoleOn(output io.Writer, terminal string) (*cpmConsole, func(), error) {
+	out := newTerminalTranslator(output, terminal)
+	if CONSOLESCRIPT != "" {
+		script, err := loadConsoleScript(CONSOLESCRIPT)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newCPMConsole(script, io.MultiWriter(out, script), true), func() {}, nil
+	}
+	if DEBUGGER { // The debugger reads its commands from stdin too
+		return nil, nil, errors.New("the console input has to be given with -script when using -debug")
+	}
+	if !isTerminal(os.Stdin) {
+		return newCPMConsole(os.Stdin, out, true), func() {}, nil
+	}
+	restore, err := makeRaw(os.Stdin)
+	if err != nil { // The host echoes the keys and they are read a line at a time
+		return newCPMConsole(os.Stdin, out, false), func() {}, nil
+	}
+	return newCPMConsole(quitReader{os.Stdin}, out, true), restore, nil
+}
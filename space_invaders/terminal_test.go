@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestTerminalTranslator : ADM-3A and VT52 sequences, including ones split over writes
+func TestTerminalTranslator(t *testing.T) {
+	tests := []struct {
+		terminal string
+		writes   []string
+		expected string
+	}{
+		{"adm3a", []string{"\x1aA\x1b=", "\x25", "\x30B"}, "\x1b[H\x1b[2JA\x1b[6;17HB"},
+		{"adm3a", []string{"\x0b\x0c\x1e\x1bT\x1bQ\r\n"}, "\x1b[A\x1b[C\x1b[H\x1b[K\r\n"},
+		{"vt52", []string{"\x1bH\x1bJ\x1bY  x\x1bA\x1bK"}, "\x1b[H\x1b[J\x1b[1;1Hx\x1b[A\x1b[K"},
+		{"vt52", []string{"\x1a\x0b"}, "\x1a\x0b"},
+		{"ansi", []string{"\x1b[2J"}, "\x1b[2J"},
+	}
+	for _, test := range tests {
+		output := &bytes.Buffer{}
+		translator := newTerminalTranslator(output, test.terminal)
+		for _, data := range test.writes {
+			if n, err := translator.Write([]byte(data)); n != len(data) || err != nil {
+				t.Errorf("%s: Write returned %d, %v", test.terminal, n, err)
+			}
+		}
+		if output.String() != test.expected {
+			t.Errorf("%s: %q gave %q, expected %q", test.terminal, test.writes, output.String(), test.expected)
+		}
+	}
+	if err := selectTerminal("vt100"); err == nil {
+		t.Errorf("An unknown terminal should be rejected")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+Binary trace format
+
+The file starts with a 16 byte header:
+  0  "I8080TRC"   magic
+  8  uint16       version (traceVersion)
+  10 uint16       size of each record in bytes (traceRecordSize)
+  12 uint32       reserved
+
+Followed by one fixed size record per executed instruction. All values are little endian:
+  0  uint16       PC
+  2  [3]uint8     opcode and the two bytes which follow it
+  5  uint8        length of the instruction in bytes
+  6  [8]uint8     B C D E H L A PSW (before the instruction is executed)
+  14 uint16       SP (before the instruction is executed)
+  16 uint64       cycles executed before this instruction
+  24 uint8        cycles taken by this instruction
+  25 uint8        number of memory accesses (0-4)
+  26 uint8        flags (bit 0 set = an interrupt was acknowledged: the opcode and its
+                  bytes came from the interrupt source and PC is where it interrupted)
+  27 uint8        reserved
+  28 [4]access    uint16 address, uint8 value, uint8 flags (bit 0 set = write)
+
+Since every record is the same size, instruction N can be found by seeking directly to
+traceHeaderSize + N*traceRecordSize
+*/
+
+const traceMagic = "I8080TRC"
+const traceVersion = 1
+const traceHeaderSize = 16
+const traceRecordSize = 28 + 4*maxMemoryAccesses
+
+// traceRecord - The state of the processor for a single executed instruction
+type traceRecord struct {
+	pc         uint16
+	bytes      [3]uint8
+	length     uint8
+	b, c, d, e uint8
+	h, l, a    uint8
+	psw        uint8
+	sp         uint16
+	cycles     uint64 // Cycles executed before this instruction
+	duration   uint8  // Cycles taken by this instruction
+	interrupt  bool   // The instruction was given by an interrupt source (see microcontroller.interrupt())
+	accesses   []memoryAccess
+}
+
+func (r *traceRecord) encode(buf []byte) {
+	binary.LittleEndian.PutUint16(buf[0:], r.pc)
+	copy(buf[2:5], r.bytes[:])
+	buf[5] = r.length
+	buf[6], buf[7], buf[8], buf[9] = r.b, r.c, r.d, r.e
+	buf[10], buf[11], buf[12], buf[13] = r.h, r.l, r.a, r.psw
+	binary.LittleEndian.PutUint16(buf[14:], r.sp)
+	binary.LittleEndian.PutUint64(buf[16:], r.cycles)
+	buf[24] = r.duration
+	buf[25] = uint8(len(r.accesses))
+	buf[26], buf[27] = 0, 0
+	if r.interrupt {
+		buf[26] = 1
+	}
+	for i := 0; i < maxMemoryAccesses; i++ {
+		offset := 28 + 4*i
+		if i >= len(r.accesses) {
+			buf[offset], buf[offset+1], buf[offset+2], buf[offset+3] = 0, 0, 0, 0
+			continue
+		}
+		access := r.accesses[i]
+		binary.LittleEndian.PutUint16(buf[offset:], access.address)
+		buf[offset+2] = access.value
+		buf[offset+3] = 0
+		if access.write {
+			buf[offset+3] = 1
+		}
+	}
+}
+
+func (r *traceRecord) decode(buf []byte) error {
+	r.pc = binary.LittleEndian.Uint16(buf[0:])
+	copy(r.bytes[:], buf[2:5])
+	r.length = buf[5]
+	r.b, r.c, r.d, r.e = buf[6], buf[7], buf[8], buf[9]
+	r.h, r.l, r.a, r.psw = buf[10], buf[11], buf[12], buf[13]
+	r.sp = binary.LittleEndian.Uint16(buf[14:])
+	r.cycles = binary.LittleEndian.Uint64(buf[16:])
+	r.duration = buf[24]
+	r.interrupt = buf[26]&0x1 == 0x1
+	count := int(buf[25])
+	if count > maxMemoryAccesses {
+		return fmt.Errorf("corrupt trace record: %d memory accesses", count)
+	}
+	r.accesses = r.accesses[:0]
+	for i := 0; i < count; i++ {
+		offset := 28 + 4*i
+		r.accesses = append(r.accesses, memoryAccess{
+			address: binary.LittleEndian.Uint16(buf[offset:]),
+			value:   buf[offset+2],
+			write:   buf[offset+3]&0x1 == 0x1,
+		})
+	}
+	return nil
+}
+
+// traceRecorder - An instructionHook which writes every executed instruction
+// to a binary trace file
+type traceRecorder struct {
+	file     *os.File
+	writer   *bufio.Writer
+	record   traceRecord
+	buffer   [traceRecordSize]byte
+	accesses [maxMemoryAccesses]memoryAccess
+}
+
+func newTraceRecorder(fileName string) (*traceRecorder, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &traceRecorder{file: file, writer: bufio.NewWriterSize(file, 1024*1024)}
+
+	header := make([]byte, traceHeaderSize)
+	copy(header, traceMagic)
+	binary.LittleEndian.PutUint16(header[8:], traceVersion)
+	binary.LittleEndian.PutUint16(header[10:], traceRecordSize)
+	if _, err := recorder.writer.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (t *traceRecorder) beforeInstruction(mc *microcontroller) {
+	r := &t.record
+	r.pc = mc.programCounter
+	r.bytes[0], r.bytes[1], r.bytes[2] = mc.fetch(0), mc.fetch(1), mc.fetch(2)
+	r.length = lengthTable[r.bytes[0]]
+	r.interrupt = mc.interruptBus != nil
+	r.b, r.c, r.d, r.e = mc.rb, mc.rc, mc.rd, mc.re
+	r.h, r.l, r.a, r.psw = mc.rh, mc.rl, mc.ra, pswByte(mc)
+	r.sp = mc.stackPointer
+	r.cycles = uint64(mc.cycles)
+	r.accesses = predictMemoryAccesses(mc, t.accesses[:])
+}
+
+func (t *traceRecorder) afterInstruction(mc *microcontroller) {
+	r := &t.record
+	r.duration = mc.lastCycles
+	r.accesses = completeMemoryAccesses(mc, r.accesses)
+	r.encode(t.buffer[:])
+	t.writer.Write(t.buffer[:]) // Errors are reported by close()
+}
+
+func (t *traceRecorder) close() error {
+	if err := t.writer.Flush(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+// traceReader - Reads back a trace file written by a traceRecorder
+type traceReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	count  int64 // Number of records in the file
+	index  int64 // Index of the record which will be returned by next()
+	buffer [traceRecordSize]byte
+}
+
+func openTrace(fileName string) (*traceReader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, traceHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: could not read the trace header: %s", fileName, err)
+	}
+	if string(header[0:8]) != traceMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a trace file", fileName)
+	}
+	version := binary.LittleEndian.Uint16(header[8:])
+	size := binary.LittleEndian.Uint16(header[10:])
+	if version != traceVersion || size != traceRecordSize {
+		file.Close()
+		return nil, fmt.Errorf("%s: unsupported trace version %d (record size %d)", fileName, version, size)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &traceReader{
+		file:   file,
+		reader: bufio.NewReaderSize(file, 1024*1024),
+		count:  (info.Size() - traceHeaderSize) / traceRecordSize,
+	}, nil
+}
+
+// seek - Positions the reader so that the next call to next() returns instruction n
+func (t *traceReader) seek(n int64) error {
+	if n < 0 || n > t.count {
+		return fmt.Errorf("instruction %d is outside of the trace (0-%d)", n, t.count)
+	}
+	if _, err := t.file.Seek(traceHeaderSize+n*traceRecordSize, io.SeekStart); err != nil {
+		return err
+	}
+	t.reader.Reset(t.file)
+	t.index = n
+	return nil
+}
+
+// next - Reads the next record. Returns io.EOF at the end of the trace
+func (t *traceReader) next(record *traceRecord) error {
+	if _, err := io.ReadFull(t.reader, t.buffer[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF // A partially written record at the end is ignored
+		}
+		return err
+	}
+	t.index++
+	return record.decode(t.buffer[:])
+}
+
+func (t *traceReader) close() error {
+	return t.file.Close()
+}
+
+var traceRecorderHook *traceRecorder
+
+// startTrace - Attaches a trace recorder to the microcontroller if -trace was given
+func startTrace(mc *microcontroller, fileName string) {
+	if fileName == "" {
+		return
+	}
+	recorder, err := newTraceRecorder(fileName)
+	if err != nil {
+		panic(fmt.Sprintf("Could not create the trace file '%s': %s", fileName, err))
+	}
+	traceRecorderHook = recorder
+	mc.addHook(recorder)
+}
+
+func stopTrace() {
+	if traceRecorderHook == nil {
+		return
+	}
+	if err := traceRecorderHook.close(); err != nil {
+		fmt.Printf("Error while writing the trace file: %s\n", err)
+	}
+	traceRecorderHook = nil
+}
+
+// traceFilter - Decides which records are shown by the trace command
+type traceFilter struct {
+	from, to uint16
+	opcodes  map[uint8]bool // Empty means every opcode
+}
+
+func (f *traceFilter) matches(r *traceRecord) bool {
+	if r.pc < f.from || r.pc > f.to {
+		return false
+	}
+	return len(f.opcodes) == 0 || f.opcodes[r.bytes[0]]
+}
+
+func parseOpcodeList(list string) (map[uint8]bool, error) {
+	opcodes := make(map[uint8]bool)
+	if list == "" {
+		return opcodes, nil
+	}
+	for _, field := range strings.Split(list, ",") {
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(field), "0x"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid opcode '%s'", field)
+		}
+		opcodes[uint8(value)] = true
+	}
+	return opcodes, nil
+}
+
+func formatAccesses(r *traceRecord, separator string) string {
+	parts := make([]string, 0, len(r.accesses))
+	for _, access := range r.accesses {
+		kind := "R"
+		if access.write {
+			kind = "W"
+		}
+		parts = append(parts, fmt.Sprintf("%s:%04X=%02X", kind, access.address, access.value))
+	}
+	return strings.Join(parts, separator)
+}
+
+func writeTraceRecord(out io.Writer, format string, index int64, r *traceRecord) {
+	opcodeBytes := ""
+	for i := uint8(0); i < r.length; i++ {
+		if i > 0 {
+			opcodeBytes += " "
+		}
+		opcodeBytes += fmt.Sprintf("%02X", r.bytes[i])
+	}
+	switch format {
+	case "csv":
+		fmt.Fprintf(out, "%d,%04X,%s,%02X,%02X,%02X,%02X,%02X,%02X,%02X,%02X,%04X,%d,%d,%s\n",
+			index, r.pc, opcodeBytes, r.b, r.c, r.d, r.e, r.h, r.l, r.a, r.psw, r.sp,
+			r.cycles, r.duration, formatAccesses(r, " "))
+	case "json":
+		accesses := make([]string, 0, len(r.accesses))
+		for _, access := range r.accesses {
+			accesses = append(accesses, fmt.Sprintf(`{"addr":%d,"value":%d,"write":%t}`,
+				access.address, access.value, access.write))
+		}
+		fmt.Fprintf(out, `{"n":%d,"pc":%d,"bytes":"%s","b":%d,"c":%d,"d":%d,"e":%d,"h":%d,"l":%d,"a":%d,"f":%d,"sp":%d,"cycles":%d,"duration":%d,"mem":[%s]}`+"\n",
+			index, r.pc, opcodeBytes, r.b, r.c, r.d, r.e, r.h, r.l, r.a, r.psw, r.sp,
+			r.cycles, r.duration, strings.Join(accesses, ","))
+	default:
+		fmt.Fprintf(out, "%10d %04X : %-8s  %02X %02X %02X %02X %02X %02X %02X %08b %04X %10d  %s\n",
+			index, r.pc, opcodeBytes, r.b, r.c, r.d, r.e, r.h, r.l, r.a, r.psw, r.sp,
+			r.cycles, formatAccesses(r, " "))
+	}
+}
+
+func writeTraceHeader(out io.Writer, format string) {
+	switch format {
+	case "csv":
+		fmt.Fprintln(out, "n,pc,bytes,b,c,d,e,h,l,a,f,sp,cycles,duration,memory")
+	case "json":
+	default:
+		fmt.Fprintln(out, "         N ADDR : bytes     B  C  D  E  H  L  A  SZ-X-P-C SP       CYCLES  memory")
+	}
+}
+
+// traceCommand - Implements "space_invaders trace", which queries a binary trace
+// file and converts the matching records to text, CSV or JSON
+func traceCommand(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	from := flags.String("from", "0000", "Only show instructions at or above this address (hex)")
+	to := flags.String("to", "FFFF", "Only show instructions at or below this address (hex)")
+	opcodes := flags.String("op", "", "Comma separated list of opcodes (hex) to show, ie: CD,C9")
+	start := flags.Int64("start", 0, "Instruction number to start reading from")
+	count := flags.Int64("count", -1, "Maximum number of instructions to show (-1 = all)")
+	format := flags.String("format", "text", "Output format: text, csv or json")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s trace [options] <trace file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("no trace file given")
+	}
+	if *format != "text" && *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format '%s'", *format)
+	}
+
+	filter := traceFilter{}
+	var ok bool
+	if filter.from, ok = parseAddress(*from); !ok {
+		return fmt.Errorf("invalid -from address '%s'", *from)
+	}
+	if filter.to, ok = parseAddress(*to); !ok {
+		return fmt.Errorf("invalid -to address '%s'", *to)
+	}
+	var err error
+	if filter.opcodes, err = parseOpcodeList(*opcodes); err != nil {
+		return err
+	}
+
+	reader, err := openTrace(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+	if err := reader.seek(*start); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	writeTraceHeader(out, *format)
+	record := traceRecord{}
+	shown := int64(0)
+	for *count < 0 || shown < *count {
+		index := reader.index
+		err := reader.next(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if filter.matches(&record) {
+			writeTraceRecord(out, *format, index, &record)
+			shown++
+		}
+	}
+	return nil
+}
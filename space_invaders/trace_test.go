@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// TestTraceRoundTrip : Records a short program to a trace file and reads it back
+func TestTraceRoundTrip(t *testing.T) {
+	memory := make([]uint8, 65536)
+	program := []uint8{
+		0x31, 0x00, 0x20, // LXI SP, 0x2000
+		0x21, 0x00, 0x10, // LXI H, 0x1000
+		0x36, 0x42, //       MVI M, 0x42
+		0xCD, 0x0C, 0x00, // CALL 0x000C
+		0x00, //       NOP
+		0xE3, //       XTHL
+		0xC9, //       RET (to 0x0B)
+	}
+	copy(memory, program)
+	mc := newMicrocontroller()
+	mc.memory = &memory
+
+	fileName := filepath.Join(t.TempDir(), "test.trc")
+	recorder, err := newTraceRecorder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.addHook(recorder)
+	for i := 0; i < 6; i++ {
+		mc.run()
+	}
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := openTrace(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.close()
+	if reader.count != 6 {
+		t.Fatalf("Expected 6 records, got %d", reader.count)
+	}
+
+	expectedPC := []uint16{0x0000, 0x0003, 0x0006, 0x0008, 0x000C, 0x000D}
+	expectedCycles := []uint64{0, 10, 20, 30, 47, 65}
+	record := traceRecord{}
+	for i, pc := range expectedPC {
+		if err := reader.next(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.pc != pc {
+			t.Errorf("Record %d: expected PC %04X, got %04X", i, pc, record.pc)
+		}
+		if record.cycles != expectedCycles[i] {
+			t.Errorf("Record %d: expected %d cycles, got %d", i, expectedCycles[i], record.cycles)
+		}
+	}
+	if err := reader.next(&record); err != io.EOF {
+		t.Errorf("Expected EOF at the end of the trace, got %v", err)
+	}
+
+	// MVI M should show a single write of 0x42 to 0x1000
+	reader.seek(2)
+	reader.next(&record)
+	if len(record.accesses) != 1 || !record.accesses[0].write ||
+		record.accesses[0].address != 0x1000 || record.accesses[0].value != 0x42 {
+		t.Errorf("Unexpected memory accesses for MVI M: %+v", record.accesses)
+	}
+
+	// CALL pushes the return address 0x000B
+	reader.next(&record)
+	if len(record.accesses) != 2 || record.accesses[0].address != 0x1FFE || record.accesses[0].value != 0x0B {
+		t.Errorf("Unexpected memory accesses for CALL: %+v", record.accesses)
+	}
+
+	// XTHL reads and writes both bytes at the top of the stack
+	reader.seek(4)
+	reader.next(&record)
+	if record.bytes[0] != 0xE3 || len(record.accesses) != 4 {
+		t.Errorf("Unexpected memory accesses for XTHL: %+v", record.accesses)
+	}
+}
+
+// TestTraceFilter : Checks that the address range and opcode filters are applied
+func TestTraceFilter(t *testing.T) {
+	opcodes, err := parseOpcodeList("CD, c9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := traceFilter{from: 0x100, to: 0x1FF, opcodes: opcodes}
+	tests := []struct {
+		pc     uint16
+		opcode uint8
+		match  bool
+	}{
+		{0x0100, 0xCD, true},
+		{0x01FF, 0xC9, true},
+		{0x0200, 0xCD, false},
+		{0x0150, 0x00, false},
+	}
+	for _, test := range tests {
+		record := traceRecord{pc: test.pc, bytes: [3]uint8{test.opcode, 0, 0}}
+		if filter.matches(&record) != test.match {
+			t.Errorf("%04X %02X: expected match=%t", test.pc, test.opcode, test.match)
+		}
+	}
+	if _, err := parseOpcodeList("XYZ"); err == nil {
+		t.Error("Expected an error for an invalid opcode list")
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Offline comparison of instruction traces written by this emulator or by other ones.
+// Every supported format is converted into a stream of traceSteps, which hold the
+// registers as they were BEFORE the instruction at pc was executed.
+//
+// Supported formats:
+//   binary    - the binary trace files written with -trace
+//   i8080core - the modified i8080-core output (the same as -c):
+//               0318 C2 00 00 13 34 0C 0A 00 ED 6A 00010010 0500
+//   human     - the default -v output of this emulator:
+//               0318 : C2 00 00		 JNZ            13 34 0C 0A 00 ED 6A 00010010 0500
+//   mame      - the output of MAME's trace command. The default trace only has the
+//               address; registers are picked up from name=value pairs added with
+//               tracelog, ie: A=6A B=13 C=34 D=0C E=0A H=00 L=ED F=02 SP=0500 0318: jnz $0000
+
+// Indices into traceStep.registers
+const (
+	stepA = iota
+	stepB
+	stepC
+	stepD
+	stepE
+	stepH
+	stepL
+	stepF
+	stepSP
+	stepRegisterCount
+)
+
+var stepRegisterNames = []string{"A", "B", "C", "D", "E", "H", "L", "F", "SP"}
+
+// traceStep - A single instruction from an imported trace
+type traceStep struct {
+	line      int // Line number in the file (or record number for binary traces)
+	pc        uint16
+	registers [stepRegisterCount]uint16
+	known     uint16 // Bit i is set if registers[i] was present in the trace
+	text      string // The original line, for the report
+}
+
+func (s *traceStep) set(register int, value uint16) {
+	s.registers[register] = value
+	s.known |= 1 << uint(register)
+}
+
+func (s *traceStep) has(register int) bool {
+	return s.known&(1<<uint(register)) != 0
+}
+
+// traceImporter - Reads traceSteps one at a time. Returns io.EOF at the end
+type traceImporter interface {
+	next() (traceStep, error)
+}
+
+// textImporter - Reads a text trace line by line, using parse() to turn a line into
+// a traceStep. Lines which parse() doesn't understand (headers, console output,
+// MAME's "(loops for N instructions)") are skipped
+type textImporter struct {
+	scanner *bufio.Scanner
+	line    int
+	parse   func(line string, step *traceStep) bool
+}
+
+func (t *textImporter) next() (traceStep, error) {
+	for t.scanner.Scan() {
+		t.line++
+		step := traceStep{line: t.line, text: strings.TrimRight(t.scanner.Text(), "\r")}
+		if t.parse(step.text, &step) {
+			return step, nil
+		}
+	}
+	if err := t.scanner.Err(); err != nil {
+		return traceStep{}, err
+	}
+	return traceStep{}, io.EOF
+}
+
+func parseHex(field string, bits int) (uint16, bool) {
+	value, err := strconv.ParseUint(field, 16, bits)
+	return uint16(value), err == nil
+}
+
+// parseRegisterFields - Parses the "B C D E H L A FLAGS SP" fields which end both
+// the i8080core and human lines. The flags are written out in binary
+func parseRegisterFields(fields []string, step *traceStep) bool {
+	if len(fields) != 9 {
+		return false
+	}
+	order := []int{stepB, stepC, stepD, stepE, stepH, stepL, stepA}
+	for i, register := range order {
+		value, ok := parseHex(fields[i], 8)
+		if !ok || len(fields[i]) != 2 {
+			return false
+		}
+		step.set(register, value)
+	}
+	flags, err := strconv.ParseUint(fields[7], 2, 8)
+	if err != nil || len(fields[7]) != 8 {
+		return false
+	}
+	step.set(stepF, uint16(flags))
+	sp, ok := parseHex(fields[8], 16)
+	if !ok {
+		return false
+	}
+	step.set(stepSP, sp)
+	return true
+}
+
+func parseI8080CoreLine(line string, step *traceStep) bool {
+	fields := strings.Fields(line)
+	if len(fields) != 13 || len(fields[0]) != 4 {
+		return false
+	}
+	pc, ok := parseHex(fields[0], 16)
+	if !ok {
+		return false
+	}
+	step.pc = pc
+	return parseRegisterFields(fields[4:], step)
+}
+
+func parseHumanLine(line string, step *traceStep) bool {
+	if index := strings.Index(line, "  ; "); index >= 0 { // Source line from -listing
+		line = line[:index]
+	}
+	parts := strings.SplitN(line, " : ", 2)
+	if len(parts) != 2 || len(parts[0]) != 4 {
+		return false
+	}
+	pc, ok := parseHex(parts[0], 16)
+	if !ok {
+		return false
+	}
+	step.pc = pc
+	fields := strings.Fields(parts[1])
+	if len(fields) < 9 {
+		return false
+	}
+	return parseRegisterFields(fields[len(fields)-9:], step)
+}
+
+var mameAddress = regexp.MustCompile(`^([0-9A-Fa-f]{4}):$`)
+var mameRegister = regexp.MustCompile(`^([A-Za-z]+)=\$?([0-9A-Fa-f]+)$`)
+
+// parseMAMELine - Finds the "PPPP:" address and any NAME=value register pairs.
+// Register pairs (BC, DE, HL, AF, PSW) are split into their two halves
+func parseMAMELine(line string, step *traceStep) bool {
+	found := false
+	for _, field := range strings.Fields(strings.Replace(line, ",", " ", -1)) {
+		if match := mameAddress.FindStringSubmatch(field); match != nil && !found {
+			step.pc, _ = parseHex(match[1], 16)
+			found = true
+			continue
+		}
+		match := mameRegister.FindStringSubmatch(field)
+		if match == nil || found {
+			continue // Only registers before the address belong to this instruction
+		}
+		value, ok := parseHex(match[2], 16)
+		if !ok {
+			continue
+		}
+		switch name := strings.ToUpper(match[1]); name {
+		case "A", "B", "C", "D", "E", "H", "L", "F":
+			step.set(strings.Index("ABCDEHLF", name), value&0xFF)
+		case "SP":
+			step.set(stepSP, value)
+		case "BC":
+			step.set(stepB, value>>8)
+			step.set(stepC, value&0xFF)
+		case "DE":
+			step.set(stepD, value>>8)
+			step.set(stepE, value&0xFF)
+		case "HL":
+			step.set(stepH, value>>8)
+			step.set(stepL, value&0xFF)
+		case "AF", "PSW":
+			step.set(stepA, value>>8)
+			step.set(stepF, value&0xFF)
+		}
+	}
+	return found
+}
+
+// binaryImporter - Reads the binary trace files written by traceRecorder
+type binaryImporter struct {
+	reader *traceReader
+	record traceRecord
+}
+
+func (b *binaryImporter) next() (traceStep, error) {
+	var index int64
+	for {
+		index = b.reader.index
+		if err := b.reader.next(&b.record); err != nil {
+			return traceStep{}, err
+		}
+		if !b.record.interrupt { // The text formats don't have a line for an interrupt
+			break
+		}
+	}
+	r := &b.record
+	step := traceStep{line: int(index) + 1, pc: r.pc}
+	for i, value := range []uint8{r.a, r.b, r.c, r.d, r.e, r.h, r.l, r.psw} {
+		step.set(i, uint16(value))
+	}
+	step.set(stepSP, r.sp)
+	step.text = fmt.Sprintf("%04X %02X %02X %02X %02X %02X %02X %02X %02X %02X %02X %08b %04X",
+		r.pc, r.bytes[0], r.bytes[1], r.bytes[2], r.b, r.c, r.d, r.e, r.h, r.l, r.a, r.psw, r.sp)
+	return step, nil
+}
+
+// detectTraceFormat - Guesses the format of a trace from its first few lines
+func detectTraceFormat(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	magic := make([]byte, len(traceMagic))
+	if n, _ := io.ReadFull(file, magic); n == len(magic) && string(magic) == traceMagic {
+		return "binary", nil
+	}
+	file.Seek(0, io.SeekStart)
+	scanner := bufio.NewScanner(file)
+	for lines := 0; scanner.Scan() && lines < 1000; lines++ {
+		step := traceStep{}
+		switch {
+		case parseI8080CoreLine(scanner.Text(), &step):
+			return "i8080core", nil
+		case parseHumanLine(scanner.Text(), &step):
+			return "human", nil
+		case parseMAMELine(scanner.Text(), &step):
+			return "mame", nil
+		}
+	}
+	return "", fmt.Errorf("could not work out the trace format of %s", fileName)
+}
+
+// openTraceImporter - Opens a trace file in the given format ("auto" to detect it)
+func openTraceImporter(fileName string, format string) (traceImporter, io.Closer, error) {
+	if format == "auto" {
+		detected, err := detectTraceFormat(fileName)
+		if err != nil {
+			return nil, nil, err
+		}
+		format = detected
+	}
+	if format == "binary" {
+		reader, err := openTrace(fileName)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &binaryImporter{reader: reader}, reader.file, nil
+	}
+
+	parsers := map[string]func(string, *traceStep) bool{
+		"i8080core": parseI8080CoreLine,
+		"human":     parseHumanLine,
+		"mame":      parseMAMELine,
+	}
+	parse, ok := parsers[format]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown trace format '%s'", format)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &textImporter{scanner: scanner, parse: parse}, file, nil
+}
+
+// traceDiffOptions - Settings for diffTraces()
+type traceDiffOptions struct {
+	flagMask uint8 // Flag bits which are compared. Bits 1, 3 and 5 differ between emulators
+	skip     [2]int
+	resync   int // How far to look ahead for a matching PC when the PCs differ
+	context  int // How many matching steps to show before the divergence
+}
+
+// traceDifference - The first semantic divergence between two traces
+type traceDifference struct {
+	index       [2]int64 // Instruction number in each trace
+	steps       [2]traceStep
+	eof         [2]bool // The trace ended before the other one
+	registers   []string
+	history     [][2]traceStep
+	resynced    []string // Notes about steps skipped to realign the traces
+	instruction int64    // Number of steps which matched before the divergence
+}
+
+// stepDifferences - Compares the registers which are present in both steps
+func stepDifferences(a *traceStep, b *traceStep, flagMask uint8) []string {
+	differences := []string{}
+	if a.pc != b.pc {
+		differences = append(differences, fmt.Sprintf("PC: %04X != %04X", a.pc, b.pc))
+	}
+	for register := 0; register < stepRegisterCount; register++ {
+		if !a.has(register) || !b.has(register) {
+			continue
+		}
+		x, y := a.registers[register], b.registers[register]
+		if register == stepF {
+			x &= uint16(flagMask)
+			y &= uint16(flagMask)
+			if x != y {
+				flagNames := []string{"C", "", "P", "", "AC", "", "Z", "S"}
+				for bit := uint(0); bit < 8; bit++ {
+					if (x>>bit)&1 != (y>>bit)&1 && flagNames[bit] != "" {
+						differences = append(differences, fmt.Sprintf("flag %s: %d != %d", flagNames[bit], (x>>bit)&1, (y>>bit)&1))
+					}
+				}
+				if x&^0xD5 != y&^0xD5 {
+					differences = append(differences, fmt.Sprintf("F: %02X != %02X", x, y))
+				}
+			}
+			continue
+		}
+		if x != y {
+			width := 2
+			if register == stepSP {
+				width = 4
+			}
+			differences = append(differences, fmt.Sprintf("%s: %0*X != %0*X", stepRegisterNames[register], width, x, width, y))
+		}
+	}
+	return differences
+}
+
+// peekingImporter - Wraps a traceImporter so that steps can be looked at ahead of time
+type peekingImporter struct {
+	importer traceImporter
+	buffer   []traceStep
+	count    int64 // Number of steps returned by next()
+}
+
+func (p *peekingImporter) peek(n int) (traceStep, error) {
+	for len(p.buffer) <= n {
+		step, err := p.importer.next()
+		if err != nil {
+			return traceStep{}, err
+		}
+		p.buffer = append(p.buffer, step)
+	}
+	return p.buffer[n], nil
+}
+
+func (p *peekingImporter) next() (traceStep, error) {
+	step, err := p.peek(0)
+	if err != nil {
+		return step, err
+	}
+	p.buffer = p.buffer[1:]
+	p.count++
+	return step, nil
+}
+
+// diffTraces - Steps through both traces and returns the first divergence, or nil if
+// they are the same. The traces are first aligned on the first PC they have in
+// common, so that differing start up code or headers are ignored
+func diffTraces(a traceImporter, b traceImporter, options traceDiffOptions) (*traceDifference, error) {
+	streams := [2]*peekingImporter{{importer: a}, {importer: b}}
+	for i, stream := range streams {
+		for n := 0; n < options.skip[i]; n++ {
+			if _, err := stream.next(); err != nil {
+				return nil, fmt.Errorf("trace %d has fewer than %d instructions", i+1, options.skip[i])
+			}
+		}
+	}
+
+	if err := alignTraces(streams); err != nil {
+		return nil, err
+	}
+
+	result := &traceDifference{}
+	var steps [2]traceStep
+	for {
+		var errs [2]error
+		for i, stream := range streams {
+			result.index[i] = stream.count
+			steps[i], errs[i] = stream.next()
+			if errs[i] != nil && errs[i] != io.EOF {
+				return nil, errs[i]
+			}
+		}
+		if errs[0] == io.EOF && errs[1] == io.EOF {
+			return nil, nil
+		}
+		if errs[0] == io.EOF || errs[1] == io.EOF {
+			result.eof = [2]bool{errs[0] == io.EOF, errs[1] == io.EOF}
+			result.steps = steps
+			return result, nil
+		}
+
+		if steps[0].pc != steps[1].pc && options.resync > 0 {
+			if note, ok := resyncTraces(streams, &steps, options.resync); ok {
+				result.resynced = append(result.resynced, note)
+			}
+		}
+
+		if differences := stepDifferences(&steps[0], &steps[1], options.flagMask); len(differences) > 0 {
+			result.steps = steps
+			result.registers = differences
+			return result, nil
+		}
+		result.instruction++
+		if options.context > 0 {
+			if len(result.history) == options.context {
+				result.history = result.history[1:]
+			}
+			result.history = append(result.history, steps)
+		}
+	}
+}
+
+// alignWindow - How far into a trace to look for the first PC of the other trace
+const alignWindow = 100000
+
+// alignTraces - Skips the start of one of the traces so that both of them begin at
+// the same PC. The first trace is searched for the start of the second one and if
+// that fails, the other way around
+func alignTraces(streams [2]*peekingImporter) error {
+	var starts [2]traceStep
+	for i, stream := range streams {
+		step, err := stream.peek(0)
+		if err != nil {
+			return fmt.Errorf("trace %d is empty", i+1)
+		}
+		starts[i] = step
+	}
+	for i := 0; i < 2; i++ {
+		other := 1 - i
+		for n := 0; n < alignWindow; n++ {
+			step, err := streams[i].peek(n)
+			if err != nil {
+				break
+			}
+			if step.pc == starts[other].pc {
+				for skipped := 0; skipped < n; skipped++ {
+					streams[i].next()
+				}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the traces have no PC in common near their start (%04X and %04X)", starts[0].pc, starts[1].pc)
+}
+
+// resyncTraces - Looks up to window steps ahead in either trace for the PC that the
+// other trace is at. This copes with traces that leave out instructions (ie: MAME
+// collapsing loops). Returns a description of what was skipped
+func resyncTraces(streams [2]*peekingImporter, steps *[2]traceStep, window int) (string, bool) {
+	for i := 0; i < 2; i++ {
+		other := 1 - i
+		for n := 0; n < window; n++ {
+			step, err := streams[i].peek(n)
+			if err != nil {
+				break
+			}
+			if step.pc == steps[other].pc {
+				for skipped := 0; skipped <= n; skipped++ {
+					steps[i], _ = streams[i].next()
+				}
+				return fmt.Sprintf("skipped %d instructions of trace %d at line %d to realign on %04X",
+					n+1, i+1, steps[i].line, step.pc), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (d *traceDifference) write(out io.Writer, names [2]string) {
+	for _, note := range d.resynced {
+		fmt.Fprintf(out, "Note: %s\n", note)
+	}
+	for i := 0; i < 2; i++ {
+		if d.eof[i] {
+			fmt.Fprintf(out, "%s ended after %d instructions; %s continues at line %d:\n    %s\n",
+				names[i], d.index[i], names[1-i], d.steps[1-i].line, d.steps[1-i].text)
+			return
+		}
+	}
+	fmt.Fprintf(out, "First divergence after %d matching instructions\n", d.instruction)
+	fmt.Fprintf(out, "(instruction %d of %s, line %d; instruction %d of %s, line %d)\n\n",
+		d.index[0], names[0], d.steps[0].line, d.index[1], names[1], d.steps[1].line)
+	for _, steps := range d.history {
+		fmt.Fprintf(out, "  %s\n  %s\n", steps[0].text, steps[1].text)
+	}
+	fmt.Fprintf(out, "> %s\n> %s\n\n", d.steps[0].text, d.steps[1].text)
+	for _, difference := range d.registers {
+		fmt.Fprintf(out, "    %s\n", difference)
+	}
+}
+
+// traceDiffCommand - Implements "space_invaders tracediff"
+func traceDiffCommand(args []string) error {
+	flags := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	formatA := flags.String("a-format", "auto", "Format of the first trace: auto, binary, i8080core, human or mame")
+	formatB := flags.String("b-format", "auto", "Format of the second trace")
+	flagMask := flags.String("flagmask", "0xD5", "Flag bits to compare (S Z - AC - P - C = 0xD5)")
+	skipA := flags.Int("skip-a", 0, "Number of instructions to skip at the start of the first trace")
+	skipB := flags.Int("skip-b", 0, "Number of instructions to skip at the start of the second trace")
+	resync := flags.Int("resync", 0, "Look this many instructions ahead to realign the traces when the PCs differ")
+	context := flags.Int("context", 5, "Number of matching instructions to show before the divergence")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s tracediff [options] <first trace> <second trace>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("two trace files are needed")
+	}
+	mask, err := strconv.ParseUint(*flagMask, 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid -flagmask '%s'", *flagMask)
+	}
+
+	names := [2]string{flags.Arg(0), flags.Arg(1)}
+	a, closeA, err := openTraceImporter(names[0], *formatA)
+	if err != nil {
+		return err
+	}
+	defer closeA.Close()
+	b, closeB, err := openTraceImporter(names[1], *formatB)
+	if err != nil {
+		return err
+	}
+	defer closeB.Close()
+
+	options := traceDiffOptions{flagMask: uint8(mask), skip: [2]int{*skipA, *skipB}, resync: *resync, context: *context}
+	result, err := diffTraces(a, b, options)
+	if err != nil {
+		return err
+	}
+	if result != nil {
+		result.write(os.Stdout, names)
+		return errors.New("the traces are different")
+	}
+	fmt.Println("No differences found")
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func newTestImporter(text string, parse func(string, *traceStep) bool) traceImporter {
+	return &textImporter{scanner: bufio.NewScanner(strings.NewReader(text)), parse: parse}
+}
+
+// TestTraceImporters : The same instruction in each text format gives the same step
+func TestTraceImporters(t *testing.T) {
+	lines := []struct {
+		parse func(string, *traceStep) bool
+		line  string
+	}{
+		{parseI8080CoreLine, "0318 C2 00 00 13 34 0C 0A 00 ED 6A 00010010 0500"},
+		{parseHumanLine, "0318 : C2 00 00\t\t JNZ            13 34 0C 0A 00 ED 6A 00010010 0500"},
+		{parseMAMELine, "A=6A B=13 C=34 D=0C E=0A H=00 L=ED F=12 SP=0500 0318: jnz  $0000"},
+		{parseMAMELine, "AF=6A12 BC=1334 DE=0C0A HL=00ED SP=0500  0318: jnz  $0000"},
+	}
+	expected := traceStep{}
+	parseI8080CoreLine(lines[0].line, &expected)
+	for _, test := range lines {
+		step := traceStep{}
+		if !test.parse(test.line, &step) {
+			t.Errorf("Could not parse '%s'", test.line)
+			continue
+		}
+		if step.pc != 0x0318 || step.registers != expected.registers || step.known != expected.known {
+			t.Errorf("'%s' was parsed as %+v", test.line, step)
+		}
+	}
+
+	for _, header := range []string{"ADDR : instruction\t\t\tB  C  D  E  H  L  A  SZ-X-P-C PW SP",
+		"   (loops for 15 instructions)", "CONOUT (9): CPU IS OPERATIONAL"} {
+		step := traceStep{}
+		if parseI8080CoreLine(header, &step) || parseHumanLine(header, &step) || parseMAMELine(header, &step) {
+			t.Errorf("'%s' should not be parsed as an instruction", header)
+		}
+	}
+}
+
+// TestTraceDiff : Traces with different headers, start points and flag conventions are
+// aligned and the first real divergence is reported
+func TestTraceDiff(t *testing.T) {
+	ours := strings.Join([]string{
+		"ADDR : instruction\t\t\tB  C  D  E  H  L  A  SZ-X-P-C PW SP",
+		"0100 : 31 00 02\t\t LXI            00 00 00 00 00 00 00 00000010 0000",
+		"0103 : 3E 01\t\t MVI            00 00 00 00 00 00 00 00000010 0200",
+		"0105 : C6 FF\t\t ADI            00 00 00 00 00 00 01 00000010 0200",
+		"0107 : 00\t\t NOP            00 00 00 00 00 00 00 01010111 0200",
+	}, "\n")
+	theirs := strings.Join([]string{
+		"MAME debugger trace",
+		"A=00 B=00 C=00 D=00 E=00 H=00 L=00 F=00 SP=0000 0000: jmp  $0100",
+		"A=00 B=00 C=00 D=00 E=00 H=00 L=00 F=00 SP=0000 0100: lxi  sp,$0200",
+		"A=00 B=00 C=00 D=00 E=00 H=00 L=00 F=00 SP=0200 0103: mvi  a,$01",
+		"A=01 B=00 C=00 D=00 E=00 H=00 L=00 F=00 SP=0200 0105: adi  $ff",
+		"A=00 B=00 C=00 D=00 E=00 H=00 L=00 F=45 SP=0200 0107: nop",
+	}, "\n")
+	options := traceDiffOptions{flagMask: 0xD5, context: 2}
+	result, err := diffTraces(newTestImporter(ours, parseHumanLine), newTestImporter(theirs, parseMAMELine), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("Expected the aux carry flag difference to be found")
+	}
+	if result.steps[0].pc != 0x0107 || result.index[0] != 3 || result.index[1] != 4 {
+		t.Errorf("Divergence found at the wrong place: %04X (%d, %d)", result.steps[0].pc, result.index[0], result.index[1])
+	}
+	if len(result.registers) != 1 || result.registers[0] != "flag AC: 1 != 0" {
+		t.Errorf("Unexpected differences: %v", result.registers)
+	}
+
+	// Ignoring the aux carry flag, the traces are the same
+	options.flagMask = 0xC5
+	result, err = diffTraces(newTestImporter(ours, parseHumanLine), newTestImporter(theirs, parseMAMELine), options)
+	if err != nil || result != nil {
+		t.Errorf("Expected no differences, got %+v (%v)", result, err)
+	}
+}
+
+// TestTraceDiffResync : A trace with missing instructions can be realigned
+func TestTraceDiffResync(t *testing.T) {
+	full := "0100: nop\n0101: nop\n0102: nop\n0103: nop\n0104: nop\n"
+	gaps := "0100: nop\n0103: nop\n0104: nop\n"
+	options := traceDiffOptions{flagMask: 0xD5}
+	result, err := diffTraces(newTestImporter(full, parseMAMELine), newTestImporter(gaps, parseMAMELine), options)
+	if err != nil || result == nil || len(result.registers) != 1 || result.registers[0] != "PC: 0101 != 0103" {
+		t.Fatalf("Expected a PC difference, got %+v (%v)", result, err)
+	}
+	options.resync = 4
+	result, err = diffTraces(newTestImporter(full, parseMAMELine), newTestImporter(gaps, parseMAMELine), options)
+	if err != nil || result != nil {
+		t.Errorf("Expected the traces to be realigned, got %+v (%v)", result, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// traceFormatter - Turns the state of the microcontroller into the text that
+// debugPrint() outputs for an instruction. format() is called before the
+// instruction at mc.programCounter is executed. name is the instruction as
+// the instruction handler describes it and immediateBytes is the number of
+// data bytes which follow the opcode.
+type traceFormatter interface {
+	format(mc *microcontroller, name string, immediateBytes uint16) string
+}
+
+// traceFormatterFunc - Allows a plain function to be registered as a trace format
+type traceFormatterFunc func(mc *microcontroller, name string, immediateBytes uint16) string
+
+func (f traceFormatterFunc) format(mc *microcontroller, name string, immediateBytes uint16) string {
+	return f(mc, name, immediateBytes)
+}
+
+// TRACEFORMAT - The formatter used by debugPrint() when DEBUGMODE is set
+var TRACEFORMAT traceFormatter = humanFormat{}
+
+var traceFormats = map[string]traceFormatter{}
+
+// registerTraceFormat - Makes a formatter selectable with the -format flag
+func registerTraceFormat(name string, formatter traceFormatter) {
+	if _, exists := traceFormats[name]; exists {
+		panic(fmt.Sprintf("trace format %s is already registered", name))
+	}
+	traceFormats[name] = formatter
+}
+
+// traceFormatNames - The registered formats in alphabetical order
+func traceFormatNames() []string {
+	names := make([]string, 0, len(traceFormats))
+	for name := range traceFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectTraceFormat - Makes the named format the one used by debugPrint()
+func selectTraceFormat(name string) error {
+	formatter, ok := traceFormats[name]
+	if !ok {
+		return fmt.Errorf("unknown trace format %s (available: %s)", name, strings.Join(traceFormatNames(), ", "))
+	}
+	TRACEFORMAT = formatter
+	COMPAREFLAG = name == "i8080core"
+	return nil
+}
+
+func init() {
+	registerTraceFormat("human", humanFormat{})
+	registerTraceFormat("i8080core", i8080CoreFormat{})
+	registerTraceFormat("mame", mameFormat{})
+	registerTraceFormat("jsonl", jsonLinesFormat{})
+}
+
+// registerString - B C D E H L A PSW SP the way both the human and the i8080-core formats show it
+func registerString(mc *microcontroller) string {
+	return fmt.Sprintf("%02X %02X %02X %02X %02X %02X %02X %08b %04X\n",
+		mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl, mc.ra, pswByte(mc), mc.stackPointer)
+}
+
+// humanFormat - The default -v output, with a header every 20 instructions
+type humanFormat struct{}
+
+func (humanFormat) format(mc *microcontroller, name string, immediateBytes uint16) string {
+	output := ""
+	if mc.instructionsExecuted%20 == 0 {
+		output += "ADDR : instruction\t\t\tB  C  D  E  H  L  A  SZ-X-P-C PW SP\n"
+	}
+	if label, ok := SYMBOLS.lookup(mc.programCounter); ok {
+		output += label + ":\n"
+	}
+	if target, ok := disassemble(*mc.memory, mc.programCounter).target(); ok && len(SYMBOLS.names) > 0 {
+		if label, ok := SYMBOLS.lookup(target); ok {
+			name += " " + label
+		}
+	}
+	output += fmt.Sprintf("%04X : %02X", mc.programCounter, (*mc.memory)[mc.programCounter])
+	for i := uint16(1); i < immediateBytes+1; i++ {
+		output += fmt.Sprintf(" %02X", (*mc.memory)[mc.programCounter+i])
+	}
+	output += fmt.Sprintf("\t\t %-15s", name) + registerString(mc)
+	if source, ok := SOURCES.lookup(mc.programCounter); ok {
+		output = strings.TrimSuffix(output, "\n") + "  ; " + source.String() + "\n"
+	}
+	return output
+}
+
+// i8080CoreFormat - Matches the output of the modified i8080-core program so
+// that both logs can be diff'd. Every line is exactly BYTESPERLINE long.
+type i8080CoreFormat struct{}
+
+func (i8080CoreFormat) format(mc *microcontroller, name string, immediateBytes uint16) string {
+	// PC, OPCODE, 2BYTES that follow the opcode
+	output := fmt.Sprintf("%04X %02X %02X %02X ", mc.programCounter,
+		(*mc.memory)[mc.programCounter],
+		(*mc.memory)[mc.programCounter+1],
+		(*mc.memory)[mc.programCounter+2])
+	return output + registerString(mc)
+}
+
+// mameFormat - Matches MAME's "trace" debugger command with the registers
+// logged before the disassembly, ie: A=01 B=00 ... SP=0200 0100: mvi  a,$01
+type mameFormat struct{}
+
+func (mameFormat) format(mc *microcontroller, name string, immediateBytes uint16) string {
+	return fmt.Sprintf("A=%02X B=%02X C=%02X D=%02X E=%02X H=%02X L=%02X F=%02X SP=%04X %04X: %s\n",
+		mc.ra, mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl, pswByte(mc), mc.stackPointer,
+		mc.programCounter, disassemble(*mc.memory, mc.programCounter).mameString())
+}
+
+// jsonString - A string as a JSON value, quoted and escaped
+func jsonString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// jsonLinesFormat - One JSON object per instruction, with the instruction
+// disassembled into its mnemonic and operands
+type jsonLinesFormat struct{}
+
+func (jsonLinesFormat) format(mc *microcontroller, name string, immediateBytes uint16) string {
+	d := disassemble(*mc.memory, mc.programCounter)
+	opcodeBytes := make([]string, d.length)
+	for i := range opcodeBytes {
+		opcodeBytes[i] = fmt.Sprintf(`"%02X"`, (*mc.memory)[mc.programCounter+uint16(i)])
+	}
+	operands := d.operandStrings()
+	for i := range operands {
+		operands[i] = jsonString(operands[i])
+	}
+	symbol := ""
+	if label, ok := SYMBOLS.lookup(mc.programCounter); ok {
+		symbol = fmt.Sprintf(`"symbol":%s,`, jsonString(label))
+	}
+	if source, ok := SOURCES.lookup(mc.programCounter); ok {
+		symbol += fmt.Sprintf(`"source":%s,`, jsonString(source.String()))
+	}
+	return fmt.Sprintf(`{"n":%d,"cycles":%d,"pc":%d,%s"bytes":[%s],"mnemonic":%s,"operands":[%s],"text":%s,`+
+		`"a":%d,"b":%d,"c":%d,"d":%d,"e":%d,"h":%d,"l":%d,"f":%d,"sp":%d}`+"\n",
+		mc.instructionsExecuted, mc.cycles, mc.programCounter, symbol, strings.Join(opcodeBytes, ","),
+		jsonString(d.mnemonic), strings.Join(operands, ","), jsonString(d.String()),
+		mc.ra, mc.rb, mc.rc, mc.rd, mc.re, mc.rh, mc.rl, pswByte(mc), mc.stackPointer)
+}
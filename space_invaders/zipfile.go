@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// splitZipPath - Splits a path through a zip archive, ie: roms.zip/TEST.COM,
+// into the archive and the name inside it
+func splitZipPath(fileName string) (string, string, bool) {
+	slashed := filepath.ToSlash(fileName)
+	if i := strings.Index(strings.ToLower(slashed), ".zip/"); i >= 0 {
+		return fileName[:i+4], slashed[i+5:], true
+	}
+	return "", "", false
+}
+
+// isZipFile - Whether a file is a zip archive, by its name
+func isZipFile(fileName string) bool {
+	return strings.EqualFold(filepath.Ext(fileName), ".zip")
+}
+
+// openZip - Reads a whole zip archive (with readFile, so it works in the
+// browser too)
+func openZip(archive string) (*zip.Reader, error) {
+	data, err := readFile(archive)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", archive, err)
+	}
+	return reader, nil
+}
+
+// findInZip - The file in a zip archive with this name, in any directory of the
+// archive and in any case, or else with this CRC32 written as 8 hex digits
+func findInZip(reader *zip.Reader, name string) *zip.File {
+	for _, file := range reader.File {
+		if strings.EqualFold(file.Name, name) || strings.EqualFold(path.Base(file.Name), name) {
+			return file
+		}
+	}
+	if crc, err := strconv.ParseUint(name, 16, 32); err == nil && len(name) == 8 {
+		for _, file := range reader.File {
+			if file.CRC32 == uint32(crc) {
+				return file
+			}
+		}
+	}
+	return nil
+}
+
+// readZipFile - Reads a file in a zip archive. Its CRC32 is checked as it is read
+func readZipFile(file *zip.File) ([]uint8, error) {
+	contents, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer contents.Close()
+	return ioutil.ReadAll(contents)
+}
+
+// readZipMember - Reads a file from a zip archive by its name or CRC32
+func readZipMember(archive string, name string) ([]uint8, error) {
+	reader, err := openZip(archive)
+	if err != nil {
+		return nil, err
+	}
+	file := findInZip(reader, name)
+	if file == nil {
+		return nil, fmt.Errorf("%s: there is no %s in the archive", archive, name)
+	}
+	data, err := readZipFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", archive, file.Name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeZip - Writes a zip archive of the files, by their names in the archive
+func writeZip(t *testing.T, fileName string, files map[string][]uint8) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(files[name])
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReadZipFile : Files in a zip archive are found by their names, in any
+// directory and case, or by their CRC32s
+func TestReadZipFile(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "Tests.ZIP")
+	program := []uint8{0x3E, 0x01, 0x76}
+	writeZip(t, archive, map[string][]uint8{"roms/TEST.COM": program, "other.bin": {0}})
+
+	for _, name := range []string{"roms/TEST.COM", "test.com", fmt.Sprintf("%08X", crc32.ChecksumIEEE(program))} {
+		data, err := readFile(archive + "/" + name)
+		if err != nil || string(data) != string(program) {
+			t.Errorf("Expected %s to be the program, got % X (%v)", name, data, err)
+		}
+	}
+	if _, err := readFile(archive + "/missing.com"); err == nil || !strings.Contains(err.Error(), "there is no missing.com") {
+		t.Errorf("Expected missing.com not to be found, got %v", err)
+	}
+
+	memory := make([]uint8, 0x10000)
+	if err := newProgramLoader(memory).load(archive+"/test.com", 0); err != nil || memory[0x100] != 0x3E {
+		t.Errorf("Expected the .COM file to be loaded from the archive at 0100 (%v)", err)
+	}
+}
+
+// TestROMSetZip : A ROM set is loaded from a zip archive, or from one of the
+// archives in a directory, where a ROM under the wrong name is found by its CRC
+func TestROMSetZip(t *testing.T) {
+	directory := t.TempDir()
+	set := &romSet{name: "test", description: "Test"}
+	files := map[string][]uint8{}
+	for i := 0; i < 2; i++ {
+		data, rom := fakeROM(i, 16)
+		set.roms, files[rom.aliases[0]] = append(set.roms, rom), data
+	}
+
+	archive := filepath.Join(directory, "test.zip")
+	writeZip(t, archive, files)
+	for _, romPath := range []string{archive, directory} {
+		memory := make([]uint8, 0x10000)
+		report := &strings.Builder{}
+		if err := loadROMSet(set, romPath, memory, report); err != nil || report.Len() > 0 {
+			t.Errorf("Expected the set to load from %s, got %v:\n%s", romPath, err, report)
+		}
+		if memory[0] != 1 || memory[16] != 2 {
+			t.Errorf("Expected the ROMs from %s in memory", romPath)
+		}
+	}
+
+	os.Remove(archive)
+	writeZip(t, filepath.Join(directory, "a.zip"), map[string][]uint8{"a.rom": files["a.rom.alt"]})
+	writeZip(t, filepath.Join(directory, "z.zip"), map[string][]uint8{"renamed": files["b.rom.alt"]})
+	report := &strings.Builder{}
+	if err := loadROMSet(set, directory, make([]uint8, 0x10000), report); err != nil {
+		t.Errorf("Expected the set to load from two archives, got %v", err)
+	}
+	if report.String() != "test (Test):\nb.rom        found as z.zip/renamed\n" {
+		t.Errorf("Expected b.rom to be found by its CRC, got:\n%s", report)
+	}
+}
@@ -146,7 +146,7 @@ func (mc *microcontroller) aci() {
 	if mc.carry {
 		carry = 1
 	}
-	mc.ra = Add(mc.ra, data+carry, mc, 0)
+	mc.ra = Add(mc.ra, data, mc, carry)
 	mc.programCounter += 2
 }
 
@@ -956,10 +956,11 @@ func (mc *microcontroller) rst() {
 	// Restart
 	debugPrint(mc, "RST", 0)
 	exp := ((*mc.memory)[mc.programCounter] >> 3) & 0x7
+	next := mc.programCounter + 1 // Return to the instruction after the RST
 
-	(*mc.memory)[mc.stackPointer-2] = uint8(mc.programCounter)      // L
-	(*mc.memory)[mc.stackPointer-1] = uint8(mc.programCounter >> 8) // H
-	mc.stackPointer -= 2                                            // The manual says (SP) <- (SP)+2, but this is probably wrong
+	(*mc.memory)[mc.stackPointer-2] = uint8(next)      // L
+	(*mc.memory)[mc.stackPointer-1] = uint8(next >> 8) // H
+	mc.stackPointer -= 2                               // The manual says (SP) <- (SP)+2, but this is probably wrong
 
 	mc.programCounter = uint16(exp << 3)
 }
@@ -1161,7 +1162,7 @@ func finalWrite() {
 	// of the remaining data
 	remaining_buffer := outputBuffer[0 : outputBufferLines*BYTES_PER_LINE]
 	n, err := connection.Write(remaining_buffer)
-	if n != len(outputBuffer) {
+	if n != len(remaining_buffer) {
 		fmt.Println("Could not write the entire buffer")
 		panic("Buffer not written")
 	}
@@ -1400,7 +1401,7 @@ func conout(mc *microcontroller) {
 		if DEBUGMODE {
 			fmt.Printf("CONOUT (2): %s\n", string(mc.re))
 		} else {
-			fmt.Printf(string(mc.re)) // No carriage return
+			fmt.Print(string(mc.re)) // No carriage return
 		}
 	}
 }
@@ -25,7 +25,7 @@ type MathTest struct {
 //             operation,   a,   b  result, zero, carry, parity, half, sign
 var subTests = []MathTest{
 	//MathTest{subtraction, 0x01, 0x2, 0xFF,
-	MathTest{subtraction, 0x4A, 0x40, 0x0A, false, false, true, false, false},
+	MathTest{subtraction, 0x4A, 0x40, 0x0A, false, false, true, true, false}, // AC is the carry out of bit 3 of A + ~B + 1
 	MathTest{subtraction, 0x1A, 0x0C, 0x0E, false, false, false, false, false},
 	MathTest{addition, 0x2E, 0x6C, 0x9A, false, false, true, true, true},
 	MathTest{addition, 0xAE, 0x74, 0x22, false, true, true, true, false},